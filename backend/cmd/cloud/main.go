@@ -4,13 +4,19 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"shosha-finance/internal/config"
 	"shosha-finance/internal/database"
+	"shosha-finance/internal/events"
 	"shosha-finance/internal/handler"
+	"shosha-finance/internal/hlc"
 	"shosha-finance/internal/middleware"
+	"shosha-finance/internal/models"
 	"shosha-finance/internal/repository"
 	"shosha-finance/internal/service"
+	"shosha-finance/internal/settings"
+	"shosha-finance/internal/worker"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/logger"
@@ -19,6 +25,9 @@ import (
 	"github.com/rs/zerolog/log"
 )
 
+// purgeInterval is how often expired rows are purged while the server runs.
+const purgeInterval = time.Hour
+
 func main() {
 	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
 	zerolog.SetGlobalLevel(zerolog.InfoLevel)
@@ -34,24 +43,80 @@ func main() {
 		log.Fatal().Err(err).Msg("Failed to run migrations")
 	}
 
-	txRepo := repository.NewTransactionRepository(db)
-	branchRepo := repository.NewBranchRepository(db)
-	userRepo := repository.NewUserRepository(db)
+	// Edits are settled by hybrid logical clock, advanced by device stamps
+	clock := hlc.NewClock()
+	if err := repository.EnableHLC(db, clock); err != nil {
+		log.Fatal().Err(err).Msg("Failed to start hybrid logical clock")
+	}
+
+	// Devices pull in the order the cloud received the writes
+	if err := repository.EnableSyncSeq(db); err != nil {
+		log.Fatal().Err(err).Msg("Failed to start receive sequence")
+	}
+	repoOpts := repository.Options{Clock: clock}
+
+	// Pushes and data changes are streamed to the head-office dashboard
+	broker := events.NewBroker()
+	if err := repository.EnableEvents(db, broker); err != nil {
+		log.Fatal().Err(err).Msg("Failed to enable events")
+	}
 
-	txService := service.NewTransactionService(txRepo)
+	txRepo := repository.NewTransactionRepository(db, repoOpts)
+	branchRepo := repository.NewBranchRepository(db, repoOpts)
+	userRepo := repository.NewUserRepository(db)
+	idempotencyRepo := repository.NewIdempotencyRepository(db)
+	tombstoneRepo := repository.NewTombstoneRepository(db, repoOpts)
+	shiftRepo := repository.NewShiftRepository(db, repoOpts)
+	reconciliationRepo := repository.NewReconciliationRepository(db, repoOpts)
+	syncRepo := repository.NewSyncRepository(db, repoOpts)
+	conflictRepo := repository.NewConflictRepository(db, repoOpts)
+	deviceRepo := repository.NewDeviceRepository(db)
+	settingRepo := repository.NewSettingRepository(db)
+
+	// Settings set on the cloud are for devices; the cloud itself only
+	// reads the environment
+	settingStore := settings.NewStore()
+
+	// Head office transactions never go through a branch cash drawer
+	txService := service.NewTransactionService(txRepo, nil, settingStore)
 	branchService := service.NewBranchService(branchRepo)
 	authService := service.NewAuthService(userRepo, cfg.JWTSecret)
+	idempotencyService := service.NewIdempotencyService(idempotencyRepo, 24*time.Hour)
+	tombstoneService := service.NewTombstoneService(tombstoneRepo, time.Duration(cfg.TombstoneRetentionDays)*24*time.Hour)
+	shiftService := service.NewShiftService(shiftRepo)
+	reconciliationService := service.NewReconciliationService(reconciliationRepo, txRepo)
+	syncService := service.NewSyncService(syncRepo, broker)
+	conflictService := service.NewConflictService(conflictRepo)
+	deviceService := service.NewDeviceService(deviceRepo, branchRepo, cfg.SyncMinProtocol)
+	userService := service.NewUserService(userRepo, branchRepo)
+	settingService := service.NewSettingService(settingRepo, branchRepo, deviceRepo)
 
 	// Create default admin user for cloud
 	if err := authService.CreateDefaultUsers(); err != nil {
 		log.Warn().Err(err).Msg("Failed to create default users")
 	}
 
-	syncHandler := handler.NewSyncHandler(txService, branchService)
+	purgeScheduler := worker.NewPurgeScheduler(purgeInterval,
+		worker.Purge{Name: "idempotency_keys", Run: idempotencyService.PurgeExpired},
+		worker.Purge{Name: "tombstones", Run: tombstoneService.PurgeExpired},
+	)
+	purgeScheduler.Start()
+
+	syncHandler := handler.NewSyncHandler(syncService, txService, branchService, tombstoneService, userService, deviceService)
 	authHandler := handler.NewAuthHandler(authService)
 	branchHandler := handler.NewBranchHandler(branchService)
-	txHandler := handler.NewTransactionHandler(txService)
-	dashboardHandler := handler.NewDashboardHandler(txService)
+	txHandler := handler.NewTransactionHandler(txService, settingStore)
+	dashboardHandler := handler.NewDashboardHandler(txService, settingStore)
+	shiftHandler := handler.NewShiftHandler(shiftService)
+	reconciliationHandler := handler.NewReconciliationHandler(reconciliationService, settingStore)
+	conflictHandler := handler.NewConflictHandler(conflictService)
+	deviceHandler := handler.NewDeviceHandler(deviceService, models.SyncHealthThresholds{
+		StaleAfterHours:   cfg.SyncStaleAfterHours,
+		OfflineAfterHours: cfg.SyncOfflineAfterHours,
+	})
+	userHandler := handler.NewUserHandler(userService)
+	settingHandler := handler.NewSettingHandler(settingService)
+	eventsHandler := handler.NewEventsHandler(broker)
 
 	app := fiber.New(fiber.Config{
 		AppName: "Shosha Finance Cloud",
@@ -73,10 +138,22 @@ func main() {
 	})
 	api.Post("/auth/login", authHandler.Login)
 
-	// Sync routes (uses API key auth)
-	syncGroup := api.Group("/sync")
-	syncGroup.Post("/push", syncHandler.Push)
-	syncGroup.Get("/pull", syncHandler.Pull)
+	// New local installs exchange an enrollment code for their credential
+	api.Post("/sync/enroll", deviceHandler.Enroll)
+
+	// Sync routes (uses device credential auth)
+	syncGroup := api.Group("/sync", middleware.DeviceAuth(deviceService))
+	syncGroup.Post("/handshake", deviceHandler.Handshake)
+
+	// Requests made with a protocol the cloud no longer accepts get 426
+	syncProtocol := middleware.SyncProtocol(deviceService)
+	syncGroup.Post("/push", syncProtocol, syncHandler.Push)
+	syncGroup.Get("/pull", syncProtocol, syncHandler.Pull)
+	syncGroup.Get("/snapshot", syncProtocol, syncHandler.Snapshot)
+	syncGroup.Get("/digests", syncProtocol, syncHandler.Digests)
+	syncGroup.Get("/digests/:branch_id/:day", syncProtocol, syncHandler.DigestDay)
+	syncGroup.Post("/report", syncProtocol, deviceHandler.Report)
+	syncGroup.Get("/settings", syncProtocol, settingHandler.Resolve)
 
 	// Protected routes (uses JWT auth)
 	protected := api.Group("", middleware.JWTAuth(authService))
@@ -92,11 +169,43 @@ func main() {
 	protected.Delete("/branches/:id", branchHandler.Delete)
 
 	protected.Get("/transactions", txHandler.GetAll)
+	protected.Get("/transactions/duplicates", txHandler.GetDuplicates)
 	protected.Get("/transactions/:id", txHandler.GetByID)
-	protected.Post("/transactions", txHandler.Create)
+	protected.Post("/transactions", middleware.Idempotency(idempotencyService), txHandler.Create)
+
+	protected.Get("/shifts", shiftHandler.GetAll)
+	protected.Get("/shifts/:id", shiftHandler.GetByID)
+	protected.Get("/shifts/:id/report", shiftHandler.GetReport)
+
+	protected.Get("/reconciliations", reconciliationHandler.GetAll)
+	protected.Get("/reconciliations/report", reconciliationHandler.GetSummary)
+	protected.Get("/reconciliations/:id", reconciliationHandler.GetByID)
 
 	protected.Get("/dashboard/summary", dashboardHandler.GetSummary)
 
+	admin := protected.Group("/admin", middleware.RequireRoles(string(models.RoleAdmin)))
+	admin.Get("/sync-batches", syncHandler.GetBatches)
+	admin.Get("/events", eventsHandler.Stream)
+	admin.Get("/conflicts", conflictHandler.GetAll)
+	admin.Get("/conflicts/:id", conflictHandler.GetByID)
+	admin.Post("/conflicts/:id/resolve", conflictHandler.Resolve)
+	admin.Get("/sync-health", deviceHandler.GetSyncHealth)
+	admin.Get("/devices", deviceHandler.GetAll)
+	admin.Put("/devices/:id/scope", deviceHandler.UpdateScope)
+	admin.Post("/devices/:id/deactivate", deviceHandler.Deactivate)
+	admin.Post("/devices/:id/activate", deviceHandler.Activate)
+	admin.Get("/enrollment-codes", deviceHandler.GetEnrollmentCodes)
+	admin.Post("/enrollment-codes", deviceHandler.CreateEnrollmentCode)
+	admin.Get("/settings", settingHandler.GetAll)
+	admin.Get("/settings/definitions", settingHandler.GetDefinitions)
+	admin.Put("/settings", settingHandler.Set)
+	admin.Delete("/settings/:id", settingHandler.Delete)
+	admin.Get("/users", userHandler.GetAll)
+	admin.Get("/users/:id", userHandler.GetByID)
+	admin.Post("/users", userHandler.Create)
+	admin.Put("/users/:id", userHandler.Update)
+	admin.Delete("/users/:id", userHandler.Delete)
+
 	go func() {
 		if err := app.Listen(":" + cfg.Port); err != nil {
 			log.Fatal().Err(err).Msg("Failed to start server")
@@ -110,5 +219,7 @@ func main() {
 	<-quit
 
 	log.Info().Msg("Shutting down...")
+	purgeScheduler.Stop()
+	broker.Close()
 	app.Shutdown()
 }
@@ -1,16 +1,22 @@
 package main
 
 import (
+	"context"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"shosha-finance/internal/config"
 	"shosha-finance/internal/database"
+	"shosha-finance/internal/events"
 	"shosha-finance/internal/handler"
+	"shosha-finance/internal/hlc"
 	"shosha-finance/internal/middleware"
 	"shosha-finance/internal/repository"
+	"shosha-finance/internal/secret"
 	"shosha-finance/internal/service"
+	"shosha-finance/internal/settings"
 	"shosha-finance/internal/worker"
 
 	"github.com/gofiber/fiber/v2"
@@ -20,50 +26,168 @@ import (
 	"github.com/rs/zerolog/log"
 )
 
+// syncShutdownTimeout is how long shutdown waits for the sync worker to
+// finish the batch in flight.
+const syncShutdownTimeout = 30 * time.Second
+
+// purgeInterval is how often expired rows are purged while the app runs.
+const purgeInterval = time.Hour
+
 func main() {
 	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
 	zerolog.SetGlobalLevel(zerolog.InfoLevel)
 
 	cfg := config.LoadLocalConfig()
 
+	// The device credential is encrypted under a key that is not in the
+	// database, so a copy of the database alone does not reveal it
+	if cfg.DeviceKey == "" {
+		key, err := secret.LoadOrCreateKey(cfg.DeviceKeyFile)
+		if err != nil {
+			log.Fatal().Err(err).Str("path", cfg.DeviceKeyFile).Msg("Failed to load device key")
+		}
+		cfg.DeviceKey = key
+	}
+
 	db, err := database.NewConnection(cfg)
 	if err != nil {
 		log.Fatal().Err(err).Msg("Failed to connect to database")
 	}
 
+	// A damaged database is set aside and rebuilt from the cloud
+	restore := cfg.RestoreFromCloud
+	if ok, err := database.CheckIntegrity(db); !ok {
+		log.Error().Err(err).Str("path", cfg.SQLitePath).Msg("Database failed integrity check, restoring from cloud")
+		db, err = database.ReplaceCorrupt(db, cfg)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to replace corrupt database")
+		}
+		restore = true
+	}
+
 	if err := database.Migrate(db); err != nil {
 		log.Fatal().Err(err).Msg("Failed to run migrations")
 	}
 
-	txRepo := repository.NewTransactionRepository(db)
-	branchRepo := repository.NewBranchRepository(db)
+	// Settings from the cloud stay in effect from the last sync; environment
+	// variables set on this laptop win over them
+	settingStore := settings.NewStore()
+	if err := worker.LoadSettings(repository.NewSyncStateRepository(db), settingStore); err != nil {
+		log.Warn().Err(err).Msg("Failed to load settings from last sync")
+	}
+
+	// Writes are ordered by hybrid logical clock, not this machine's wall clock
+	clock := hlc.NewClock()
+	if err := repository.EnableHLC(db, clock); err != nil {
+		log.Fatal().Err(err).Msg("Failed to start hybrid logical clock")
+	}
+
+	// Every write to synced data goes through the change log for the worker
+	// to push, and lists only show the branches this install pulls
+	repoOpts := repository.Options{
+		ChangeLog: true,
+		Clock:     clock,
+		Scope:     repository.NewBranchScope(),
+	}
+
+	// Data changes and sync progress are pushed to the UI as they happen
+	broker := events.NewBroker()
+	if err := repository.EnableEvents(db, broker); err != nil {
+		log.Fatal().Err(err).Msg("Failed to enable events")
+	}
+
+	txRepo := repository.NewTransactionRepository(db, repoOpts)
+	branchRepo := repository.NewBranchRepository(db, repoOpts)
 	userRepo := repository.NewUserRepository(db)
+	idempotencyRepo := repository.NewIdempotencyRepository(db)
+	tombstoneRepo := repository.NewTombstoneRepository(db, repoOpts)
+	recurringRepo := repository.NewRecurringRepository(db, repoOpts)
+	shiftRepo := repository.NewShiftRepository(db, repoOpts)
+	reconciliationRepo := repository.NewReconciliationRepository(db, repoOpts)
+	syncErrorRepo := repository.NewSyncErrorRepository(db)
+	conflictRepo := repository.NewConflictRepository(db, repoOpts)
+	syncRunRepo := repository.NewSyncRunRepository(db)
+	syncVerificationRepo := repository.NewSyncVerificationRepository(db)
+	changeLogRepo := repository.NewChangeLogRepository(db)
 
-	txService := service.NewTransactionService(txRepo)
+	txService := service.NewTransactionService(txRepo, shiftRepo, settingStore)
 	branchService := service.NewBranchService(branchRepo)
 	authService := service.NewAuthService(userRepo, cfg.JWTSecret)
+	idempotencyService := service.NewIdempotencyService(idempotencyRepo, 24*time.Hour)
+	tombstoneService := service.NewTombstoneService(tombstoneRepo, time.Duration(cfg.TombstoneRetentionDays)*24*time.Hour)
+	recurringService := service.NewRecurringService(recurringRepo, settingStore)
+	shiftService := service.NewShiftService(shiftRepo)
+	reconciliationService := service.NewReconciliationService(reconciliationRepo, txRepo)
+	syncErrorService := service.NewSyncErrorService(syncErrorRepo, changeLogRepo)
+	conflictService := service.NewConflictService(conflictRepo)
+	syncRunService := service.NewSyncRunService(syncRunRepo, time.Duration(cfg.SyncHistoryRetentionDays)*24*time.Hour)
+	syncVerificationService := service.NewSyncVerificationService(syncVerificationRepo, time.Duration(cfg.SyncHistoryRetentionDays)*24*time.Hour)
 
-	if err := authService.CreateDefaultUsers(); err != nil {
-		log.Warn().Err(err).Msg("Failed to create default users")
+	// The sync worker's repositories are bound to its context, so shutdown
+	// can cancel their writes when it cannot wait for them
+	syncCtx, cancelSync, syncDB := worker.NewSyncContext(db)
+	syncWorker := worker.NewSyncWorker(syncCtx, cancelSync, syncDB, worker.SyncRepositories{
+		SyncErrors:    repository.NewSyncErrorRepository(syncDB),
+		Sync:          repository.NewSyncRepository(syncDB, repoOpts),
+		Runs:          repository.NewSyncRunRepository(syncDB),
+		State:         repository.NewSyncStateRepository(syncDB),
+		ChangeLog:     repository.NewChangeLogRepository(syncDB),
+		Conflicts:     repository.NewConflictRepository(syncDB, repoOpts),
+		Tombstones:    repository.NewTombstoneRepository(syncDB, repoOpts),
+		Users:         repository.NewUserRepository(syncDB),
+		Transactions:  repository.NewTransactionRepository(syncDB, repoOpts),
+		Verifications: repository.NewSyncVerificationRepository(syncDB),
+		Options:       repoOpts,
+	}, cfg, settingStore, broker)
+	if restore {
+		if err := syncWorker.RequestRestore(); err != nil {
+			log.Fatal().Err(err).Msg("Failed to request restore from cloud")
+		}
 	}
 
-	if err := branchService.CreateDefaultBranches(); err != nil {
-		log.Warn().Err(err).Msg("Failed to create default branches")
+	// A restoring install gets its users and branches from the snapshot
+	if !syncWorker.RestorePending() {
+		if err := authService.CreateDefaultUsers(); err != nil {
+			log.Warn().Err(err).Msg("Failed to create default users")
+		}
+
+		// Branches are head office's; an enrolled install may not push its own
+		if !syncWorker.Enrolled() {
+			if err := branchService.CreateDefaultBranches(); err != nil {
+				log.Warn().Err(err).Msg("Failed to create default branches")
+			}
+		}
 	}
 
-	// Initialize sync worker
-	syncWorker := worker.NewSyncWorker(db, cfg)
+	purgeScheduler := worker.NewPurgeScheduler(purgeInterval,
+		worker.Purge{Name: "idempotency_keys", Run: idempotencyService.PurgeExpired},
+		worker.Purge{Name: "tombstones", Run: tombstoneService.PurgeExpired},
+		worker.Purge{Name: "sync_runs", Run: syncRunService.PurgeExpired},
+		worker.Purge{Name: "sync_verifications", Run: syncVerificationService.PurgeExpired},
+	)
+	purgeScheduler.Start()
+
+	// Start sync worker
 	if cfg.CloudAPIURL != "" {
 		syncWorker.Start()
 	} else {
 		log.Warn().Msg("Sync worker disabled: CLOUD_API_URL not set")
 	}
 
-	txHandler := handler.NewTransactionHandler(txService)
-	dashboardHandler := handler.NewDashboardHandler(txService)
-	systemHandler := handler.NewSystemHandler(txService, syncWorker)
+	// Materialize due recurring transactions, catching up on missed ones
+	recurringScheduler := worker.NewRecurringScheduler(recurringService, time.Minute)
+	recurringScheduler.Start()
+
+	txHandler := handler.NewTransactionHandler(txService, settingStore)
+	dashboardHandler := handler.NewDashboardHandler(txService, settingStore)
+	systemHandler := handler.NewSystemHandler(txService, syncWorker, syncErrorService, conflictService, syncRunService, syncVerificationService, settingStore)
 	authHandler := handler.NewAuthHandler(authService)
 	branchHandler := handler.NewBranchHandler(branchService)
+	recurringHandler := handler.NewRecurringHandler(recurringService)
+	shiftHandler := handler.NewShiftHandler(shiftService)
+	reconciliationHandler := handler.NewReconciliationHandler(reconciliationService, settingStore)
+	conflictHandler := handler.NewConflictHandler(conflictService)
+	eventsHandler := handler.NewEventsHandler(broker)
 
 	app := fiber.New(fiber.Config{
 		AppName: "Shosha Finance Local",
@@ -81,12 +205,13 @@ func main() {
 
 	// Protected routes
 	protected := api.Group("", middleware.JWTAuth(authService))
-	
+
 	protected.Get("/auth/me", authHandler.Me)
 	protected.Post("/auth/logout", authHandler.Logout)
 
-	protected.Post("/transactions", txHandler.Create)
+	protected.Post("/transactions", middleware.Idempotency(idempotencyService), txHandler.Create)
 	protected.Get("/transactions", txHandler.GetAll)
+	protected.Get("/transactions/duplicates", txHandler.GetDuplicates)
 	protected.Get("/transactions/:id", txHandler.GetByID)
 
 	protected.Get("/branches", branchHandler.GetAll)
@@ -96,9 +221,40 @@ func main() {
 	protected.Put("/branches/:id", branchHandler.Update)
 	protected.Delete("/branches/:id", branchHandler.Delete)
 
+	protected.Get("/recurring", recurringHandler.GetAll)
+	protected.Get("/recurring/:id", recurringHandler.GetByID)
+	protected.Get("/recurring/:id/preview", recurringHandler.Preview)
+	protected.Post("/recurring", recurringHandler.Create)
+	protected.Post("/recurring/:id/pause", recurringHandler.Pause)
+	protected.Post("/recurring/:id/resume", recurringHandler.Resume)
+
+	protected.Get("/shifts", shiftHandler.GetAll)
+	protected.Get("/shifts/current", shiftHandler.GetCurrent)
+	protected.Get("/shifts/:id", shiftHandler.GetByID)
+	protected.Get("/shifts/:id/report", shiftHandler.GetReport)
+	protected.Post("/shifts/open", shiftHandler.Open)
+	protected.Post("/shifts/:id/close", shiftHandler.Close)
+
+	protected.Get("/reconciliations", reconciliationHandler.GetAll)
+	protected.Get("/reconciliations/report", reconciliationHandler.GetSummary)
+	protected.Get("/reconciliations/:id", reconciliationHandler.GetByID)
+	protected.Post("/reconciliations", reconciliationHandler.Create)
+
 	protected.Get("/dashboard/summary", dashboardHandler.GetSummary)
 
 	protected.Get("/system/status", systemHandler.GetStatus)
+	protected.Get("/system/config", systemHandler.GetConfig)
+	protected.Get("/events", eventsHandler.Stream)
+	protected.Post("/system/sync", systemHandler.TriggerSync)
+	protected.Get("/system/sync-history", systemHandler.GetSyncHistory)
+	protected.Get("/system/verifications", systemHandler.GetVerifications)
+	protected.Post("/system/verifications", systemHandler.RequestVerification)
+	protected.Get("/system/sync-errors", systemHandler.GetSyncErrors)
+	protected.Post("/system/sync-errors/:id/retry", systemHandler.RetrySyncError)
+	protected.Post("/system/sync-errors/:id/resolve", systemHandler.ResolveSyncError)
+	protected.Get("/system/conflicts", conflictHandler.GetAll)
+	protected.Get("/system/conflicts/:id", conflictHandler.GetByID)
+	protected.Post("/system/conflicts/:id/resolve", conflictHandler.Resolve)
 
 	go func() {
 		if err := app.Listen(":" + cfg.Port); err != nil {
@@ -113,6 +269,16 @@ func main() {
 	<-quit
 
 	log.Info().Msg("Shutting down...")
-	syncWorker.Stop()
+	recurringScheduler.Stop()
+	purgeScheduler.Stop()
+
+	// Let the sync worker finish the batch it is pushing
+	ctx, cancel := context.WithTimeout(context.Background(), syncShutdownTimeout)
+	defer cancel()
+	if err := syncWorker.Stop(ctx); err != nil {
+		log.Warn().Err(err).Msg("Sync worker stopped before finishing its batch")
+	}
+
+	broker.Close()
 	app.Shutdown()
 }
@@ -3,32 +3,106 @@ package config
 import (
 	"os"
 	"strconv"
+
+	"github.com/rs/zerolog/log"
 )
 
+// AppVersion is reported to the cloud by local installs; release builds set
+// it with -ldflags "-X shosha-finance/internal/config.AppVersion=...".
+var AppVersion = "dev"
+
+// MinSyncBackoff is the shortest SYNC_MAX_BACKOFF, in seconds, so a failing
+// cloud is not retried in a tight loop.
+const MinSyncBackoff = 5
+
 type Config struct {
-	AppMode      string
-	Port         string
-	DBDriver     string
-	DBHost       string
-	DBPort       string
-	DBUser       string
-	DBPassword   string
-	DBName       string
-	SQLitePath   string
-	CloudAPIURL  string
-	SyncInterval int
-	JWTSecret    string
+	AppMode     string
+	Port        string
+	DBDriver    string
+	DBHost      string
+	DBPort      string
+	DBUser      string
+	DBPassword  string
+	DBName      string
+	SQLitePath  string
+	CloudAPIURL string
+	BranchID    string
+	JWTSecret   string
+
+	// SyncMaxAttempts is how many times the cloud may reject a record before
+	// the local app quarantines it and stops pushing it.
+	SyncMaxAttempts int
+
+	// SyncBatchSize caps the change-log entries sent in one push request.
+	// SyncMaxBackoff caps, in seconds, the delay between retries after a
+	// failed sync; it is never below MinSyncBackoff.
+	SyncBatchSize  int
+	SyncMaxBackoff int
+
+	// SyncEncoding is how pushes and pulls travel: "zstd" or "gzip"
+	// compressed streams, or "json" documents for a cloud that predates
+	// streaming.
+	SyncEncoding string
+
+	// SyncMinProtocol is the oldest sync protocol version the cloud still
+	// accepts; local apps on an older one are asked to update.
+	SyncMinProtocol int
+
+	// SyncStaleAfterHours and SyncOfflineAfterHours are how long since its
+	// last sync a device shows as stale and as offline in the sync health
+	// overview.
+	SyncStaleAfterHours   int
+	SyncOfflineAfterHours int
+
+	// TombstoneRetentionDays is how long soft-deleted master data is kept
+	// so the delete can reach every device before the row is purged.
+	TombstoneRetentionDays int
+
+	// SyncHistoryRetentionDays is how long the local sync run history is
+	// kept.
+	SyncHistoryRetentionDays int
+
+	// EnrollmentCode is exchanged with the cloud for the device's identity
+	// on first start. DeviceName is how the device shows in the cloud's
+	// registry. DeviceKey encrypts the device credential stored in SQLite;
+	// when it is not set, a random key kept in DeviceKeyFile is used.
+	EnrollmentCode string
+	DeviceName     string
+	DeviceKey      string
+	DeviceKeyFile  string
+
+	// RestoreFromCloud loads a snapshot of the device's branch scope from
+	// the cloud before normal sync starts, for an install that starts over
+	// from an empty database.
+	RestoreFromCloud bool
 }
 
 func LoadLocalConfig() *Config {
+	sqlitePath := getEnv("SQLITE_PATH", "./shosha_finance.db")
+
 	return &Config{
-		AppMode:      getEnv("APP_MODE", "local"),
-		Port:         getEnv("PORT", "8080"),
-		DBDriver:     "sqlite",
-		SQLitePath:   getEnv("SQLITE_PATH", "./shosha_finance.db"),
-		CloudAPIURL:  getEnv("CLOUD_API_URL", "http://localhost:3000"),
-		SyncInterval: getEnvInt("SYNC_INTERVAL", 30),
-		JWTSecret:    getEnv("JWT_SECRET", "shosha-finance-secret-key-2024"),
+		AppMode:     getEnv("APP_MODE", "local"),
+		Port:        getEnv("PORT", "8080"),
+		DBDriver:    "sqlite",
+		SQLitePath:  sqlitePath,
+		CloudAPIURL: getEnv("CLOUD_API_URL", "http://localhost:3000"),
+		BranchID:    getEnv("BRANCH_ID", ""),
+		JWTSecret:   getEnv("JWT_SECRET", "shosha-finance-secret-key-2024"),
+
+		SyncMaxAttempts: getEnvInt("SYNC_MAX_ATTEMPTS", 5),
+		SyncBatchSize:   getEnvInt("SYNC_BATCH_SIZE", 100),
+		SyncMaxBackoff:  getEnvIntMin("SYNC_MAX_BACKOFF", 300, MinSyncBackoff),
+		SyncEncoding:    getEnv("SYNC_ENCODING", "zstd"),
+
+		TombstoneRetentionDays:   getEnvInt("TOMBSTONE_RETENTION_DAYS", 30),
+		SyncHistoryRetentionDays: getEnvInt("SYNC_HISTORY_RETENTION_DAYS", 30),
+
+		EnrollmentCode: getEnv("ENROLLMENT_CODE", ""),
+		DeviceName:     getEnv("DEVICE_NAME", hostname()),
+		DeviceKey:      getEnv("DEVICE_KEY", ""),
+		DeviceKeyFile:  getEnv("DEVICE_KEY_FILE", sqlitePath+".key"),
+
+		RestoreFromCloud: getEnvBool("RESTORE_FROM_CLOUD", false),
 	}
 }
 
@@ -47,6 +121,13 @@ func LoadCloudConfig() *Config {
 		DBName:     getEnv("DB_NAME", "shosha_finance"),
 		SQLitePath: getEnv("SQLITE_PATH", "./shosha_cloud.db"),
 		JWTSecret:  getEnv("JWT_SECRET", "shosha-finance-cloud-secret-2024"),
+
+		SyncMinProtocol: getEnvInt("SYNC_MIN_PROTOCOL", 1),
+
+		SyncStaleAfterHours:   getEnvInt("SYNC_STALE_AFTER_HOURS", 24),
+		SyncOfflineAfterHours: getEnvInt("SYNC_OFFLINE_AFTER_HOURS", 72),
+
+		TombstoneRetentionDays: getEnvInt("TOMBSTONE_RETENTION_DAYS", 30),
 	}
 }
 
@@ -65,3 +146,31 @@ func getEnvInt(key string, defaultValue int) int {
 	}
 	return defaultValue
 }
+
+// getEnvIntMin is getEnvInt for values that may not go below min; smaller
+// ones are raised to it.
+func getEnvIntMin(key string, defaultValue, min int) int {
+	value := getEnvInt(key, defaultValue)
+	if value < min {
+		log.Warn().Str("env", key).Int("value", value).Int("min", min).Msg("Setting below minimum, using minimum")
+		return min
+	}
+	return value
+}
+
+func getEnvBool(key string, defaultValue bool) bool {
+	if value := os.Getenv(key); value != "" {
+		if boolVal, err := strconv.ParseBool(value); err == nil {
+			return boolVal
+		}
+	}
+	return defaultValue
+}
+
+func hostname() string {
+	name, err := os.Hostname()
+	if err != nil {
+		return ""
+	}
+	return name
+}
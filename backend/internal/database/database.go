@@ -8,7 +8,6 @@ import (
 
 	"github.com/rs/zerolog/log"
 	"gorm.io/driver/postgres"
-	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 	"gorm.io/gorm/logger"
 )
@@ -23,7 +22,7 @@ func NewConnection(cfg *config.Config) (*gorm.DB, error) {
 
 	switch cfg.DBDriver {
 	case "sqlite":
-		db, err = gorm.Open(sqlite.Open(cfg.SQLitePath), gormConfig)
+		db, err = OpenSQLite(cfg.SQLitePath, gormConfig)
 	case "postgres":
 		dsn := fmt.Sprintf(
 			"host=%s user=%s password=%s dbname=%s port=%s sslmode=disable",
@@ -49,11 +48,58 @@ func Migrate(db *gorm.DB) error {
 		&models.Branch{},
 		&models.Transaction{},
 		&models.User{},
+		&models.RecurringTransaction{},
+		&models.Shift{},
+		&models.ShiftDenomination{},
+		&models.CashReconciliation{},
+		&models.IdempotencyKey{},
+		&models.SyncError{},
+		&models.SyncBatch{},
+		&models.SyncState{},
+		&models.SyncCursor{},
+		&models.SyncSequence{},
+		&models.ChangeLog{},
+		&models.SyncConflict{},
+		&models.SyncRun{},
+		&models.SyncVerification{},
+		&models.Device{},
+		&models.DeviceBranch{},
+		&models.EnrollmentCode{},
+		&models.Setting{},
 	)
 	if err != nil {
 		return fmt.Errorf("failed to run migrations: %w", err)
 	}
 
+	// A branch has one cash drawer, so only one of its shifts may be open.
+	// The cloud holds the same rule, so two devices of a branch cannot both
+	// sync an open shift and a snapshot never carries two
+	err = db.Exec("CREATE UNIQUE INDEX IF NOT EXISTS idx_shifts_open_branch ON shifts (branch_id) WHERE status = 'open'").Error
+	if err != nil {
+		return fmt.Errorf("failed to add open shift constraint: %w", err)
+	}
+
+	// Branch codes used to be unique across deleted branches too
+	if db.Migrator().HasIndex(&models.Branch{}, "idx_branches_code") {
+		if err := db.Migrator().DropIndex(&models.Branch{}, "idx_branches_code"); err != nil {
+			return fmt.Errorf("failed to drop branch code index: %w", err)
+		}
+	}
+
+	// Times used to be written in the zone they were made in
+	if db.Dialector.Name() == "sqlite" {
+		normalize := map[string][]string{
+			"transactions":           {"created_at"},
+			"cash_reconciliations":   {"reconciled_at"},
+			"recurring_transactions": {"next_run_at"},
+		}
+		for table, columns := range normalize {
+			if err := normalizeTimes(db, table, columns...); err != nil {
+				return fmt.Errorf("failed to normalize times of %s: %w", table, err)
+			}
+		}
+	}
+
 	log.Info().Msg("Database migrations completed")
 	return nil
 }
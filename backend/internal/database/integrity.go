@@ -0,0 +1,73 @@
+package database
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"shosha-finance/internal/config"
+	"shosha-finance/internal/models"
+
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+)
+
+// CheckIntegrity runs SQLite's integrity check and reports whether the
+// database file is sound. A file too damaged to run the check is reported
+// as unsound along with the error.
+func CheckIntegrity(db *gorm.DB) (bool, error) {
+	var results []string
+	if err := db.Raw("PRAGMA integrity_check").Scan(&results).Error; err != nil {
+		return false, err
+	}
+	if len(results) == 1 && results[0] == "ok" {
+		return true, nil
+	}
+	return false, fmt.Errorf("integrity check: %s", strings.Join(results, "; "))
+}
+
+// ReplaceCorrupt moves a damaged SQLite file aside and opens an empty one
+// in its place. The device's enrollment is carried over when it can still
+// be read, so the install can restore itself from the cloud without a new
+// enrollment code.
+func ReplaceCorrupt(db *gorm.DB, cfg *config.Config) (*gorm.DB, error) {
+	var enrollment []models.SyncState
+	db.Raw(
+		"SELECT key, value FROM sync_states WHERE key IN ?",
+		[]string{models.SyncStateDeviceID, models.SyncStateDeviceCredential, models.SyncStateBranchID},
+	).Scan(&enrollment)
+
+	if sqlDB, err := db.DB(); err == nil {
+		sqlDB.Close()
+	}
+
+	suffix := ".corrupt-" + time.Now().Format("20060102-150405")
+	for _, ext := range []string{"", "-wal", "-shm", "-journal"} {
+		path := cfg.SQLitePath + ext
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+		if err := os.Rename(path, path+suffix); err != nil {
+			return nil, fmt.Errorf("failed to move corrupt database aside: %w", err)
+		}
+	}
+	log.Warn().Str("path", cfg.SQLitePath+suffix).Msg("Corrupt database moved aside")
+
+	fresh, err := NewConnection(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(enrollment) > 0 {
+		if err := fresh.AutoMigrate(&models.SyncState{}); err != nil {
+			return nil, err
+		}
+		if err := fresh.Create(&enrollment).Error; err != nil {
+			return nil, err
+		}
+		log.Info().Msg("Device enrollment recovered from corrupt database")
+	}
+
+	return fresh, nil
+}
@@ -0,0 +1,118 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+// OpenSQLite opens the SQLite database at path, handing the driver every
+// time in UTC. SQLite keeps a time as text in the zone it was written in
+// and compares it as text, so times written or queried in different zones
+// would not order correctly.
+func OpenSQLite(path string, config *gorm.Config) (*gorm.DB, error) {
+	sqlDB, err := sql.Open(sqlite.DriverName, path)
+	if err != nil {
+		return nil, err
+	}
+	return gorm.Open(sqlite.New(sqlite.Config{DSN: path, Conn: &utcPool{sqlDB}}), config)
+}
+
+// utcPool is a connection pool whose statements take their times in UTC.
+type utcPool struct {
+	*sql.DB
+}
+
+func (p *utcPool) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	return p.DB.ExecContext(ctx, query, utcArgs(args)...)
+}
+
+func (p *utcPool) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	return p.DB.QueryContext(ctx, query, utcArgs(args)...)
+}
+
+func (p *utcPool) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	return p.DB.QueryRowContext(ctx, query, utcArgs(args)...)
+}
+
+func (p *utcPool) BeginTx(ctx context.Context, opts *sql.TxOptions) (gorm.ConnPool, error) {
+	tx, err := p.DB.BeginTx(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &utcTx{tx}, nil
+}
+
+func (p *utcPool) GetDBConn() (*sql.DB, error) {
+	return p.DB, nil
+}
+
+// utcTx is a transaction whose statements take their times in UTC.
+type utcTx struct {
+	*sql.Tx
+}
+
+func (t *utcTx) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	return t.Tx.ExecContext(ctx, query, utcArgs(args)...)
+}
+
+func (t *utcTx) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	return t.Tx.QueryContext(ctx, query, utcArgs(args)...)
+}
+
+func (t *utcTx) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	return t.Tx.QueryRowContext(ctx, query, utcArgs(args)...)
+}
+
+// utcArgs returns args with every time in UTC, leaving args as it is.
+func utcArgs(args []interface{}) []interface{} {
+	converted := make([]interface{}, len(args))
+	for i, arg := range args {
+		switch v := arg.(type) {
+		case time.Time:
+			arg = v.UTC()
+		case *time.Time:
+			if v != nil {
+				arg = v.UTC()
+			}
+		case sql.NullTime:
+			if v.Valid {
+				arg = v.Time.UTC()
+			}
+		case gorm.DeletedAt:
+			if v.Valid {
+				arg = v.Time.UTC()
+			}
+		}
+		converted[i] = arg
+	}
+	return converted
+}
+
+// normalizeTimes rewrites the times of the given columns that were written
+// in a zone other than UTC, as they were before every time was written in
+// UTC.
+func normalizeTimes(db *gorm.DB, table string, columns ...string) error {
+	for _, column := range columns {
+		var rows []struct {
+			ID    string
+			Value time.Time
+		}
+		err := db.Table(table).Select("id, "+column+" AS value").
+			Where(column+" IS NOT NULL AND "+column+" NOT LIKE ?", "%+00:00").
+			Scan(&rows).Error
+		if err != nil {
+			return err
+		}
+		for _, row := range rows {
+			err := db.Table(table).Where("id = ?", row.ID).UpdateColumn(column, row.Value).Error
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
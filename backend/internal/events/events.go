@@ -0,0 +1,164 @@
+// Package events fans out server-side events, such as sync progress and
+// data changes, to the clients listening on the event stream.
+package events
+
+import (
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Event types sent on the stream.
+const (
+	// TransactionsChanged is sent when transactions were written; clients
+	// refetch what they show.
+	TransactionsChanged = "transactions.changed"
+	// SyncState is sent when the local sync worker starts or finishes a
+	// cycle or goes on- or offline.
+	SyncState = "sync.state"
+	// SyncProgress is sent as a local sync cycle restores, pulls or pushes
+	// records.
+	SyncProgress = "sync.progress"
+	// SyncRun is sent with the summary of a finished local sync cycle.
+	SyncRun = "sync.run"
+	// SyncVerification is sent with the result of comparing the local
+	// books with the cloud's.
+	SyncVerification = "sync.verification"
+	// SyncError is sent when a sync step fails or a record is rejected.
+	SyncError = "sync.error"
+	// SyncPush is sent by the cloud when a device's push was applied.
+	SyncPush = "sync.push"
+	// ConfigChanged is sent when settings from the cloud changed values in
+	// effect on the local install.
+	ConfigChanged = "config.changed"
+)
+
+// Sources of a TransactionsChanged event.
+const (
+	SourceLocal = "local"
+	SourcePull  = "pull"
+	SourcePush  = "push"
+)
+
+// subscriberBuffer is how many events a slow client may fall behind before
+// further events are dropped for it.
+const subscriberBuffer = 64
+
+type Event struct {
+	Type string      `json:"type"`
+	Data interface{} `json:"data"`
+	At   time.Time   `json:"at"`
+}
+
+// TransactionsChangedData lists the transactions written and where the
+// write came from.
+type TransactionsChangedData struct {
+	Source         string      `json:"source"`
+	TransactionIDs []uuid.UUID `json:"transaction_ids"`
+}
+
+// SyncStateData is the state the local sync worker moved to: idle,
+// checking, pulling, pushing, backoff or stopped.
+type SyncStateData struct {
+	State       string     `json:"state"`
+	Online      bool       `json:"online"`
+	NextRetryAt *time.Time `json:"next_retry_at,omitempty"`
+}
+
+// SyncProgressData counts what the current sync cycle has moved so far.
+type SyncProgressData struct {
+	Stage      string `json:"stage"`
+	Restored   int    `json:"restored"`
+	Pulled     int    `json:"pulled"`
+	Pushed     int    `json:"pushed"`
+	QueueDepth int64  `json:"queue_depth"`
+}
+
+// SyncPushData summarizes a push the cloud applied for a device.
+type SyncPushData struct {
+	BatchID  uuid.UUID  `json:"batch_id"`
+	DeviceID string     `json:"device_id"`
+	BranchID *uuid.UUID `json:"branch_id,omitempty"`
+	Accepted int        `json:"accepted"`
+	Rejected int        `json:"rejected"`
+}
+
+// SyncErrorData describes a failed sync step or a rejected record.
+type SyncErrorData struct {
+	Stage      string     `json:"stage"`
+	Message    string     `json:"message"`
+	EntityType string     `json:"entity_type,omitempty"`
+	EntityID   *uuid.UUID `json:"entity_id,omitempty"`
+}
+
+// ConfigChangedData lists the settings whose value in effect changed.
+type ConfigChangedData struct {
+	Keys []string `json:"keys"`
+}
+
+// Broker hands every published event to all current subscribers. A nil
+// Broker drops events, so publishers need not check whether one is set.
+type Broker struct {
+	mu          sync.Mutex
+	subscribers map[chan Event]struct{}
+	closed      bool
+}
+
+func NewBroker() *Broker {
+	return &Broker{subscribers: map[chan Event]struct{}{}}
+}
+
+// Publish sends an event to every subscriber without waiting; a subscriber
+// whose buffer is full misses it.
+func (b *Broker) Publish(eventType string, data interface{}) {
+	if b == nil {
+		return
+	}
+	event := Event{Type: eventType, Data: data, At: time.Now()}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subscribers {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// Subscribe returns a channel receiving published events and a function
+// that ends the subscription. The channel is closed when the subscription
+// ends or the broker is closed.
+func (b *Broker) Subscribe() (<-chan Event, func()) {
+	ch := make(chan Event, subscriberBuffer)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		close(ch)
+		return ch, func() {}
+	}
+	b.subscribers[ch] = struct{}{}
+
+	return ch, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if _, ok := b.subscribers[ch]; ok {
+			delete(b.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// Close ends every subscription, letting open streams finish so the server
+// can shut down.
+func (b *Broker) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	for ch := range b.subscribers {
+		delete(b.subscribers, ch)
+		close(ch)
+	}
+}
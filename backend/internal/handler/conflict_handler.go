@@ -0,0 +1,85 @@
+package handler
+
+import (
+	"errors"
+	"strconv"
+
+	"shosha-finance/internal/models"
+	"shosha-finance/internal/repository"
+	"shosha-finance/internal/response"
+	"shosha-finance/internal/service"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+type ConflictHandler struct {
+	conflictService service.ConflictService
+}
+
+func NewConflictHandler(conflictService service.ConflictService) *ConflictHandler {
+	return &ConflictHandler{conflictService: conflictService}
+}
+
+// GetAll lists recent sync conflicts, optionally by status or entity type.
+func (h *ConflictHandler) GetAll(c *fiber.Ctx) error {
+	limit, _ := strconv.Atoi(c.Query("limit", "50"))
+	if limit < 1 || limit > 500 {
+		limit = 50
+	}
+
+	filter := &repository.ConflictFilter{
+		Status:     models.ConflictStatus(c.Query("status")),
+		EntityType: c.Query("entity_type"),
+		Limit:      limit,
+	}
+
+	conflicts, err := h.conflictService.GetAll(filter)
+	if err != nil {
+		return response.InternalError(c, "Failed to get sync conflicts")
+	}
+
+	return response.Success(c, "Success", conflicts)
+}
+
+func (h *ConflictHandler) GetByID(c *fiber.Ctx) error {
+	id, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return response.BadRequest(c, "Invalid conflict ID")
+	}
+
+	conflict, err := h.conflictService.GetByID(id)
+	if err != nil {
+		return response.NotFound(c, "Sync conflict not found")
+	}
+
+	return response.Success(c, "Success", conflict)
+}
+
+// Resolve keeps the local or cloud version of a conflicting record.
+func (h *ConflictHandler) Resolve(c *fiber.Ctx) error {
+	id, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return response.BadRequest(c, "Invalid conflict ID")
+	}
+
+	var req models.ResolveConflictRequest
+	if err := c.BodyParser(&req); err != nil {
+		return response.BadRequest(c, "Invalid request body")
+	}
+
+	user := c.Locals("user").(*models.User)
+
+	conflict, err := h.conflictService.Resolve(id, req.Winner, user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, service.ErrInvalidConflictSide):
+			return response.BadRequest(c, err.Error())
+		case errors.Is(err, service.ErrConflictNotFound):
+			return response.NotFound(c, "Sync conflict not found")
+		}
+		return response.InternalError(c, "Failed to resolve sync conflict")
+	}
+
+	return response.Success(c, "Sync conflict resolved", conflict)
+}
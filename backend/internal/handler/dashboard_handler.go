@@ -6,6 +6,7 @@ import (
 	"shosha-finance/internal/repository"
 	"shosha-finance/internal/response"
 	"shosha-finance/internal/service"
+	"shosha-finance/internal/settings"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/google/uuid"
@@ -13,10 +14,13 @@ import (
 
 type DashboardHandler struct {
 	txService service.TransactionService
+	settings  *settings.Store
 }
 
-func NewDashboardHandler(txService service.TransactionService) *DashboardHandler {
-	return &DashboardHandler{txService: txService}
+// NewDashboardHandler creates the handler. The date in queries is a day in
+// the business time zone read from store.
+func NewDashboardHandler(txService service.TransactionService, store *settings.Store) *DashboardHandler {
+	return &DashboardHandler{txService: txService, settings: store}
 }
 
 func (h *DashboardHandler) GetSummary(c *fiber.Ctx) error {
@@ -35,12 +39,10 @@ func (h *DashboardHandler) GetSummary(c *fiber.Ctx) error {
 	// Optional date filter (format: YYYY-MM-DD)
 	dateParam := c.Query("date")
 	if dateParam != "" {
-		date, err := time.Parse("2006-01-02", dateParam)
+		startOfDay, err := time.ParseInLocation("2006-01-02", dateParam, h.settings.Location())
 		if err != nil {
 			return response.BadRequest(c, "Invalid date format. Use YYYY-MM-DD")
 		}
-		// Start of day
-		startOfDay := time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, date.Location())
 		// End of day (start of next day)
 		endOfDay := startOfDay.AddDate(0, 0, 1)
 		filter.StartDate = &startOfDay
@@ -0,0 +1,220 @@
+package handler
+
+import (
+	"errors"
+	"strconv"
+
+	"shosha-finance/internal/models"
+	"shosha-finance/internal/response"
+	"shosha-finance/internal/service"
+	"shosha-finance/internal/syncproto"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+type DeviceHandler struct {
+	deviceService service.DeviceService
+	thresholds    models.SyncHealthThresholds
+}
+
+// NewDeviceHandler returns the device handler; thresholds are the default
+// staleness thresholds of the sync health overview.
+func NewDeviceHandler(deviceService service.DeviceService, thresholds models.SyncHealthThresholds) *DeviceHandler {
+	return &DeviceHandler{deviceService: deviceService, thresholds: thresholds}
+}
+
+// GetAll lists the devices that have synced with the cloud and their
+// branch assignments.
+func (h *DeviceHandler) GetAll(c *fiber.Ctx) error {
+	devices, err := h.deviceService.GetAll()
+	if err != nil {
+		return response.InternalError(c, "Failed to get devices")
+	}
+
+	return response.Success(c, "Success", devices)
+}
+
+// UpdateScope sets the branches a device pulls data for.
+func (h *DeviceHandler) UpdateScope(c *fiber.Ctx) error {
+	var req models.DeviceScopeRequest
+	if err := c.BodyParser(&req); err != nil {
+		return response.BadRequest(c, "Invalid request body")
+	}
+
+	device, err := h.deviceService.UpdateScope(c.Params("id"), &req)
+	if err != nil {
+		switch {
+		case errors.Is(err, service.ErrDeviceNotFound):
+			return response.NotFound(c, "Device not found")
+		case errors.Is(err, service.ErrInvalidScopeBranch):
+			return response.BadRequest(c, err.Error())
+		}
+		return response.InternalError(c, "Failed to update device scope")
+	}
+
+	return response.Success(c, "Device scope updated", device)
+}
+
+// Deactivate stops a device, such as a lost laptop, from syncing. It is
+// refused on its next request.
+func (h *DeviceHandler) Deactivate(c *fiber.Ctx) error {
+	device, err := h.deviceService.SetActive(c.Params("id"), false)
+	if err != nil {
+		return deviceError(c, err)
+	}
+
+	return response.Success(c, "Device deactivated", device)
+}
+
+func (h *DeviceHandler) Activate(c *fiber.Ctx) error {
+	device, err := h.deviceService.SetActive(c.Params("id"), true)
+	if err != nil {
+		return deviceError(c, err)
+	}
+
+	return response.Success(c, "Device activated", device)
+}
+
+// CreateEnrollmentCode issues a one-time code for enrolling a device at a
+// branch.
+func (h *DeviceHandler) CreateEnrollmentCode(c *fiber.Ctx) error {
+	var req models.EnrollmentCodeRequest
+	if err := c.BodyParser(&req); err != nil {
+		return response.BadRequest(c, "Invalid request body")
+	}
+
+	if req.BranchID == "" {
+		return response.BadRequest(c, "Branch ID is required")
+	}
+
+	user := c.Locals("user").(*models.User)
+
+	code, err := h.deviceService.CreateEnrollmentCode(&req, user.ID)
+	if err != nil {
+		if errors.Is(err, service.ErrEnrollmentBranch) {
+			return response.BadRequest(c, err.Error())
+		}
+		return response.InternalError(c, "Failed to create enrollment code")
+	}
+
+	return response.Created(c, "Enrollment code created", code)
+}
+
+func (h *DeviceHandler) GetEnrollmentCodes(c *fiber.Ctx) error {
+	codes, err := h.deviceService.GetEnrollmentCodes()
+	if err != nil {
+		return response.InternalError(c, "Failed to get enrollment codes")
+	}
+
+	return response.Success(c, "Success", codes)
+}
+
+// Enroll exchanges an enrollment code for a device ID and credential. It is
+// called once by a new local install.
+func (h *DeviceHandler) Enroll(c *fiber.Ctx) error {
+	var req models.EnrollRequest
+	if err := c.BodyParser(&req); err != nil {
+		return response.BadRequest(c, "Invalid request body")
+	}
+
+	if req.Code == "" {
+		return response.BadRequest(c, "Enrollment code is required")
+	}
+
+	enrollment, err := h.deviceService.Enroll(&req)
+	if err != nil {
+		if errors.Is(err, service.ErrInvalidEnrollmentCode) {
+			return response.Unauthorized(c, err.Error())
+		}
+		return response.InternalError(c, "Failed to enroll device")
+	}
+
+	return response.Created(c, "Device enrolled", enrollment)
+}
+
+// Handshake settles the sync protocol version and capabilities with an
+// enrolled device. A device too old for the cloud, or too new for it, is
+// told which side needs updating with 426.
+func (h *DeviceHandler) Handshake(c *fiber.Ctx) error {
+	var hello syncproto.Hello
+	if err := c.BodyParser(&hello); err != nil {
+		return response.BadRequest(c, "Invalid request body")
+	}
+
+	if hello.ProtocolVersion < syncproto.Version1 {
+		return response.BadRequest(c, "Protocol version is required")
+	}
+	if hello.MinProtocolVersion < syncproto.Version1 || hello.MinProtocolVersion > hello.ProtocolVersion {
+		hello.MinProtocolVersion = hello.ProtocolVersion
+	}
+
+	device := c.Locals("device").(*models.Device)
+	welcome, err := h.deviceService.Handshake(device, &hello)
+	if err != nil {
+		var refusal *syncproto.Refusal
+		if errors.As(err, &refusal) {
+			return response.UpgradeRequired(c, refusal.Error(), refusal)
+		}
+		return response.InternalError(c, "Failed to settle sync protocol")
+	}
+
+	return response.Success(c, "Sync protocol agreed", welcome)
+}
+
+// Report stores what a device tells at the end of a sync cycle: its push
+// backlog and why the cycle failed, if it did.
+func (h *DeviceHandler) Report(c *fiber.Ctx) error {
+	var report syncproto.StatusReport
+	if err := c.BodyParser(&report); err != nil {
+		return response.BadRequest(c, "Invalid request body")
+	}
+
+	if report.QueueDepth < 0 {
+		return response.BadRequest(c, "Queue depth cannot be negative")
+	}
+
+	device := c.Locals("device").(*models.Device)
+	if err := h.deviceService.RecordReport(device.ID, &report); err != nil {
+		return response.InternalError(c, "Failed to record sync report")
+	}
+
+	return response.Success(c, "Sync report recorded", nil)
+}
+
+// GetSyncHealth shows every branch's sync health, worst first, so head
+// office can see which branches have not synced for a while. The
+// thresholds can be overridden with stale_hours and offline_hours.
+func (h *DeviceHandler) GetSyncHealth(c *fiber.Ctx) error {
+	thresholds := h.thresholds
+	if value := c.Query("stale_hours"); value != "" {
+		hours, err := strconv.Atoi(value)
+		if err != nil || hours < 1 {
+			return response.BadRequest(c, "Invalid stale_hours")
+		}
+		thresholds.StaleAfterHours = hours
+	}
+	if value := c.Query("offline_hours"); value != "" {
+		hours, err := strconv.Atoi(value)
+		if err != nil || hours < 1 {
+			return response.BadRequest(c, "Invalid offline_hours")
+		}
+		thresholds.OfflineAfterHours = hours
+	}
+	if thresholds.OfflineAfterHours < thresholds.StaleAfterHours {
+		return response.BadRequest(c, "offline_hours must not be less than stale_hours")
+	}
+
+	health, err := h.deviceService.GetSyncHealth(thresholds)
+	if err != nil {
+		return response.InternalError(c, "Failed to get sync health")
+	}
+
+	return response.Success(c, "Success", health)
+}
+
+func deviceError(c *fiber.Ctx, err error) error {
+	if errors.Is(err, service.ErrDeviceNotFound) {
+		return response.NotFound(c, "Device not found")
+	}
+	return response.InternalError(c, "Failed to update device")
+}
@@ -0,0 +1,124 @@
+package handler
+
+import (
+	"time"
+
+	"shosha-finance/internal/models"
+	"shosha-finance/internal/repository"
+	"shosha-finance/internal/response"
+	"shosha-finance/internal/service"
+	"shosha-finance/internal/settings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+type ReconciliationHandler struct {
+	reconciliationService service.ReconciliationService
+	settings              *settings.Store
+}
+
+// NewReconciliationHandler creates the handler. Dates in queries are days
+// in the business time zone read from store.
+func NewReconciliationHandler(reconciliationService service.ReconciliationService, store *settings.Store) *ReconciliationHandler {
+	return &ReconciliationHandler{reconciliationService: reconciliationService, settings: store}
+}
+
+func (h *ReconciliationHandler) Create(c *fiber.Ctx) error {
+	var req models.CashReconciliationRequest
+	if err := c.BodyParser(&req); err != nil {
+		return response.BadRequest(c, "Invalid request body")
+	}
+
+	if req.BranchID == "" {
+		return response.BadRequest(c, "Branch ID is required")
+	}
+
+	if req.CountedAmount < 0 {
+		return response.BadRequest(c, "Counted amount cannot be negative")
+	}
+
+	user := c.Locals("user").(*models.User)
+
+	rec, err := h.reconciliationService.Create(&req, user.ID)
+	if err != nil {
+		return response.InternalError(c, "Failed to create cash reconciliation")
+	}
+
+	return response.Created(c, "Cash reconciliation recorded successfully", rec)
+}
+
+func (h *ReconciliationHandler) GetAll(c *fiber.Ctx) error {
+	filter, err := parseReconciliationFilter(c, h.settings.Location())
+	if err != nil {
+		return response.BadRequest(c, err.Error())
+	}
+
+	recs, err := h.reconciliationService.GetAll(filter)
+	if err != nil {
+		return response.InternalError(c, "Failed to get cash reconciliations")
+	}
+
+	return response.Success(c, "Success", recs)
+}
+
+func (h *ReconciliationHandler) GetSummary(c *fiber.Ctx) error {
+	filter, err := parseReconciliationFilter(c, h.settings.Location())
+	if err != nil {
+		return response.BadRequest(c, err.Error())
+	}
+
+	summaries, err := h.reconciliationService.GetSummary(filter)
+	if err != nil {
+		return response.InternalError(c, "Failed to get cash reconciliation report")
+	}
+
+	return response.Success(c, "Success", summaries)
+}
+
+func (h *ReconciliationHandler) GetByID(c *fiber.Ctx) error {
+	id, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return response.BadRequest(c, "Invalid reconciliation ID")
+	}
+
+	rec, err := h.reconciliationService.GetByID(id)
+	if err != nil {
+		return response.NotFound(c, "Cash reconciliation not found")
+	}
+
+	return response.Success(c, "Success", rec)
+}
+
+// parseReconciliationFilter reads branch_id, start_date and end_date
+// (YYYY-MM-DD, both inclusive, days in loc) from the query string.
+func parseReconciliationFilter(c *fiber.Ctx, loc *time.Location) (*repository.ReconciliationFilter, error) {
+	filter := &repository.ReconciliationFilter{}
+
+	if branchIDParam := c.Query("branch_id"); branchIDParam != "" {
+		id, err := uuid.Parse(branchIDParam)
+		if err != nil {
+			return nil, fiber.NewError(fiber.StatusBadRequest, "Invalid branch_id")
+		}
+		filter.BranchID = &id
+	}
+
+	if startParam := c.Query("start_date"); startParam != "" {
+		start, err := time.ParseInLocation("2006-01-02", startParam, loc)
+		if err != nil {
+			return nil, fiber.NewError(fiber.StatusBadRequest, "Invalid start_date format. Use YYYY-MM-DD")
+		}
+		filter.StartDate = &start
+	}
+
+	if endParam := c.Query("end_date"); endParam != "" {
+		end, err := time.ParseInLocation("2006-01-02", endParam, loc)
+		if err != nil {
+			return nil, fiber.NewError(fiber.StatusBadRequest, "Invalid end_date format. Use YYYY-MM-DD")
+		}
+		end = end.AddDate(0, 0, 1)
+		filter.EndDate = &end
+	}
+
+	return filter, nil
+}
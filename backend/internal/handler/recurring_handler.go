@@ -0,0 +1,132 @@
+package handler
+
+import (
+	"strconv"
+
+	"shosha-finance/internal/models"
+	"shosha-finance/internal/response"
+	"shosha-finance/internal/service"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+type RecurringHandler struct {
+	recurringService service.RecurringService
+}
+
+func NewRecurringHandler(recurringService service.RecurringService) *RecurringHandler {
+	return &RecurringHandler{recurringService: recurringService}
+}
+
+func (h *RecurringHandler) Create(c *fiber.Ctx) error {
+	var req models.RecurringTransactionRequest
+	if err := c.BodyParser(&req); err != nil {
+		return response.BadRequest(c, "Invalid request body")
+	}
+
+	if req.BranchID == "" {
+		return response.BadRequest(c, "Branch ID is required")
+	}
+
+	if req.Type != models.TransactionTypeIN && req.Type != models.TransactionTypeOUT {
+		return response.BadRequest(c, "Type must be IN or OUT")
+	}
+
+	if req.Amount <= 0 {
+		return response.BadRequest(c, "Amount must be greater than 0")
+	}
+
+	if req.Category == "" {
+		return response.BadRequest(c, "Category is required")
+	}
+
+	rec, err := h.recurringService.Create(&req)
+	if err != nil {
+		switch err {
+		case service.ErrInvalidSchedule:
+			return response.BadRequest(c, "Invalid schedule: use daily, weekly with day_of_week 0-6, or monthly with day_of_month 1-31")
+		case service.ErrInvalidDate:
+			return response.BadRequest(c, "Invalid date format. Use YYYY-MM-DD")
+		case service.ErrCategoryNotAllowed:
+			return response.BadRequest(c, "Category is not in the allowed categories")
+		default:
+			return response.InternalError(c, "Failed to create recurring transaction")
+		}
+	}
+
+	return response.Created(c, "Recurring transaction created successfully", rec)
+}
+
+func (h *RecurringHandler) GetAll(c *fiber.Ctx) error {
+	recs, err := h.recurringService.GetAll()
+	if err != nil {
+		return response.InternalError(c, "Failed to get recurring transactions")
+	}
+
+	return response.Success(c, "Success", recs)
+}
+
+func (h *RecurringHandler) GetByID(c *fiber.Ctx) error {
+	id, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return response.BadRequest(c, "Invalid recurring transaction ID")
+	}
+
+	rec, err := h.recurringService.GetByID(id)
+	if err != nil {
+		return response.NotFound(c, "Recurring transaction not found")
+	}
+
+	return response.Success(c, "Success", rec)
+}
+
+func (h *RecurringHandler) Pause(c *fiber.Ctx) error {
+	id, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return response.BadRequest(c, "Invalid recurring transaction ID")
+	}
+
+	rec, err := h.recurringService.Pause(id)
+	if err != nil {
+		return response.NotFound(c, "Recurring transaction not found")
+	}
+
+	return response.Success(c, "Recurring transaction paused", rec)
+}
+
+func (h *RecurringHandler) Resume(c *fiber.Ctx) error {
+	id, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return response.BadRequest(c, "Invalid recurring transaction ID")
+	}
+
+	rec, err := h.recurringService.Resume(id)
+	if err != nil {
+		if err == service.ErrScheduleEnded {
+			return response.BadRequest(c, "Recurring schedule has ended")
+		}
+		return response.NotFound(c, "Recurring transaction not found")
+	}
+
+	return response.Success(c, "Recurring transaction resumed", rec)
+}
+
+func (h *RecurringHandler) Preview(c *fiber.Ctx) error {
+	id, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return response.BadRequest(c, "Invalid recurring transaction ID")
+	}
+
+	count, _ := strconv.Atoi(c.Query("count", "5"))
+	if count < 1 || count > 24 {
+		count = 5
+	}
+
+	occurrences, err := h.recurringService.Preview(id, count)
+	if err != nil {
+		return response.NotFound(c, "Recurring transaction not found")
+	}
+
+	return response.Success(c, "Success", occurrences)
+}
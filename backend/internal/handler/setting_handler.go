@@ -0,0 +1,104 @@
+package handler
+
+import (
+	"errors"
+
+	"shosha-finance/internal/models"
+	"shosha-finance/internal/repository"
+	"shosha-finance/internal/response"
+	"shosha-finance/internal/service"
+	"shosha-finance/internal/settings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+type SettingHandler struct {
+	settingService service.SettingService
+}
+
+func NewSettingHandler(settingService service.SettingService) *SettingHandler {
+	return &SettingHandler{settingService: settingService}
+}
+
+// GetDefinitions lists the settings that can be set, with their kinds and
+// defaults.
+func (h *SettingHandler) GetDefinitions(c *fiber.Ctx) error {
+	return response.Success(c, "Success", settings.Definitions)
+}
+
+// GetAll lists the values set on the cloud, optionally by key or scope.
+func (h *SettingHandler) GetAll(c *fiber.Ctx) error {
+	filter := &repository.SettingFilter{
+		Key:     c.Query("key"),
+		Scope:   models.SettingScope(c.Query("scope")),
+		ScopeID: c.Query("scope_id"),
+	}
+
+	values, err := h.settingService.GetAll(filter)
+	if err != nil {
+		return response.InternalError(c, "Failed to get settings")
+	}
+
+	return response.Success(c, "Success", values)
+}
+
+// Set stores a value for a setting and scope, replacing the one set
+// before. Devices pick it up at their next sync.
+func (h *SettingHandler) Set(c *fiber.Ctx) error {
+	var req models.SettingRequest
+	if err := c.BodyParser(&req); err != nil {
+		return response.BadRequest(c, "Invalid request body")
+	}
+	if req.Key == "" {
+		return response.BadRequest(c, "Key is required")
+	}
+	if len(req.Value) == 0 {
+		return response.BadRequest(c, "Value is required")
+	}
+	if req.Scope == "" {
+		req.Scope = models.SettingScopeGlobal
+	}
+
+	user := c.Locals("user").(*models.User)
+
+	setting, err := h.settingService.Set(&req, user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, settings.ErrUnknownKey), errors.Is(err, settings.ErrInvalidValue),
+			errors.Is(err, service.ErrSettingScope), errors.Is(err, service.ErrSettingTarget):
+			return response.BadRequest(c, err.Error())
+		}
+		return response.InternalError(c, "Failed to save setting")
+	}
+
+	return response.Success(c, "Setting saved", setting)
+}
+
+func (h *SettingHandler) Delete(c *fiber.Ctx) error {
+	id, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return response.BadRequest(c, "Invalid setting ID")
+	}
+
+	if err := h.settingService.Delete(id); err != nil {
+		if errors.Is(err, service.ErrSettingNotFound) {
+			return response.NotFound(c, "Setting not found")
+		}
+		return response.InternalError(c, "Failed to delete setting")
+	}
+
+	return response.Success(c, "Setting deleted", nil)
+}
+
+// Resolve sends a device the settings that apply to it.
+func (h *SettingHandler) Resolve(c *fiber.Ctx) error {
+	device := c.Locals("device").(*models.Device)
+
+	resolved, err := h.settingService.Resolve(device)
+	if err != nil {
+		return response.InternalError(c, "Failed to resolve settings")
+	}
+
+	return response.Success(c, "Success", resolved)
+}
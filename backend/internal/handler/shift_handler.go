@@ -0,0 +1,144 @@
+package handler
+
+import (
+	"shosha-finance/internal/models"
+	"shosha-finance/internal/repository"
+	"shosha-finance/internal/response"
+	"shosha-finance/internal/service"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+type ShiftHandler struct {
+	shiftService service.ShiftService
+}
+
+func NewShiftHandler(shiftService service.ShiftService) *ShiftHandler {
+	return &ShiftHandler{shiftService: shiftService}
+}
+
+func (h *ShiftHandler) Open(c *fiber.Ctx) error {
+	var req models.OpenShiftRequest
+	if err := c.BodyParser(&req); err != nil {
+		return response.BadRequest(c, "Invalid request body")
+	}
+
+	if req.BranchID == "" {
+		return response.BadRequest(c, "Branch ID is required")
+	}
+
+	if req.OpeningFloat < 0 {
+		return response.BadRequest(c, "Opening float cannot be negative")
+	}
+
+	user := c.Locals("user").(*models.User)
+
+	shift, err := h.shiftService.Open(&req, user.ID)
+	if err != nil {
+		switch err {
+		case service.ErrShiftAlreadyOpen:
+			return response.BadRequest(c, "Branch already has an open shift")
+		case service.ErrInvalidShiftBranch:
+			return response.BadRequest(c, "Invalid branch ID")
+		}
+		return response.InternalError(c, "Failed to open shift")
+	}
+
+	return response.Created(c, "Shift opened successfully", shift)
+}
+
+func (h *ShiftHandler) Close(c *fiber.Ctx) error {
+	id, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return response.BadRequest(c, "Invalid shift ID")
+	}
+
+	var req models.CloseShiftRequest
+	if err := c.BodyParser(&req); err != nil {
+		return response.BadRequest(c, "Invalid request body")
+	}
+
+	if len(req.Denominations) == 0 {
+		return response.BadRequest(c, "Cash count by denomination is required")
+	}
+
+	report, err := h.shiftService.Close(id, &req)
+	if err != nil {
+		switch err {
+		case service.ErrShiftNotOpen:
+			return response.BadRequest(c, "Shift is not open")
+		case service.ErrInvalidDenomination:
+			return response.BadRequest(c, "Invalid denomination or quantity")
+		default:
+			return response.NotFound(c, "Shift not found")
+		}
+	}
+
+	return response.Success(c, "Shift closed successfully", report)
+}
+
+func (h *ShiftHandler) GetAll(c *fiber.Ctx) error {
+	filter := &repository.ShiftFilter{}
+
+	if branchIDParam := c.Query("branch_id"); branchIDParam != "" {
+		id, err := uuid.Parse(branchIDParam)
+		if err != nil {
+			return response.BadRequest(c, "Invalid branch_id")
+		}
+		filter.BranchID = &id
+	}
+
+	if status := c.Query("status"); status != "" {
+		filter.Status = models.ShiftStatus(status)
+	}
+
+	shifts, err := h.shiftService.GetAll(filter)
+	if err != nil {
+		return response.InternalError(c, "Failed to get shifts")
+	}
+
+	return response.Success(c, "Success", shifts)
+}
+
+func (h *ShiftHandler) GetCurrent(c *fiber.Ctx) error {
+	branchID, err := uuid.Parse(c.Query("branch_id"))
+	if err != nil {
+		return response.BadRequest(c, "Invalid branch_id")
+	}
+
+	shift, err := h.shiftService.GetOpenByBranch(branchID)
+	if err != nil {
+		return response.NotFound(c, "No open shift for this branch")
+	}
+
+	return response.Success(c, "Success", shift)
+}
+
+func (h *ShiftHandler) GetByID(c *fiber.Ctx) error {
+	id, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return response.BadRequest(c, "Invalid shift ID")
+	}
+
+	shift, err := h.shiftService.GetByID(id)
+	if err != nil {
+		return response.NotFound(c, "Shift not found")
+	}
+
+	return response.Success(c, "Success", shift)
+}
+
+func (h *ShiftHandler) GetReport(c *fiber.Ctx) error {
+	id, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return response.BadRequest(c, "Invalid shift ID")
+	}
+
+	report, err := h.shiftService.GetReport(id)
+	if err != nil {
+		return response.NotFound(c, "Shift not found")
+	}
+
+	return response.Success(c, "Success", report)
+}
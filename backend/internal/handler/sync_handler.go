@@ -1,105 +1,450 @@
 package handler
 
 import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
 	"time"
 
 	"shosha-finance/internal/models"
+	"shosha-finance/internal/repository"
 	"shosha-finance/internal/response"
 	"shosha-finance/internal/service"
+	"shosha-finance/internal/syncproto"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
 )
 
+// pullPageSize is how many transactions a streamed pull reads from the
+// database and sends at a time.
+const pullPageSize = 500
+
 type SyncHandler struct {
-	txService     service.TransactionService
-	branchService service.BranchService
+	syncService      service.SyncService
+	txService        service.TransactionService
+	branchService    service.BranchService
+	tombstoneService service.TombstoneService
+	userService      service.UserService
+	deviceService    service.DeviceService
 }
 
-func NewSyncHandler(txService service.TransactionService, branchService service.BranchService) *SyncHandler {
+func NewSyncHandler(
+	syncService service.SyncService,
+	txService service.TransactionService,
+	branchService service.BranchService,
+	tombstoneService service.TombstoneService,
+	userService service.UserService,
+	deviceService service.DeviceService,
+) *SyncHandler {
 	return &SyncHandler{
-		txService:     txService,
-		branchService: branchService,
+		syncService:      syncService,
+		txService:        txService,
+		branchService:    branchService,
+		tombstoneService: tombstoneService,
+		userService:      userService,
+		deviceService:    deviceService,
 	}
 }
 
-type SyncPushRequest struct {
-	Branches     []models.Branch      `json:"branches"`
-	Transactions []models.Transaction `json:"transactions"`
-}
+// Push - receive data from local app and save to cloud. The response is
+// only sent once the whole batch is committed. Local apps send either a
+// stream of frames or, before streaming, one JSON document.
+func (h *SyncHandler) Push(c *fiber.Ctx) error {
+	if syncproto.IsStream(c.Get("Content-Type")) {
+		return h.pushStream(c)
+	}
 
-type SyncPushResponse struct {
-	Branches     []uuid.UUID `json:"branches"`
-	Transactions []uuid.UUID `json:"transactions"`
-}
+	var req models.SyncPushBatch
+	if err := c.BodyParser(&req); err != nil {
+		return response.BadRequest(c, "Invalid request body")
+	}
 
-type SyncPullResponse struct {
-	Branches     []models.Branch      `json:"branches"`
-	Transactions []models.Transaction `json:"transactions"`
-	LastSyncAt   string               `json:"last_sync_at"`
+	// The batch is applied for the device that authenticated and limited to
+	// its branches, whatever the body claims
+	device := c.Locals("device").(*models.Device)
+	req.DeviceID = device.ID
+
+	result, err := h.syncService.Push(&req, device.Scope())
+	if err != nil {
+		if err == service.ErrMissingDeviceID {
+			return response.BadRequest(c, "Device ID is required")
+		}
+		h.deviceService.RecordPush(req.DeviceID, err)
+		return response.InternalError(c, "Failed to apply sync batch")
+	}
+
+	h.deviceService.RecordPush(req.DeviceID, nil)
+	return response.Success(c, "Data synced successfully", result)
 }
 
-// Push - receive data from local app and save to cloud
-func (h *SyncHandler) Push(c *fiber.Ctx) error {
-	var req SyncPushRequest
-	if err := c.BodyParser(&req); err != nil {
-		return response.BadRequest(c, "Invalid request body")
+// pushStream applies a push sent as a batch frame followed by one frame
+// per change. The server buffers the compressed body; it is decompressed
+// and applied one change at a time, so the DB transaction never waits on
+// the network and the decoded batch is never held as a whole.
+func (h *SyncHandler) pushStream(c *fiber.Ctx) error {
+	// The raw body; c.Body() would decompress all of it up front
+	reader, err := syncproto.NewReader(bytes.NewReader(c.Request().Body()), c.Get("Content-Encoding"))
+	if err != nil {
+		return response.BadRequest(c, "Invalid push stream: "+err.Error())
+	}
+	defer reader.Close()
+
+	frame, err := reader.Next()
+	if err != nil || frame.Kind != syncproto.KindBatch {
+		return response.BadRequest(c, "Push stream must start with a batch frame")
+	}
+	var header syncproto.PushHeader
+	if err := frame.Decode(&header); err != nil {
+		return response.BadRequest(c, err.Error())
 	}
 
-	syncedBranches := []uuid.UUID{}
-	syncedTransactions := []uuid.UUID{}
+	// The batch is applied for the device that authenticated and limited to
+	// its branches, whatever the header claims
+	device := c.Locals("device").(*models.Device)
+	batch := &models.SyncPushBatch{
+		BatchID:  header.BatchID,
+		DeviceID: device.ID,
+		BranchID: header.BranchID,
+	}
 
-	// Upsert branches
-	for _, branch := range req.Branches {
-		err := h.branchService.Upsert(&branch)
+	var streamErr error
+	next := func() (*models.SyncChange, error) {
+		frame, err := reader.Next()
+		if err == io.EOF {
+			return nil, nil
+		}
+		if err == nil && frame.Kind != syncproto.KindChange {
+			err = fmt.Errorf("unexpected %s frame", frame.Kind)
+		}
+		var change models.SyncChange
+		if err == nil {
+			err = frame.Decode(&change)
+		}
 		if err != nil {
-			continue
+			streamErr = err
+			return nil, err
 		}
-		syncedBranches = append(syncedBranches, branch.ID)
+		return &change, nil
+	}
+
+	result, err := h.syncService.PushStream(batch, device.Scope(), next)
+	if err != nil {
+		if streamErr != nil {
+			return response.BadRequest(c, "Invalid push stream: "+streamErr.Error())
+		}
+		h.deviceService.RecordPush(batch.DeviceID, err)
+		return response.InternalError(c, "Failed to apply sync batch")
+	}
+
+	h.deviceService.RecordPush(batch.DeviceID, nil)
+	return response.Success(c, "Data synced successfully", result)
+}
+
+// GetBatches lists recent push receipts, optionally for one branch or device.
+func (h *SyncHandler) GetBatches(c *fiber.Ctx) error {
+	limit, _ := strconv.Atoi(c.Query("limit", "50"))
+	if limit < 1 || limit > 500 {
+		limit = 50
+	}
+
+	filter := &repository.SyncBatchFilter{
+		DeviceID: c.Query("device_id"),
+		Limit:    limit,
 	}
 
-	// Upsert transactions
-	for _, tx := range req.Transactions {
-		err := h.txService.Upsert(&tx)
+	if branchIDParam := c.Query("branch_id"); branchIDParam != "" {
+		id, err := uuid.Parse(branchIDParam)
 		if err != nil {
-			continue
+			return response.BadRequest(c, "Invalid branch_id")
 		}
-		syncedTransactions = append(syncedTransactions, tx.ID)
+		filter.BranchID = &id
 	}
 
-	return response.Success(c, "Data synced successfully", SyncPushResponse{
-		Branches:     syncedBranches,
-		Transactions: syncedTransactions,
-	})
+	batches, err := h.syncService.GetBatches(filter)
+	if err != nil {
+		return response.InternalError(c, "Failed to get sync batches")
+	}
+
+	return response.Success(c, "Success", batches)
 }
 
-// Pull - send latest data to local app
+// Pull - send latest data to local app. Devices pass the cursor of their
+// previous pull as since and get the records the cloud wrote after it, in
+// the order it wrote them. The cursor is the cloud's receive sequence
+// number rather than a record's stamp, so a record pushed late, or stamped
+// by a device with a slow clock, still reaches every device. Transactions
+// and users are limited to the branches assigned to the device; branches
+// and deletes are master data and go to every device.
 func (h *SyncHandler) Pull(c *fiber.Ctx) error {
-	// Get last sync time from query param (optional)
-	lastSyncParam := c.Query("last_sync", "")
-	var lastSync *time.Time
-	if lastSyncParam != "" {
-		t, err := time.Parse(time.RFC3339, lastSyncParam)
-		if err == nil {
-			lastSync = &t
+	device := c.Locals("device").(*models.Device)
+	scope := device.Scope()
+
+	var since uint64
+	if sinceParam := c.Query("since"); sinceParam != "" {
+		seq, err := strconv.ParseUint(sinceParam, 10, 64)
+		if err != nil {
+			return response.BadRequest(c, "Invalid since cursor")
 		}
+		since = seq
+	}
+
+	// Records are read up to the newest committed number, which becomes
+	// the cursor; anything written meanwhile waits for the next pull
+	until, err := h.syncService.LatestSeq()
+	if err != nil {
+		return response.InternalError(c, "Failed to get sync cursor")
+	}
+	cursor := until
+	if since > cursor {
+		cursor = since
+	}
+
+	// Streams came with protocol version 2; older devices get a document
+	version, _ := c.Locals("syncProtocol").(int)
+	if version >= syncproto.Version2 && syncproto.IsStream(c.Get("Accept")) {
+		return h.pullStream(c, device.ID, since, cursor, scope)
 	}
 
-	// Get branches updated after lastSync
-	branches, err := h.branchService.GetUpdatedAfter(lastSync)
+	// Get branches written after since
+	branches, err := h.branchService.GetUpdatedBetween(since, cursor)
 	if err != nil {
 		return response.InternalError(c, "Failed to get branches")
 	}
 
-	// Get transactions updated after lastSync
-	transactions, err := h.txService.GetUpdatedAfter(lastSync)
+	// Get transactions of the device's branches written after since
+	transactions, err := h.txService.GetUpdatedBetween(since, cursor, scope)
 	if err != nil {
 		return response.InternalError(c, "Failed to get transactions")
 	}
 
-	return response.Success(c, "Data retrieved successfully", SyncPullResponse{
+	// Get users of the device's branches, with password hashes for offline
+	// login, and the IDs of changed users it may no longer have
+	userChanges, err := h.userService.GetUpdatedBetween(since, cursor, scope)
+	if err != nil {
+		return response.InternalError(c, "Failed to get users")
+	}
+
+	// Get records deleted after since
+	tombstones, err := h.tombstoneService.GetBetween(since, cursor)
+	if err != nil {
+		return response.InternalError(c, "Failed to get deleted records")
+	}
+
+	h.deviceService.RecordPull(device.ID, nil)
+	return response.Success(c, "Data retrieved successfully", syncproto.PullResponse{
 		Branches:     branches,
 		Transactions: transactions,
+		Tombstones:   tombstones,
+		Users:        userChanges.Users,
+		RevokedUsers: userChanges.Revoked,
+		Scope:        scope,
+		Cursor:       cursor,
 		LastSyncAt:   time.Now().Format(time.RFC3339),
 	})
 }
+
+// pullStream sends a pull as frames, compressed as the device accepts,
+// of the records written after since up to the cursor. Transactions are
+// read and sent a page at a time; the smaller record types are read up
+// front. A failure once the stream has started ends it with an error frame
+// instead of the end frame, so the device keeps its cursor and pulls again.
+func (h *SyncHandler) pullStream(c *fiber.Ctx, deviceID string, since, cursor uint64, scope *models.BranchScope) error {
+	branches, err := h.branchService.GetUpdatedBetween(since, cursor)
+	if err != nil {
+		return response.InternalError(c, "Failed to get branches")
+	}
+
+	userChanges, err := h.userService.GetUpdatedBetween(since, cursor, scope)
+	if err != nil {
+		return response.InternalError(c, "Failed to get users")
+	}
+
+	tombstones, err := h.tombstoneService.GetBetween(since, cursor)
+	if err != nil {
+		return response.InternalError(c, "Failed to get deleted records")
+	}
+
+	encoding := syncproto.Negotiate(c.Get("Accept-Encoding"))
+	c.Set("Content-Type", syncproto.ContentType)
+	c.Set("Vary", "Accept-Encoding")
+	if encoding != "" {
+		c.Set("Content-Encoding", encoding)
+	}
+
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		stream, err := syncproto.NewWriter(w, encoding)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to start pull stream")
+			return
+		}
+
+		records := 0
+		send := func(kind string, data interface{}) error {
+			records++
+			return stream.Write(kind, data)
+		}
+		// A failed flush means the device has gone away
+		flush := func() error {
+			if err := stream.Flush(); err != nil {
+				return err
+			}
+			return w.Flush()
+		}
+
+		err = func() error {
+			if err := stream.Write(syncproto.KindScope, scope); err != nil {
+				return err
+			}
+			for i := range branches {
+				if err := send(syncproto.KindBranch, &branches[i]); err != nil {
+					return err
+				}
+			}
+			if err := flush(); err != nil {
+				return err
+			}
+
+			err := h.txService.EachUpdatedBetween(since, cursor, scope, pullPageSize, func(page []models.Transaction) error {
+				for i := range page {
+					if err := send(syncproto.KindTransaction, page[i].ToSync()); err != nil {
+						return err
+					}
+				}
+				return flush()
+			})
+			if err != nil {
+				return err
+			}
+
+			for i := range userChanges.Users {
+				if err := send(syncproto.KindUser, &userChanges.Users[i]); err != nil {
+					return err
+				}
+			}
+			for _, id := range userChanges.Revoked {
+				if err := send(syncproto.KindRevokedUser, id); err != nil {
+					return err
+				}
+			}
+			for i := range tombstones {
+				if err := send(syncproto.KindTombstone, &tombstones[i]); err != nil {
+					return err
+				}
+			}
+			return nil
+		}()
+
+		h.deviceService.RecordPull(deviceID, err)
+		if err != nil {
+			log.Error().Err(err).Msg("Pull stream failed")
+			stream.Write(syncproto.KindError, syncproto.StreamError{Message: "pull failed, try again"})
+		} else {
+			stream.Write(syncproto.KindEnd, syncproto.PullEnd{
+				Cursor:     cursor,
+				LastSyncAt: time.Now().Format(time.RFC3339),
+				Records:    records,
+			})
+		}
+		if err := stream.Close(); err == nil {
+			w.Flush()
+		}
+	})
+
+	return nil
+}
+
+// Snapshot - send a consistent copy of everything the device's branch scope
+// holds, for a new or broken local install to restore from before it
+// starts pulling. The snapshot's cursor is where its first pull continues.
+func (h *SyncHandler) Snapshot(c *fiber.Ctx) error {
+	device := c.Locals("device").(*models.Device)
+
+	snapshot, err := h.syncService.Snapshot(device.Scope())
+	if err != nil {
+		return response.InternalError(c, "Failed to take sync snapshot")
+	}
+
+	return response.Success(c, "Snapshot retrieved successfully", snapshot)
+}
+
+// Digests - send the day digests of the device's books on the cloud, for
+// the device to compare with its own. Days run from from to to, both
+// included, and only transactions received up to until, the device's pull
+// cursor, count, so records it has not pulled yet do not show as
+// differences.
+func (h *SyncHandler) Digests(c *fiber.Ctx) error {
+	device := c.Locals("device").(*models.Device)
+
+	from, err := time.Parse(models.DigestDayLayout, c.Query("from"))
+	if err != nil {
+		return response.BadRequest(c, "Invalid from day, use YYYY-MM-DD")
+	}
+	to, err := time.Parse(models.DigestDayLayout, c.Query("to"))
+	if err != nil || to.Before(from) {
+		return response.BadRequest(c, "Invalid to day, use YYYY-MM-DD")
+	}
+	until, err := strconv.ParseUint(c.Query("until"), 10, 64)
+	if err != nil {
+		return response.BadRequest(c, "Invalid until cursor")
+	}
+
+	digests, err := h.txService.GetDayDigests(from, to.AddDate(0, 0, 1), until, device.Scope())
+	if err != nil {
+		return response.InternalError(c, "Failed to compute digests")
+	}
+
+	return response.Success(c, "Digests computed successfully", syncproto.Digests{
+		From:    from.Format(models.DigestDayLayout),
+		To:      to.Format(models.DigestDayLayout),
+		Until:   until,
+		Digests: digests,
+	})
+}
+
+// DigestDay - send every transaction of a branch on one day received up to
+// until, the device's pull cursor, for the device to find which rows differ
+// on a day whose digests do not match. Those received later are sent by ID
+// only, as they are still on their way.
+func (h *SyncHandler) DigestDay(c *fiber.Ctx) error {
+	device := c.Locals("device").(*models.Device)
+
+	branchID, err := uuid.Parse(c.Params("branch_id"))
+	if err != nil {
+		return response.BadRequest(c, "Invalid branch ID")
+	}
+	if !device.Scope().Contains(branchID) {
+		return response.NotFound(c, "Branch is not in the device's scope")
+	}
+	day, err := time.Parse(models.DigestDayLayout, c.Params("day"))
+	if err != nil {
+		return response.BadRequest(c, "Invalid day, use YYYY-MM-DD")
+	}
+	until, err := strconv.ParseUint(c.Query("until"), 10, 64)
+	if err != nil {
+		return response.BadRequest(c, "Invalid until cursor")
+	}
+
+	transactions, err := h.txService.GetBranchDay(branchID, day)
+	if err != nil {
+		return response.InternalError(c, "Failed to get transactions")
+	}
+
+	digestDay := syncproto.DigestDay{
+		BranchID:     branchID,
+		Day:          day.Format(models.DigestDayLayout),
+		Transactions: []models.Transaction{},
+		Pending:      []uuid.UUID{},
+	}
+	for _, tx := range transactions {
+		if tx.SyncSeq > until {
+			digestDay.Pending = append(digestDay.Pending, tx.ID)
+		} else {
+			digestDay.Transactions = append(digestDay.Transactions, tx)
+		}
+	}
+	return response.Success(c, "Transactions retrieved successfully", digestDay)
+}
@@ -1,31 +1,66 @@
 package handler
 
 import (
+	"strconv"
 	"time"
 
+	"shosha-finance/internal/config"
+	"shosha-finance/internal/models"
+	"shosha-finance/internal/repository"
 	"shosha-finance/internal/response"
 	"shosha-finance/internal/service"
+	"shosha-finance/internal/settings"
 	"shosha-finance/internal/worker"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
 )
 
 type SystemHandler struct {
-	txService  service.TransactionService
-	syncWorker *worker.SyncWorker
+	txService        service.TransactionService
+	syncWorker       *worker.SyncWorker
+	syncErrorService service.SyncErrorService
+	conflictService  service.ConflictService
+	syncRunService   service.SyncRunService
+	verifyService    service.SyncVerificationService
+	settings         *settings.Store
 }
 
-func NewSystemHandler(txService service.TransactionService, syncWorker *worker.SyncWorker) *SystemHandler {
+func NewSystemHandler(txService service.TransactionService, syncWorker *worker.SyncWorker, syncErrorService service.SyncErrorService, conflictService service.ConflictService, syncRunService service.SyncRunService, verifyService service.SyncVerificationService, store *settings.Store) *SystemHandler {
 	return &SystemHandler{
-		txService:  txService,
-		syncWorker: syncWorker,
+		txService:        txService,
+		syncWorker:       syncWorker,
+		syncErrorService: syncErrorService,
+		conflictService:  conflictService,
+		syncRunService:   syncRunService,
+		verifyService:    verifyService,
+		settings:         store,
 	}
 }
 
 type SystemStatus struct {
-	Status        string `json:"status"`
-	UnsyncedCount int64  `json:"unsynced_count"`
-	Timestamp     string `json:"timestamp"`
+	Status         string `json:"status"`
+	UnsyncedCount  int64  `json:"unsynced_count"`
+	SyncErrorCount int64  `json:"sync_error_count"`
+	ConflictCount  int64  `json:"conflict_count"`
+	Timestamp      string `json:"timestamp"`
+
+	// What the sync worker is doing: idle, checking, pulling, pushing,
+	// verifying, backoff or stopped
+	SyncState worker.State `json:"sync_state,omitempty"`
+
+	// Sync protocol version agreed with the cloud, and the reason when the
+	// cloud asks for this app or itself to be updated first
+	SyncProtocol   int    `json:"sync_protocol,omitempty"`
+	UpdateRequired string `json:"update_required,omitempty"`
+
+	// Push backlog; the estimate is null until a throughput was measured
+	QueueDepth              int64      `json:"queue_depth"`
+	EstimatedCatchUpSeconds *int64     `json:"estimated_catch_up_seconds"`
+	NextRetryAt             *time.Time `json:"next_retry_at,omitempty"`
+
+	// Restoring is set until the install has loaded its cloud snapshot
+	Restoring bool `json:"restoring"`
 }
 
 func (h *SystemHandler) GetStatus(c *fiber.Ctx) error {
@@ -35,12 +70,155 @@ func (h *SystemHandler) GetStatus(c *fiber.Ctx) error {
 	}
 
 	unsyncedCount, _ := h.txService.GetUnsyncedCount()
+	syncErrorCount, _ := h.syncErrorService.CountOpen()
+	conflictCount, _ := h.conflictService.CountOpen()
+
+	result := SystemStatus{
+		Status:         status,
+		UnsyncedCount:  unsyncedCount,
+		SyncErrorCount: syncErrorCount,
+		ConflictCount:  conflictCount,
+		Timestamp:      time.Now().Format(time.RFC3339),
+	}
+
+	if h.syncWorker != nil {
+		if stats, err := h.syncWorker.Stats(); err == nil {
+			result.SyncState = stats.State
+			result.UpdateRequired = stats.UpdateRequired
+			if stats.Protocol != nil {
+				result.SyncProtocol = stats.Protocol.ProtocolVersion
+			}
+			result.QueueDepth = stats.QueueDepth
+			result.EstimatedCatchUpSeconds = stats.EstimatedCatchUpSeconds
+			result.NextRetryAt = stats.NextRetryAt
+		}
+		result.Restoring = h.syncWorker.RestorePending()
+	}
+
+	return response.Success(c, "Success", result)
+}
+
+// TriggerSync starts a sync cycle right away. Requests made while a cycle
+// is already waiting to start join it.
+func (h *SystemHandler) TriggerSync(c *fiber.Ctx) error {
+	queued, err := h.syncWorker.TriggerSync()
+	if err != nil {
+		if err == worker.ErrSyncDisabled {
+			return response.BadRequest(c, "Sync is disabled, CLOUD_API_URL is not set")
+		}
+		return response.InternalError(c, "Failed to start sync")
+	}
+
+	message := "Sync started"
+	if !queued {
+		message = "Sync already requested"
+	}
+	return response.Success(c, message, fiber.Map{"queued": queued})
+}
+
+// GetSyncHistory lists recent sync runs, newest first. Scheduled runs that
+// moved nothing are not kept.
+func (h *SystemHandler) GetSyncHistory(c *fiber.Ctx) error {
+	limit, _ := strconv.Atoi(c.Query("limit", "50"))
+	if limit < 1 || limit > 500 {
+		limit = 50
+	}
 
-	return response.Success(c, "Success", SystemStatus{
-		Status:        status,
-		UnsyncedCount: unsyncedCount,
-		Timestamp:     time.Now().Format(time.RFC3339),
+	runs, err := h.syncRunService.GetRecent(&repository.SyncRunFilter{
+		Status: models.SyncRunStatus(c.Query("status")),
+		Limit:  limit,
 	})
+	if err != nil {
+		return response.InternalError(c, "Failed to get sync history")
+	}
+
+	return response.Success(c, "Success", runs)
+}
+
+// GetVerifications lists recent comparisons of the local books with the
+// cloud's, newest first, with the days that differed and what was repaired.
+func (h *SystemHandler) GetVerifications(c *fiber.Ctx) error {
+	limit, _ := strconv.Atoi(c.Query("limit", "20"))
+	if limit < 1 || limit > 200 {
+		limit = 20
+	}
+
+	verifications, err := h.verifyService.GetRecent(limit)
+	if err != nil {
+		return response.InternalError(c, "Failed to get sync verifications")
+	}
+
+	return response.Success(c, "Success", verifications)
+}
+
+// RequestVerification compares the local books with the cloud's at the end
+// of a sync cycle started right away.
+func (h *SystemHandler) RequestVerification(c *fiber.Ctx) error {
+	if err := h.syncWorker.RequestVerification(); err != nil {
+		if err == worker.ErrSyncDisabled {
+			return response.BadRequest(c, "Sync is disabled, CLOUD_API_URL is not set")
+		}
+		return response.InternalError(c, "Failed to request verification")
+	}
+
+	return response.Success(c, "Verification requested", nil)
+}
+
+// SystemConfig is the configuration in effect on this install.
+type SystemConfig struct {
+	AppVersion string `json:"app_version"`
+
+	// Settings in effect and where each comes from: the default, the cloud
+	// or an environment variable on this laptop, which wins over the cloud
+	Settings          []settings.Value `json:"settings"`
+	SettingsAppliedAt *time.Time       `json:"settings_applied_at"`
+}
+
+// GetConfig shows the settings in effect, so it is clear whether a value
+// head office set has reached this install.
+func (h *SystemHandler) GetConfig(c *fiber.Ctx) error {
+	return response.Success(c, "Success", SystemConfig{
+		AppVersion:        config.AppVersion,
+		Settings:          h.settings.Values(),
+		SettingsAppliedAt: h.settings.AppliedAt(),
+	})
+}
+
+func (h *SystemHandler) GetSyncErrors(c *fiber.Ctx) error {
+	syncErrs, err := h.syncErrorService.GetAll(models.SyncErrorStatus(c.Query("status")))
+	if err != nil {
+		return response.InternalError(c, "Failed to get sync errors")
+	}
+
+	return response.Success(c, "Success", syncErrs)
+}
+
+func (h *SystemHandler) RetrySyncError(c *fiber.Ctx) error {
+	id, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return response.BadRequest(c, "Invalid sync error ID")
+	}
+
+	syncErr, err := h.syncErrorService.Retry(id)
+	if err != nil {
+		return response.NotFound(c, "Sync error not found")
+	}
+
+	return response.Success(c, "Record queued for retry", syncErr)
+}
+
+func (h *SystemHandler) ResolveSyncError(c *fiber.Ctx) error {
+	id, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return response.BadRequest(c, "Invalid sync error ID")
+	}
+
+	syncErr, err := h.syncErrorService.Resolve(id)
+	if err != nil {
+		return response.NotFound(c, "Sync error not found")
+	}
+
+	return response.Success(c, "Sync error resolved", syncErr)
 }
 
 func (h *SystemHandler) HealthCheck(c *fiber.Ctx) error {
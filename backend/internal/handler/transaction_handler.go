@@ -1,22 +1,29 @@
 package handler
 
 import (
+	"errors"
 	"strconv"
+	"time"
 
 	"shosha-finance/internal/models"
+	"shosha-finance/internal/repository"
 	"shosha-finance/internal/response"
 	"shosha-finance/internal/service"
+	"shosha-finance/internal/settings"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/google/uuid"
 )
 
 type TransactionHandler struct {
-	service service.TransactionService
+	service  service.TransactionService
+	settings *settings.Store
 }
 
-func NewTransactionHandler(svc service.TransactionService) *TransactionHandler {
-	return &TransactionHandler{service: svc}
+// NewTransactionHandler creates the handler. Dates in queries are days in
+// the business time zone read from store.
+func NewTransactionHandler(svc service.TransactionService, store *settings.Store) *TransactionHandler {
+	return &TransactionHandler{service: svc, settings: store}
 }
 
 func (h *TransactionHandler) Create(c *fiber.Ctx) error {
@@ -30,6 +37,12 @@ func (h *TransactionHandler) Create(c *fiber.Ctx) error {
 		return response.BadRequest(c, "Branch ID is required")
 	}
 
+	if req.ID != "" {
+		if _, err := uuid.Parse(req.ID); err != nil {
+			return response.BadRequest(c, "Invalid transaction ID")
+		}
+	}
+
 	if req.Type != models.TransactionTypeIN && req.Type != models.TransactionTypeOUT {
 		return response.BadRequest(c, "Type must be IN or OUT")
 	}
@@ -44,6 +57,18 @@ func (h *TransactionHandler) Create(c *fiber.Ctx) error {
 
 	tx, err := h.service.Create(&req)
 	if err != nil {
+		var dupErr *service.DuplicateError
+		if errors.As(err, &dupErr) {
+			return response.Conflict(c, "Possible duplicate transaction. Resubmit with force=true to save anyway", fiber.Map{
+				"duplicate_ids": dupErr.IDs,
+			})
+		}
+		if err == service.ErrTransactionIDConflict {
+			return response.Conflict(c, "Transaction ID already used for different data", nil)
+		}
+		if err == service.ErrCategoryNotAllowed {
+			return response.BadRequest(c, "Category is not in the allowed categories")
+		}
 		return response.InternalError(c, "Failed to create transaction")
 	}
 
@@ -83,3 +108,46 @@ func (h *TransactionHandler) GetByID(c *fiber.Ctx) error {
 
 	return response.Success(c, "Success", tx)
 }
+
+func (h *TransactionHandler) GetDuplicates(c *fiber.Ctx) error {
+	filter := &repository.DashboardFilter{}
+
+	if branchIDParam := c.Query("branch_id"); branchIDParam != "" {
+		id, err := uuid.Parse(branchIDParam)
+		if err != nil {
+			return response.BadRequest(c, "Invalid branch_id")
+		}
+		filter.BranchID = &id
+	}
+
+	// Defaults to the last 30 days
+	loc := h.settings.Location()
+	endDate := time.Now()
+	startDate := endDate.AddDate(0, 0, -30)
+
+	if startParam := c.Query("start_date"); startParam != "" {
+		start, err := time.ParseInLocation("2006-01-02", startParam, loc)
+		if err != nil {
+			return response.BadRequest(c, "Invalid start_date format. Use YYYY-MM-DD")
+		}
+		startDate = start
+	}
+
+	if endParam := c.Query("end_date"); endParam != "" {
+		end, err := time.ParseInLocation("2006-01-02", endParam, loc)
+		if err != nil {
+			return response.BadRequest(c, "Invalid end_date format. Use YYYY-MM-DD")
+		}
+		endDate = end.AddDate(0, 0, 1)
+	}
+
+	filter.StartDate = &startDate
+	filter.EndDate = &endDate
+
+	groups, err := h.service.FindDuplicates(filter)
+	if err != nil {
+		return response.InternalError(c, "Failed to find duplicate transactions")
+	}
+
+	return response.Success(c, "Success", groups)
+}
@@ -0,0 +1,115 @@
+package handler
+
+import (
+	"errors"
+
+	"shosha-finance/internal/models"
+	"shosha-finance/internal/response"
+	"shosha-finance/internal/service"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+type UserHandler struct {
+	userService service.UserService
+}
+
+func NewUserHandler(userService service.UserService) *UserHandler {
+	return &UserHandler{userService: userService}
+}
+
+func (h *UserHandler) GetAll(c *fiber.Ctx) error {
+	users, err := h.userService.GetAll()
+	if err != nil {
+		return response.InternalError(c, "Failed to get users")
+	}
+
+	result := make([]models.UserResponse, len(users))
+	for i := range users {
+		result[i] = users[i].ToResponse()
+	}
+	return response.Success(c, "Users retrieved successfully", result)
+}
+
+func (h *UserHandler) GetByID(c *fiber.Ctx) error {
+	id, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return response.BadRequest(c, "Invalid user ID")
+	}
+
+	user, err := h.userService.GetByID(id)
+	if err != nil {
+		return response.NotFound(c, "User not found")
+	}
+
+	return response.Success(c, "User retrieved successfully", user.ToResponse())
+}
+
+func (h *UserHandler) Create(c *fiber.Ctx) error {
+	var req models.CreateUserRequest
+	if err := c.BodyParser(&req); err != nil {
+		return response.BadRequest(c, "Invalid request body")
+	}
+
+	if req.Username == "" || req.Password == "" || req.Name == "" || req.Role == "" {
+		return response.BadRequest(c, "Username, password, name and role are required")
+	}
+
+	user, err := h.userService.Create(&req)
+	if err != nil {
+		return userError(c, err, "Failed to create user")
+	}
+
+	return response.Created(c, "User created successfully", user.ToResponse())
+}
+
+// Update changes a user; set is_active to false to lock the user out of
+// every branch after the next sync.
+func (h *UserHandler) Update(c *fiber.Ctx) error {
+	id, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return response.BadRequest(c, "Invalid user ID")
+	}
+
+	var req models.UpdateUserRequest
+	if err := c.BodyParser(&req); err != nil {
+		return response.BadRequest(c, "Invalid request body")
+	}
+
+	if req.Password != nil && *req.Password == "" {
+		return response.BadRequest(c, "Password cannot be empty")
+	}
+
+	user, err := h.userService.Update(id, &req)
+	if err != nil {
+		return userError(c, err, "Failed to update user")
+	}
+
+	return response.Success(c, "User updated successfully", user.ToResponse())
+}
+
+func (h *UserHandler) Delete(c *fiber.Ctx) error {
+	id, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return response.BadRequest(c, "Invalid user ID")
+	}
+
+	if err := h.userService.Delete(id); err != nil {
+		return userError(c, err, "Failed to delete user")
+	}
+
+	return response.Success(c, "User deleted successfully", nil)
+}
+
+func userError(c *fiber.Ctx, err error, message string) error {
+	switch {
+	case errors.Is(err, service.ErrUserNotFound):
+		return response.NotFound(c, "User not found")
+	case errors.Is(err, service.ErrInvalidRole), errors.Is(err, service.ErrUserBranch):
+		return response.BadRequest(c, err.Error())
+	case errors.Is(err, service.ErrUsernameTaken):
+		return response.Conflict(c, err.Error(), nil)
+	}
+	return response.InternalError(c, message)
+}
@@ -0,0 +1,130 @@
+// Package hlc implements hybrid logical clocks. A timestamp combines the
+// wall clock in milliseconds with a logical counter, so it stays close to
+// real time while still ordering events correctly when machines' clocks
+// disagree or go backwards.
+package hlc
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// logicalBits is the number of low bits holding the logical counter.
+const logicalBits = 16
+
+const logicalMask = 1<<logicalBits - 1
+
+// Timestamp is a hybrid logical clock reading: milliseconds since the Unix
+// epoch in the high bits and a logical counter in the low 16 bits. Zero
+// means not stamped. Timestamps marshal to JSON as decimal strings since
+// they do not fit in a JavaScript number.
+type Timestamp uint64
+
+func New(physical time.Time, logical uint16) Timestamp {
+	return Timestamp(uint64(physical.UnixMilli())<<logicalBits | uint64(logical))
+}
+
+// Time returns the physical part of the timestamp.
+func (t Timestamp) Time() time.Time {
+	return time.UnixMilli(int64(t >> logicalBits)).UTC()
+}
+
+func (t Timestamp) Logical() uint16 {
+	return uint16(t & logicalMask)
+}
+
+func (t Timestamp) IsZero() bool {
+	return t == 0
+}
+
+func (t Timestamp) String() string {
+	return strconv.FormatUint(uint64(t), 10)
+}
+
+// Parse reads a timestamp in its decimal form.
+func Parse(s string) (Timestamp, error) {
+	v, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid hlc timestamp %q", s)
+	}
+	return Timestamp(v), nil
+}
+
+func (t Timestamp) MarshalJSON() ([]byte, error) {
+	return []byte(strconv.Quote(t.String())), nil
+}
+
+// UnmarshalJSON accepts the string form as well as a bare number.
+func (t *Timestamp) UnmarshalJSON(data []byte) error {
+	if bytes.Equal(data, []byte("null")) {
+		*t = 0
+		return nil
+	}
+	s := string(data)
+	if unquoted, err := strconv.Unquote(s); err == nil {
+		s = unquoted
+	}
+	if s == "" {
+		*t = 0
+		return nil
+	}
+	v, err := Parse(s)
+	if err != nil {
+		return err
+	}
+	*t = v
+	return nil
+}
+
+// Clock hands out strictly increasing timestamps. It is safe for
+// concurrent use.
+type Clock struct {
+	mu   sync.Mutex
+	last Timestamp
+	now  func() time.Time
+}
+
+func NewClock() *Clock {
+	return &Clock{now: time.Now}
+}
+
+// Now returns a timestamp for a local event, later than every timestamp the
+// clock has issued or observed.
+func (c *Clock) Now() Timestamp {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.last = c.next(c.last)
+	return c.last
+}
+
+// Observe advances the clock past a timestamp received from another
+// machine, so later local events order after it even if this machine's
+// wall clock is behind.
+func (c *Clock) Observe(remote Timestamp) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if remote > c.last {
+		c.last = remote
+	}
+}
+
+// Last returns the latest timestamp issued or observed.
+func (c *Clock) Last() Timestamp {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.last
+}
+
+func (c *Clock) next(last Timestamp) Timestamp {
+	wall := New(c.now(), 0)
+	if wall > last {
+		return wall
+	}
+	// The wall clock is behind the latest timestamp; count on from it
+	return last + 1
+}
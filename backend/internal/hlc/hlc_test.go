@@ -0,0 +1,112 @@
+package hlc
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestClockNow(t *testing.T) {
+	wall := time.Date(2026, 10, 1, 8, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name string
+		last Timestamp
+		want Timestamp
+	}{
+		{"wall clock ahead", New(wall.Add(-time.Second), 5), New(wall, 0)},
+		{"wall clock equal", New(wall, 0), New(wall, 1)},
+		{"wall clock behind", New(wall.Add(time.Minute), 7), New(wall.Add(time.Minute), 8)},
+		{"never issued", 0, New(wall, 0)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Clock{last: tt.last, now: func() time.Time { return wall }}
+			if got := c.Now(); got != tt.want {
+				t.Errorf("Now() = %v, want %v", got, tt.want)
+			}
+			if got := c.Last(); got != tt.want {
+				t.Errorf("Last() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClockObserve(t *testing.T) {
+	wall := time.Date(2026, 10, 1, 8, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		last     Timestamp
+		remote   Timestamp
+		wantLast Timestamp
+		wantNext Timestamp
+	}{
+		{"remote ahead", New(wall, 0), New(wall.Add(time.Hour), 3), New(wall.Add(time.Hour), 3), New(wall.Add(time.Hour), 4)},
+		{"remote behind", New(wall, 2), New(wall.Add(-time.Hour), 9), New(wall, 2), New(wall, 3)},
+		{"remote zero", 0, 0, 0, New(wall, 0)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Clock{last: tt.last, now: func() time.Time { return wall }}
+			c.Observe(tt.remote)
+			if got := c.Last(); got != tt.wantLast {
+				t.Errorf("Last() = %v, want %v", got, tt.wantLast)
+			}
+			if got := c.Now(); got != tt.wantNext {
+				t.Errorf("Now() = %v, want %v", got, tt.wantNext)
+			}
+		})
+	}
+}
+
+func TestTimestampParts(t *testing.T) {
+	wall := time.Date(2026, 10, 1, 8, 0, 0, 123e6, time.UTC)
+	ts := New(wall, 42)
+
+	if !ts.Time().Equal(wall) {
+		t.Errorf("Time() = %v, want %v", ts.Time(), wall)
+	}
+	if ts.Logical() != 42 {
+		t.Errorf("Logical() = %d, want 42", ts.Logical())
+	}
+	if New(wall, 65535) >= New(wall.Add(time.Millisecond), 0) {
+		t.Error("logical counter overflows into the next millisecond")
+	}
+}
+
+func TestTimestampJSON(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    Timestamp
+		wantErr bool
+	}{
+		{"string", `"123456789012345"`, 123456789012345, false},
+		{"number", `42`, 42, false},
+		{"null", `null`, 0, false},
+		{"empty string", `""`, 0, false},
+		{"not a number", `"abc"`, 0, true},
+		{"negative", `"-1"`, 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got Timestamp
+			err := json.Unmarshal([]byte(tt.input), &got)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Unmarshal(%s) error = %v, wantErr %v", tt.input, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("Unmarshal(%s) = %v, want %v", tt.input, got, tt.want)
+			}
+		})
+	}
+
+	data, err := json.Marshal(Timestamp(123456789012345))
+	if err != nil || string(data) != `"123456789012345"` {
+		t.Errorf("Marshal = %s, %v", data, err)
+	}
+}
@@ -8,7 +8,7 @@ import (
 func SetupCORS() fiber.Handler {
 	return cors.New(cors.Config{
 		AllowOrigins: "*",
-		AllowHeaders: "Origin, Content-Type, Accept, Authorization",
+		AllowHeaders: "Origin, Content-Type, Accept, Authorization, Idempotency-Key",
 		AllowMethods: "GET, POST, PUT, DELETE, OPTIONS",
 	})
 }
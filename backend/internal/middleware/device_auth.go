@@ -0,0 +1,40 @@
+package middleware
+
+import (
+	"strings"
+
+	"shosha-finance/internal/response"
+	"shosha-finance/internal/service"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+)
+
+// DeviceAuth authenticates sync requests from enrolled local installs. They
+// send their device ID in X-Device-ID and the credential they got at
+// enrollment as a bearer token.
+func DeviceAuth(deviceService service.DeviceService) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		deviceID := c.Get("X-Device-ID")
+		if deviceID == "" {
+			return response.Unauthorized(c, "Missing device ID")
+		}
+
+		parts := strings.Split(c.Get("Authorization"), " ")
+		if len(parts) != 2 || parts[0] != "Bearer" {
+			return response.Unauthorized(c, "Missing device credential")
+		}
+
+		device, err := deviceService.Authenticate(deviceID, parts[1], c.Get("X-App-Version"))
+		if err != nil {
+			log.Warn().Err(err).Str("device_id", deviceID).Msg("Device authentication failed")
+			if err == service.ErrDeviceInactive {
+				return response.Unauthorized(c, "Device has been deactivated")
+			}
+			return response.Unauthorized(c, "Invalid device credential")
+		}
+
+		c.Locals("device", device)
+		return c.Next()
+	}
+}
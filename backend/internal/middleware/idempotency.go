@@ -0,0 +1,71 @@
+package middleware
+
+import (
+	"shosha-finance/internal/response"
+	"shosha-finance/internal/service"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+)
+
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// Idempotency answers a retried request carrying the same Idempotency-Key
+// header with the stored response of the first successful attempt. Failed
+// attempts release the key so the client can retry. Requests without the
+// header pass through untouched. Must run after JWTAuth.
+func Idempotency(idempotencyService service.IdempotencyService) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		key := c.Get(IdempotencyKeyHeader)
+		if key == "" {
+			return c.Next()
+		}
+
+		if len(key) > 255 {
+			return response.BadRequest(c, "Idempotency-Key is too long")
+		}
+
+		userID, _ := c.Locals("user_id").(string)
+
+		stored, err := idempotencyService.Begin(key, userID, c.Method(), c.Path(), c.Body())
+		if err != nil {
+			switch err {
+			case service.ErrIdempotencyKeyReused:
+				return c.Status(fiber.StatusUnprocessableEntity).JSON(response.APIResponse{
+					Success: false,
+					Message: "Idempotency-Key was already used for a different request",
+				})
+			case service.ErrIdempotencyKeyInProgress:
+				return response.Conflict(c, "A request with this Idempotency-Key is still in progress", nil)
+			default:
+				log.Error().Err(err).Msg("Failed to check idempotency key")
+				return response.InternalError(c, "Failed to check idempotency key")
+			}
+		}
+
+		if stored != nil {
+			c.Set("Idempotent-Replayed", "true")
+			c.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+			return c.Status(stored.StatusCode).SendString(stored.ResponseBody)
+		}
+
+		if err := c.Next(); err != nil {
+			idempotencyService.Release(key)
+			return err
+		}
+
+		status := c.Response().StatusCode()
+		if status < fiber.StatusOK || status >= fiber.StatusMultipleChoices {
+			if err := idempotencyService.Release(key); err != nil {
+				log.Error().Err(err).Str("key", key).Msg("Failed to release idempotency key")
+			}
+			return nil
+		}
+
+		if err := idempotencyService.Complete(key, status, c.Response().Body()); err != nil {
+			log.Error().Err(err).Str("key", key).Msg("Failed to store idempotent response")
+		}
+
+		return nil
+	}
+}
@@ -14,6 +14,11 @@ import (
 func JWTAuth(authService service.AuthService) fiber.Handler {
 	return func(c *fiber.Ctx) error {
 		authHeader := c.Get("Authorization")
+		// Browsers cannot set headers on an EventSource, so event streams
+		// may pass the token as a query parameter instead
+		if authHeader == "" && strings.Contains(c.Get("Accept"), "text/event-stream") && c.Query("access_token") != "" {
+			authHeader = "Bearer " + c.Query("access_token")
+		}
 		if authHeader == "" {
 			return response.Unauthorized(c, "Missing authorization header")
 		}
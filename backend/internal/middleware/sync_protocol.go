@@ -0,0 +1,39 @@
+package middleware
+
+import (
+	"shosha-finance/internal/response"
+	"shosha-finance/internal/service"
+	"shosha-finance/internal/syncproto"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+)
+
+// SyncProtocol refuses sync requests made with a protocol version the cloud
+// no longer accepts. Devices send the version agreed at the handshake in
+// X-Sync-Protocol; those that predate the handshake send none and are
+// taken as version 1. The version is left in Locals("syncProtocol") for
+// handlers that answer differently per version. It must run after
+// DeviceAuth.
+func SyncProtocol(deviceService service.DeviceService) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		version := syncproto.RequestVersion(c.Get(syncproto.HeaderVersion))
+
+		if version < deviceService.MinProtocol() {
+			refusal := &syncproto.Refusal{
+				Update:             syncproto.UpdateLocal,
+				ProtocolVersion:    syncproto.CurrentVersion,
+				MinProtocolVersion: deviceService.MinProtocol(),
+				RequestedVersion:   version,
+			}
+			log.Warn().
+				Str("device_id", c.Get("X-Device-ID")).
+				Int("protocol_version", version).
+				Msg("Sync request refused, protocol too old")
+			return response.UpgradeRequired(c, refusal.Error(), refusal)
+		}
+
+		c.Locals("syncProtocol", version)
+		return c.Next()
+	}
+}
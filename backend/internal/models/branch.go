@@ -3,20 +3,27 @@ package models
 import (
 	"time"
 
+	"shosha-finance/internal/hlc"
+
 	"github.com/google/uuid"
 	"gorm.io/gorm"
 )
 
 type Branch struct {
-	ID          uuid.UUID  `gorm:"type:uuid;primary_key" json:"id"`
-	Code        string     `gorm:"type:varchar(20);uniqueIndex;not null" json:"code"`
-	Name        string     `gorm:"type:varchar(100);not null" json:"name"`
-	Description string     `gorm:"type:text" json:"description"`
-	IsActive    bool       `gorm:"default:true" json:"is_active"`
-	IsSynced    bool       `gorm:"default:false" json:"is_synced"`
-	SyncedAt    *time.Time `json:"synced_at"`
-	CreatedAt   time.Time  `gorm:"autoCreateTime" json:"created_at"`
-	UpdatedAt   time.Time  `gorm:"autoUpdateTime" json:"updated_at"`
+	ID uuid.UUID `gorm:"type:uuid;primary_key" json:"id"`
+	// Code is unique among branches that are not deleted, so a deleted
+	// branch's code can be reused while its tombstone is kept
+	Code        string         `gorm:"type:varchar(20);uniqueIndex:idx_branches_code_live,where:deleted_at IS NULL;not null" json:"code"`
+	Name        string         `gorm:"type:varchar(100);not null" json:"name"`
+	Description string         `gorm:"type:text" json:"description"`
+	IsActive    bool           `gorm:"default:true" json:"is_active"`
+	IsSynced    bool           `gorm:"default:false" json:"is_synced"`
+	SyncedAt    *time.Time     `json:"synced_at"`
+	CreatedAt   time.Time      `gorm:"autoCreateTime" json:"created_at"`
+	UpdatedAt   time.Time      `gorm:"autoUpdateTime" json:"updated_at"`
+	HLC         hlc.Timestamp  `gorm:"index;not null;default:0" json:"hlc"`
+	SyncSeq     uint64         `gorm:"index;not null;default:0" json:"-"`
+	DeletedAt   gorm.DeletedAt `gorm:"index" json:"deleted_at"`
 }
 
 func (b *Branch) BeforeCreate(tx *gorm.DB) error {
@@ -0,0 +1,55 @@
+package models
+
+import (
+	"time"
+
+	"shosha-finance/internal/hlc"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// CategoryCashAdjustment is the category of transactions posted to bring the
+// system balance in line with a cash count.
+const CategoryCashAdjustment = "Selisih Kas"
+
+type CashReconciliation struct {
+	ID             uuid.UUID     `gorm:"type:uuid;primary_key" json:"id"`
+	BranchID       uuid.UUID     `gorm:"type:uuid;index;not null" json:"branch_id"`
+	UserID         uuid.UUID     `gorm:"type:uuid;not null" json:"user_id"`
+	CountedAmount  int64         `gorm:"not null" json:"counted_amount"`
+	SystemBalance  int64         `gorm:"not null" json:"system_balance"`
+	Difference     int64         `gorm:"not null" json:"difference"`
+	Notes          string        `gorm:"type:text" json:"notes"`
+	AdjustmentTxID *uuid.UUID    `gorm:"type:uuid" json:"adjustment_tx_id,omitempty"`
+	ReconciledAt   time.Time     `gorm:"index;not null" json:"reconciled_at"`
+	IsSynced       bool          `gorm:"default:false" json:"is_synced"`
+	SyncedAt       *time.Time    `json:"synced_at"`
+	CreatedAt      time.Time     `gorm:"autoCreateTime" json:"created_at"`
+	UpdatedAt      time.Time     `gorm:"autoUpdateTime" json:"updated_at"`
+	HLC            hlc.Timestamp `gorm:"index;not null;default:0" json:"hlc"`
+}
+
+func (r *CashReconciliation) BeforeCreate(tx *gorm.DB) error {
+	if r.ID == uuid.Nil {
+		r.ID = uuid.New()
+	}
+	return nil
+}
+
+type CashReconciliationRequest struct {
+	BranchID       string `json:"branch_id" validate:"required"`
+	CountedAmount  int64  `json:"counted_amount" validate:"gte=0"`
+	Notes          string `json:"notes"`
+	PostAdjustment bool   `json:"post_adjustment"`
+}
+
+type CashReconciliationSummary struct {
+	BranchID         uuid.UUID `json:"branch_id"`
+	Count            int64     `json:"count"`
+	TotalDifference  int64     `json:"total_difference"`
+	TotalShortage    int64     `json:"total_shortage"`
+	TotalSurplus     int64     `json:"total_surplus"`
+	AdjustedCount    int64     `json:"adjusted_count"`
+	LastReconciledAt time.Time `json:"last_reconciled_at"`
+}
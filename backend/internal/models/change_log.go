@@ -0,0 +1,90 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"shosha-finance/internal/hlc"
+
+	"github.com/google/uuid"
+)
+
+type ChangeOperation string
+
+const (
+	ChangeCreate ChangeOperation = "create"
+	ChangeUpdate ChangeOperation = "update"
+	ChangeDelete ChangeOperation = "delete"
+)
+
+// ChangeLog is the local outbox. Every write to a synced entity adds an
+// entry in the same DB transaction; the sync worker pushes entries in
+// sequence order and removes them once the cloud has acknowledged them.
+type ChangeLog struct {
+	Seq        uint64          `gorm:"primaryKey;autoIncrement" json:"seq"`
+	EntityType string          `gorm:"type:varchar(30);index:idx_change_log_entity;not null" json:"entity_type"`
+	EntityID   uuid.UUID       `gorm:"type:uuid;index:idx_change_log_entity;not null" json:"entity_id"`
+	Operation  ChangeOperation `gorm:"type:varchar(10);not null" json:"operation"`
+	Payload    string          `gorm:"type:text" json:"payload"`
+	// BaseVersion is the version of the record the update was made on; the
+	// cloud flags a conflict when its copy has changed since.
+	BaseVersion *hlc.Timestamp `json:"base_version"`
+	CreatedAt   time.Time      `gorm:"autoCreateTime" json:"created_at"`
+}
+
+// SyncChange is a change-log entry as sent to the cloud. Payload holds the
+// full record after the change, or a tombstone for deletes.
+type SyncChange struct {
+	Seq         uint64          `json:"seq"`
+	EntityType  string          `json:"entity_type"`
+	EntityID    uuid.UUID       `json:"entity_id"`
+	Operation   ChangeOperation `json:"operation"`
+	Payload     json.RawMessage `json:"payload,omitempty"`
+	BaseVersion *hlc.Timestamp  `json:"base_version,omitempty"`
+}
+
+func (c *ChangeLog) ToSyncChange() SyncChange {
+	change := SyncChange{
+		Seq:         c.Seq,
+		EntityType:  c.EntityType,
+		EntityID:    c.EntityID,
+		Operation:   c.Operation,
+		BaseVersion: c.BaseVersion,
+	}
+	if c.Payload != "" {
+		change.Payload = json.RawMessage(c.Payload)
+	}
+	return change
+}
+
+// DecodeRecord returns the record carried by the change as a pointer to its
+// model. Deletes return their *Tombstone, or nil when sent without one.
+// Changes to an entity type that is not synced are refused whatever their
+// operation.
+func (c *SyncChange) DecodeRecord() (interface{}, error) {
+	var record interface{}
+	switch c.EntityType {
+	case EntityBranch:
+		record = &Branch{}
+	case EntityTransaction:
+		record = &Transaction{}
+	case EntityShift:
+		record = &Shift{}
+	case EntityReconciliation:
+		record = &CashReconciliation{}
+	default:
+		return nil, fmt.Errorf("unknown entity type %q", c.EntityType)
+	}
+	if c.Operation == ChangeDelete {
+		if len(c.Payload) == 0 {
+			return nil, nil
+		}
+		record = &Tombstone{}
+	}
+
+	if err := json.Unmarshal(c.Payload, record); err != nil {
+		return nil, fmt.Errorf("invalid payload: %w", err)
+	}
+	return record, nil
+}
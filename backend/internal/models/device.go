@@ -0,0 +1,118 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Device is a local installation enrolled with the cloud. Its branch
+// assignments decide which branches' data it pulls; head-office devices
+// subscribe to all branches. A deactivated device, such as a lost laptop,
+// can no longer sync. ProtocolVersion is the sync protocol agreed at its
+// last handshake. The sync fields are what the cloud knows of the device's
+// sync health: when it last pushed and pulled, and what it last reported
+// of its push backlog and errors.
+type Device struct {
+	ID              string         `gorm:"type:varchar(64);primary_key" json:"id"`
+	Name            string         `gorm:"type:varchar(100)" json:"name"`
+	AllBranches     bool           `gorm:"default:false" json:"all_branches"`
+	Branches        []DeviceBranch `gorm:"foreignKey:DeviceID" json:"branches"`
+	CredentialHash  string         `gorm:"type:varchar(64)" json:"-"`
+	IsActive        bool           `gorm:"default:true" json:"is_active"`
+	AppVersion      string         `gorm:"type:varchar(50)" json:"app_version"`
+	ProtocolVersion int            `gorm:"default:1" json:"protocol_version"`
+	LastSeenAt      *time.Time     `json:"last_seen_at"`
+	LastPushAt      *time.Time     `json:"last_push_at"`
+	LastPullAt      *time.Time     `json:"last_pull_at"`
+	PendingCount    int64          `gorm:"default:0" json:"pending_count"`
+	ReportedAt      *time.Time     `json:"reported_at"`
+	LastError       string         `gorm:"type:text" json:"last_error,omitempty"`
+	LastErrorAt     *time.Time     `json:"last_error_at"`
+	EnrolledAt      *time.Time     `json:"enrolled_at"`
+	DeactivatedAt   *time.Time     `json:"deactivated_at"`
+	CreatedAt       time.Time      `gorm:"autoCreateTime" json:"created_at"`
+	UpdatedAt       time.Time      `gorm:"autoUpdateTime" json:"updated_at"`
+}
+
+// DeviceBranch assigns a branch to a device.
+type DeviceBranch struct {
+	DeviceID string    `gorm:"type:varchar(64);primaryKey" json:"device_id"`
+	BranchID uuid.UUID `gorm:"type:uuid;primaryKey" json:"branch_id"`
+}
+
+// Scope returns the branches the device may see.
+func (d *Device) Scope() *BranchScope {
+	scope := &BranchScope{AllBranches: d.AllBranches, BranchIDs: []uuid.UUID{}}
+	for _, assignment := range d.Branches {
+		scope.BranchIDs = append(scope.BranchIDs, assignment.BranchID)
+	}
+	return scope
+}
+
+// BranchScope is the set of branches whose data a device may see.
+type BranchScope struct {
+	AllBranches bool        `json:"all_branches"`
+	BranchIDs   []uuid.UUID `json:"branch_ids"`
+}
+
+func (s *BranchScope) Contains(branchID uuid.UUID) bool {
+	if s.AllBranches {
+		return true
+	}
+	for _, id := range s.BranchIDs {
+		if id == branchID {
+			return true
+		}
+	}
+	return false
+}
+
+type DeviceScopeRequest struct {
+	Name        *string  `json:"name"`
+	AllBranches bool     `json:"all_branches"`
+	BranchIDs   []string `json:"branch_ids"`
+}
+
+// EnrollmentCode is a one-time code an admin hands to a new local install.
+// The install exchanges it for its device ID and credential, and is
+// assigned the code's branch.
+type EnrollmentCode struct {
+	ID         uuid.UUID  `gorm:"type:uuid;primary_key" json:"id"`
+	Code       string     `gorm:"type:varchar(20);uniqueIndex;not null" json:"code"`
+	BranchID   uuid.UUID  `gorm:"type:uuid;not null" json:"branch_id"`
+	DeviceName string     `gorm:"type:varchar(100)" json:"device_name"`
+	ExpiresAt  time.Time  `gorm:"not null" json:"expires_at"`
+	UsedAt     *time.Time `json:"used_at"`
+	DeviceID   *string    `gorm:"type:varchar(64)" json:"device_id,omitempty"`
+	CreatedBy  uuid.UUID  `gorm:"type:uuid" json:"created_by"`
+	CreatedAt  time.Time  `gorm:"autoCreateTime" json:"created_at"`
+}
+
+func (e *EnrollmentCode) BeforeCreate(tx *gorm.DB) error {
+	if e.ID == uuid.Nil {
+		e.ID = uuid.New()
+	}
+	return nil
+}
+
+type EnrollmentCodeRequest struct {
+	BranchID       string `json:"branch_id" validate:"required"`
+	DeviceName     string `json:"device_name"`
+	ExpiresInHours int    `json:"expires_in_hours"`
+}
+
+type EnrollRequest struct {
+	Code       string `json:"code" validate:"required"`
+	Name       string `json:"name"`
+	AppVersion string `json:"app_version"`
+}
+
+// EnrollResponse hands a newly enrolled install its identity. The
+// credential is only ever sent this once.
+type EnrollResponse struct {
+	DeviceID   string    `json:"device_id"`
+	Credential string    `json:"credential"`
+	BranchID   uuid.UUID `json:"branch_id"`
+}
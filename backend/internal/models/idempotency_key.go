@@ -0,0 +1,17 @@
+package models
+
+import "time"
+
+// IdempotencyKey stores the response of a request sent with an
+// Idempotency-Key header so that a retried request can be answered with the
+// original result. A zero StatusCode means the first request is still running.
+type IdempotencyKey struct {
+	Key          string    `gorm:"column:idempotency_key;type:varchar(255);primary_key" json:"key"`
+	UserID       string    `gorm:"type:varchar(36);index" json:"user_id"`
+	Method       string    `gorm:"type:varchar(10);not null" json:"method"`
+	Path         string    `gorm:"type:varchar(255);not null" json:"path"`
+	RequestHash  string    `gorm:"type:varchar(64);not null" json:"request_hash"`
+	StatusCode   int       `gorm:"default:0" json:"status_code"`
+	ResponseBody string    `gorm:"type:text" json:"response_body"`
+	CreatedAt    time.Time `gorm:"autoCreateTime;index" json:"created_at"`
+}
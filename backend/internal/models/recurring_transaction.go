@@ -0,0 +1,112 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+type RecurrenceFrequency string
+
+const (
+	FrequencyDaily   RecurrenceFrequency = "daily"
+	FrequencyWeekly  RecurrenceFrequency = "weekly"
+	FrequencyMonthly RecurrenceFrequency = "monthly"
+)
+
+type RecurringTransaction struct {
+	ID          uuid.UUID           `gorm:"type:uuid;primary_key" json:"id"`
+	BranchID    uuid.UUID           `gorm:"type:uuid;index;not null" json:"branch_id"`
+	Type        TransactionType     `gorm:"type:varchar(10);not null" json:"type"`
+	Category    string              `gorm:"type:varchar(50);not null" json:"category"`
+	Amount      int64               `gorm:"not null" json:"amount"`
+	Description string              `gorm:"type:text" json:"description"`
+	Frequency   RecurrenceFrequency `gorm:"type:varchar(10);not null" json:"frequency"`
+	DayOfMonth  int                 `gorm:"default:0" json:"day_of_month"`
+	DayOfWeek   int                 `gorm:"default:0" json:"day_of_week"`
+	StartDate   time.Time           `gorm:"not null" json:"start_date"`
+	EndDate     *time.Time          `json:"end_date"`
+	NextRunAt   time.Time           `gorm:"index;not null" json:"next_run_at"`
+	LastRunAt   *time.Time          `json:"last_run_at"`
+	IsActive    bool                `gorm:"default:true" json:"is_active"`
+	CreatedAt   time.Time           `gorm:"autoCreateTime" json:"created_at"`
+	UpdatedAt   time.Time           `gorm:"autoUpdateTime" json:"updated_at"`
+	DeletedAt   gorm.DeletedAt      `gorm:"index" json:"deleted_at"`
+}
+
+func (r *RecurringTransaction) BeforeCreate(tx *gorm.DB) error {
+	if r.ID == uuid.Nil {
+		r.ID = uuid.New()
+	}
+	return nil
+}
+
+// NextOccurrence returns the first scheduled occurrence strictly after the
+// given time, or nil when the template has ended. Days are counted in loc.
+func (r *RecurringTransaction) NextOccurrence(after time.Time, loc *time.Location) *time.Time {
+	candidate := r.firstOnOrAfter(after, loc)
+	if !candidate.After(after) {
+		candidate = r.firstOnOrAfter(after.AddDate(0, 0, 1), loc)
+	}
+	if r.EndDate != nil && candidate.After(*r.EndDate) {
+		return nil
+	}
+	return &candidate
+}
+
+// FirstOccurrence returns the first scheduled occurrence on or after
+// StartDate. Days are counted in loc.
+func (r *RecurringTransaction) FirstOccurrence(loc *time.Location) time.Time {
+	return r.firstOnOrAfter(r.StartDate, loc)
+}
+
+// firstOnOrAfter finds the first schedule date on or after the day of t.
+// Occurrences always fall at midnight in loc; times are stored in UTC, so
+// everything is converted before comparing days.
+func (r *RecurringTransaction) firstOnOrAfter(t time.Time, loc *time.Location) time.Time {
+	t = t.In(loc)
+	startDate := r.StartDate.In(loc)
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+	if start := time.Date(startDate.Year(), startDate.Month(), startDate.Day(), 0, 0, 0, 0, loc); day.Before(start) {
+		day = start
+	}
+
+	switch r.Frequency {
+	case FrequencyWeekly:
+		offset := (r.DayOfWeek - int(day.Weekday()) + 7) % 7
+		return day.AddDate(0, 0, offset)
+	case FrequencyMonthly:
+		candidate := monthlyDate(day.Year(), day.Month(), r.DayOfMonth, loc)
+		if candidate.Before(day) {
+			candidate = monthlyDate(day.Year(), day.Month()+1, r.DayOfMonth, loc)
+		}
+		return candidate
+	default:
+		return day
+	}
+}
+
+// monthlyDate clamps the day to the last day of the month, so a template on
+// the 31st runs on the 30th in April and the 28th/29th in February.
+func monthlyDate(year int, month time.Month, dayOfMonth int, loc *time.Location) time.Time {
+	firstOfMonth := time.Date(year, month, 1, 0, 0, 0, 0, loc)
+	lastDay := firstOfMonth.AddDate(0, 1, -1).Day()
+	if dayOfMonth > lastDay {
+		dayOfMonth = lastDay
+	}
+	return firstOfMonth.AddDate(0, 0, dayOfMonth-1)
+}
+
+type RecurringTransactionRequest struct {
+	BranchID    string              `json:"branch_id" validate:"required"`
+	Type        TransactionType     `json:"type" validate:"required,oneof=IN OUT"`
+	Category    string              `json:"category" validate:"required"`
+	Amount      int64               `json:"amount" validate:"required,gt=0"`
+	Description string              `json:"description"`
+	Frequency   RecurrenceFrequency `json:"frequency" validate:"required,oneof=daily weekly monthly"`
+	DayOfMonth  int                 `json:"day_of_month"`
+	DayOfWeek   int                 `json:"day_of_week"`
+	StartDate   string              `json:"start_date"`
+	EndDate     string              `json:"end_date"`
+}
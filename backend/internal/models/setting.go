@@ -0,0 +1,48 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// SettingScope is who a setting applies to.
+type SettingScope string
+
+const (
+	SettingScopeGlobal SettingScope = "global"
+	SettingScopeBranch SettingScope = "branch"
+	SettingScopeDevice SettingScope = "device"
+)
+
+// Setting is a value head office set on the cloud for one of the known
+// settings. Global settings apply to every device, branch settings to the
+// devices assigned to the branch and device settings to one device; the
+// narrowest scope wins. ScopeID is the branch or device ID, empty for
+// global settings.
+type Setting struct {
+	ID        uuid.UUID       `gorm:"type:uuid;primary_key" json:"id"`
+	Key       string          `gorm:"type:varchar(64);uniqueIndex:idx_setting_scope;not null" json:"key"`
+	Scope     SettingScope    `gorm:"type:varchar(10);uniqueIndex:idx_setting_scope;not null" json:"scope"`
+	ScopeID   string          `gorm:"type:varchar(64);uniqueIndex:idx_setting_scope;not null;default:''" json:"scope_id,omitempty"`
+	Value     json.RawMessage `gorm:"type:text;serializer:json" json:"value"`
+	UpdatedBy *uuid.UUID      `gorm:"type:uuid" json:"updated_by,omitempty"`
+	CreatedAt time.Time       `gorm:"autoCreateTime" json:"created_at"`
+	UpdatedAt time.Time       `gorm:"autoUpdateTime" json:"updated_at"`
+}
+
+func (s *Setting) BeforeCreate(tx *gorm.DB) error {
+	if s.ID == uuid.Nil {
+		s.ID = uuid.New()
+	}
+	return nil
+}
+
+type SettingRequest struct {
+	Key     string          `json:"key"`
+	Value   json.RawMessage `json:"value"`
+	Scope   SettingScope    `json:"scope"`
+	ScopeID string          `json:"scope_id"`
+}
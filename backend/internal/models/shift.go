@@ -0,0 +1,89 @@
+package models
+
+import (
+	"time"
+
+	"shosha-finance/internal/hlc"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+type ShiftStatus string
+
+const (
+	ShiftStatusOpen   ShiftStatus = "open"
+	ShiftStatusClosed ShiftStatus = "closed"
+)
+
+// Denominations lists the Rupiah notes and coins accepted in a cash count.
+var Denominations = []int64{100000, 50000, 20000, 10000, 5000, 2000, 1000, 500, 200, 100}
+
+type Shift struct {
+	ID            uuid.UUID           `gorm:"type:uuid;primary_key" json:"id"`
+	BranchID      uuid.UUID           `gorm:"type:uuid;index;not null" json:"branch_id"`
+	UserID        uuid.UUID           `gorm:"type:uuid;index;not null" json:"user_id"`
+	Status        ShiftStatus         `gorm:"type:varchar(10);index;not null" json:"status"`
+	OpeningFloat  int64               `gorm:"not null" json:"opening_float"`
+	ExpectedCash  int64               `gorm:"default:0" json:"expected_cash"`
+	CountedCash   int64               `gorm:"default:0" json:"counted_cash"`
+	Variance      int64               `gorm:"default:0" json:"variance"`
+	Notes         string              `gorm:"type:text" json:"notes"`
+	OpenedAt      time.Time           `gorm:"not null" json:"opened_at"`
+	ClosedAt      *time.Time          `json:"closed_at"`
+	IsSynced      bool                `gorm:"default:false" json:"is_synced"`
+	SyncedAt      *time.Time          `json:"synced_at"`
+	CreatedAt     time.Time           `gorm:"autoCreateTime" json:"created_at"`
+	UpdatedAt     time.Time           `gorm:"autoUpdateTime" json:"updated_at"`
+	HLC           hlc.Timestamp       `gorm:"index;not null;default:0" json:"hlc"`
+	Denominations []ShiftDenomination `gorm:"foreignKey:ShiftID" json:"denominations,omitempty"`
+}
+
+func (s *Shift) BeforeCreate(tx *gorm.DB) error {
+	if s.ID == uuid.Nil {
+		s.ID = uuid.New()
+	}
+	return nil
+}
+
+type ShiftDenomination struct {
+	ID       uuid.UUID `gorm:"type:uuid;primary_key" json:"id"`
+	ShiftID  uuid.UUID `gorm:"type:uuid;index;not null" json:"shift_id"`
+	Value    int64     `gorm:"not null" json:"value"`
+	Quantity int       `gorm:"not null" json:"quantity"`
+	Subtotal int64     `gorm:"not null" json:"subtotal"`
+}
+
+func (d *ShiftDenomination) BeforeCreate(tx *gorm.DB) error {
+	if d.ID == uuid.Nil {
+		d.ID = uuid.New()
+	}
+	return nil
+}
+
+type OpenShiftRequest struct {
+	BranchID     string `json:"branch_id" validate:"required"`
+	OpeningFloat int64  `json:"opening_float" validate:"gte=0"`
+	Notes        string `json:"notes"`
+}
+
+type DenominationCount struct {
+	Value    int64 `json:"value"`
+	Quantity int   `json:"quantity"`
+}
+
+type CloseShiftRequest struct {
+	Denominations []DenominationCount `json:"denominations" validate:"required"`
+	Notes         string              `json:"notes"`
+}
+
+type ShiftReport struct {
+	Shift        Shift `json:"shift"`
+	TotalIn      int64 `json:"total_in"`
+	TotalOut     int64 `json:"total_out"`
+	CountIn      int64 `json:"count_in"`
+	CountOut     int64 `json:"count_out"`
+	ExpectedCash int64 `json:"expected_cash"`
+	CountedCash  int64 `json:"counted_cash"`
+	Variance     int64 `json:"variance"`
+}
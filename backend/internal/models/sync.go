@@ -0,0 +1,102 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// SyncPushBatch is what a local app sends in one push: change-log entries
+// in sequence order. The record lists are still accepted from local apps
+// that predate the change log. The batch ID stays the same when the local
+// app re-sends a batch whose response it never received.
+type SyncPushBatch struct {
+	BatchID         uuid.UUID            `json:"batch_id"`
+	DeviceID        string               `json:"device_id"`
+	BranchID        *uuid.UUID           `json:"branch_id,omitempty"`
+	Changes         []SyncChange         `json:"changes"`
+	Branches        []Branch             `json:"branches"`
+	Transactions    []Transaction        `json:"transactions"`
+	Shifts          []Shift              `json:"shifts"`
+	Reconciliations []CashReconciliation `json:"reconciliations"`
+}
+
+// SyncRejection tells the local app why a pushed record was not accepted.
+// Seq is set when the record came in as a change-log entry.
+type SyncRejection struct {
+	Seq        uint64    `json:"seq,omitempty"`
+	EntityType string    `json:"entity_type"`
+	EntityID   uuid.UUID `json:"entity_id"`
+	Reason     string    `json:"reason"`
+}
+
+// SyncPushResult lists the IDs stored by a push, per entity type, and the
+// records that were rejected. AckedSeq is the device's cursor after the
+// push: every change up to it has been processed, applied or rejected.
+// Replayed is set when the batch had already been applied and the answer
+// comes from its receipt.
+type SyncPushResult struct {
+	BatchID         uuid.UUID       `json:"batch_id"`
+	Replayed        bool            `json:"replayed"`
+	AckedSeq        uint64          `json:"acked_seq"`
+	Branches        []uuid.UUID     `json:"branches"`
+	Transactions    []uuid.UUID     `json:"transactions"`
+	Shifts          []uuid.UUID     `json:"shifts"`
+	Reconciliations []uuid.UUID     `json:"reconciliations"`
+	Rejected        []SyncRejection `json:"rejected"`
+}
+
+// NewSyncPushResult returns a result with empty, non-nil lists so they
+// encode as [] rather than null.
+func NewSyncPushResult() *SyncPushResult {
+	return &SyncPushResult{
+		Branches:        []uuid.UUID{},
+		Transactions:    []uuid.UUID{},
+		Shifts:          []uuid.UUID{},
+		Reconciliations: []uuid.UUID{},
+		Rejected:        []SyncRejection{},
+	}
+}
+
+// Received counts the records in the batch.
+func (b *SyncPushBatch) Received() int {
+	return len(b.Changes) + len(b.Branches) + len(b.Transactions) + len(b.Shifts) + len(b.Reconciliations)
+}
+
+// Accepted counts the records stored by the push.
+func (r *SyncPushResult) Accepted() int {
+	return len(r.Branches) + len(r.Transactions) + len(r.Shifts) + len(r.Reconciliations)
+}
+
+func (r *SyncPushResult) Reject(entityType string, id uuid.UUID, reason string) {
+	r.Rejected = append(r.Rejected, SyncRejection{EntityType: entityType, EntityID: id, Reason: reason})
+}
+
+func (r *SyncPushResult) RejectChange(change *SyncChange, reason string) {
+	r.Rejected = append(r.Rejected, SyncRejection{
+		Seq:        change.Seq,
+		EntityType: change.EntityType,
+		EntityID:   change.EntityID,
+		Reason:     reason,
+	})
+}
+
+// SyncSnapshot is a consistent copy of a device's branch scope, read in a
+// single DB transaction, that a new or broken local install starts from.
+// Cursor is the cloud's receive sequence number when it was taken; the
+// first pull after loading it continues from there.
+type SyncSnapshot struct {
+	Branches        []Branch             `json:"branches"`
+	Users           []SyncUser           `json:"users"`
+	Transactions    []Transaction        `json:"transactions"`
+	Shifts          []Shift              `json:"shifts"`
+	Reconciliations []CashReconciliation `json:"reconciliations"`
+	Scope           *BranchScope         `json:"scope"`
+	Cursor          uint64               `json:"cursor"`
+	TakenAt         time.Time            `json:"taken_at"`
+}
+
+// Records counts the records in the snapshot.
+func (s *SyncSnapshot) Records() int {
+	return len(s.Branches) + len(s.Users) + len(s.Transactions) + len(s.Shifts) + len(s.Reconciliations)
+}
@@ -0,0 +1,40 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// SyncBatch is the cloud's receipt for one push. The stored result lets a
+// re-sent batch be answered exactly like the original.
+type SyncBatch struct {
+	ID             uuid.UUID  `gorm:"type:uuid;primary_key" json:"id"`
+	DeviceID       string     `gorm:"type:varchar(64);index" json:"device_id"`
+	BranchID       *uuid.UUID `gorm:"type:uuid;index" json:"branch_id"`
+	ReceivedCount  int        `json:"received_count"`
+	AcceptedCount  int        `json:"accepted_count"`
+	RejectedCount  int        `json:"rejected_count"`
+	Result         string     `gorm:"type:text" json:"-"`
+	ReplayCount    int        `gorm:"default:0" json:"replay_count"`
+	LastReplayedAt *time.Time `json:"last_replayed_at"`
+	ReceivedAt     time.Time  `gorm:"index;not null" json:"received_at"`
+}
+
+// SyncSequence is the cloud's receive sequence counter. Each write of a
+// pulled record takes the next value while holding the row, so values are
+// handed out in commit order and a pull cursor never passes a write that
+// has yet to commit.
+type SyncSequence struct {
+	Name  string `gorm:"type:varchar(30);primary_key" json:"name"`
+	Value uint64 `gorm:"not null;default:0" json:"value"`
+}
+
+// SyncCursor is the highest change-log sequence number the cloud has
+// processed for a device. Changes at or below it are skipped, so a re-sent
+// change is never applied twice.
+type SyncCursor struct {
+	DeviceID  string    `gorm:"type:varchar(64);primary_key" json:"device_id"`
+	LastSeq   uint64    `gorm:"not null;default:0" json:"last_seq"`
+	UpdatedAt time.Time `gorm:"autoUpdateTime" json:"updated_at"`
+}
@@ -0,0 +1,143 @@
+package models
+
+import (
+	"time"
+
+	"shosha-finance/internal/hlc"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// ConflictPolicy decides which version survives when a record was changed
+// both on a device and on the cloud since they were last in sync.
+type ConflictPolicy string
+
+const (
+	// ConflictCloudWins keeps the cloud version; used for master data that
+	// head office owns.
+	ConflictCloudWins ConflictPolicy = "cloud_wins"
+	// ConflictLastWriterWins keeps the most recently written version.
+	ConflictLastWriterWins ConflictPolicy = "last_writer_wins"
+	// ConflictManual keeps the cloud version untouched and leaves the
+	// conflict open until someone picks a side.
+	ConflictManual ConflictPolicy = "manual"
+)
+
+// ConflictPolicies maps each synced entity type to its policy.
+var ConflictPolicies = map[string]ConflictPolicy{
+	EntityBranch:         ConflictCloudWins,
+	EntityTransaction:    ConflictLastWriterWins,
+	EntityShift:          ConflictLastWriterWins,
+	EntityReconciliation: ConflictManual,
+}
+
+// ConflictPolicyFor returns the policy of an entity type. Unknown types are
+// left to a person.
+func ConflictPolicyFor(entityType string) ConflictPolicy {
+	if policy, ok := ConflictPolicies[entityType]; ok {
+		return policy
+	}
+	return ConflictManual
+}
+
+// ConflictSide names one of the two versions in a conflict.
+type ConflictSide string
+
+const (
+	ConflictSideLocal ConflictSide = "local"
+	ConflictSideCloud ConflictSide = "cloud"
+)
+
+// Versioned is implemented by synced records so concurrent edits can be
+// detected and ordered.
+type Versioned interface {
+	// Version returns the hybrid logical clock stamp of the record's last
+	// change.
+	Version() hlc.Timestamp
+}
+
+// ConcurrentEdit reports whether current was changed after base, the
+// version an edit was made on, i.e. both sides edited the record
+// independently. Edits without a base, such as creates, never conflict.
+func ConcurrentEdit(base *hlc.Timestamp, current Versioned) bool {
+	if base == nil {
+		return false
+	}
+	return current.Version() > *base
+}
+
+// Settle applies the policy to a conflict and returns the winning side, or
+// an empty side when the conflict has to be resolved manually.
+func (p ConflictPolicy) Settle(local, cloud Versioned) ConflictSide {
+	switch p {
+	case ConflictCloudWins:
+		return ConflictSideCloud
+	case ConflictLastWriterWins:
+		if local.Version() > cloud.Version() {
+			return ConflictSideLocal
+		}
+		return ConflictSideCloud
+	}
+	return ""
+}
+
+type ConflictStatus string
+
+const (
+	ConflictOpen     ConflictStatus = "open"
+	ConflictResolved ConflictStatus = "resolved"
+)
+
+// SyncConflict records a concurrent edit and both versions of the record.
+// Conflicts settled by policy are stored as resolved so they can still be
+// reviewed and overridden. For a delete the local version is the
+// tombstone.
+type SyncConflict struct {
+	ID           uuid.UUID       `gorm:"type:uuid;primary_key" json:"id"`
+	EntityType   string          `gorm:"type:varchar(30);index;not null" json:"entity_type"`
+	EntityID     uuid.UUID       `gorm:"type:uuid;index;not null" json:"entity_id"`
+	Operation    ChangeOperation `gorm:"type:varchar(10);not null;default:update" json:"operation"`
+	DeviceID     string          `gorm:"type:varchar(64);index" json:"device_id"`
+	Policy       ConflictPolicy  `gorm:"type:varchar(20);not null" json:"policy"`
+	Status       ConflictStatus  `gorm:"type:varchar(20);index;not null" json:"status"`
+	Winner       ConflictSide    `gorm:"type:varchar(10)" json:"winner"`
+	LocalPayload string          `gorm:"type:text" json:"local_payload"`
+	CloudPayload string          `gorm:"type:text" json:"cloud_payload"`
+	LocalVersion hlc.Timestamp   `json:"local_version"`
+	CloudVersion hlc.Timestamp   `json:"cloud_version"`
+	DetectedAt   time.Time       `gorm:"index;not null" json:"detected_at"`
+	ResolvedAt   *time.Time      `json:"resolved_at"`
+	ResolvedBy   *uuid.UUID      `gorm:"type:uuid" json:"resolved_by,omitempty"`
+}
+
+func (c *SyncConflict) BeforeCreate(tx *gorm.DB) error {
+	if c.ID == uuid.Nil {
+		c.ID = uuid.New()
+	}
+	return nil
+}
+
+type ResolveConflictRequest struct {
+	Winner ConflictSide `json:"winner" validate:"required,oneof=local cloud"`
+}
+
+func (b *Branch) Version() hlc.Timestamp {
+	return b.HLC
+}
+
+func (t *Transaction) Version() hlc.Timestamp {
+	return t.HLC
+}
+
+func (s *Shift) Version() hlc.Timestamp {
+	return s.HLC
+}
+
+func (r *CashReconciliation) Version() hlc.Timestamp {
+	return r.HLC
+}
+
+func (t *Tombstone) Version() hlc.Timestamp {
+	return t.HLC
+}
@@ -0,0 +1,78 @@
+package models
+
+import (
+	"testing"
+
+	"shosha-finance/internal/hlc"
+)
+
+type stamped hlc.Timestamp
+
+func (s stamped) Version() hlc.Timestamp { return hlc.Timestamp(s) }
+
+func TestConflictPolicySettle(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy ConflictPolicy
+		local  stamped
+		cloud  stamped
+		want   ConflictSide
+	}{
+		{"cloud wins over newer local", ConflictCloudWins, 20, 10, ConflictSideCloud},
+		{"cloud wins over older local", ConflictCloudWins, 10, 20, ConflictSideCloud},
+		{"last writer local", ConflictLastWriterWins, 20, 10, ConflictSideLocal},
+		{"last writer cloud", ConflictLastWriterWins, 10, 20, ConflictSideCloud},
+		{"last writer tie keeps cloud", ConflictLastWriterWins, 10, 10, ConflictSideCloud},
+		{"manual", ConflictManual, 20, 10, ""},
+		{"unknown policy", ConflictPolicy("coin_flip"), 20, 10, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.policy.Settle(tt.local, tt.cloud); got != tt.want {
+				t.Errorf("Settle() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConcurrentEdit(t *testing.T) {
+	base := hlc.Timestamp(10)
+
+	tests := []struct {
+		name    string
+		base    *hlc.Timestamp
+		current stamped
+		want    bool
+	}{
+		{"create", nil, 20, false},
+		{"unchanged since base", &base, 10, false},
+		{"changed since base", &base, 11, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ConcurrentEdit(tt.base, tt.current); got != tt.want {
+				t.Errorf("ConcurrentEdit() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConflictPolicyFor(t *testing.T) {
+	tests := []struct {
+		entityType string
+		want       ConflictPolicy
+	}{
+		{EntityBranch, ConflictCloudWins},
+		{EntityTransaction, ConflictLastWriterWins},
+		{EntityReconciliation, ConflictManual},
+		{"widget", ConflictManual},
+	}
+
+	for _, tt := range tests {
+		if got := ConflictPolicyFor(tt.entityType); got != tt.want {
+			t.Errorf("ConflictPolicyFor(%q) = %q, want %q", tt.entityType, got, tt.want)
+		}
+	}
+}
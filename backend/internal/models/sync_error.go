@@ -0,0 +1,48 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Entity types exchanged with the cloud during sync.
+const (
+	EntityBranch         = "branch"
+	EntityTransaction    = "transaction"
+	EntityShift          = "shift"
+	EntityReconciliation = "cash_reconciliation"
+)
+
+type SyncErrorStatus string
+
+const (
+	SyncErrorPending     SyncErrorStatus = "pending"
+	SyncErrorQuarantined SyncErrorStatus = "quarantined"
+	SyncErrorResolved    SyncErrorStatus = "resolved"
+)
+
+// SyncError tracks a record the cloud rejected during push. After too many
+// failed attempts the record is quarantined and no longer pushed until a
+// user retries or resolves it.
+type SyncError struct {
+	ID            uuid.UUID       `gorm:"type:uuid;primary_key" json:"id"`
+	EntityType    string          `gorm:"type:varchar(30);uniqueIndex:idx_sync_error_entity;not null" json:"entity_type"`
+	EntityID      uuid.UUID       `gorm:"type:uuid;uniqueIndex:idx_sync_error_entity;not null" json:"entity_id"`
+	Reason        string          `gorm:"type:text" json:"reason"`
+	Attempts      int             `gorm:"default:0" json:"attempts"`
+	Status        SyncErrorStatus `gorm:"type:varchar(20);index;not null" json:"status"`
+	FirstFailedAt time.Time       `json:"first_failed_at"`
+	LastFailedAt  time.Time       `json:"last_failed_at"`
+	ResolvedAt    *time.Time      `json:"resolved_at"`
+	CreatedAt     time.Time       `gorm:"autoCreateTime" json:"created_at"`
+	UpdatedAt     time.Time       `gorm:"autoUpdateTime" json:"updated_at"`
+}
+
+func (e *SyncError) BeforeCreate(tx *gorm.DB) error {
+	if e.ID == uuid.Nil {
+		e.ID = uuid.New()
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type SyncHealthStatus string
+
+// Sync health statuses.
+const (
+	// SyncHealthOK synced within the stale threshold.
+	SyncHealthOK SyncHealthStatus = "ok"
+	// SyncHealthFailing reaches the cloud but its last cycle failed.
+	SyncHealthFailing SyncHealthStatus = "failing"
+	// SyncHealthStale has not synced within the stale threshold.
+	SyncHealthStale SyncHealthStatus = "stale"
+	// SyncHealthOffline has not synced within the offline threshold.
+	SyncHealthOffline SyncHealthStatus = "offline"
+	// SyncHealthNever has never synced, or a branch has no active device.
+	SyncHealthNever SyncHealthStatus = "never"
+	// SyncHealthInactive is a deactivated device; it does not count toward
+	// its branches' status.
+	SyncHealthInactive SyncHealthStatus = "inactive"
+)
+
+// Severity orders statuses so the worst sorts first: offline, then never
+// synced, stale, failing and ok. Inactive devices sort last.
+func (s SyncHealthStatus) Severity() int {
+	switch s {
+	case SyncHealthOK:
+		return 1
+	case SyncHealthFailing:
+		return 2
+	case SyncHealthStale:
+		return 3
+	case SyncHealthNever:
+		return 4
+	case SyncHealthOffline:
+		return 5
+	}
+	return 0
+}
+
+// SyncHealthThresholds are how long, in hours, since its last sync a
+// device counts as stale and as offline.
+type SyncHealthThresholds struct {
+	StaleAfterHours   int `json:"stale_after_hours"`
+	OfflineAfterHours int `json:"offline_after_hours"`
+}
+
+// DeviceSyncHealth is one device's sync health. LastSyncAt is its last
+// push or pull, whichever came later.
+type DeviceSyncHealth struct {
+	DeviceID        string           `json:"device_id"`
+	Name            string           `json:"name"`
+	Status          SyncHealthStatus `json:"status"`
+	AppVersion      string           `json:"app_version"`
+	ProtocolVersion int              `json:"protocol_version"`
+	LastSeenAt      *time.Time       `json:"last_seen_at"`
+	LastPushAt      *time.Time       `json:"last_push_at"`
+	LastPullAt      *time.Time       `json:"last_pull_at"`
+	LastSyncAt      *time.Time       `json:"last_sync_at"`
+	PendingCount    int64            `json:"pending_count"`
+	ReportedAt      *time.Time       `json:"reported_at"`
+	LastError       string           `json:"last_error,omitempty"`
+	LastErrorAt     *time.Time       `json:"last_error_at"`
+}
+
+// BranchSyncHealth is a branch's sync health: that of its healthiest
+// active device, with the backlog of all of them.
+type BranchSyncHealth struct {
+	BranchID     uuid.UUID          `json:"branch_id"`
+	Code         string             `json:"code"`
+	Name         string             `json:"name"`
+	Status       SyncHealthStatus   `json:"status"`
+	LastSyncAt   *time.Time         `json:"last_sync_at"`
+	PendingCount int64              `json:"pending_count"`
+	Devices      []DeviceSyncHealth `json:"devices"`
+}
+
+// SyncHealth is the overview of every branch's sync, worst first. Devices
+// not tied to a branch, such as head office ones, are listed on their own.
+type SyncHealth struct {
+	GeneratedAt  time.Time                `json:"generated_at"`
+	Thresholds   SyncHealthThresholds     `json:"thresholds"`
+	Summary      map[SyncHealthStatus]int `json:"summary"`
+	Branches     []BranchSyncHealth       `json:"branches"`
+	OtherDevices []DeviceSyncHealth       `json:"other_devices"`
+}
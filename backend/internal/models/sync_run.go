@@ -0,0 +1,54 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+type SyncRunTrigger string
+
+const (
+	SyncRunScheduled SyncRunTrigger = "scheduled"
+	SyncRunManual    SyncRunTrigger = "manual"
+)
+
+type SyncRunStatus string
+
+const (
+	SyncRunSucceeded SyncRunStatus = "succeeded"
+	SyncRunFailed    SyncRunStatus = "failed"
+	// SyncRunSkipped means the run did not reach the cloud: it was offline
+	// or the device is not enrolled.
+	SyncRunSkipped SyncRunStatus = "skipped"
+)
+
+// SyncRun is one cycle of the local sync worker, kept so support can see
+// when data last moved and why a cycle failed.
+type SyncRun struct {
+	ID         uuid.UUID      `gorm:"type:uuid;primary_key" json:"id"`
+	Trigger    SyncRunTrigger `gorm:"type:varchar(20);not null" json:"trigger"`
+	Status     SyncRunStatus  `gorm:"type:varchar(20);index;not null" json:"status"`
+	StartedAt  time.Time      `gorm:"index;not null" json:"started_at"`
+	FinishedAt time.Time      `json:"finished_at"`
+	Restored   int            `json:"restored"`
+	Pulled     int            `json:"pulled"`
+	Pushed     int            `json:"pushed"`
+	Rejected   int            `json:"rejected"`
+	Conflicts  int            `json:"conflicts"`
+	Error      string         `gorm:"type:text" json:"error,omitempty"`
+}
+
+func (r *SyncRun) BeforeCreate(tx *gorm.DB) error {
+	if r.ID == uuid.Nil {
+		r.ID = uuid.New()
+	}
+	return nil
+}
+
+// Moved reports whether the run restored, pulled, pushed or rejected any
+// record.
+func (r *SyncRun) Moved() bool {
+	return r.Restored+r.Pulled+r.Pushed+r.Rejected > 0
+}
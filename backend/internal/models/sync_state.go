@@ -0,0 +1,37 @@
+package models
+
+import "time"
+
+// Keys of the local sync state.
+const (
+	SyncStateDeviceID     = "device_id"
+	SyncStatePendingBatch = "pending_push_batch"
+	// SyncStatePullCursor is the cloud receive sequence number the next
+	// pull continues after.
+	SyncStatePullCursor = "pull_seq"
+	// SyncStateBranchScope is the JSON branch scope the cloud last reported
+	// for this device.
+	SyncStateBranchScope = "branch_scope"
+	// SyncStateDeviceCredential is the credential the cloud issued at
+	// enrollment, encrypted with the device key.
+	SyncStateDeviceCredential = "device_credential"
+	// SyncStateBranchID is the branch the device was enrolled for.
+	SyncStateBranchID = "branch_id"
+	// SyncStateRestorePending is set while the install waits to be
+	// restored from a cloud snapshot.
+	SyncStateRestorePending = "restore_pending"
+	// SyncStateRestoredAt records when the install was last restored from
+	// a cloud snapshot.
+	SyncStateRestoredAt = "restored_at"
+	// SyncStateSettings is the JSON settings the cloud last sent, applied
+	// again at startup.
+	SyncStateSettings = "settings"
+)
+
+// SyncState is a small key/value store the local sync worker uses to keep
+// its state across restarts.
+type SyncState struct {
+	Key       string    `gorm:"type:varchar(64);primary_key" json:"key"`
+	Value     string    `gorm:"type:text" json:"value"`
+	UpdatedAt time.Time `gorm:"autoUpdateTime" json:"updated_at"`
+}
@@ -0,0 +1,136 @@
+package models
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// DigestDayLayout is how digest days are written. Days are UTC so the
+// cloud and every device cut them the same way.
+const DigestDayLayout = "2006-01-02"
+
+// DayDigest summarises one branch's transactions on one day. Two sides
+// holding the same transactions compute the same digest; the hash covers
+// the IDs, the sums catch changed amounts.
+type DayDigest struct {
+	BranchID uuid.UUID `json:"branch_id"`
+	Day      string    `json:"day"`
+	Count    int64     `json:"count"`
+	SumIn    int64     `json:"sum_in"`
+	SumOut   int64     `json:"sum_out"`
+	Hash     string    `json:"hash"`
+}
+
+// Matches reports whether both digests describe the same transactions.
+func (d DayDigest) Matches(other DayDigest) bool {
+	return d.Count == other.Count && d.SumIn == other.SumIn && d.SumOut == other.SumOut && d.Hash == other.Hash
+}
+
+// DigestBuilder adds up transactions into day digests.
+type DigestBuilder struct {
+	digests map[string]*DayDigest
+	ids     map[string][]string
+}
+
+func NewDigestBuilder() *DigestBuilder {
+	return &DigestBuilder{digests: map[string]*DayDigest{}, ids: map[string][]string{}}
+}
+
+func (b *DigestBuilder) Add(branchID, id uuid.UUID, txType TransactionType, amount int64, createdAt time.Time) {
+	day := createdAt.UTC().Format(DigestDayLayout)
+	key := branchID.String() + "/" + day
+	digest, ok := b.digests[key]
+	if !ok {
+		digest = &DayDigest{BranchID: branchID, Day: day}
+		b.digests[key] = digest
+	}
+	digest.Count++
+	if txType == TransactionTypeIN {
+		digest.SumIn += amount
+	} else {
+		digest.SumOut += amount
+	}
+	b.ids[key] = append(b.ids[key], id.String())
+}
+
+// Digests returns the digests ordered by branch and day.
+func (b *DigestBuilder) Digests() []DayDigest {
+	keys := make([]string, 0, len(b.digests))
+	for key := range b.digests {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	digests := make([]DayDigest, 0, len(keys))
+	for _, key := range keys {
+		ids := b.ids[key]
+		sort.Strings(ids)
+		sum := sha256.Sum256([]byte(strings.Join(ids, "\n")))
+		digest := *b.digests[key]
+		digest.Hash = hex.EncodeToString(sum[:16])
+		digests = append(digests, digest)
+	}
+	return digests
+}
+
+type SyncVerificationStatus string
+
+const (
+	// SyncVerificationMatched means every day matched the cloud.
+	SyncVerificationMatched SyncVerificationStatus = "matched"
+	// SyncVerificationRepaired means mismatching rows were pulled again or
+	// queued to be pushed again.
+	SyncVerificationRepaired SyncVerificationStatus = "repaired"
+	// SyncVerificationPending means days differ only by records still on
+	// their way, which the next sync brings in line.
+	SyncVerificationPending SyncVerificationStatus = "pending"
+	// SyncVerificationFailed means the check could not be completed.
+	SyncVerificationFailed SyncVerificationStatus = "failed"
+)
+
+// SyncVerification is one comparison of the local books with the cloud's,
+// day by day, for the days from From to To. Only cloud rows received up to
+// Cursor, the pull cursor at the time, are compared; later ones are still
+// on their way. Repulled rows were missing or outdated here and were taken from the
+// cloud; Repushed rows were missing or outdated on the cloud and were
+// queued to be pushed again.
+type SyncVerification struct {
+	ID             uuid.UUID              `gorm:"type:uuid;primary_key" json:"id"`
+	Status         SyncVerificationStatus `gorm:"type:varchar(20);index;not null" json:"status"`
+	StartedAt      time.Time              `gorm:"index;not null" json:"started_at"`
+	FinishedAt     time.Time              `json:"finished_at"`
+	From           string                 `gorm:"type:varchar(10)" json:"from"`
+	To             string                 `gorm:"type:varchar(10)" json:"to"`
+	Cursor         uint64                 `json:"cursor"`
+	DaysChecked    int                    `json:"days_checked"`
+	DaysMismatched int                    `json:"days_mismatched"`
+	Repulled       int                    `json:"repulled"`
+	Repushed       int                    `json:"repushed"`
+	Mismatches     []DayMismatch          `gorm:"serializer:json;type:text" json:"mismatches"`
+	Error          string                 `gorm:"type:text" json:"error,omitempty"`
+}
+
+func (v *SyncVerification) BeforeCreate(tx *gorm.DB) error {
+	if v.ID == uuid.Nil {
+		v.ID = uuid.New()
+	}
+	return nil
+}
+
+// DayMismatch is a day whose digests differ, with what the drill-down
+// found: rows missing on either side and rows whose content differs.
+type DayMismatch struct {
+	BranchID     uuid.UUID   `json:"branch_id"`
+	Day          string      `json:"day"`
+	Local        DayDigest   `json:"local"`
+	Cloud        DayDigest   `json:"cloud"`
+	MissingLocal []uuid.UUID `json:"missing_local"`
+	MissingCloud []uuid.UUID `json:"missing_cloud"`
+	Differing    []uuid.UUID `json:"differing"`
+}
@@ -0,0 +1,122 @@
+package models
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestDigestBuilder(t *testing.T) {
+	branchA := uuid.MustParse("00000000-0000-0000-0000-00000000000a")
+	branchB := uuid.MustParse("00000000-0000-0000-0000-00000000000b")
+	id1 := uuid.MustParse("00000000-0000-0000-0000-000000000001")
+	id2 := uuid.MustParse("00000000-0000-0000-0000-000000000002")
+	id3 := uuid.MustParse("00000000-0000-0000-0000-000000000003")
+	wib := time.FixedZone("WIB", 7*3600)
+
+	type row struct {
+		branch uuid.UUID
+		id     uuid.UUID
+		txType TransactionType
+		amount int64
+		at     time.Time
+	}
+	tests := []struct {
+		name string
+		rows []row
+		want []DayDigest // without hashes
+	}{
+		{
+			name: "empty",
+			want: []DayDigest{},
+		},
+		{
+			name: "sums per type",
+			rows: []row{
+				{branchA, id1, TransactionTypeIN, 100, time.Date(2026, 10, 1, 9, 0, 0, 0, time.UTC)},
+				{branchA, id2, TransactionTypeOUT, 40, time.Date(2026, 10, 1, 15, 0, 0, 0, time.UTC)},
+			},
+			want: []DayDigest{{BranchID: branchA, Day: "2026-10-01", Count: 2, SumIn: 100, SumOut: 40}},
+		},
+		{
+			name: "days cut in UTC",
+			rows: []row{
+				{branchA, id1, TransactionTypeIN, 100, time.Date(2026, 10, 2, 6, 0, 0, 0, wib)},
+				{branchA, id2, TransactionTypeIN, 50, time.Date(2026, 10, 2, 8, 0, 0, 0, wib)},
+			},
+			want: []DayDigest{
+				{BranchID: branchA, Day: "2026-10-01", Count: 1, SumIn: 100},
+				{BranchID: branchA, Day: "2026-10-02", Count: 1, SumIn: 50},
+			},
+		},
+		{
+			name: "ordered by branch then day",
+			rows: []row{
+				{branchB, id1, TransactionTypeIN, 1, time.Date(2026, 10, 1, 9, 0, 0, 0, time.UTC)},
+				{branchA, id2, TransactionTypeIN, 2, time.Date(2026, 10, 3, 9, 0, 0, 0, time.UTC)},
+				{branchA, id3, TransactionTypeIN, 3, time.Date(2026, 10, 2, 9, 0, 0, 0, time.UTC)},
+			},
+			want: []DayDigest{
+				{BranchID: branchA, Day: "2026-10-02", Count: 1, SumIn: 3},
+				{BranchID: branchA, Day: "2026-10-03", Count: 1, SumIn: 2},
+				{BranchID: branchB, Day: "2026-10-01", Count: 1, SumIn: 1},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := NewDigestBuilder()
+			for _, r := range tt.rows {
+				b.Add(r.branch, r.id, r.txType, r.amount, r.at)
+			}
+			got := b.Digests()
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %d digests, want %d", len(got), len(tt.want))
+			}
+			for i, want := range tt.want {
+				want.Hash = got[i].Hash
+				if got[i] != want {
+					t.Errorf("digest %d = %+v, want %+v", i, got[i], want)
+				}
+				if got[i].Hash == "" {
+					t.Errorf("digest %d has no hash", i)
+				}
+			}
+		})
+	}
+}
+
+func TestDigestHash(t *testing.T) {
+	branch := uuid.New()
+	day := time.Date(2026, 10, 1, 9, 0, 0, 0, time.UTC)
+	ids := []uuid.UUID{uuid.New(), uuid.New(), uuid.New()}
+
+	digest := func(ids ...uuid.UUID) DayDigest {
+		b := NewDigestBuilder()
+		for _, id := range ids {
+			b.Add(branch, id, TransactionTypeIN, 10, day)
+		}
+		return b.Digests()[0]
+	}
+
+	forward := digest(ids[0], ids[1], ids[2])
+	tests := []struct {
+		name  string
+		other DayDigest
+		match bool
+	}{
+		{"same rows in another order", digest(ids[2], ids[0], ids[1]), true},
+		{"different row with the same sums", digest(ids[0], ids[1], uuid.New()), false},
+		{"missing row", digest(ids[0], ids[1]), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := forward.Matches(tt.other); got != tt.match {
+				t.Errorf("Matches() = %v, want %v", got, tt.match)
+			}
+		})
+	}
+}
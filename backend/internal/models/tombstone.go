@@ -0,0 +1,20 @@
+package models
+
+import (
+	"time"
+
+	"shosha-finance/internal/hlc"
+
+	"github.com/google/uuid"
+)
+
+// Tombstone tells the other side of a sync that a record was deleted.
+// Soft-deleted rows are kept as tombstones until the retention window has
+// passed.
+type Tombstone struct {
+	EntityType string    `json:"entity_type"`
+	EntityID   uuid.UUID `json:"entity_id"`
+	DeletedAt  time.Time `json:"deleted_at"`
+	// HLC is the hybrid logical clock stamp of the delete.
+	HLC hlc.Timestamp `json:"hlc"`
+}
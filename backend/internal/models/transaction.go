@@ -1,8 +1,14 @@
 package models
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"strings"
 	"time"
 
+	"shosha-finance/internal/hlc"
+
 	"github.com/google/uuid"
 	"gorm.io/gorm"
 )
@@ -21,10 +27,18 @@ type Transaction struct {
 	Category    string          `gorm:"type:varchar(50);not null" json:"category"`
 	Amount      int64           `gorm:"not null" json:"amount"`
 	Description string          `gorm:"type:text" json:"description"`
-	CreatedAt   time.Time       `gorm:"autoCreateTime" json:"created_at"`
-	IsSynced    bool            `gorm:"default:false" json:"is_synced"`
-	SyncedAt    *time.Time      `json:"synced_at"`
-	Branch      Branch          `gorm:"foreignKey:BranchID" json:"branch,omitempty"`
+	RecurringID *uuid.UUID      `gorm:"type:uuid;index" json:"recurring_id,omitempty"`
+	ShiftID     *uuid.UUID      `gorm:"type:uuid;index" json:"shift_id,omitempty"`
+	// RequiresApproval marks an amount above the approval threshold set
+	// when the transaction was recorded.
+	RequiresApproval bool          `gorm:"not null;default:false" json:"requires_approval"`
+	CreatedAt        time.Time     `gorm:"autoCreateTime" json:"created_at"`
+	UpdatedAt        time.Time     `gorm:"autoUpdateTime" json:"updated_at"`
+	HLC              hlc.Timestamp `gorm:"index;not null;default:0" json:"hlc"`
+	SyncSeq          uint64        `gorm:"index;not null;default:0" json:"-"`
+	IsSynced         bool          `gorm:"default:false" json:"is_synced"`
+	SyncedAt         *time.Time    `json:"synced_at"`
+	Branch           Branch        `gorm:"foreignKey:BranchID" json:"branch,omitempty"`
 }
 
 func (t *Transaction) BeforeCreate(tx *gorm.DB) error {
@@ -34,12 +48,51 @@ func (t *Transaction) BeforeCreate(tx *gorm.DB) error {
 	return nil
 }
 
+// SyncTransaction is a transaction as sent through sync. It leaves out the
+// Branch relation, which sync never loads; branches travel on their own and
+// an empty one would otherwise be encoded with every transaction.
+type SyncTransaction struct {
+	*Transaction
+	Branch *Branch `json:"branch,omitempty"`
+}
+
+func (t *Transaction) ToSync() SyncTransaction {
+	return SyncTransaction{Transaction: t}
+}
+
+// Checksum identifies the transaction's content, leaving out its stamp and
+// sync bookkeeping, so two copies can be compared.
+func (t *Transaction) Checksum() string {
+	fields := []string{
+		t.ID.String(),
+		t.BranchID.String(),
+		string(t.Type),
+		t.Category,
+		strconv.FormatInt(t.Amount, 10),
+		t.Description,
+		t.CreatedAt.UTC().Format(time.RFC3339),
+	}
+	if t.RecurringID != nil {
+		fields = append(fields, "recurring:"+t.RecurringID.String())
+	}
+	if t.ShiftID != nil {
+		fields = append(fields, "shift:"+t.ShiftID.String())
+	}
+	sum := sha256.Sum256([]byte(strings.Join(fields, "\x00")))
+	return hex.EncodeToString(sum[:16])
+}
+
 type TransactionRequest struct {
+	// ID is an optional client-generated UUID. Retrying with the same ID
+	// returns the stored transaction instead of creating a second one.
+	ID          string          `json:"id"`
 	BranchID    string          `json:"branch_id" validate:"required"`
 	Type        TransactionType `json:"type" validate:"required,oneof=IN OUT"`
 	Category    string          `json:"category" validate:"required"`
 	Amount      int64           `json:"amount" validate:"required,gt=0"`
 	Description string          `json:"description"`
+	// Force skips the duplicate check once the user has confirmed.
+	Force bool `json:"force"`
 }
 
 type TransactionResponse struct {
@@ -51,3 +104,13 @@ type TransactionResponse struct {
 	Description string          `json:"description"`
 	CreatedAt   time.Time       `json:"created_at"`
 }
+
+// DuplicateGroup is a set of transactions that look like the same entry
+// recorded more than once.
+type DuplicateGroup struct {
+	BranchID     uuid.UUID       `json:"branch_id"`
+	Type         TransactionType `json:"type"`
+	Category     string          `json:"category"`
+	Amount       int64           `json:"amount"`
+	Transactions []Transaction   `json:"transactions"`
+}
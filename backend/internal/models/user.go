@@ -3,6 +3,8 @@ package models
 import (
 	"time"
 
+	"shosha-finance/internal/hlc"
+
 	"github.com/google/uuid"
 	"golang.org/x/crypto/bcrypt"
 	"gorm.io/gorm"
@@ -17,18 +19,25 @@ const (
 )
 
 type User struct {
-	ID        uuid.UUID  `gorm:"type:uuid;primary_key" json:"id"`
-	Username  string     `gorm:"type:varchar(50);uniqueIndex;not null" json:"username"`
-	Email     *string    `gorm:"type:varchar(100);uniqueIndex" json:"email,omitempty"`
-	Password  string     `gorm:"type:varchar(255);not null" json:"-"`
-	Name      string     `gorm:"type:varchar(100);not null" json:"name"`
-	Role      UserRole   `gorm:"type:varchar(20);not null;default:'staff'" json:"role"`
-	BranchID  *uuid.UUID `gorm:"type:uuid" json:"branch_id,omitempty"`
-	IsActive  bool       `gorm:"default:true" json:"is_active"`
-	IsSynced  bool       `gorm:"default:false" json:"is_synced"`
-	SyncedAt  *time.Time `json:"synced_at"`
-	CreatedAt time.Time  `gorm:"autoCreateTime" json:"created_at"`
-	UpdatedAt time.Time  `gorm:"autoUpdateTime" json:"updated_at"`
+	ID       uuid.UUID  `gorm:"type:uuid;primary_key" json:"id"`
+	Username string     `gorm:"type:varchar(50);uniqueIndex;not null" json:"username"`
+	Email    *string    `gorm:"type:varchar(100);uniqueIndex" json:"email,omitempty"`
+	Password string     `gorm:"type:varchar(255);not null" json:"-"`
+	Name     string     `gorm:"type:varchar(100);not null" json:"name"`
+	Role     UserRole   `gorm:"type:varchar(20);not null;default:'staff'" json:"role"`
+	BranchID *uuid.UUID `gorm:"type:uuid" json:"branch_id,omitempty"`
+	// OfflineLogin sends a user without a branch, such as a head office
+	// supervisor, to every device so they can log in offline. Users without
+	// a branch are otherwise kept on the cloud.
+	OfflineLogin bool           `gorm:"default:false" json:"offline_login"`
+	IsActive     bool           `gorm:"default:true" json:"is_active"`
+	IsSynced     bool           `gorm:"default:false" json:"is_synced"`
+	SyncedAt     *time.Time     `json:"synced_at"`
+	CreatedAt    time.Time      `gorm:"autoCreateTime" json:"created_at"`
+	UpdatedAt    time.Time      `gorm:"autoUpdateTime" json:"updated_at"`
+	HLC          hlc.Timestamp  `gorm:"index;not null;default:0" json:"hlc"`
+	SyncSeq      uint64         `gorm:"index;not null;default:0" json:"-"`
+	DeletedAt    gorm.DeletedAt `gorm:"index" json:"-"`
 }
 
 func (u *User) BeforeCreate(tx *gorm.DB) error {
@@ -53,23 +62,112 @@ func (u *User) CheckPassword(password string) bool {
 }
 
 type UserResponse struct {
-	ID       uuid.UUID  `json:"id"`
-	Username string     `json:"username"`
-	Email    *string    `json:"email,omitempty"`
-	Name     string     `json:"name"`
-	Role     UserRole   `json:"role"`
-	BranchID *uuid.UUID `json:"branch_id,omitempty"`
-	IsActive bool       `json:"is_active"`
+	ID           uuid.UUID  `json:"id"`
+	Username     string     `json:"username"`
+	Email        *string    `json:"email,omitempty"`
+	Name         string     `json:"name"`
+	Role         UserRole   `json:"role"`
+	BranchID     *uuid.UUID `json:"branch_id,omitempty"`
+	OfflineLogin bool       `json:"offline_login"`
+	IsActive     bool       `json:"is_active"`
 }
 
 func (u *User) ToResponse() UserResponse {
 	return UserResponse{
-		ID:       u.ID,
-		Username: u.Username,
-		Email:    u.Email,
-		Name:     u.Name,
-		Role:     u.Role,
-		BranchID: u.BranchID,
-		IsActive: u.IsActive,
+		ID:           u.ID,
+		Username:     u.Username,
+		Email:        u.Email,
+		Name:         u.Name,
+		Role:         u.Role,
+		BranchID:     u.BranchID,
+		OfflineLogin: u.OfflineLogin,
+		IsActive:     u.IsActive,
+	}
+}
+
+type CreateUserRequest struct {
+	Username     string     `json:"username" validate:"required"`
+	Email        *string    `json:"email"`
+	Password     string     `json:"password" validate:"required"`
+	Name         string     `json:"name" validate:"required"`
+	Role         UserRole   `json:"role" validate:"required,oneof=admin manager staff"`
+	BranchID     *uuid.UUID `json:"branch_id"`
+	OfflineLogin bool       `json:"offline_login"`
+}
+
+type UpdateUserRequest struct {
+	Email        *string    `json:"email"`
+	Password     *string    `json:"password"`
+	Name         *string    `json:"name"`
+	Role         *UserRole  `json:"role" validate:"omitempty,oneof=admin manager staff"`
+	BranchID     *uuid.UUID `json:"branch_id"`
+	OfflineLogin *bool      `json:"offline_login"`
+	IsActive     *bool      `json:"is_active"`
+}
+
+// ValidRole reports whether role is one of the known roles.
+func ValidRole(role UserRole) bool {
+	switch role {
+	case RoleAdmin, RoleManager, RoleStaff:
+		return true
+	}
+	return false
+}
+
+// SyncUser carries a user from the cloud to local installs. Unlike the
+// API responses it includes the password hash, so staff can log in to a
+// branch laptop while it is offline.
+type SyncUser struct {
+	ID           uuid.UUID     `json:"id"`
+	Username     string        `json:"username"`
+	Email        *string       `json:"email,omitempty"`
+	PasswordHash string        `json:"password_hash"`
+	Name         string        `json:"name"`
+	Role         UserRole      `json:"role"`
+	BranchID     *uuid.UUID    `json:"branch_id,omitempty"`
+	IsActive     bool          `json:"is_active"`
+	CreatedAt    time.Time     `json:"created_at"`
+	UpdatedAt    time.Time     `json:"updated_at"`
+	HLC          hlc.Timestamp `json:"hlc"`
+	DeletedAt    *time.Time    `json:"deleted_at,omitempty"`
+}
+
+func (u *User) ToSync() SyncUser {
+	synced := SyncUser{
+		ID:           u.ID,
+		Username:     u.Username,
+		Email:        u.Email,
+		PasswordHash: u.Password,
+		Name:         u.Name,
+		Role:         u.Role,
+		BranchID:     u.BranchID,
+		IsActive:     u.IsActive,
+		CreatedAt:    u.CreatedAt,
+		UpdatedAt:    u.UpdatedAt,
+		HLC:          u.HLC,
+	}
+	if u.DeletedAt.Valid {
+		synced.DeletedAt = &u.DeletedAt.Time
+	}
+	return synced
+}
+
+func (s *SyncUser) ToUser() *User {
+	user := &User{
+		ID:        s.ID,
+		Username:  s.Username,
+		Email:     s.Email,
+		Password:  s.PasswordHash,
+		Name:      s.Name,
+		Role:      s.Role,
+		BranchID:  s.BranchID,
+		IsActive:  s.IsActive,
+		CreatedAt: s.CreatedAt,
+		UpdatedAt: s.UpdatedAt,
+		HLC:       s.HLC,
+	}
+	if s.DeletedAt != nil {
+		user.DeletedAt = gorm.DeletedAt{Time: *s.DeletedAt, Valid: true}
 	}
+	return user
 }
@@ -7,7 +7,6 @@ import (
 
 	"github.com/google/uuid"
 	"gorm.io/gorm"
-	"gorm.io/gorm/clause"
 )
 
 type BranchRepository interface {
@@ -20,19 +19,25 @@ type BranchRepository interface {
 	Delete(id uuid.UUID) error
 	Count() (int64, error)
 	Upsert(branch *models.Branch) error
-	GetUpdatedAfter(since *time.Time) ([]models.Branch, error)
+	GetUpdatedBetween(since, until uint64) ([]models.Branch, error)
 }
 
 type branchRepository struct {
-	db *gorm.DB
+	db   *gorm.DB
+	opts Options
 }
 
-func NewBranchRepository(db *gorm.DB) BranchRepository {
-	return &branchRepository{db: db}
+func NewBranchRepository(db *gorm.DB, opts Options) BranchRepository {
+	return &branchRepository{db: db, opts: opts}
 }
 
 func (r *branchRepository) Create(branch *models.Branch) error {
-	return r.db.Create(branch).Error
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(branch).Error; err != nil {
+			return err
+		}
+		return r.opts.recordChange(tx, models.EntityBranch, models.ChangeCreate, branch.ID, branch)
+	})
 }
 
 func (r *branchRepository) FindByID(id uuid.UUID) (*models.Branch, error) {
@@ -55,22 +60,46 @@ func (r *branchRepository) FindByCode(code string) (*models.Branch, error) {
 
 func (r *branchRepository) FindAll() ([]models.Branch, error) {
 	var branches []models.Branch
-	err := r.db.Order("name asc").Find(&branches).Error
+	err := r.db.Scopes(r.opts.Scope.filter("id")).Order("name asc").Find(&branches).Error
 	return branches, err
 }
 
 func (r *branchRepository) FindActive() ([]models.Branch, error) {
 	var branches []models.Branch
-	err := r.db.Where("is_active = ?", true).Order("name asc").Find(&branches).Error
+	err := r.db.Scopes(r.opts.Scope.filter("id")).Where("is_active = ?", true).Order("name asc").Find(&branches).Error
 	return branches, err
 }
 
 func (r *branchRepository) Update(branch *models.Branch) error {
-	return r.db.Save(branch).Error
+	base := branch.HLC
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(branch).Error; err != nil {
+			return err
+		}
+		return r.opts.recordUpdate(tx, models.EntityBranch, branch.ID, branch, base)
+	})
 }
 
+// Delete soft-deletes the branch; the row stays as a tombstone so the delete
+// reaches the cloud and other devices.
 func (r *branchRepository) Delete(id uuid.UUID) error {
-	return r.db.Delete(&models.Branch{}, id).Error
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		// An update rather than Delete so the delete gets its own HLC stamp
+		if err := tx.Model(&models.Branch{}).Where("id = ?", id).Update("deleted_at", time.Now()).Error; err != nil {
+			return err
+		}
+
+		var branch models.Branch
+		if err := tx.Unscoped().Where("id = ?", id).First(&branch).Error; err != nil {
+			return err
+		}
+		return r.opts.recordChange(tx, models.EntityBranch, models.ChangeDelete, id, models.Tombstone{
+			EntityType: models.EntityBranch,
+			EntityID:   id,
+			DeletedAt:  branch.DeletedAt.Time,
+			HLC:        branch.HLC,
+		})
+	})
 }
 
 func (r *branchRepository) Count() (int64, error) {
@@ -80,18 +109,20 @@ func (r *branchRepository) Count() (int64, error) {
 }
 
 func (r *branchRepository) Upsert(branch *models.Branch) error {
-	return r.db.Clauses(clause.OnConflict{
-		Columns:   []clause.Column{{Name: "id"}},
-		UpdateAll: true,
-	}).Create(branch).Error
+	return upsertBranch(r.db, branch)
 }
 
-func (r *branchRepository) GetUpdatedAfter(since *time.Time) ([]models.Branch, error) {
+func upsertBranch(db *gorm.DB, branch *models.Branch) error {
+	return upsertReceived(db, branch)
+}
+
+// GetUpdatedBetween returns branches written after the since receive
+// sequence number and no later than until, in the order they were written.
+func (r *branchRepository) GetUpdatedBetween(since, until uint64) ([]models.Branch, error) {
 	var branches []models.Branch
-	query := r.db.Model(&models.Branch{})
-	if since != nil {
-		query = query.Where("updated_at > ? OR created_at > ?", since, since)
-	}
-	err := query.Find(&branches).Error
+	err := r.db.Model(&models.Branch{}).
+		Where("sync_seq > ? AND sync_seq <= ?", since, until).
+		Order("sync_seq asc").
+		Find(&branches).Error
 	return branches, err
 }
@@ -0,0 +1,50 @@
+package repository
+
+import (
+	"sync"
+
+	"shosha-finance/internal/models"
+
+	"gorm.io/gorm"
+)
+
+// BranchScope limits what a local install lists to the branches it pulls
+// from the cloud. Until the install has learned its scope nothing is
+// hidden. It is safe for concurrent use.
+type BranchScope struct {
+	mu    sync.RWMutex
+	scope *models.BranchScope
+}
+
+func NewBranchScope() *BranchScope {
+	return &BranchScope{}
+}
+
+// Set makes the repositories' list and report queries show only records of
+// the scope's branches.
+func (s *BranchScope) Set(scope *models.BranchScope) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.scope = scope
+}
+
+// filter limits a query to the current scope on the given branch column.
+// A nil BranchScope leaves the query alone.
+func (s *BranchScope) filter(column string) func(*gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		if s == nil {
+			return db
+		}
+		s.mu.RLock()
+		scope := s.scope
+		s.mu.RUnlock()
+
+		if scope == nil || scope.AllBranches {
+			return db
+		}
+		if len(scope.BranchIDs) == 0 {
+			return db.Where("1 = 0")
+		}
+		return db.Where(column+" IN ?", scope.BranchIDs)
+	}
+}
@@ -0,0 +1,289 @@
+package repository
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"shosha-finance/internal/hlc"
+	"shosha-finance/internal/models"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// recordChange adds a change-log entry using the caller's DB transaction
+// when the app keeps a change log. The payload is the record after the
+// change; deletes pass nil.
+func (o Options) recordChange(tx *gorm.DB, entityType string, op models.ChangeOperation, id uuid.UUID, record interface{}) error {
+	if !o.ChangeLog {
+		return nil
+	}
+	return logChange(tx, entityType, op, id, record, nil)
+}
+
+// recordUpdate is recordChange for an update made on the given version of
+// the record, so the cloud can tell whether it was edited concurrently.
+func (o Options) recordUpdate(tx *gorm.DB, entityType string, id uuid.UUID, record interface{}, base hlc.Timestamp) error {
+	if !o.ChangeLog {
+		return nil
+	}
+	return logChange(tx, entityType, models.ChangeUpdate, id, record, &base)
+}
+
+func logChange(tx *gorm.DB, entityType string, op models.ChangeOperation, id uuid.UUID, record interface{}, base *hlc.Timestamp) error {
+	entry := models.ChangeLog{
+		EntityType:  entityType,
+		EntityID:    id,
+		Operation:   op,
+		BaseVersion: base,
+	}
+	// Transactions are logged without their empty Branch relation
+	if t, ok := record.(*models.Transaction); ok {
+		record = t.ToSync()
+	}
+	if record != nil {
+		data, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		entry.Payload = string(data)
+	}
+
+	if op == models.ChangeUpdate {
+		// The record has changes the cloud has not seen yet
+		model, err := syncedModel(entityType)
+		if err != nil {
+			return err
+		}
+		if err := tx.Model(model).Where("id = ?", id).UpdateColumn("is_synced", false).Error; err != nil {
+			return err
+		}
+	}
+
+	return tx.Create(&entry).Error
+}
+
+// syncedModel returns an empty model for a synced entity type.
+func syncedModel(entityType string) (interface{}, error) {
+	switch entityType {
+	case models.EntityBranch:
+		return &models.Branch{}, nil
+	case models.EntityTransaction:
+		return &models.Transaction{}, nil
+	case models.EntityShift:
+		return &models.Shift{}, nil
+	case models.EntityReconciliation:
+		return &models.CashReconciliation{}, nil
+	}
+	return nil, fmt.Errorf("unknown synced entity type %q", entityType)
+}
+
+var syncedEntityTypes = []string{
+	models.EntityBranch,
+	models.EntityTransaction,
+	models.EntityShift,
+	models.EntityReconciliation,
+}
+
+type ChangeLogRepository interface {
+	FindPending(limit int, skip []uuid.UUID) ([]models.ChangeLog, error)
+	Count() (int64, error)
+	Acknowledge(upTo uint64, keep []uint64) ([]models.ChangeLog, error)
+	Supersede(seq uint64) (bool, error)
+	Requeue(seq uint64) error
+	Remove(seq uint64) error
+	EnqueueSnapshot(entityType string, id uuid.UUID) error
+	BackfillUnsynced() (int, error)
+}
+
+type changeLogRepository struct {
+	db *gorm.DB
+}
+
+func NewChangeLogRepository(db *gorm.DB) ChangeLogRepository {
+	return &changeLogRepository{db: db}
+}
+
+// FindPending returns the oldest entries, leaving out those for the given
+// entities.
+func (r *changeLogRepository) FindPending(limit int, skip []uuid.UUID) ([]models.ChangeLog, error) {
+	var entries []models.ChangeLog
+	query := r.db.Model(&models.ChangeLog{})
+	if len(skip) > 0 {
+		query = query.Where("entity_id NOT IN ?", skip)
+	}
+	err := query.Order("seq asc").Limit(limit).Find(&entries).Error
+	return entries, err
+}
+
+func (r *changeLogRepository) Count() (int64, error) {
+	var count int64
+	err := r.db.Model(&models.ChangeLog{}).Count(&count).Error
+	return count, err
+}
+
+// Acknowledge removes the entries up to and including upTo, except those
+// in keep, and marks their records as synced when no later change for them
+// is still waiting. It returns the removed entries.
+func (r *changeLogRepository) Acknowledge(upTo uint64, keep []uint64) ([]models.ChangeLog, error) {
+	var acked []models.ChangeLog
+
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		query := tx.Where("seq <= ?", upTo)
+		if len(keep) > 0 {
+			query = query.Where("seq NOT IN ?", keep)
+		}
+		if err := query.Order("seq asc").Find(&acked).Error; err != nil {
+			return err
+		}
+		if len(acked) == 0 {
+			return nil
+		}
+
+		seqs := make([]uint64, len(acked))
+		for i, entry := range acked {
+			seqs[i] = entry.Seq
+		}
+		if err := tx.Where("seq IN ?", seqs).Delete(&models.ChangeLog{}).Error; err != nil {
+			return err
+		}
+
+		now := time.Now()
+		for _, entry := range acked {
+			if entry.Operation == models.ChangeDelete {
+				continue
+			}
+			model, err := syncedModel(entry.EntityType)
+			if err != nil {
+				return err
+			}
+			err = tx.Model(model).
+				Where("id = ?", entry.EntityID).
+				Where("NOT EXISTS (?)", tx.Model(&models.ChangeLog{}).Select("1").Where("entity_id = ?", entry.EntityID)).
+				UpdateColumns(map[string]interface{}{
+					"is_synced": true,
+					"synced_at": now,
+				}).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	return acked, err
+}
+
+// Supersede removes an entry when a later change to the same record is
+// queued, which carries the record as it is now, and reports whether it
+// did.
+func (r *changeLogRepository) Supersede(seq uint64) (bool, error) {
+	var removed bool
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		var entry models.ChangeLog
+		if err := tx.Where("seq = ?", seq).First(&entry).Error; err != nil {
+			return err
+		}
+		var err error
+		removed, err = supersede(tx, &entry)
+		return err
+	})
+	return removed, err
+}
+
+func supersede(tx *gorm.DB, entry *models.ChangeLog) (bool, error) {
+	var later int64
+	err := tx.Model(&models.ChangeLog{}).
+		Where("entity_type = ? AND entity_id = ? AND seq > ?", entry.EntityType, entry.EntityID, entry.Seq).
+		Count(&later).Error
+	if err != nil || later == 0 {
+		return false, err
+	}
+	return true, tx.Delete(entry).Error
+}
+
+// Requeue moves an entry to the end of the queue under a new sequence
+// number; the cloud has already moved its cursor past the old one. An
+// entry a later change supersedes is removed instead, so the older version
+// is never applied over the newer one.
+func (r *changeLogRepository) Requeue(seq uint64) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		var entry models.ChangeLog
+		if err := tx.Where("seq = ?", seq).First(&entry).Error; err != nil {
+			return err
+		}
+		if removed, err := supersede(tx, &entry); removed || err != nil {
+			return err
+		}
+		if err := tx.Delete(&entry).Error; err != nil {
+			return err
+		}
+		entry.Seq = 0
+		entry.CreatedAt = time.Time{}
+		return tx.Create(&entry).Error
+	})
+}
+
+func (r *changeLogRepository) Remove(seq uint64) error {
+	return r.db.Where("seq = ?", seq).Delete(&models.ChangeLog{}).Error
+}
+
+// EnqueueSnapshot queues the current state of a record, for instance to
+// push it again after it was quarantined.
+func (r *changeLogRepository) EnqueueSnapshot(entityType string, id uuid.UUID) error {
+	return enqueueSnapshot(r.db, entityType, id)
+}
+
+func enqueueSnapshot(tx *gorm.DB, entityType string, id uuid.UUID) error {
+	record, err := findSynced(tx, entityType, id)
+	if err != nil {
+		return err
+	}
+	return logChange(tx, entityType, models.ChangeUpdate, id, record, nil)
+}
+
+// findSynced loads a synced record, including soft-deleted rows and shift
+// denominations.
+func findSynced(tx *gorm.DB, entityType string, id uuid.UUID) (interface{}, error) {
+	record, err := syncedModel(entityType)
+	if err != nil {
+		return nil, err
+	}
+	query := tx.Unscoped()
+	if entityType == models.EntityShift {
+		query = query.Preload("Denominations")
+	}
+	if err := query.Where("id = ?", id).First(record).Error; err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// BackfillUnsynced queues records that are still unsynced but have no
+// change-log entry, such as those written before the change log existed.
+func (r *changeLogRepository) BackfillUnsynced() (int, error) {
+	total := 0
+	for _, entityType := range syncedEntityTypes {
+		model, err := syncedModel(entityType)
+		if err != nil {
+			return total, err
+		}
+		var ids []uuid.UUID
+		err = r.db.Model(model).
+			Where("is_synced = ?", false).
+			Where("id NOT IN (?)", r.db.Model(&models.ChangeLog{}).Select("entity_id")).
+			Pluck("id", &ids).Error
+		if err != nil {
+			return total, err
+		}
+
+		for _, id := range ids {
+			if err := r.EnqueueSnapshot(entityType, id); err != nil {
+				return total, err
+			}
+			total++
+		}
+	}
+	return total, nil
+}
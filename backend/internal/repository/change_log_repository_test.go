@@ -0,0 +1,57 @@
+package repository
+
+import (
+	"testing"
+
+	"shosha-finance/internal/models"
+
+	"github.com/google/uuid"
+)
+
+func TestChangeLogRequeue(t *testing.T) {
+	rejected, other := uuid.New(), uuid.New()
+
+	tests := []struct {
+		name    string
+		later   uuid.UUID // entity of the change queued after the rejected one
+		wantIDs []uuid.UUID
+	}{
+		{"moves the change behind the queue", other, []uuid.UUID{other, rejected}},
+		{"drops a change a later one supersedes", rejected, []uuid.UUID{rejected}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newTestDB(t)
+			first := models.ChangeLog{EntityType: models.EntityTransaction, EntityID: rejected, Operation: models.ChangeUpdate, Payload: "{}"}
+			later := models.ChangeLog{EntityType: models.EntityTransaction, EntityID: tt.later, Operation: models.ChangeUpdate, Payload: "{}"}
+			for _, entry := range []*models.ChangeLog{&first, &later} {
+				if err := db.Create(entry).Error; err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			repo := NewChangeLogRepository(db)
+			if err := repo.Requeue(first.Seq); err != nil {
+				t.Fatalf("Requeue() error = %v", err)
+			}
+
+			pending, err := repo.FindPending(10, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(pending) != len(tt.wantIDs) {
+				t.Fatalf("pending = %+v, want %v", pending, tt.wantIDs)
+			}
+			for i, id := range tt.wantIDs {
+				if pending[i].EntityID != id {
+					t.Errorf("pending[%d] = %v, want %v", i, pending[i].EntityID, id)
+				}
+			}
+			// The superseded change is gone; only the later one remains
+			if tt.later == rejected && pending[0].Seq != later.Seq {
+				t.Errorf("pending seq = %d, want %d", pending[0].Seq, later.Seq)
+			}
+		})
+	}
+}
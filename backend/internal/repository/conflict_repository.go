@@ -0,0 +1,329 @@
+package repository
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"shosha-finance/internal/models"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+)
+
+type ConflictRepository interface {
+	FindByID(id uuid.UUID) (*models.SyncConflict, error)
+	FindAll(filter *ConflictFilter) ([]models.SyncConflict, error)
+	CountOpen() (int64, error)
+	ApplyCloudVersion(entityType string, record models.Versioned) (*models.SyncConflict, error)
+	Resolve(conflict *models.SyncConflict, winner models.ConflictSide, userID uuid.UUID) error
+}
+
+type ConflictFilter struct {
+	Status     models.ConflictStatus
+	EntityType string
+	Limit      int
+}
+
+type conflictRepository struct {
+	db   *gorm.DB
+	opts Options
+}
+
+func NewConflictRepository(db *gorm.DB, opts Options) ConflictRepository {
+	return &conflictRepository{db: db, opts: opts}
+}
+
+func (r *conflictRepository) FindByID(id uuid.UUID) (*models.SyncConflict, error) {
+	var conflict models.SyncConflict
+	err := r.db.Where("id = ?", id).First(&conflict).Error
+	if err != nil {
+		return nil, err
+	}
+	return &conflict, nil
+}
+
+func (r *conflictRepository) FindAll(filter *ConflictFilter) ([]models.SyncConflict, error) {
+	var conflicts []models.SyncConflict
+	query := r.db.Model(&models.SyncConflict{})
+	if filter.Status != "" {
+		query = query.Where("status = ?", filter.Status)
+	}
+	if filter.EntityType != "" {
+		query = query.Where("entity_type = ?", filter.EntityType)
+	}
+	err := query.Order("detected_at desc").Limit(filter.Limit).Find(&conflicts).Error
+	return conflicts, err
+}
+
+func (r *conflictRepository) CountOpen() (int64, error) {
+	var count int64
+	err := r.db.Model(&models.SyncConflict{}).Where("status = ?", models.ConflictOpen).Count(&count).Error
+	return count, err
+}
+
+// ApplyCloudVersion writes a record pulled from the cloud on a local
+// install. Records with no local changes waiting are simply stored. When
+// changes are waiting and the cloud copy has not moved since they were
+// made, the local version is kept and pushed as usual. Otherwise both sides
+// edited the record and its policy decides: a cloud win replaces the local
+// version and drops the waiting changes, a local win keeps them and rebases
+// them on the cloud version so the cloud applies them. Manual conflicts
+// keep the local version; the cloud records them when it is pushed. The
+// conflict settled here, if any, is returned.
+func (r *conflictRepository) ApplyCloudVersion(entityType string, record models.Versioned) (*models.SyncConflict, error) {
+	var settled *models.SyncConflict
+
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		id := syncedRecordID(record)
+
+		var oldest models.ChangeLog
+		err := tx.Where("entity_type = ? AND entity_id = ?", entityType, id).Order("seq asc").First(&oldest).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return upsertSynced(tx, record)
+		}
+		if err != nil {
+			return err
+		}
+		if !models.ConcurrentEdit(oldest.BaseVersion, record) {
+			return nil
+		}
+
+		current, err := findSynced(tx, entityType, id)
+		if err != nil {
+			return err
+		}
+		conflict, err := newConflict(entityType, id, models.ChangeUpdate, "", current.(models.Versioned), record)
+		if err != nil {
+			return err
+		}
+
+		switch conflict.Winner {
+		case models.ConflictSideCloud:
+			if err := tx.Where("entity_type = ? AND entity_id = ?", entityType, id).Delete(&models.ChangeLog{}).Error; err != nil {
+				return err
+			}
+			if err := upsertSynced(tx, record); err != nil {
+				return err
+			}
+		case models.ConflictSideLocal:
+			err := tx.Model(&models.ChangeLog{}).
+				Where("entity_type = ? AND entity_id = ? AND base_version < ?", entityType, id, record.Version()).
+				Update("base_version", record.Version()).Error
+			if err != nil {
+				return err
+			}
+		default:
+			return nil
+		}
+
+		if err := tx.Create(conflict).Error; err != nil {
+			return err
+		}
+		settled = conflict
+		return nil
+	})
+
+	return settled, err
+}
+
+// Resolve settles a conflict on the given side, overriding a decision made
+// by policy if need be. When the winning version is not the one stored
+// here it is written back: on a local install the cloud version replaces
+// any waiting changes, while a local version is stamped as the newest write
+// and queued again without a base so the cloud takes it as is. On the cloud
+// the winner is stamped as the newest write so devices pull it.
+func (r *conflictRepository) Resolve(conflict *models.SyncConflict, winner models.ConflictSide, userID uuid.UUID) error {
+	here := models.ConflictSideCloud
+	if r.opts.ChangeLog {
+		here = models.ConflictSideLocal
+	}
+	stored := conflict.Winner
+	if stored == "" {
+		stored = here
+	}
+
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		if winner != stored {
+			payload := conflict.CloudPayload
+			if winner == models.ConflictSideLocal {
+				payload = conflict.LocalPayload
+			}
+			change := models.SyncChange{
+				EntityType: conflict.EntityType,
+				EntityID:   conflict.EntityID,
+				Operation:  models.ChangeUpdate,
+				Payload:    json.RawMessage(payload),
+			}
+			if winner == models.ConflictSideLocal && conflict.Operation == models.ChangeDelete {
+				change.Operation = models.ChangeDelete
+			}
+			record, err := change.DecodeRecord()
+			if err != nil {
+				return err
+			}
+			if err := applyChange(tx, &change, record); err != nil {
+				return err
+			}
+
+			switch {
+			case here == models.ConflictSideCloud:
+				err = touch(tx, conflict.EntityType, conflict.EntityID)
+			case winner == models.ConflictSideCloud:
+				err = tx.Where("entity_type = ? AND entity_id = ?", conflict.EntityType, conflict.EntityID).Delete(&models.ChangeLog{}).Error
+				var model interface{}
+				if err == nil {
+					model, err = syncedModel(conflict.EntityType)
+				}
+				if err == nil {
+					err = tx.Model(model).Where("id = ?", conflict.EntityID).
+						UpdateColumns(map[string]interface{}{"is_synced": true, "synced_at": time.Now()}).Error
+				}
+			default:
+				err = touch(tx, conflict.EntityType, conflict.EntityID)
+				if err == nil {
+					err = enqueueSnapshot(tx, conflict.EntityType, conflict.EntityID)
+				}
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		now := time.Now()
+		conflict.Status = models.ConflictResolved
+		conflict.Winner = winner
+		conflict.ResolvedAt = &now
+		conflict.ResolvedBy = &userID
+		return tx.Save(conflict).Error
+	})
+}
+
+// settleConflict checks a pushed update against the cloud's copy. When the
+// copy changed after the version the device edited, the entity's policy is
+// applied and the conflict recorded. Deletes carry no base version, so they
+// only meet the policy of entities whose cloud copy always wins: the delete
+// is dropped and recorded as a conflict. It reports whether the pushed
+// record should be written.
+func settleConflict(tx *gorm.DB, deviceID string, change *models.SyncChange, record interface{}) (bool, error) {
+	var local models.Versioned
+	switch change.Operation {
+	case models.ChangeUpdate:
+		versioned, ok := record.(models.Versioned)
+		if !ok {
+			return true, nil
+		}
+		local = versioned
+	case models.ChangeDelete:
+		if models.ConflictPolicyFor(change.EntityType) != models.ConflictCloudWins {
+			return true, nil
+		}
+		tombstone, ok := record.(*models.Tombstone)
+		if !ok {
+			tombstone = &models.Tombstone{EntityType: change.EntityType, EntityID: change.EntityID}
+		}
+		local = tombstone
+	default:
+		return true, nil
+	}
+
+	current, err := findSynced(tx, change.EntityType, change.EntityID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	cloud := current.(models.Versioned)
+	switch change.Operation {
+	case models.ChangeUpdate:
+		if !models.ConcurrentEdit(change.BaseVersion, cloud) {
+			return true, nil
+		}
+	case models.ChangeDelete:
+		// Deleted on the cloud as well; there is nothing to keep
+		if branch, ok := current.(*models.Branch); ok && branch.DeletedAt.Valid {
+			return true, nil
+		}
+	}
+
+	conflict, err := newConflict(change.EntityType, change.EntityID, change.Operation, deviceID, local, cloud)
+	if err != nil {
+		return false, err
+	}
+	if err := tx.Create(conflict).Error; err != nil {
+		return false, err
+	}
+	if conflict.Winner == models.ConflictSideCloud {
+		// Restamp the cloud version so the device pulls it back
+		if err := touch(tx, change.EntityType, change.EntityID); err != nil {
+			return false, err
+		}
+	}
+
+	log.Warn().
+		Str("entity_type", conflict.EntityType).
+		Str("entity_id", conflict.EntityID.String()).
+		Str("device_id", deviceID).
+		Str("policy", string(conflict.Policy)).
+		Str("winner", string(conflict.Winner)).
+		Msg("Sync conflict detected")
+
+	return conflict.Winner == models.ConflictSideLocal, nil
+}
+
+// newConflict settles a conflict by the entity's policy and returns the
+// record of it; manual conflicts are left open.
+func newConflict(entityType string, id uuid.UUID, op models.ChangeOperation, deviceID string, local, cloud models.Versioned) (*models.SyncConflict, error) {
+	localData, err := json.Marshal(local)
+	if err != nil {
+		return nil, err
+	}
+	cloudData, err := json.Marshal(cloud)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	policy := models.ConflictPolicyFor(entityType)
+	conflict := &models.SyncConflict{
+		EntityType:   entityType,
+		EntityID:     id,
+		Operation:    op,
+		DeviceID:     deviceID,
+		Policy:       policy,
+		Status:       models.ConflictOpen,
+		Winner:       policy.Settle(local, cloud),
+		LocalPayload: string(localData),
+		CloudPayload: string(cloudData),
+		LocalVersion: local.Version(),
+		CloudVersion: cloud.Version(),
+		DetectedAt:   now,
+	}
+	if conflict.Winner != "" {
+		conflict.Status = models.ConflictResolved
+		conflict.ResolvedAt = &now
+	}
+	return conflict, nil
+}
+
+func syncedRecordID(record interface{}) uuid.UUID {
+	switch rec := record.(type) {
+	case *models.Branch:
+		return rec.ID
+	case *models.Transaction:
+		return rec.ID
+	case *models.Shift:
+		return rec.ID
+	case *models.CashReconciliation:
+		return rec.ID
+	}
+	return uuid.Nil
+}
+
+// upsertSynced writes a record received from the cloud without logging it.
+func upsertSynced(tx *gorm.DB, record interface{}) error {
+	change := models.SyncChange{Operation: models.ChangeUpdate}
+	return applyChange(tx, &change, record)
+}
@@ -0,0 +1,134 @@
+package repository
+
+import (
+	"time"
+
+	"shosha-finance/internal/models"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+type DeviceRepository interface {
+	FindByID(id string) (*models.Device, error)
+	FindAll() ([]models.Device, error)
+	UpdateScope(device *models.Device, branchIDs []uuid.UUID) error
+	Update(device *models.Device) error
+	MarkSeen(id, appVersion string, at time.Time) error
+	SetProtocol(id string, version int) error
+	UpdateSyncHealth(id string, columns map[string]interface{}) error
+	CreateEnrollmentCode(code *models.EnrollmentCode) error
+	FindEnrollmentCode(code string) (*models.EnrollmentCode, error)
+	FindEnrollmentCodes() ([]models.EnrollmentCode, error)
+	Enroll(code *models.EnrollmentCode, device *models.Device) error
+}
+
+type deviceRepository struct {
+	db *gorm.DB
+}
+
+func NewDeviceRepository(db *gorm.DB) DeviceRepository {
+	return &deviceRepository{db: db}
+}
+
+func (r *deviceRepository) FindByID(id string) (*models.Device, error) {
+	var device models.Device
+	err := r.db.Preload("Branches").Where("id = ?", id).First(&device).Error
+	if err != nil {
+		return nil, err
+	}
+	return &device, nil
+}
+
+func (r *deviceRepository) FindAll() ([]models.Device, error) {
+	var devices []models.Device
+	err := r.db.Preload("Branches").Order("created_at asc").Find(&devices).Error
+	return devices, err
+}
+
+// UpdateScope saves the device and replaces its branch assignments.
+func (r *deviceRepository) UpdateScope(device *models.Device, branchIDs []uuid.UUID) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Omit("Branches").Save(device).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("device_id = ?", device.ID).Delete(&models.DeviceBranch{}).Error; err != nil {
+			return err
+		}
+
+		device.Branches = make([]models.DeviceBranch, 0, len(branchIDs))
+		for _, branchID := range branchIDs {
+			device.Branches = append(device.Branches, models.DeviceBranch{DeviceID: device.ID, BranchID: branchID})
+		}
+		if len(device.Branches) == 0 {
+			return nil
+		}
+		return tx.Create(&device.Branches).Error
+	})
+}
+
+func (r *deviceRepository) Update(device *models.Device) error {
+	return r.db.Omit("Branches").Save(device).Error
+}
+
+// MarkSeen records a request from the device without touching updated_at.
+func (r *deviceRepository) MarkSeen(id, appVersion string, at time.Time) error {
+	columns := map[string]interface{}{"last_seen_at": at}
+	if appVersion != "" {
+		columns["app_version"] = appVersion
+	}
+	return r.db.Model(&models.Device{}).Where("id = ?", id).UpdateColumns(columns).Error
+}
+
+// SetProtocol records the sync protocol version agreed with the device.
+func (r *deviceRepository) SetProtocol(id string, version int) error {
+	return r.db.Model(&models.Device{}).Where("id = ?", id).UpdateColumn("protocol_version", version).Error
+}
+
+// UpdateSyncHealth records sync activity of the device without touching
+// updated_at.
+func (r *deviceRepository) UpdateSyncHealth(id string, columns map[string]interface{}) error {
+	return r.db.Model(&models.Device{}).Where("id = ?", id).UpdateColumns(columns).Error
+}
+
+func (r *deviceRepository) CreateEnrollmentCode(code *models.EnrollmentCode) error {
+	return r.db.Create(code).Error
+}
+
+func (r *deviceRepository) FindEnrollmentCode(code string) (*models.EnrollmentCode, error) {
+	var enrollment models.EnrollmentCode
+	err := r.db.Where("code = ?", code).First(&enrollment).Error
+	if err != nil {
+		return nil, err
+	}
+	return &enrollment, nil
+}
+
+func (r *deviceRepository) FindEnrollmentCodes() ([]models.EnrollmentCode, error) {
+	var codes []models.EnrollmentCode
+	err := r.db.Order("created_at desc").Find(&codes).Error
+	return codes, err
+}
+
+// Enroll redeems the code and registers the device with the code's branch
+// in one transaction, so a code can only ever enroll one device.
+func (r *deviceRepository) Enroll(code *models.EnrollmentCode, device *models.Device) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		result := tx.Model(&models.EnrollmentCode{}).
+			Where("id = ? AND used_at IS NULL", code.ID).
+			Updates(map[string]interface{}{"used_at": now, "device_id": device.ID})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			// Redeemed by a concurrent request
+			return gorm.ErrRecordNotFound
+		}
+		code.UsedAt = &now
+		code.DeviceID = &device.ID
+
+		device.Branches = []models.DeviceBranch{{DeviceID: device.ID, BranchID: code.BranchID}}
+		return tx.Create(device).Error
+	})
+}
@@ -0,0 +1,67 @@
+package repository
+
+import (
+	"reflect"
+
+	"shosha-finance/internal/events"
+	"shosha-finance/internal/models"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// EnableEvents publishes a TransactionsChanged event for every transaction
+// written through db, whichever service wrote it. Records received through
+// sync are left out; the sync code publishes one event per batch for them.
+// Events are sent when the statement runs, which may be before its DB
+// transaction commits, so they tell clients to refetch rather than carry
+// data.
+func EnableEvents(db *gorm.DB, broker *events.Broker) error {
+	publish := func(db *gorm.DB) {
+		publishTransactionWrite(db, broker)
+	}
+	if err := db.Callback().Create().After("gorm:create").Register("events:publish", publish); err != nil {
+		return err
+	}
+	return db.Callback().Update().After("gorm:update").Register("events:publish", publish)
+}
+
+var transactionType = reflect.TypeOf(models.Transaction{})
+
+func publishTransactionWrite(db *gorm.DB, broker *events.Broker) {
+	stmt := db.Statement
+	if db.Error != nil || db.RowsAffected == 0 || stmt.Schema == nil || stmt.Schema.ModelType != transactionType {
+		return
+	}
+	if received, ok := db.Get(hlcReceived); ok && received == true {
+		return
+	}
+	// UpdateColumn(s) calls only touch sync bookkeeping
+	if stmt.SkipHooks {
+		return
+	}
+
+	ids := []uuid.UUID{}
+	collect := func(rv reflect.Value) {
+		if tx, ok := rv.Addr().Interface().(*models.Transaction); ok && tx.ID != uuid.Nil {
+			ids = append(ids, tx.ID)
+		}
+	}
+	switch stmt.ReflectValue.Kind() {
+	case reflect.Struct:
+		if stmt.ReflectValue.CanAddr() {
+			collect(stmt.ReflectValue)
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < stmt.ReflectValue.Len(); i++ {
+			if rv := reflect.Indirect(stmt.ReflectValue.Index(i)); rv.CanAddr() {
+				collect(rv)
+			}
+		}
+	}
+
+	broker.Publish(events.TransactionsChanged, events.TransactionsChangedData{
+		Source:         events.SourceLocal,
+		TransactionIDs: ids,
+	})
+}
@@ -0,0 +1,111 @@
+package repository
+
+import (
+	"reflect"
+	"time"
+
+	"shosha-finance/internal/hlc"
+	"shosha-finance/internal/models"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// hlcReceived marks a statement that writes a record received through
+// sync; the record keeps the stamp it came with.
+const hlcReceived = "hlc:received"
+
+// EnableHLC stamps every create and update of a synced record with the
+// clock. Records received through sync keep their stamp and move the clock
+// past it instead. Before that the clock is moved past every stamp already
+// stored, and rows written before stamps existed are given one so edits
+// can be settled against them.
+func EnableHLC(db *gorm.DB, c *hlc.Clock) error {
+	for _, model := range stampedModels() {
+		var latest hlc.Timestamp
+		err := db.Unscoped().Model(model).Select("COALESCE(MAX(hlc), 0)").Scan(&latest).Error
+		if err != nil {
+			return err
+		}
+		c.Observe(latest)
+	}
+
+	for _, model := range stampedModels() {
+		err := db.Unscoped().Model(model).Where("hlc = ?", 0).UpdateColumn("hlc", c.Now()).Error
+		if err != nil {
+			return err
+		}
+	}
+
+	stamp := func(db *gorm.DB) {
+		stampHLC(db, c)
+	}
+	if err := db.Callback().Create().Before("gorm:create").Register("hlc:stamp", stamp); err != nil {
+		return err
+	}
+	return db.Callback().Update().Before("gorm:update").Register("hlc:stamp", stamp)
+}
+
+// stampedModels returns the models carrying an HLC stamp: the synced
+// entities and users, which only travel from the cloud to devices.
+func stampedModels() []interface{} {
+	stamped := []interface{}{&models.User{}}
+	for _, entityType := range syncedEntityTypes {
+		if model, err := syncedModel(entityType); err == nil {
+			stamped = append(stamped, model)
+		}
+	}
+	return stamped
+}
+
+// stampHLC sets the HLC of the records being written. UpdateColumn(s)
+// calls skip it, as they do for updated_at, since they only touch sync
+// bookkeeping.
+func stampHLC(db *gorm.DB, clock *hlc.Clock) {
+	stmt := db.Statement
+	if stmt.Schema == nil {
+		return
+	}
+	field := stmt.Schema.LookUpField("HLC")
+	if field == nil {
+		return
+	}
+
+	if received, ok := db.Get(hlcReceived); ok && received == true {
+		observe := func(rv reflect.Value) {
+			if value, zero := field.ValueOf(stmt.Context, rv); !zero {
+				clock.Observe(value.(hlc.Timestamp))
+			}
+		}
+		switch stmt.ReflectValue.Kind() {
+		case reflect.Struct:
+			observe(stmt.ReflectValue)
+		case reflect.Slice, reflect.Array:
+			for i := 0; i < stmt.ReflectValue.Len(); i++ {
+				observe(reflect.Indirect(stmt.ReflectValue.Index(i)))
+			}
+		}
+		return
+	}
+
+	if stmt.SkipHooks {
+		return
+	}
+	stmt.SetColumn("HLC", clock.Now(), true)
+}
+
+// receivedWrite marks writes on the returned session as records received
+// through sync.
+func receivedWrite(db *gorm.DB) *gorm.DB {
+	return db.Set(hlcReceived, true)
+}
+
+// touch marks a synced record as changed without altering its data, so
+// devices pull it again.
+func touch(tx *gorm.DB, entityType string, id uuid.UUID) error {
+	model, err := syncedModel(entityType)
+	if err != nil {
+		return err
+	}
+	return tx.Unscoped().Model(model).Where("id = ?", id).Update("updated_at", time.Now()).Error
+}
@@ -0,0 +1,56 @@
+package repository
+
+import (
+	"time"
+
+	"shosha-finance/internal/models"
+
+	"gorm.io/gorm"
+)
+
+type IdempotencyRepository interface {
+	Create(record *models.IdempotencyKey) error
+	FindByKey(key string) (*models.IdempotencyKey, error)
+	Complete(key string, statusCode int, body string) error
+	Delete(key string) error
+	DeleteOlderThan(cutoff time.Time) (int64, error)
+}
+
+type idempotencyRepository struct {
+	db *gorm.DB
+}
+
+func NewIdempotencyRepository(db *gorm.DB) IdempotencyRepository {
+	return &idempotencyRepository{db: db}
+}
+
+func (r *idempotencyRepository) Create(record *models.IdempotencyKey) error {
+	return r.db.Create(record).Error
+}
+
+func (r *idempotencyRepository) FindByKey(key string) (*models.IdempotencyKey, error) {
+	var record models.IdempotencyKey
+	err := r.db.Where("idempotency_key = ?", key).First(&record).Error
+	if err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+func (r *idempotencyRepository) Complete(key string, statusCode int, body string) error {
+	return r.db.Model(&models.IdempotencyKey{}).
+		Where("idempotency_key = ?", key).
+		Updates(map[string]interface{}{
+			"status_code":   statusCode,
+			"response_body": body,
+		}).Error
+}
+
+func (r *idempotencyRepository) Delete(key string) error {
+	return r.db.Where("idempotency_key = ?", key).Delete(&models.IdempotencyKey{}).Error
+}
+
+func (r *idempotencyRepository) DeleteOlderThan(cutoff time.Time) (int64, error) {
+	result := r.db.Where("created_at < ?", cutoff).Delete(&models.IdempotencyKey{})
+	return result.RowsAffected, result.Error
+}
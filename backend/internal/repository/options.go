@@ -0,0 +1,27 @@
+package repository
+
+import (
+	"shosha-finance/internal/hlc"
+)
+
+// Options set what the repositories do besides reading and writing their
+// own tables. Each app builds one in main and passes it to the
+// repositories that need it.
+type Options struct {
+	// ChangeLog records every write to a synced entity in the change log.
+	// Only the local app keeps one; the cloud has no outbox to drain.
+	ChangeLog bool
+	// Clock is moved past the stamps of deletes received through sync, so
+	// later writes are ordered after them. See EnableHLC.
+	Clock *hlc.Clock
+	// Scope limits list and report queries to the branches the install
+	// pulls. It is nil on the cloud, where nothing is hidden.
+	Scope *BranchScope
+}
+
+// observe moves the clock past a stamp received through sync.
+func (o Options) observe(ts hlc.Timestamp) {
+	if o.Clock != nil {
+		o.Clock.Observe(ts)
+	}
+}
@@ -0,0 +1,93 @@
+package repository
+
+import (
+	"time"
+
+	"shosha-finance/internal/models"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+type ReconciliationRepository interface {
+	Create(rec *models.CashReconciliation, adjustment *models.Transaction) error
+	FindByID(id uuid.UUID) (*models.CashReconciliation, error)
+	FindAll(filter *ReconciliationFilter) ([]models.CashReconciliation, error)
+	Upsert(rec *models.CashReconciliation) error
+}
+
+type ReconciliationFilter struct {
+	BranchID  *uuid.UUID
+	StartDate *time.Time
+	EndDate   *time.Time
+}
+
+type reconciliationRepository struct {
+	db   *gorm.DB
+	opts Options
+}
+
+func NewReconciliationRepository(db *gorm.DB, opts Options) ReconciliationRepository {
+	return &reconciliationRepository{db: db, opts: opts}
+}
+
+// Create stores the reconciliation and, when given, the adjustment
+// transaction in a single DB transaction.
+func (r *reconciliationRepository) Create(rec *models.CashReconciliation, adjustment *models.Transaction) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		if adjustment != nil {
+			if err := tx.Create(adjustment).Error; err != nil {
+				return err
+			}
+			if err := r.opts.recordChange(tx, models.EntityTransaction, models.ChangeCreate, adjustment.ID, adjustment); err != nil {
+				return err
+			}
+			rec.AdjustmentTxID = &adjustment.ID
+		}
+		if err := tx.Create(rec).Error; err != nil {
+			return err
+		}
+		return r.opts.recordChange(tx, models.EntityReconciliation, models.ChangeCreate, rec.ID, rec)
+	})
+}
+
+func (r *reconciliationRepository) FindByID(id uuid.UUID) (*models.CashReconciliation, error) {
+	var rec models.CashReconciliation
+	err := r.db.Where("id = ?", id).First(&rec).Error
+	if err != nil {
+		return nil, err
+	}
+	return &rec, nil
+}
+
+func (r *reconciliationRepository) applyFilter(query *gorm.DB, filter *ReconciliationFilter) *gorm.DB {
+	query = query.Scopes(r.opts.Scope.filter("branch_id"))
+	if filter == nil {
+		return query
+	}
+	if filter.BranchID != nil {
+		query = query.Where("branch_id = ?", *filter.BranchID)
+	}
+	if filter.StartDate != nil {
+		query = query.Where("reconciled_at >= ?", *filter.StartDate)
+	}
+	if filter.EndDate != nil {
+		query = query.Where("reconciled_at < ?", *filter.EndDate)
+	}
+	return query
+}
+
+func (r *reconciliationRepository) FindAll(filter *ReconciliationFilter) ([]models.CashReconciliation, error) {
+	var recs []models.CashReconciliation
+	query := r.applyFilter(r.db.Model(&models.CashReconciliation{}), filter)
+	err := query.Order("reconciled_at desc").Find(&recs).Error
+	return recs, err
+}
+
+func (r *reconciliationRepository) Upsert(rec *models.CashReconciliation) error {
+	return upsertReconciliation(r.db, rec)
+}
+
+func upsertReconciliation(db *gorm.DB, rec *models.CashReconciliation) error {
+	return upsertReceived(db, rec)
+}
@@ -0,0 +1,73 @@
+package repository
+
+import (
+	"time"
+
+	"shosha-finance/internal/models"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+type RecurringRepository interface {
+	Create(rec *models.RecurringTransaction) error
+	FindByID(id uuid.UUID) (*models.RecurringTransaction, error)
+	FindAll() ([]models.RecurringTransaction, error)
+	FindDue(now time.Time) ([]models.RecurringTransaction, error)
+	Update(rec *models.RecurringTransaction) error
+	Materialize(rec *models.RecurringTransaction, tx *models.Transaction) error
+}
+
+type recurringRepository struct {
+	db   *gorm.DB
+	opts Options
+}
+
+func NewRecurringRepository(db *gorm.DB, opts Options) RecurringRepository {
+	return &recurringRepository{db: db, opts: opts}
+}
+
+func (r *recurringRepository) Create(rec *models.RecurringTransaction) error {
+	return r.db.Create(rec).Error
+}
+
+func (r *recurringRepository) FindByID(id uuid.UUID) (*models.RecurringTransaction, error) {
+	var rec models.RecurringTransaction
+	err := r.db.Where("id = ?", id).First(&rec).Error
+	if err != nil {
+		return nil, err
+	}
+	return &rec, nil
+}
+
+func (r *recurringRepository) FindAll() ([]models.RecurringTransaction, error) {
+	var recs []models.RecurringTransaction
+	err := r.db.Order("next_run_at asc").Find(&recs).Error
+	return recs, err
+}
+
+func (r *recurringRepository) FindDue(now time.Time) ([]models.RecurringTransaction, error) {
+	var recs []models.RecurringTransaction
+	err := r.db.Where("is_active = ? AND next_run_at <= ?", true, now).
+		Order("next_run_at asc").
+		Find(&recs).Error
+	return recs, err
+}
+
+func (r *recurringRepository) Update(rec *models.RecurringTransaction) error {
+	return r.db.Save(rec).Error
+}
+
+// Materialize inserts the generated transaction and advances the template in
+// a single DB transaction, so a crash never produces an occurrence twice.
+func (r *recurringRepository) Materialize(rec *models.RecurringTransaction, tx *models.Transaction) error {
+	return r.db.Transaction(func(dbTx *gorm.DB) error {
+		if err := dbTx.Create(tx).Error; err != nil {
+			return err
+		}
+		if err := r.opts.recordChange(dbTx, models.EntityTransaction, models.ChangeCreate, tx.ID, tx); err != nil {
+			return err
+		}
+		return dbTx.Save(rec).Error
+	})
+}
@@ -0,0 +1,98 @@
+package repository
+
+import (
+	"shosha-finance/internal/models"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+type SettingRepository interface {
+	FindByID(id uuid.UUID) (*models.Setting, error)
+	FindAll(filter *SettingFilter) ([]models.Setting, error)
+	FindByScope(key string, scope models.SettingScope, scopeID string) (*models.Setting, error)
+	FindForDevice(deviceID string, branchIDs []string) ([]models.Setting, error)
+	Create(setting *models.Setting) error
+	Update(setting *models.Setting) error
+	Delete(id uuid.UUID) error
+}
+
+type SettingFilter struct {
+	Key     string
+	Scope   models.SettingScope
+	ScopeID string
+}
+
+type settingRepository struct {
+	db *gorm.DB
+}
+
+func NewSettingRepository(db *gorm.DB) SettingRepository {
+	return &settingRepository{db: db}
+}
+
+func (r *settingRepository) FindByID(id uuid.UUID) (*models.Setting, error) {
+	var setting models.Setting
+	err := r.db.Where("id = ?", id).First(&setting).Error
+	if err != nil {
+		return nil, err
+	}
+	return &setting, nil
+}
+
+func (r *settingRepository) FindAll(filter *SettingFilter) ([]models.Setting, error) {
+	var settings []models.Setting
+	query := r.db.Model(&models.Setting{})
+	if filter.Key != "" {
+		query = query.Where("key = ?", filter.Key)
+	}
+	if filter.Scope != "" {
+		query = query.Where("scope = ?", filter.Scope)
+	}
+	if filter.ScopeID != "" {
+		query = query.Where("scope_id = ?", filter.ScopeID)
+	}
+	err := query.Order("key asc, scope asc, scope_id asc").Find(&settings).Error
+	return settings, err
+}
+
+func (r *settingRepository) FindByScope(key string, scope models.SettingScope, scopeID string) (*models.Setting, error) {
+	var setting models.Setting
+	err := r.db.Where("key = ? AND scope = ? AND scope_id = ?", key, scope, scopeID).First(&setting).Error
+	if err != nil {
+		return nil, err
+	}
+	return &setting, nil
+}
+
+// FindForDevice returns the global settings and those set for the device
+// or any of the given branches.
+func (r *settingRepository) FindForDevice(deviceID string, branchIDs []string) ([]models.Setting, error) {
+	var settings []models.Setting
+	query := r.db.Where("scope = ?", models.SettingScopeGlobal).
+		Or("scope = ? AND scope_id = ?", models.SettingScopeDevice, deviceID)
+	if len(branchIDs) > 0 {
+		query = query.Or("scope = ? AND scope_id IN ?", models.SettingScopeBranch, branchIDs)
+	}
+	err := query.Order("key asc").Find(&settings).Error
+	return settings, err
+}
+
+func (r *settingRepository) Create(setting *models.Setting) error {
+	return r.db.Create(setting).Error
+}
+
+func (r *settingRepository) Update(setting *models.Setting) error {
+	return r.db.Save(setting).Error
+}
+
+func (r *settingRepository) Delete(id uuid.UUID) error {
+	result := r.db.Where("id = ?", id).Delete(&models.Setting{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
@@ -0,0 +1,172 @@
+package repository
+
+import (
+	"errors"
+
+	"shosha-finance/internal/models"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+type ShiftRepository interface {
+	Create(shift *models.Shift) error
+	FindByID(id uuid.UUID) (*models.Shift, error)
+	FindOpenByBranch(branchID uuid.UUID) (*models.Shift, error)
+	FindAll(filter *ShiftFilter) ([]models.Shift, error)
+	Close(shift *models.Shift) error
+	GetTotals(shiftID uuid.UUID) (*ShiftTotals, error)
+	Upsert(shift *models.Shift) error
+}
+
+type ShiftFilter struct {
+	BranchID *uuid.UUID
+	Status   models.ShiftStatus
+}
+
+type ShiftTotals struct {
+	TotalIn  int64
+	TotalOut int64
+	CountIn  int64
+	CountOut int64
+}
+
+type shiftRepository struct {
+	db   *gorm.DB
+	opts Options
+}
+
+func NewShiftRepository(db *gorm.DB, opts Options) ShiftRepository {
+	return &shiftRepository{db: db, opts: opts}
+}
+
+func (r *shiftRepository) Create(shift *models.Shift) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(shift).Error; err != nil {
+			return err
+		}
+		return r.opts.recordChange(tx, models.EntityShift, models.ChangeCreate, shift.ID, shift)
+	})
+}
+
+func (r *shiftRepository) FindByID(id uuid.UUID) (*models.Shift, error) {
+	var shift models.Shift
+	err := r.db.Preload("Denominations").Where("id = ?", id).First(&shift).Error
+	if err != nil {
+		return nil, err
+	}
+	return &shift, nil
+}
+
+func (r *shiftRepository) FindOpenByBranch(branchID uuid.UUID) (*models.Shift, error) {
+	var shift models.Shift
+	err := r.db.Where("branch_id = ? AND status = ?", branchID, models.ShiftStatusOpen).
+		Order("opened_at desc").
+		First(&shift).Error
+	if err != nil {
+		return nil, err
+	}
+	return &shift, nil
+}
+
+func (r *shiftRepository) FindAll(filter *ShiftFilter) ([]models.Shift, error) {
+	var shifts []models.Shift
+	query := r.db.Model(&models.Shift{}).Scopes(r.opts.Scope.filter("branch_id"))
+	if filter != nil {
+		if filter.BranchID != nil {
+			query = query.Where("branch_id = ?", *filter.BranchID)
+		}
+		if filter.Status != "" {
+			query = query.Where("status = ?", filter.Status)
+		}
+	}
+	err := query.Order("opened_at desc").Find(&shifts).Error
+	return shifts, err
+}
+
+// Close saves the closed shift together with its denomination counts.
+func (r *shiftRepository) Close(shift *models.Shift) error {
+	base := shift.HLC
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Omit("Denominations").Save(shift).Error; err != nil {
+			return err
+		}
+		for i := range shift.Denominations {
+			shift.Denominations[i].ShiftID = shift.ID
+		}
+		if len(shift.Denominations) > 0 {
+			if err := tx.Create(&shift.Denominations).Error; err != nil {
+				return err
+			}
+		}
+		return r.opts.recordUpdate(tx, models.EntityShift, shift.ID, shift, base)
+	})
+}
+
+func (r *shiftRepository) GetTotals(shiftID uuid.UUID) (*ShiftTotals, error) {
+	var rows []struct {
+		Type  models.TransactionType
+		Total int64
+		Count int64
+	}
+
+	err := r.db.Model(&models.Transaction{}).
+		Select("type, COALESCE(SUM(amount), 0) AS total, COUNT(*) AS count").
+		Where("shift_id = ?", shiftID).
+		Group("type").
+		Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+
+	totals := &ShiftTotals{}
+	for _, row := range rows {
+		switch row.Type {
+		case models.TransactionTypeIN:
+			totals.TotalIn = row.Total
+			totals.CountIn = row.Count
+		case models.TransactionTypeOUT:
+			totals.TotalOut = row.Total
+			totals.CountOut = row.Count
+		}
+	}
+
+	return totals, nil
+}
+
+// Upsert replaces the shift and its denomination counts with the given copy.
+func (r *shiftRepository) Upsert(shift *models.Shift) error {
+	return upsertShift(r.db, shift)
+}
+
+// upsertShift writes a shift received through sync. An open shift is
+// refused while another shift of its branch is open, as a device pushing
+// one opened alongside another device's would be.
+func upsertShift(db *gorm.DB, shift *models.Shift) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if shift.Status == models.ShiftStatusOpen {
+			var open int64
+			err := tx.Model(&models.Shift{}).
+				Where("branch_id = ? AND status = ? AND id <> ?", shift.BranchID, models.ShiftStatusOpen, shift.ID).
+				Count(&open).Error
+			if err != nil {
+				return err
+			}
+			if open > 0 {
+				return errors.New("branch already has an open shift")
+			}
+		}
+
+		if err := upsertReceived(tx, shift, "Denominations"); err != nil {
+			return err
+		}
+
+		if err := tx.Where("shift_id = ?", shift.ID).Delete(&models.ShiftDenomination{}).Error; err != nil {
+			return err
+		}
+		if len(shift.Denominations) == 0 {
+			return nil
+		}
+		return tx.Create(&shift.Denominations).Error
+	})
+}
@@ -0,0 +1,109 @@
+package repository
+
+import (
+	"errors"
+	"time"
+
+	"shosha-finance/internal/models"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+type SyncErrorRepository interface {
+	RecordFailure(entityType string, entityID uuid.UUID, reason string, maxAttempts int) (*models.SyncError, error)
+	ResolveEntities(entityType string, entityIDs []uuid.UUID) error
+	FindByID(id uuid.UUID) (*models.SyncError, error)
+	FindAll(status models.SyncErrorStatus) ([]models.SyncError, error)
+	CountOpen() (int64, error)
+	Update(syncErr *models.SyncError) error
+}
+
+type syncErrorRepository struct {
+	db *gorm.DB
+}
+
+func NewSyncErrorRepository(db *gorm.DB) SyncErrorRepository {
+	return &syncErrorRepository{db: db}
+}
+
+// RecordFailure registers one more failed attempt for the entity and
+// quarantines it once maxAttempts is reached. A previously resolved error is
+// reopened with a fresh attempt count.
+func (r *syncErrorRepository) RecordFailure(entityType string, entityID uuid.UUID, reason string, maxAttempts int) (*models.SyncError, error) {
+	now := time.Now()
+
+	var syncErr models.SyncError
+	err := r.db.Where("entity_type = ? AND entity_id = ?", entityType, entityID).First(&syncErr).Error
+	if err != nil {
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, err
+		}
+		syncErr = models.SyncError{
+			EntityType:    entityType,
+			EntityID:      entityID,
+			FirstFailedAt: now,
+		}
+	}
+
+	if syncErr.Status == models.SyncErrorResolved {
+		syncErr.Attempts = 0
+		syncErr.FirstFailedAt = now
+		syncErr.ResolvedAt = nil
+	}
+
+	syncErr.Attempts++
+	syncErr.Reason = reason
+	syncErr.LastFailedAt = now
+	syncErr.Status = models.SyncErrorPending
+	if syncErr.Attempts >= maxAttempts {
+		syncErr.Status = models.SyncErrorQuarantined
+	}
+
+	if err := r.db.Save(&syncErr).Error; err != nil {
+		return nil, err
+	}
+	return &syncErr, nil
+}
+
+// ResolveEntities closes open errors for entities the cloud has accepted.
+func (r *syncErrorRepository) ResolveEntities(entityType string, entityIDs []uuid.UUID) error {
+	if len(entityIDs) == 0 {
+		return nil
+	}
+	return r.db.Model(&models.SyncError{}).
+		Where("entity_type = ? AND entity_id IN ? AND status <> ?", entityType, entityIDs, models.SyncErrorResolved).
+		Updates(map[string]interface{}{
+			"status":      models.SyncErrorResolved,
+			"resolved_at": time.Now(),
+		}).Error
+}
+
+func (r *syncErrorRepository) FindByID(id uuid.UUID) (*models.SyncError, error) {
+	var syncErr models.SyncError
+	err := r.db.Where("id = ?", id).First(&syncErr).Error
+	if err != nil {
+		return nil, err
+	}
+	return &syncErr, nil
+}
+
+func (r *syncErrorRepository) FindAll(status models.SyncErrorStatus) ([]models.SyncError, error) {
+	var syncErrs []models.SyncError
+	query := r.db.Model(&models.SyncError{})
+	if status != "" {
+		query = query.Where("status = ?", status)
+	}
+	err := query.Order("last_failed_at desc").Find(&syncErrs).Error
+	return syncErrs, err
+}
+
+func (r *syncErrorRepository) CountOpen() (int64, error) {
+	var count int64
+	err := r.db.Model(&models.SyncError{}).Where("status <> ?", models.SyncErrorResolved).Count(&count).Error
+	return count, err
+}
+
+func (r *syncErrorRepository) Update(syncErr *models.SyncError) error {
+	return r.db.Save(syncErr).Error
+}
@@ -0,0 +1,496 @@
+package repository
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"time"
+
+	"shosha-finance/internal/models"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// syncSavePoint marks the start of the record being applied so a failing
+// record can be undone without aborting the whole batch.
+const syncSavePoint = "sync_record"
+
+type SyncRepository interface {
+	ApplyPush(batch *models.SyncPushBatch, scope *models.BranchScope, validate ChangeValidator, result *models.SyncPushResult, receipt *models.SyncBatch) error
+	ApplyPushStream(batch *models.SyncPushBatch, scope *models.BranchScope, next ChangeSource, validate ChangeValidator, result *models.SyncPushResult, receipt *models.SyncBatch) error
+	FindBatch(id uuid.UUID) (*models.SyncBatch, error)
+	MarkReplayed(receipt *models.SyncBatch) error
+	FindBatches(filter *SyncBatchFilter) ([]models.SyncBatch, error)
+	Snapshot(scope *models.BranchScope) (*models.SyncSnapshot, error)
+	LoadSnapshot(snapshot *models.SyncSnapshot) error
+	LatestSeq() (uint64, error)
+}
+
+type SyncBatchFilter struct {
+	BranchID *uuid.UUID
+	DeviceID string
+	Limit    int
+}
+
+type syncRepository struct {
+	db   *gorm.DB
+	opts Options
+}
+
+func NewSyncRepository(db *gorm.DB, opts Options) SyncRepository {
+	return &syncRepository{db: db, opts: opts}
+}
+
+// ChangeValidator checks a decoded change before it is applied and returns
+// the reason for rejecting it, or an empty string.
+type ChangeValidator func(change *models.SyncChange, record interface{}) string
+
+// ChangeSource returns the next change of a push, or nil once there are no
+// more. Changes come in sequence order.
+type ChangeSource func() (*models.SyncChange, error)
+
+// ApplyPush writes a push batch in a single DB transaction. Change-log
+// entries are applied in sequence order, skipping those at or below the
+// device's cursor, and the cursor is moved past every change processed.
+// Updates made on a version the cloud has since changed are settled by the
+// entity's conflict policy and recorded as conflicts. Records of branches
+// outside the device's scope are rejected; for deletes, which carry no
+// branch, the branch of the stored row counts.
+// Record lists from older local apps are written branches first, then
+// transactions in creation order, shifts and reconciliations, so references
+// within the batch resolve. A record that fails is rolled back to its
+// savepoint and added to the rejections; any other error rolls back the
+// whole batch. The receipt, holding the final result, is written in the
+// same transaction so a batch is either applied and receipted or not at
+// all. The result is only meaningful when nil is returned, i.e. after
+// commit.
+func (r *syncRepository) ApplyPush(batch *models.SyncPushBatch, scope *models.BranchScope, validate ChangeValidator, result *models.SyncPushResult, receipt *models.SyncBatch) error {
+	sort.SliceStable(batch.Changes, func(i, j int) bool {
+		return batch.Changes[i].Seq < batch.Changes[j].Seq
+	})
+	sort.SliceStable(batch.Transactions, func(i, j int) bool {
+		return batch.Transactions[i].CreatedAt.Before(batch.Transactions[j].CreatedAt)
+	})
+
+	i := 0
+	next := func() (*models.SyncChange, error) {
+		if i == len(batch.Changes) {
+			return nil, nil
+		}
+		i++
+		return &batch.Changes[i-1], nil
+	}
+	return r.applyPush(batch, scope, next, validate, result, receipt)
+}
+
+// ApplyPushStream is ApplyPush for changes decoded one at a time from a
+// stream; only one change is held at once. An error from next rolls back
+// the whole batch.
+func (r *syncRepository) ApplyPushStream(batch *models.SyncPushBatch, scope *models.BranchScope, next ChangeSource, validate ChangeValidator, result *models.SyncPushResult, receipt *models.SyncBatch) error {
+	return r.applyPush(batch, scope, next, validate, result, receipt)
+}
+
+// outOfScope is the rejection reason for a record of a branch the device
+// is not assigned to.
+const outOfScope = "branch outside device scope"
+
+func (r *syncRepository) applyPush(batch *models.SyncPushBatch, scope *models.BranchScope, next ChangeSource, validate ChangeValidator, result *models.SyncPushResult, receipt *models.SyncBatch) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		knownBranches := map[uuid.UUID]bool{}
+		branchExists := func(id uuid.UUID) (bool, error) {
+			if exists, ok := knownBranches[id]; ok {
+				return exists, nil
+			}
+			var count int64
+			if err := tx.Model(&models.Branch{}).Where("id = ?", id).Count(&count).Error; err != nil {
+				return false, err
+			}
+			knownBranches[id] = count > 0
+			return count > 0, nil
+		}
+
+		// apply writes one record and returns why it was not stored, or an
+		// empty string. Only errors that should abort the batch are
+		// returned.
+		apply := func(branchID *uuid.UUID, write func() error) (string, error) {
+			if branchID != nil {
+				exists, err := branchExists(*branchID)
+				if err != nil {
+					return "", err
+				}
+				if !exists {
+					return "unknown branch", nil
+				}
+			}
+
+			if err := tx.SavePoint(syncSavePoint).Error; err != nil {
+				return "", err
+			}
+			if err := write(); err != nil {
+				if rbErr := tx.RollbackTo(syncSavePoint).Error; rbErr != nil {
+					return "", rbErr
+				}
+				return err.Error(), nil
+			}
+			return "", nil
+		}
+
+		accept := func(entityType string, id uuid.UUID) {
+			switch entityType {
+			case models.EntityBranch:
+				knownBranches[id] = true
+				result.Branches = append(result.Branches, id)
+			case models.EntityTransaction:
+				result.Transactions = append(result.Transactions, id)
+			case models.EntityShift:
+				result.Shifts = append(result.Shifts, id)
+			case models.EntityReconciliation:
+				result.Reconciliations = append(result.Reconciliations, id)
+			}
+		}
+
+		// The device's cursor is loaded with its first change, so a batch
+		// without changes leaves it alone
+		var cursor *models.SyncCursor
+		var processed uint64
+		for {
+			change, err := next()
+			if err != nil {
+				return err
+			}
+			if change == nil {
+				break
+			}
+
+			if cursor == nil {
+				cursor = &models.SyncCursor{}
+				err := tx.Where("device_id = ?", batch.DeviceID).Attrs(models.SyncCursor{DeviceID: batch.DeviceID}).FirstOrInit(cursor).Error
+				if err != nil {
+					return err
+				}
+				processed = cursor.LastSeq
+			}
+			if change.Seq <= processed {
+				continue
+			}
+			// Skipping a change that arrives after a later one would
+			// acknowledge it unapplied; the device queues it again instead
+			if change.Seq <= cursor.LastSeq {
+				result.RejectChange(change, "change out of sequence order")
+				continue
+			}
+			cursor.LastSeq = change.Seq
+
+			record, err := change.DecodeRecord()
+			if err != nil {
+				result.RejectChange(change, err.Error())
+				continue
+			}
+			if reason := validate(change, record); reason != "" {
+				result.RejectChange(change, reason)
+				continue
+			}
+			allowed, err := changeInScope(tx, scope, change, record)
+			if err != nil {
+				return err
+			}
+			if !allowed {
+				result.RejectChange(change, outOfScope)
+				continue
+			}
+
+			if tombstone, ok := record.(*models.Tombstone); ok {
+				r.opts.observe(tombstone.HLC)
+			}
+
+			// A change that loses a conflict is still accepted so the
+			// device stops sending it; the cloud version stands
+			reason, err := apply(recordBranchID(record), func() error {
+				write, err := settleConflict(tx, batch.DeviceID, change, record)
+				if err != nil || !write {
+					return err
+				}
+				return applyChange(tx, change, record)
+			})
+			if err != nil {
+				return err
+			}
+			if reason != "" {
+				result.RejectChange(change, reason)
+				continue
+			}
+			accept(change.EntityType, change.EntityID)
+		}
+
+		if cursor != nil {
+			if err := tx.Save(cursor).Error; err != nil {
+				return err
+			}
+			result.AckedSeq = cursor.LastSeq
+		}
+
+		for i := range batch.Branches {
+			branch := &batch.Branches[i]
+			if !scope.Contains(branch.ID) {
+				result.Reject(models.EntityBranch, branch.ID, outOfScope)
+				continue
+			}
+			reason, err := apply(nil, func() error { return upsertBranch(tx, branch) })
+			if err != nil {
+				return err
+			}
+			if reason != "" {
+				result.Reject(models.EntityBranch, branch.ID, reason)
+				continue
+			}
+			accept(models.EntityBranch, branch.ID)
+		}
+
+		for i := range batch.Transactions {
+			t := &batch.Transactions[i]
+			if !scope.Contains(t.BranchID) {
+				result.Reject(models.EntityTransaction, t.ID, outOfScope)
+				continue
+			}
+			reason, err := apply(&t.BranchID, func() error { return upsertTransaction(tx, t) })
+			if err != nil {
+				return err
+			}
+			if reason != "" {
+				result.Reject(models.EntityTransaction, t.ID, reason)
+				continue
+			}
+			accept(models.EntityTransaction, t.ID)
+		}
+
+		for i := range batch.Shifts {
+			shift := &batch.Shifts[i]
+			if !scope.Contains(shift.BranchID) {
+				result.Reject(models.EntityShift, shift.ID, outOfScope)
+				continue
+			}
+			reason, err := apply(&shift.BranchID, func() error { return upsertShift(tx, shift) })
+			if err != nil {
+				return err
+			}
+			if reason != "" {
+				result.Reject(models.EntityShift, shift.ID, reason)
+				continue
+			}
+			accept(models.EntityShift, shift.ID)
+		}
+
+		for i := range batch.Reconciliations {
+			rec := &batch.Reconciliations[i]
+			if !scope.Contains(rec.BranchID) {
+				result.Reject(models.EntityReconciliation, rec.ID, outOfScope)
+				continue
+			}
+			reason, err := apply(&rec.BranchID, func() error { return upsertReconciliation(tx, rec) })
+			if err != nil {
+				return err
+			}
+			if reason != "" {
+				result.Reject(models.EntityReconciliation, rec.ID, reason)
+				continue
+			}
+			accept(models.EntityReconciliation, rec.ID)
+		}
+
+		data, err := json.Marshal(result)
+		if err != nil {
+			return err
+		}
+		receipt.AcceptedCount = result.Accepted()
+		receipt.RejectedCount = len(result.Rejected)
+		receipt.Result = string(data)
+		return tx.Create(receipt).Error
+	})
+}
+
+// applyChange writes one change-log entry: an upsert of the carried record
+// or a delete. Branches are soft-deleted with the device's delete time so
+// the tombstone travels on to other devices.
+func applyChange(tx *gorm.DB, change *models.SyncChange, record interface{}) error {
+	if change.Operation == models.ChangeDelete {
+		if change.EntityType == models.EntityBranch {
+			deletedAt := time.Now()
+			if tombstone, ok := record.(*models.Tombstone); ok && !tombstone.DeletedAt.IsZero() {
+				deletedAt = tombstone.DeletedAt
+			}
+			return tx.Model(&models.Branch{}).Where("id = ?", change.EntityID).Update("deleted_at", deletedAt).Error
+		}
+		if change.EntityType == models.EntityShift {
+			if err := tx.Where("shift_id = ?", change.EntityID).Delete(&models.ShiftDenomination{}).Error; err != nil {
+				return err
+			}
+		}
+		model, err := syncedModel(change.EntityType)
+		if err != nil {
+			return err
+		}
+		return tx.Where("id = ?", change.EntityID).Delete(model).Error
+	}
+
+	switch rec := record.(type) {
+	case *models.Branch:
+		return upsertBranch(tx, rec)
+	case *models.Transaction:
+		return upsertTransaction(tx, rec)
+	case *models.Shift:
+		return upsertShift(tx, rec)
+	case *models.CashReconciliation:
+		return upsertReconciliation(tx, rec)
+	}
+	return fmt.Errorf("unsupported record %T", record)
+}
+
+// upsertOnID returns the ON CONFLICT clause for writing a synced record
+// over an existing copy. Unlike UpdateAll it keeps the record's own
+// updated_at instead of stamping the time of the sync.
+func upsertOnID(db *gorm.DB, record interface{}) (clause.OnConflict, error) {
+	stmt := &gorm.Statement{DB: db}
+	if err := stmt.Parse(record); err != nil {
+		return clause.OnConflict{}, err
+	}
+
+	var columns []string
+	for _, name := range stmt.Schema.DBNames {
+		if name != "id" {
+			columns = append(columns, name)
+		}
+	}
+	return clause.OnConflict{
+		Columns:   []clause.Column{{Name: "id"}},
+		DoUpdates: clause.AssignmentColumns(columns),
+	}, nil
+}
+
+// upsertReceived writes a record received through sync over any existing
+// copy. gorm inserts a column's default in place of a zero value, which
+// would turn a received false into a default true, so those columns are
+// written again afterwards, unless the write itself gave them a value,
+// such as the receive sequence number.
+func upsertReceived(db *gorm.DB, record interface{}, omit ...string) error {
+	stmt := &gorm.Statement{DB: db}
+	if err := stmt.Parse(record); err != nil {
+		return err
+	}
+	rv := reflect.Indirect(reflect.ValueOf(record))
+	zeroed := map[string]interface{}{}
+	for _, field := range stmt.Schema.Fields {
+		if field.DBName == "" || field.DefaultValueInterface == nil {
+			continue
+		}
+		if value, zero := field.ValueOf(db.Statement.Context, rv); zero {
+			zeroed[field.DBName] = value
+		}
+	}
+
+	onConflict, err := upsertOnID(db, record)
+	if err != nil {
+		return err
+	}
+	query := receivedWrite(db).Clauses(onConflict)
+	if len(omit) > 0 {
+		query = query.Omit(omit...)
+	}
+	if err := query.Create(record).Error; err != nil {
+		return err
+	}
+	for name := range zeroed {
+		field := stmt.Schema.FieldsByDBName[name]
+		value, zero := field.ValueOf(db.Statement.Context, rv)
+		if !zero && value != field.DefaultValueInterface {
+			delete(zeroed, name)
+		}
+	}
+	if len(zeroed) == 0 {
+		return nil
+	}
+
+	for name, value := range zeroed {
+		if err := stmt.Schema.FieldsByDBName[name].Set(db.Statement.Context, rv, value); err != nil {
+			return err
+		}
+	}
+	return db.Unscoped().Model(record).UpdateColumns(zeroed).Error
+}
+
+// changeInScope reports whether a change only touches branches of the
+// scope: a branch change its own branch, any other the branch of the record
+// it carries and that of the stored row it replaces or deletes. Deletes
+// carry no record, so only the stored row counts for them.
+func changeInScope(tx *gorm.DB, scope *models.BranchScope, change *models.SyncChange, record interface{}) (bool, error) {
+	if scope.AllBranches {
+		return true, nil
+	}
+	if change.EntityType == models.EntityBranch {
+		return scope.Contains(change.EntityID), nil
+	}
+	if id := recordBranchID(record); id != nil && !scope.Contains(*id) {
+		return false, nil
+	}
+
+	stored, err := findSynced(tx, change.EntityType, change.EntityID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if id := recordBranchID(stored); id != nil && !scope.Contains(*id) {
+		return false, nil
+	}
+	return true, nil
+}
+
+// recordBranchID returns the branch a record belongs to, or nil for
+// branches themselves and deletes.
+func recordBranchID(record interface{}) *uuid.UUID {
+	switch rec := record.(type) {
+	case *models.Transaction:
+		return &rec.BranchID
+	case *models.Shift:
+		return &rec.BranchID
+	case *models.CashReconciliation:
+		return &rec.BranchID
+	}
+	return nil
+}
+
+func (r *syncRepository) FindBatch(id uuid.UUID) (*models.SyncBatch, error) {
+	var receipt models.SyncBatch
+	err := r.db.Where("id = ?", id).First(&receipt).Error
+	if err != nil {
+		return nil, err
+	}
+	return &receipt, nil
+}
+
+func (r *syncRepository) MarkReplayed(receipt *models.SyncBatch) error {
+	now := time.Now()
+	receipt.ReplayCount++
+	receipt.LastReplayedAt = &now
+	return r.db.Model(receipt).Updates(map[string]interface{}{
+		"replay_count":     receipt.ReplayCount,
+		"last_replayed_at": now,
+	}).Error
+}
+
+func (r *syncRepository) FindBatches(filter *SyncBatchFilter) ([]models.SyncBatch, error) {
+	var receipts []models.SyncBatch
+	query := r.db.Model(&models.SyncBatch{})
+	if filter.BranchID != nil {
+		query = query.Where("branch_id = ?", *filter.BranchID)
+	}
+	if filter.DeviceID != "" {
+		query = query.Where("device_id = ?", filter.DeviceID)
+	}
+	err := query.Order("received_at desc").Limit(filter.Limit).Find(&receipts).Error
+	return receipts, err
+}
@@ -0,0 +1,660 @@
+package repository
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"shosha-finance/internal/database"
+	"shosha-finance/internal/hlc"
+	"shosha-finance/internal/models"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+const testDevice = "device-1"
+
+func newTestDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	db, err := database.OpenSQLite("file::memory:", &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Every connection to :memory: opens a database of its own
+	sqlDB.SetMaxOpenConns(1)
+	t.Cleanup(func() { sqlDB.Close() })
+
+	if err := database.Migrate(db); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func newTestChange(t *testing.T, seq uint64, entityType string, id uuid.UUID, op models.ChangeOperation, record interface{}) models.SyncChange {
+	t.Helper()
+	change := models.SyncChange{Seq: seq, EntityType: entityType, EntityID: id, Operation: op}
+	if record != nil {
+		payload, err := json.Marshal(record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		change.Payload = payload
+	}
+	return change
+}
+
+// applyTestPush applies a batch from testDevice for a device with the
+// given scope, accepting every change when validate is nil.
+func applyTestPush(t *testing.T, db *gorm.DB, batch *models.SyncPushBatch, scope *models.BranchScope, validate ChangeValidator) (*models.SyncPushResult, error) {
+	t.Helper()
+	if batch.BatchID == uuid.Nil {
+		batch.BatchID = uuid.New()
+	}
+	batch.DeviceID = testDevice
+	if scope == nil {
+		scope = &models.BranchScope{AllBranches: true}
+	}
+	if validate == nil {
+		validate = func(*models.SyncChange, interface{}) string { return "" }
+	}
+
+	result := models.NewSyncPushResult()
+	receipt := &models.SyncBatch{ID: batch.BatchID, DeviceID: testDevice, ReceivedAt: time.Now()}
+	err := NewSyncRepository(db, Options{}).ApplyPush(batch, scope, validate, result, receipt)
+	return result, err
+}
+
+// storedAnywhere reports whether a row with the ID exists in any of the
+// pushed tables, soft-deleted rows included.
+func storedAnywhere(t *testing.T, db *gorm.DB, id uuid.UUID) bool {
+	t.Helper()
+	for _, model := range []interface{}{&models.Branch{}, &models.Transaction{}, &models.Shift{}, &models.ShiftDenomination{}} {
+		var count int64
+		if err := db.Unscoped().Model(model).Where("id = ?", id).Count(&count).Error; err != nil {
+			t.Fatal(err)
+		}
+		if count > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func TestApplyPushAllOrNothing(t *testing.T) {
+	branch := models.Branch{ID: uuid.New(), Code: "A", Name: "Branch A"}
+	now := time.Now().UTC().Truncate(time.Second)
+
+	transaction := func(branchID uuid.UUID) models.Transaction {
+		return models.Transaction{ID: uuid.New(), BranchID: branchID, Type: models.TransactionTypeIN, Category: "Sales", Amount: 1000, CreatedAt: now, HLC: 1}
+	}
+	tx, txUnknown := transaction(branch.ID), transaction(uuid.New())
+	clash := models.Branch{ID: uuid.New(), Code: "A", Name: "Same code as A"}
+	// The denominations share an ID, so the shift's second insert fails
+	// after the shift row itself was written
+	denomID := uuid.New()
+	shift := models.Shift{ID: uuid.New(), BranchID: branch.ID, UserID: uuid.New(), Status: models.ShiftStatusClosed, OpenedAt: now, HLC: 1}
+	shift.Denominations = []models.ShiftDenomination{
+		{ID: denomID, ShiftID: shift.ID, Value: 1000, Quantity: 1, Subtotal: 1000},
+		{ID: denomID, ShiftID: shift.ID, Value: 500, Quantity: 1, Subtotal: 500},
+	}
+
+	tests := []struct {
+		name         string
+		batch        models.SyncPushBatch
+		receipted    bool // a receipt for the batch is already stored
+		wantErr      bool
+		wantAccepted int
+		wantRejected []uuid.UUID
+		wantStored   []uuid.UUID
+		wantMissing  []uuid.UUID
+	}{
+		{
+			name:         "rolls a failed record back to its savepoint",
+			batch:        models.SyncPushBatch{Branches: []models.Branch{clash}, Transactions: []models.Transaction{tx}, Shifts: []models.Shift{shift}},
+			wantAccepted: 1,
+			wantRejected: []uuid.UUID{clash.ID, shift.ID},
+			wantStored:   []uuid.UUID{tx.ID},
+			wantMissing:  []uuid.UUID{clash.ID, shift.ID, denomID},
+		},
+		{
+			name:         "rejects records of unknown branches",
+			batch:        models.SyncPushBatch{Transactions: []models.Transaction{txUnknown, tx}},
+			wantAccepted: 1,
+			wantRejected: []uuid.UUID{txUnknown.ID},
+			wantStored:   []uuid.UUID{tx.ID},
+			wantMissing:  []uuid.UUID{txUnknown.ID},
+		},
+		{
+			name:        "keeps nothing of a batch that fails",
+			batch:       models.SyncPushBatch{Transactions: []models.Transaction{tx}},
+			receipted:   true,
+			wantErr:     true,
+			wantMissing: []uuid.UUID{tx.ID},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newTestDB(t)
+			if err := db.Create(&branch).Error; err != nil {
+				t.Fatal(err)
+			}
+			batch := tt.batch
+			batch.BatchID = uuid.New()
+			if tt.receipted {
+				if err := db.Create(&models.SyncBatch{ID: batch.BatchID, ReceivedAt: now}).Error; err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			result, err := applyTestPush(t, db, &batch, nil, nil)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ApplyPush() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			for _, id := range tt.wantStored {
+				if !storedAnywhere(t, db, id) {
+					t.Errorf("record %v not stored", id)
+				}
+			}
+			for _, id := range tt.wantMissing {
+				if storedAnywhere(t, db, id) {
+					t.Errorf("record %v stored, want it rolled back", id)
+				}
+			}
+			if tt.wantErr {
+				return
+			}
+
+			if got := result.Accepted(); got != tt.wantAccepted {
+				t.Errorf("accepted = %d, want %d", got, tt.wantAccepted)
+			}
+			if len(result.Rejected) != len(tt.wantRejected) {
+				t.Fatalf("rejected = %+v, want %v", result.Rejected, tt.wantRejected)
+			}
+			for i, id := range tt.wantRejected {
+				if result.Rejected[i].EntityID != id || result.Rejected[i].Reason == "" {
+					t.Errorf("rejected[%d] = %+v, want %v with a reason", i, result.Rejected[i], id)
+				}
+			}
+
+			var receipt models.SyncBatch
+			if err := db.First(&receipt, "id = ?", batch.BatchID).Error; err != nil {
+				t.Fatalf("receipt not stored: %v", err)
+			}
+			if receipt.AcceptedCount != tt.wantAccepted || receipt.RejectedCount != len(tt.wantRejected) {
+				t.Errorf("receipt counts = %d/%d, want %d/%d", receipt.AcceptedCount, receipt.RejectedCount, tt.wantAccepted, len(tt.wantRejected))
+			}
+		})
+	}
+}
+
+func TestApplyPushOpenShifts(t *testing.T) {
+	branch := models.Branch{ID: uuid.New(), Code: "A", Name: "Branch A"}
+	now := time.Now().UTC().Truncate(time.Second)
+	open := models.Shift{ID: uuid.New(), BranchID: branch.ID, UserID: uuid.New(), Status: models.ShiftStatusOpen, OpenedAt: now, HLC: 1}
+
+	shift := func(status models.ShiftStatus) *models.Shift {
+		return &models.Shift{ID: uuid.New(), BranchID: branch.ID, UserID: uuid.New(), Status: status, OpenedAt: now, HLC: 2}
+	}
+	reopened := open
+	reopened.Notes, reopened.HLC = "counted twice", 3
+
+	tests := []struct {
+		name     string
+		shift    *models.Shift
+		op       models.ChangeOperation
+		rejected string
+	}{
+		{"second open shift of the branch", shift(models.ShiftStatusOpen), models.ChangeCreate, "branch already has an open shift"},
+		{"closed shift alongside the open one", shift(models.ShiftStatusClosed), models.ChangeCreate, ""},
+		{"update of the open shift itself", &reopened, models.ChangeUpdate, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newTestDB(t)
+			for _, record := range []interface{}{&branch, &open} {
+				if err := db.Create(record).Error; err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			batch := &models.SyncPushBatch{Changes: []models.SyncChange{
+				newTestChange(t, 1, models.EntityShift, tt.shift.ID, tt.op, tt.shift),
+			}}
+			result, err := applyTestPush(t, db, batch, nil, nil)
+			if err != nil {
+				t.Fatalf("ApplyPush() error = %v", err)
+			}
+
+			if tt.rejected == "" {
+				if len(result.Rejected) != 0 || len(result.Shifts) != 1 {
+					t.Errorf("rejected = %+v, want the shift accepted", result.Rejected)
+				}
+				return
+			}
+			if len(result.Rejected) != 1 || result.Rejected[0].Reason != tt.rejected {
+				t.Fatalf("rejected = %+v, want %q", result.Rejected, tt.rejected)
+			}
+			if storedAnywhere(t, db, tt.shift.ID) {
+				t.Error("rejected shift stored")
+			}
+		})
+	}
+}
+
+func TestApplyPushValidation(t *testing.T) {
+	branch := models.Branch{ID: uuid.New(), Code: "A", Name: "Branch A"}
+	now := time.Now().UTC().Truncate(time.Second)
+	valid := &models.Transaction{ID: uuid.New(), BranchID: branch.ID, Type: models.TransactionTypeIN, Category: "Sales", Amount: 1000, CreatedAt: now, HLC: 1}
+	invalid := &models.Transaction{ID: uuid.New(), BranchID: branch.ID, Type: models.TransactionTypeIN, Category: "Sales", Amount: -5, CreatedAt: now, HLC: 1}
+
+	validate := func(change *models.SyncChange, record interface{}) string {
+		if tx, ok := record.(*models.Transaction); ok && tx.Amount <= 0 {
+			return "invalid amount"
+		}
+		return ""
+	}
+
+	tests := []struct {
+		name         string
+		record       *models.Transaction
+		wantRejected string
+	}{
+		{"valid record", valid, ""},
+		{"refused record", invalid, "invalid amount"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newTestDB(t)
+			if err := db.Create(&branch).Error; err != nil {
+				t.Fatal(err)
+			}
+
+			batch := &models.SyncPushBatch{Changes: []models.SyncChange{
+				newTestChange(t, 1, models.EntityTransaction, tt.record.ID, models.ChangeCreate, tt.record),
+			}}
+			result, err := applyTestPush(t, db, batch, nil, validate)
+			if err != nil {
+				t.Fatalf("ApplyPush() error = %v", err)
+			}
+
+			if tt.wantRejected == "" {
+				if len(result.Rejected) != 0 || !storedAnywhere(t, db, tt.record.ID) {
+					t.Errorf("rejected = %+v, want the record stored", result.Rejected)
+				}
+				return
+			}
+			if len(result.Rejected) != 1 {
+				t.Fatalf("rejected = %+v, want one rejection", result.Rejected)
+			}
+			got := result.Rejected[0]
+			if got.Seq != 1 || got.EntityID != tt.record.ID || got.Reason != tt.wantRejected {
+				t.Errorf("rejected = %+v, want seq 1 %v %q", got, tt.record.ID, tt.wantRejected)
+			}
+			if storedAnywhere(t, db, tt.record.ID) {
+				t.Error("refused record stored")
+			}
+			// The change was processed, so the cursor moves past it
+			if result.AckedSeq != 1 {
+				t.Errorf("AckedSeq = %d, want 1", result.AckedSeq)
+			}
+		})
+	}
+}
+
+func TestApplyPushSequence(t *testing.T) {
+	branch := models.Branch{ID: uuid.New(), Code: "A", Name: "Branch A"}
+	now := time.Now().UTC().Truncate(time.Second)
+
+	transaction := func() *models.Transaction {
+		return &models.Transaction{ID: uuid.New(), BranchID: branch.ID, Type: models.TransactionTypeIN, Category: "Sales", Amount: 1000, CreatedAt: now, HLC: 1}
+	}
+	txA, txB := transaction(), transaction()
+	widget := uuid.New()
+
+	tests := []struct {
+		name         string
+		cursor       uint64
+		changes      func(t *testing.T) []models.SyncChange
+		wantAcked    uint64
+		wantStored   []uuid.UUID
+		wantMissing  []uuid.UUID
+		wantRejected []uuid.UUID
+	}{
+		{
+			name: "applies changes and moves the cursor",
+			changes: func(t *testing.T) []models.SyncChange {
+				return []models.SyncChange{
+					newTestChange(t, 2, models.EntityTransaction, txB.ID, models.ChangeCreate, txB),
+					newTestChange(t, 1, models.EntityTransaction, txA.ID, models.ChangeCreate, txA),
+				}
+			},
+			wantAcked:  2,
+			wantStored: []uuid.UUID{txA.ID, txB.ID},
+		},
+		{
+			name:   "skips changes at or below the cursor",
+			cursor: 5,
+			changes: func(t *testing.T) []models.SyncChange {
+				return []models.SyncChange{
+					newTestChange(t, 4, models.EntityTransaction, txA.ID, models.ChangeCreate, txA),
+					newTestChange(t, 6, models.EntityTransaction, txB.ID, models.ChangeCreate, txB),
+				}
+			},
+			wantAcked:   6,
+			wantStored:  []uuid.UUID{txB.ID},
+			wantMissing: []uuid.UUID{txA.ID},
+		},
+		{
+			name: "rejects unknown entity types",
+			changes: func(t *testing.T) []models.SyncChange {
+				return []models.SyncChange{
+					newTestChange(t, 1, "widget", widget, models.ChangeDelete, nil),
+					newTestChange(t, 2, models.EntityTransaction, txA.ID, models.ChangeCreate, txA),
+				}
+			},
+			wantAcked:    2,
+			wantStored:   []uuid.UUID{txA.ID},
+			wantRejected: []uuid.UUID{widget},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newTestDB(t)
+			if err := db.Create(&branch).Error; err != nil {
+				t.Fatal(err)
+			}
+			if tt.cursor > 0 {
+				if err := db.Create(&models.SyncCursor{DeviceID: testDevice, LastSeq: tt.cursor}).Error; err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			result, err := applyTestPush(t, db, &models.SyncPushBatch{Changes: tt.changes(t)}, nil, nil)
+			if err != nil {
+				t.Fatalf("ApplyPush() error = %v", err)
+			}
+
+			if result.AckedSeq != tt.wantAcked {
+				t.Errorf("AckedSeq = %d, want %d", result.AckedSeq, tt.wantAcked)
+			}
+			var cursor models.SyncCursor
+			if err := db.First(&cursor, "device_id = ?", testDevice).Error; err != nil || cursor.LastSeq != tt.wantAcked {
+				t.Errorf("stored cursor = %d (%v), want %d", cursor.LastSeq, err, tt.wantAcked)
+			}
+			for _, id := range tt.wantStored {
+				if !storedAnywhere(t, db, id) {
+					t.Errorf("record %v not stored", id)
+				}
+			}
+			for _, id := range tt.wantMissing {
+				if storedAnywhere(t, db, id) {
+					t.Errorf("record %v stored, want it skipped", id)
+				}
+			}
+			if len(result.Rejected) != len(tt.wantRejected) {
+				t.Fatalf("rejected = %+v, want %v", result.Rejected, tt.wantRejected)
+			}
+			for i, id := range tt.wantRejected {
+				if result.Rejected[i].EntityID != id || result.Rejected[i].Reason == "" {
+					t.Errorf("rejected[%d] = %+v, want %v with a reason", i, result.Rejected[i], id)
+				}
+			}
+		})
+	}
+}
+
+func TestApplyPushConflicts(t *testing.T) {
+	branch := models.Branch{ID: uuid.New(), Code: "A", Name: "Branch A"}
+	now := time.Now().UTC().Truncate(time.Second)
+	// A shift changed on the cloud since the device's base version
+	stored := models.Shift{ID: uuid.New(), BranchID: branch.ID, UserID: uuid.New(), Status: models.ShiftStatusOpen, OpenedAt: now, HLC: 5}
+	base := hlc.Timestamp(2)
+
+	// An older device edit, which the cloud wins
+	older := stored
+	older.Notes, older.HLC = "edited on the device", 3
+	// A newer device edit, which the device wins, whose denominations
+	// share an ID so the write fails after the conflict is recorded
+	denomID := uuid.New()
+	failing := stored
+	failing.Status, failing.HLC = models.ShiftStatusClosed, 9
+	failing.Denominations = []models.ShiftDenomination{
+		{ID: denomID, ShiftID: stored.ID, Value: 1000, Quantity: 1, Subtotal: 1000},
+		{ID: denomID, ShiftID: stored.ID, Value: 500, Quantity: 1, Subtotal: 500},
+	}
+
+	tests := []struct {
+		name         string
+		edit         *models.Shift
+		wantRejected bool
+		wantConflict int64
+	}{
+		{"records a conflict the cloud wins", &older, false, 1},
+		{"rolls back the conflict of a failed record", &failing, true, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newTestDB(t)
+			for _, record := range []interface{}{&branch, &stored} {
+				if err := db.Create(record).Error; err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			change := newTestChange(t, 1, models.EntityShift, stored.ID, models.ChangeUpdate, tt.edit)
+			change.BaseVersion = &base
+			result, err := applyTestPush(t, db, &models.SyncPushBatch{Changes: []models.SyncChange{change}}, nil, nil)
+			if err != nil {
+				t.Fatalf("ApplyPush() error = %v", err)
+			}
+
+			if got := len(result.Rejected) == 1; got != tt.wantRejected {
+				t.Errorf("rejected = %+v, want rejected %v", result.Rejected, tt.wantRejected)
+			}
+			var conflicts int64
+			if err := db.Model(&models.SyncConflict{}).Count(&conflicts).Error; err != nil {
+				t.Fatal(err)
+			}
+			if conflicts != tt.wantConflict {
+				t.Errorf("conflicts = %d, want %d", conflicts, tt.wantConflict)
+			}
+			// Either way the cloud's copy stays as it was
+			var shift models.Shift
+			if err := db.First(&shift, "id = ?", stored.ID).Error; err != nil {
+				t.Fatal(err)
+			}
+			if shift.Status != stored.Status || shift.Notes != stored.Notes || shift.HLC != stored.HLC {
+				t.Errorf("stored shift = %+v, want it unchanged", shift)
+			}
+			if storedAnywhere(t, db, denomID) {
+				t.Error("denomination of the failed write stored")
+			}
+		})
+	}
+}
+
+func TestApplyPushScope(t *testing.T) {
+	branchA := models.Branch{ID: uuid.New(), Code: "A", Name: "Branch A"}
+	branchB := models.Branch{ID: uuid.New(), Code: "B", Name: "Branch B"}
+	now := time.Now().UTC().Truncate(time.Second)
+	scope := &models.BranchScope{BranchIDs: []uuid.UUID{branchA.ID}}
+
+	transaction := func(branch uuid.UUID) *models.Transaction {
+		return &models.Transaction{ID: uuid.New(), BranchID: branch, Type: models.TransactionTypeIN, Category: "Sales", Amount: 1000, CreatedAt: now, HLC: 1}
+	}
+	// A transaction of branch B the device tries to move into its own
+	storedB := transaction(branchB.ID)
+	moved := *storedB
+	moved.BranchID, moved.HLC = branchA.ID, 2
+
+	tests := []struct {
+		name     string
+		change   func(t *testing.T) models.SyncChange
+		accepted bool
+	}{
+		{
+			name: "transaction of an assigned branch",
+			change: func(t *testing.T) models.SyncChange {
+				tx := transaction(branchA.ID)
+				return newTestChange(t, 1, models.EntityTransaction, tx.ID, models.ChangeCreate, tx)
+			},
+			accepted: true,
+		},
+		{
+			name: "transaction of another branch",
+			change: func(t *testing.T) models.SyncChange {
+				tx := transaction(branchB.ID)
+				return newTestChange(t, 1, models.EntityTransaction, tx.ID, models.ChangeCreate, tx)
+			},
+		},
+		{
+			name: "delete of another branch",
+			change: func(t *testing.T) models.SyncChange {
+				return newTestChange(t, 1, models.EntityBranch, branchB.ID, models.ChangeDelete, nil)
+			},
+		},
+		{
+			name: "stored record of another branch moved into scope",
+			change: func(t *testing.T) models.SyncChange {
+				return newTestChange(t, 1, models.EntityTransaction, moved.ID, models.ChangeUpdate, &moved)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newTestDB(t)
+			for _, record := range []interface{}{&branchA, &branchB, storedB} {
+				if err := db.Create(record).Error; err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			change := tt.change(t)
+			result, err := applyTestPush(t, db, &models.SyncPushBatch{Changes: []models.SyncChange{change}}, scope, nil)
+			if err != nil {
+				t.Fatalf("ApplyPush() error = %v", err)
+			}
+
+			if tt.accepted {
+				if len(result.Rejected) != 0 || !storedAnywhere(t, db, change.EntityID) {
+					t.Errorf("rejected = %+v, want the change applied", result.Rejected)
+				}
+				return
+			}
+			if len(result.Rejected) != 1 || result.Rejected[0].Reason != outOfScope {
+				t.Fatalf("rejected = %+v, want %q", result.Rejected, outOfScope)
+			}
+			// Nothing of the other branch changed
+			var branch models.Branch
+			if err := db.First(&branch, "id = ?", branchB.ID).Error; err != nil {
+				t.Errorf("branch B: %v, want it kept", err)
+			}
+			var stored models.Transaction
+			if err := db.First(&stored, "id = ?", storedB.ID).Error; err != nil || stored.BranchID != branchB.ID {
+				t.Errorf("stored transaction = %+v (%v), want it left in branch B", stored, err)
+			}
+		})
+	}
+}
+
+func TestApplyPushStream(t *testing.T) {
+	branch := models.Branch{ID: uuid.New(), Code: "A", Name: "Branch A"}
+	now := time.Now().UTC().Truncate(time.Second)
+
+	transaction := func() *models.Transaction {
+		return &models.Transaction{ID: uuid.New(), BranchID: branch.ID, Type: models.TransactionTypeIN, Category: "Sales", Amount: 1000, CreatedAt: now, HLC: 1}
+	}
+	txA, txB, txC := transaction(), transaction(), transaction()
+
+	tests := []struct {
+		name         string
+		changes      func(t *testing.T) []models.SyncChange
+		wantAcked    uint64
+		wantStored   []uuid.UUID
+		wantRejected []uuid.UUID
+	}{
+		{
+			name: "applies changes in sequence order",
+			changes: func(t *testing.T) []models.SyncChange {
+				return []models.SyncChange{
+					newTestChange(t, 1, models.EntityTransaction, txA.ID, models.ChangeCreate, txA),
+					newTestChange(t, 2, models.EntityTransaction, txB.ID, models.ChangeCreate, txB),
+				}
+			},
+			wantAcked:  2,
+			wantStored: []uuid.UUID{txA.ID, txB.ID},
+		},
+		{
+			name: "rejects a change after a later one",
+			changes: func(t *testing.T) []models.SyncChange {
+				return []models.SyncChange{
+					newTestChange(t, 3, models.EntityTransaction, txA.ID, models.ChangeCreate, txA),
+					newTestChange(t, 2, models.EntityTransaction, txB.ID, models.ChangeCreate, txB),
+					newTestChange(t, 4, models.EntityTransaction, txC.ID, models.ChangeCreate, txC),
+				}
+			},
+			wantAcked:    4,
+			wantStored:   []uuid.UUID{txA.ID, txC.ID},
+			wantRejected: []uuid.UUID{txB.ID},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newTestDB(t)
+			if err := db.Create(&branch).Error; err != nil {
+				t.Fatal(err)
+			}
+
+			changes := tt.changes(t)
+			next := func() (*models.SyncChange, error) {
+				if len(changes) == 0 {
+					return nil, nil
+				}
+				change := changes[0]
+				changes = changes[1:]
+				return &change, nil
+			}
+			batch := &models.SyncPushBatch{BatchID: uuid.New(), DeviceID: testDevice}
+			result := models.NewSyncPushResult()
+			receipt := &models.SyncBatch{ID: batch.BatchID, DeviceID: testDevice, ReceivedAt: time.Now()}
+			accept := func(*models.SyncChange, interface{}) string { return "" }
+			err := NewSyncRepository(db, Options{}).ApplyPushStream(batch, &models.BranchScope{AllBranches: true}, next, accept, result, receipt)
+			if err != nil {
+				t.Fatalf("ApplyPushStream() error = %v", err)
+			}
+
+			if result.AckedSeq != tt.wantAcked {
+				t.Errorf("AckedSeq = %d, want %d", result.AckedSeq, tt.wantAcked)
+			}
+			for _, id := range tt.wantStored {
+				if !storedAnywhere(t, db, id) {
+					t.Errorf("record %v not stored", id)
+				}
+			}
+			if len(result.Rejected) != len(tt.wantRejected) {
+				t.Fatalf("rejected = %+v, want %v", result.Rejected, tt.wantRejected)
+			}
+			for i, id := range tt.wantRejected {
+				if result.Rejected[i].EntityID != id || result.Rejected[i].Reason != "change out of sequence order" {
+					t.Errorf("rejected[%d] = %+v, want %v out of order", i, result.Rejected[i], id)
+				}
+				if storedAnywhere(t, db, id) {
+					t.Errorf("record %v stored, want it rejected", id)
+				}
+			}
+		})
+	}
+}
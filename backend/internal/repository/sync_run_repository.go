@@ -0,0 +1,47 @@
+package repository
+
+import (
+	"time"
+
+	"shosha-finance/internal/models"
+
+	"gorm.io/gorm"
+)
+
+type SyncRunRepository interface {
+	Create(run *models.SyncRun) error
+	FindRecent(filter *SyncRunFilter) ([]models.SyncRun, error)
+	DeleteOlderThan(cutoff time.Time) (int64, error)
+}
+
+type SyncRunFilter struct {
+	Status models.SyncRunStatus
+	Limit  int
+}
+
+type syncRunRepository struct {
+	db *gorm.DB
+}
+
+func NewSyncRunRepository(db *gorm.DB) SyncRunRepository {
+	return &syncRunRepository{db: db}
+}
+
+func (r *syncRunRepository) Create(run *models.SyncRun) error {
+	return r.db.Create(run).Error
+}
+
+func (r *syncRunRepository) FindRecent(filter *SyncRunFilter) ([]models.SyncRun, error) {
+	var runs []models.SyncRun
+	query := r.db.Model(&models.SyncRun{})
+	if filter.Status != "" {
+		query = query.Where("status = ?", filter.Status)
+	}
+	err := query.Order("started_at desc").Limit(filter.Limit).Find(&runs).Error
+	return runs, err
+}
+
+func (r *syncRunRepository) DeleteOlderThan(cutoff time.Time) (int64, error) {
+	result := r.db.Where("started_at < ?", cutoff).Delete(&models.SyncRun{})
+	return result.RowsAffected, result.Error
+}
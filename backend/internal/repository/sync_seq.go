@@ -0,0 +1,88 @@
+package repository
+
+import (
+	"shosha-finance/internal/models"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// syncSeqName names the receive sequence in the sync_sequences table.
+const syncSeqName = "receive"
+
+// EnableSyncSeq gives every create and update of a pulled record on the
+// cloud the next receive sequence number, records received through sync
+// included. Pulls continue from the last number they sent, so a record
+// pushed late or by a device with a slow clock still reaches every device,
+// however old its HLC stamp. Rows written before sequence numbers existed
+// are given one first.
+func EnableSyncSeq(db *gorm.DB) error {
+	err := db.Clauses(clause.OnConflict{DoNothing: true}).Create(&models.SyncSequence{Name: syncSeqName}).Error
+	if err != nil {
+		return err
+	}
+
+	for _, model := range sequencedModels() {
+		err := db.Transaction(func(tx *gorm.DB) error {
+			var unset int64
+			if err := tx.Unscoped().Model(model).Where("sync_seq = ?", 0).Count(&unset).Error; err != nil || unset == 0 {
+				return err
+			}
+			seq, err := nextSyncSeq(tx)
+			if err != nil {
+				return err
+			}
+			return tx.Unscoped().Model(model).Where("sync_seq = ?", 0).UpdateColumn("sync_seq", seq).Error
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := db.Callback().Create().Before("gorm:create").Register("sync_seq:assign", assignSyncSeq); err != nil {
+		return err
+	}
+	return db.Callback().Update().Before("gorm:update").Register("sync_seq:assign", assignSyncSeq)
+}
+
+// sequencedModels returns the models devices pull by receive sequence.
+func sequencedModels() []interface{} {
+	return []interface{}{&models.Branch{}, &models.Transaction{}, &models.User{}}
+}
+
+// assignSyncSeq sets the receive sequence number of the records being
+// written. UpdateColumn(s) calls skip it, as they skip the HLC stamp.
+func assignSyncSeq(db *gorm.DB) {
+	stmt := db.Statement
+	if stmt.Schema == nil || stmt.Schema.LookUpField("SyncSeq") == nil || stmt.SkipHooks {
+		return
+	}
+	seq, err := nextSyncSeq(db.Session(&gorm.Session{NewDB: true}))
+	if err != nil {
+		db.AddError(err)
+		return
+	}
+	stmt.SetColumn("SyncSeq", seq, true)
+}
+
+// nextSyncSeq takes the next receive sequence number. The counter row
+// stays locked until tx commits, so the writes holding numbers commit in
+// their order.
+func nextSyncSeq(tx *gorm.DB) (uint64, error) {
+	err := tx.Model(&models.SyncSequence{}).Where("name = ?", syncSeqName).
+		UpdateColumn("value", gorm.Expr("value + 1")).Error
+	if err != nil {
+		return 0, err
+	}
+	var seq uint64
+	err = tx.Model(&models.SyncSequence{}).Where("name = ?", syncSeqName).Select("value").Scan(&seq).Error
+	return seq, err
+}
+
+// latestSyncSeq returns the newest committed receive sequence number.
+// Every write numbered up to it has committed.
+func latestSyncSeq(db *gorm.DB) (uint64, error) {
+	var seq uint64
+	err := db.Model(&models.SyncSequence{}).Where("name = ?", syncSeqName).Select("value").Scan(&seq).Error
+	return seq, err
+}
@@ -0,0 +1,88 @@
+package repository
+
+import (
+	"testing"
+	"time"
+
+	"shosha-finance/internal/hlc"
+	"shosha-finance/internal/models"
+
+	"github.com/google/uuid"
+)
+
+func TestPullAfterLatePush(t *testing.T) {
+	branch := models.Branch{ID: uuid.New(), Code: "A", Name: "Branch A"}
+	now := time.Now().UTC().Truncate(time.Second)
+
+	transaction := func(stamp hlc.Timestamp) *models.Transaction {
+		return &models.Transaction{ID: uuid.New(), BranchID: branch.ID, Type: models.TransactionTypeIN, Category: "Sales", Amount: 1000, CreatedAt: now, HLC: stamp}
+	}
+
+	tests := []struct {
+		name  string
+		clock time.Duration // how far the pushing device's clock is behind
+	}{
+		{"push from a slow clock", time.Hour},
+		{"push made offline days ago", 72 * time.Hour},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newTestDB(t)
+			clock := hlc.NewClock()
+			if err := EnableHLC(db, clock); err != nil {
+				t.Fatal(err)
+			}
+			if err := EnableSyncSeq(db); err != nil {
+				t.Fatal(err)
+			}
+			if err := db.Create(&branch).Error; err != nil {
+				t.Fatal(err)
+			}
+
+			// Another device pulls a transaction the cloud just wrote
+			recent := transaction(0)
+			if err := db.Create(recent).Error; err != nil {
+				t.Fatal(err)
+			}
+			syncRepo := NewSyncRepository(db, Options{Clock: clock})
+			txRepo := NewTransactionRepository(db, Options{Clock: clock})
+			cursor, err := syncRepo.LatestSeq()
+			if err != nil {
+				t.Fatal(err)
+			}
+			pulled, err := txRepo.GetUpdatedBetween(0, cursor, nil)
+			if err != nil || len(pulled) != 1 || pulled[0].ID != recent.ID {
+				t.Fatalf("first pull = %v (%v), want the recent transaction", pulled, err)
+			}
+
+			// Then a push arrives stamped before it
+			late := transaction(hlc.New(now.Add(-tt.clock), 0))
+			batch := &models.SyncPushBatch{Changes: []models.SyncChange{
+				newTestChange(t, 1, models.EntityTransaction, late.ID, models.ChangeCreate, late),
+			}}
+			if _, err := applyTestPush(t, db, batch, nil, nil); err != nil {
+				t.Fatalf("ApplyPush() error = %v", err)
+			}
+			if late.HLC >= recent.HLC {
+				t.Fatalf("late stamp %v not before %v", late.HLC, recent.HLC)
+			}
+
+			until, err := syncRepo.LatestSeq()
+			if err != nil {
+				t.Fatal(err)
+			}
+			pulled, err = txRepo.GetUpdatedBetween(cursor, until, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(pulled) != 1 || pulled[0].ID != late.ID {
+				t.Fatalf("next pull = %v, want the late transaction", pulled)
+			}
+			// The device's stamp is kept for last-writer-wins
+			if pulled[0].HLC != late.HLC {
+				t.Errorf("stored stamp = %v, want %v", pulled[0].HLC, late.HLC)
+			}
+		})
+	}
+}
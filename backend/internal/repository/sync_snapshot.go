@@ -0,0 +1,153 @@
+package repository
+
+import (
+	"database/sql"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"shosha-finance/internal/models"
+
+	"gorm.io/gorm"
+)
+
+// Snapshot reads everything a device of the given scope holds in one
+// read-only transaction, so the records and the cursor agree with each
+// other even while pushes are being applied.
+func (r *syncRepository) Snapshot(scope *models.BranchScope) (*models.SyncSnapshot, error) {
+	snapshot := &models.SyncSnapshot{Scope: scope}
+
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		// The cursor is read first: anything written after it is newer
+		// than the snapshot and comes with the first pull
+		cursor, err := latestSyncSeq(tx)
+		if err != nil {
+			return err
+		}
+		snapshot.Cursor = cursor
+		snapshot.TakenAt = time.Now()
+
+		if err := tx.Order("hlc asc").Find(&snapshot.Branches).Error; err != nil {
+			return err
+		}
+
+		var users []models.User
+		userQuery := tx.Order("hlc asc")
+		if !scope.AllBranches {
+			if len(scope.BranchIDs) > 0 {
+				userQuery = userQuery.Where("branch_id IS NULL OR branch_id IN ?", scope.BranchIDs)
+			} else {
+				userQuery = userQuery.Where("branch_id IS NULL")
+			}
+		}
+		if err := userQuery.Find(&users).Error; err != nil {
+			return err
+		}
+		snapshot.Users = make([]models.SyncUser, len(users))
+		for i := range users {
+			snapshot.Users[i] = users[i].ToSync()
+		}
+
+		if err := scopedQuery(tx, scope).Order("hlc asc").Find(&snapshot.Transactions).Error; err != nil {
+			return err
+		}
+		if err := scopedQuery(tx, scope).Preload("Denominations").Order("hlc asc").Find(&snapshot.Shifts).Error; err != nil {
+			return err
+		}
+		return scopedQuery(tx, scope).Order("hlc asc").Find(&snapshot.Reconciliations).Error
+	}, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	return snapshot, nil
+}
+
+// scopedQuery limits a query to the scope's branches; an empty scope
+// matches nothing.
+func scopedQuery(db *gorm.DB, scope *models.BranchScope) *gorm.DB {
+	if scope.AllBranches {
+		return db
+	}
+	if len(scope.BranchIDs) == 0 {
+		return db.Where("1 = 0")
+	}
+	return db.Where("branch_id IN ?", scope.BranchIDs)
+}
+
+// LatestSeq returns the newest committed receive sequence number.
+func (r *syncRepository) LatestSeq() (uint64, error) {
+	return latestSyncSeq(r.db)
+}
+
+// LoadSnapshot replaces the synced data of a local install with a snapshot
+// from the cloud in one DB transaction, and stores the snapshot's scope
+// and cursor so normal sync carries on from it. Local users not known to
+// the cloud, such as the seeded defaults, are removed.
+func (r *syncRepository) LoadSnapshot(snapshot *models.SyncSnapshot) error {
+	scope, err := json.Marshal(snapshot.Scope)
+	if err != nil {
+		return err
+	}
+
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		if len(snapshot.Users) > 0 {
+			if err := tx.Unscoped().Where("is_synced = ?", false).Delete(&models.User{}).Error; err != nil {
+				return err
+			}
+		}
+
+		now := time.Now()
+		for i := range snapshot.Branches {
+			branch := &snapshot.Branches[i]
+			branch.IsSynced = true
+			branch.SyncedAt = &now
+			if err := upsertSynced(tx, branch); err != nil {
+				return err
+			}
+		}
+		for i := range snapshot.Users {
+			user := snapshot.Users[i].ToUser()
+			user.IsSynced = true
+			user.SyncedAt = &now
+			if err := upsertReceived(tx, user); err != nil {
+				return err
+			}
+		}
+		for i := range snapshot.Transactions {
+			record := &snapshot.Transactions[i]
+			record.IsSynced = true
+			record.SyncedAt = &now
+			if err := upsertSynced(tx, record); err != nil {
+				return err
+			}
+		}
+		for i := range snapshot.Shifts {
+			shift := &snapshot.Shifts[i]
+			shift.IsSynced = true
+			shift.SyncedAt = &now
+			if err := upsertSynced(tx, shift); err != nil {
+				return err
+			}
+		}
+		for i := range snapshot.Reconciliations {
+			rec := &snapshot.Reconciliations[i]
+			rec.IsSynced = true
+			rec.SyncedAt = &now
+			if err := upsertSynced(tx, rec); err != nil {
+				return err
+			}
+		}
+
+		stateRepo := NewSyncStateRepository(tx)
+		if err := stateRepo.Set(models.SyncStateBranchScope, string(scope)); err != nil {
+			return err
+		}
+		if err := stateRepo.Set(models.SyncStatePullCursor, strconv.FormatUint(snapshot.Cursor, 10)); err != nil {
+			return err
+		}
+		if err := stateRepo.Delete(models.SyncStateRestorePending); err != nil {
+			return err
+		}
+		return stateRepo.Set(models.SyncStateRestoredAt, now.Format(time.RFC3339))
+	})
+}
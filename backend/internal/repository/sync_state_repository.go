@@ -0,0 +1,48 @@
+package repository
+
+import (
+	"errors"
+
+	"shosha-finance/internal/models"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type SyncStateRepository interface {
+	Get(key string) (string, error)
+	Set(key, value string) error
+	Delete(key string) error
+}
+
+type syncStateRepository struct {
+	db *gorm.DB
+}
+
+func NewSyncStateRepository(db *gorm.DB) SyncStateRepository {
+	return &syncStateRepository{db: db}
+}
+
+// Get returns the stored value, or an empty string when the key is not set.
+func (r *syncStateRepository) Get(key string) (string, error) {
+	var state models.SyncState
+	err := r.db.Where("key = ?", key).First(&state).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return state.Value, nil
+}
+
+func (r *syncStateRepository) Set(key, value string) error {
+	return r.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "key"}},
+		DoUpdates: clause.AssignmentColumns([]string{"value", "updated_at"}),
+	}).Create(&models.SyncState{Key: key, Value: value}).Error
+}
+
+func (r *syncStateRepository) Delete(key string) error {
+	return r.db.Where("key = ?", key).Delete(&models.SyncState{}).Error
+}
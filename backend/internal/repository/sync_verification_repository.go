@@ -0,0 +1,48 @@
+package repository
+
+import (
+	"time"
+
+	"shosha-finance/internal/models"
+
+	"gorm.io/gorm"
+)
+
+type SyncVerificationRepository interface {
+	Create(verification *models.SyncVerification) error
+	FindRecent(limit int) ([]models.SyncVerification, error)
+	FindLatest() (*models.SyncVerification, error)
+	DeleteOlderThan(cutoff time.Time) (int64, error)
+}
+
+type syncVerificationRepository struct {
+	db *gorm.DB
+}
+
+func NewSyncVerificationRepository(db *gorm.DB) SyncVerificationRepository {
+	return &syncVerificationRepository{db: db}
+}
+
+func (r *syncVerificationRepository) Create(verification *models.SyncVerification) error {
+	return r.db.Create(verification).Error
+}
+
+func (r *syncVerificationRepository) FindRecent(limit int) ([]models.SyncVerification, error) {
+	var verifications []models.SyncVerification
+	err := r.db.Order("started_at desc").Limit(limit).Find(&verifications).Error
+	return verifications, err
+}
+
+func (r *syncVerificationRepository) FindLatest() (*models.SyncVerification, error) {
+	var verification models.SyncVerification
+	err := r.db.Order("started_at desc").First(&verification).Error
+	if err != nil {
+		return nil, err
+	}
+	return &verification, nil
+}
+
+func (r *syncVerificationRepository) DeleteOlderThan(cutoff time.Time) (int64, error) {
+	result := r.db.Where("started_at < ?", cutoff).Delete(&models.SyncVerification{})
+	return result.RowsAffected, result.Error
+}
@@ -0,0 +1,117 @@
+package repository
+
+import (
+	"errors"
+	"time"
+
+	"shosha-finance/internal/hlc"
+	"shosha-finance/internal/models"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+type TombstoneRepository interface {
+	FindBetween(since, until uint64) ([]models.Tombstone, error)
+	Apply(tombstone *models.Tombstone) error
+	Purge(before time.Time) (int64, error)
+}
+
+type tombstoneRepository struct {
+	db   *gorm.DB
+	opts Options
+}
+
+func NewTombstoneRepository(db *gorm.DB, opts Options) TombstoneRepository {
+	return &tombstoneRepository{db: db, opts: opts}
+}
+
+// FindBetween returns the synced records deleted after the since receive
+// sequence number and no later than until. Only branches are soft-deleted
+// synced records: users travel with their deleted_at in the user pull,
+// recurring transactions stay on the device that has them and the other
+// synced entities are never deleted once shared.
+func (r *tombstoneRepository) FindBetween(since, until uint64) ([]models.Tombstone, error) {
+	var rows []struct {
+		ID        uuid.UUID
+		DeletedAt time.Time
+		HLC       hlc.Timestamp
+	}
+	err := r.db.Unscoped().Model(&models.Branch{}).
+		Select("id, deleted_at, hlc").
+		Where("deleted_at IS NOT NULL").
+		Where("sync_seq > ? AND sync_seq <= ?", since, until).
+		Order("sync_seq asc").
+		Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+
+	tombstones := make([]models.Tombstone, len(rows))
+	for i, row := range rows {
+		tombstones[i] = models.Tombstone{
+			EntityType: models.EntityBranch,
+			EntityID:   row.ID,
+			DeletedAt:  row.DeletedAt,
+			HLC:        row.HLC,
+		}
+	}
+	return tombstones, nil
+}
+
+// Apply soft-deletes a record deleted elsewhere, keeping the row as a
+// tombstone.
+func (r *tombstoneRepository) Apply(tombstone *models.Tombstone) error {
+	if tombstone.EntityType != models.EntityBranch {
+		return nil
+	}
+	r.opts.observe(tombstone.HLC)
+	return r.db.Model(&models.Branch{}).
+		Where("id = ?", tombstone.EntityID).
+		Update("deleted_at", tombstone.DeletedAt).Error
+}
+
+// branchReferences are the tables whose rows point at a branch. A deleted
+// branch they still point at keeps its row, since transactions, shifts and
+// the rest are kept for the books.
+var branchReferences = []string{
+	"transactions",
+	"shifts",
+	"cash_reconciliations",
+	"recurring_transactions",
+	"users",
+	"device_branches",
+}
+
+// Purge permanently removes soft-deleted master data deleted before the
+// given time. Rows that point at a branch go first so the branch may go
+// with them; a branch that is still referenced is kept. A failure on one
+// model does not stop the others from being purged.
+func (r *tombstoneRepository) Purge(before time.Time) (int64, error) {
+	expired := func() *gorm.DB {
+		return r.db.Unscoped().Where("deleted_at IS NOT NULL AND deleted_at < ?", before)
+	}
+
+	var total int64
+	var errs []error
+	for _, model := range []interface{}{&models.User{}, &models.RecurringTransaction{}} {
+		result := expired().Delete(model)
+		if result.Error != nil {
+			errs = append(errs, result.Error)
+			continue
+		}
+		total += result.RowsAffected
+	}
+
+	query := expired()
+	for _, table := range branchReferences {
+		query = query.Where("id NOT IN (?)", r.db.Unscoped().Table(table).Select("branch_id").Where("branch_id IS NOT NULL"))
+	}
+	result := query.Delete(&models.Branch{})
+	if result.Error != nil {
+		errs = append(errs, result.Error)
+	} else {
+		total += result.RowsAffected
+	}
+	return total, errors.Join(errs...)
+}
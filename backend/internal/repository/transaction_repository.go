@@ -7,7 +7,6 @@ import (
 
 	"github.com/google/uuid"
 	"gorm.io/gorm"
-	"gorm.io/gorm/clause"
 )
 
 type TransactionRepository interface {
@@ -17,7 +16,12 @@ type TransactionRepository interface {
 	GetDashboardSummary(filter *DashboardFilter) (*DashboardSummary, error)
 	GetUnsyncedCount() (int64, error)
 	Upsert(tx *models.Transaction) error
-	GetUpdatedAfter(since *time.Time) ([]models.Transaction, error)
+	GetUpdatedBetween(since, until uint64, scope *models.BranchScope) ([]models.Transaction, error)
+	EachUpdatedBetween(since, until uint64, scope *models.BranchScope, size int, fn func([]models.Transaction) error) error
+	FindSimilar(tx *models.Transaction, window time.Duration) ([]models.Transaction, error)
+	DayDigests(from, to time.Time, until *uint64, scope *models.BranchScope) ([]models.DayDigest, error)
+	FindByBranchDay(branchID uuid.UUID, day time.Time) ([]models.Transaction, error)
+	FindByPeriod(filter *DashboardFilter) ([]models.Transaction, error)
 }
 
 type DashboardSummary struct {
@@ -30,15 +34,21 @@ type DashboardSummary struct {
 }
 
 type transactionRepository struct {
-	db *gorm.DB
+	db   *gorm.DB
+	opts Options
 }
 
-func NewTransactionRepository(db *gorm.DB) TransactionRepository {
-	return &transactionRepository{db: db}
+func NewTransactionRepository(db *gorm.DB, opts Options) TransactionRepository {
+	return &transactionRepository{db: db, opts: opts}
 }
 
 func (r *transactionRepository) Create(tx *models.Transaction) error {
-	return r.db.Create(tx).Error
+	return r.db.Transaction(func(dbTx *gorm.DB) error {
+		if err := dbTx.Create(tx).Error; err != nil {
+			return err
+		}
+		return r.opts.recordChange(dbTx, models.EntityTransaction, models.ChangeCreate, tx.ID, tx)
+	})
 }
 
 func (r *transactionRepository) FindByID(id uuid.UUID) (*models.Transaction, error) {
@@ -56,12 +66,12 @@ func (r *transactionRepository) FindAll(page, limit int) ([]models.Transaction,
 
 	offset := (page - 1) * limit
 
-	err := r.db.Model(&models.Transaction{}).Count(&total).Error
+	err := r.db.Model(&models.Transaction{}).Scopes(r.opts.Scope.filter("branch_id")).Count(&total).Error
 	if err != nil {
 		return nil, 0, err
 	}
 
-	err = r.db.Order("created_at DESC").Offset(offset).Limit(limit).Find(&transactions).Error
+	err = r.db.Scopes(r.opts.Scope.filter("branch_id")).Order("created_at DESC").Offset(offset).Limit(limit).Find(&transactions).Error
 	if err != nil {
 		return nil, 0, err
 	}
@@ -83,6 +93,7 @@ func (r *transactionRepository) GetDashboardSummary(filter *DashboardFilter) (*D
 
 	// Helper to apply filters
 	applyFilter := func(query *gorm.DB) *gorm.DB {
+		query = query.Scopes(r.opts.Scope.filter("branch_id"))
 		if filter != nil {
 			if filter.BranchID != nil {
 				query = query.Where("branch_id = ?", *filter.BranchID)
@@ -126,7 +137,7 @@ func (r *transactionRepository) GetDashboardSummary(filter *DashboardFilter) (*D
 	}
 
 	// Unsync count (no date filter for this)
-	queryUnsync := r.db.Model(&models.Transaction{}).Where("is_synced = ?", false)
+	queryUnsync := r.db.Model(&models.Transaction{}).Scopes(r.opts.Scope.filter("branch_id")).Where("is_synced = ?", false)
 	if filter != nil && filter.BranchID != nil {
 		queryUnsync = queryUnsync.Where("branch_id = ?", *filter.BranchID)
 	}
@@ -152,18 +163,140 @@ func (r *transactionRepository) GetUnsyncedCount() (int64, error) {
 }
 
 func (r *transactionRepository) Upsert(tx *models.Transaction) error {
-	return r.db.Clauses(clause.OnConflict{
-		Columns:   []clause.Column{{Name: "id"}},
-		UpdateAll: true,
-	}).Create(tx).Error
+	return upsertTransaction(r.db, tx)
+}
+
+func upsertTransaction(db *gorm.DB, tx *models.Transaction) error {
+	return upsertReceived(db, tx)
 }
 
-func (r *transactionRepository) GetUpdatedAfter(since *time.Time) ([]models.Transaction, error) {
+// GetUpdatedBetween returns transactions written after the since receive
+// sequence number and no later than until, in the order they were written,
+// limited to the scope's branches when a scope is given.
+func (r *transactionRepository) GetUpdatedBetween(since, until uint64, scope *models.BranchScope) ([]models.Transaction, error) {
 	var transactions []models.Transaction
-	query := r.db.Model(&models.Transaction{})
-	if since != nil {
-		query = query.Where("updated_at > ? OR created_at > ?", since, since)
+	query := r.db.Model(&models.Transaction{}).Where("sync_seq > ? AND sync_seq <= ?", since, until)
+	if scope != nil && !scope.AllBranches {
+		if len(scope.BranchIDs) == 0 {
+			return []models.Transaction{}, nil
+		}
+		query = query.Where("branch_id IN ?", scope.BranchIDs)
+	}
+	err := query.Order("sync_seq asc").Find(&transactions).Error
+	return transactions, err
+}
+
+// EachUpdatedBetween calls fn with pages of up to size transactions written
+// after the since receive sequence number and no later than until, in the
+// order they were written, limited to the scope's branches when a scope is
+// given. Pages continue from the last number and ID read rather than an
+// offset, so rows written in between do not shift them.
+func (r *transactionRepository) EachUpdatedBetween(since, until uint64, scope *models.BranchScope, size int, fn func([]models.Transaction) error) error {
+	query := r.db.Model(&models.Transaction{}).Where("sync_seq > ? AND sync_seq <= ?", since, until)
+	if scope != nil && !scope.AllBranches {
+		if len(scope.BranchIDs) == 0 {
+			return nil
+		}
+		query = query.Where("branch_id IN ?", scope.BranchIDs)
+	}
+
+	var last *models.Transaction
+	for {
+		page := query.Session(&gorm.Session{})
+		if last != nil {
+			page = page.Where("sync_seq > ? OR (sync_seq = ? AND id > ?)", last.SyncSeq, last.SyncSeq, last.ID)
+		}
+		var transactions []models.Transaction
+		if err := page.Order("sync_seq asc, id asc").Limit(size).Find(&transactions).Error; err != nil {
+			return err
+		}
+		if len(transactions) == 0 {
+			return nil
+		}
+		if err := fn(transactions); err != nil {
+			return err
+		}
+		if len(transactions) < size {
+			return nil
+		}
+		last = &transactions[len(transactions)-1]
+	}
+}
+
+// DayDigests sums up, per branch and day, the transactions created from
+// from up to but not including to, limited to those written no later than
+// the until receive sequence number when given and to the scope's branches
+// when a scope is given.
+func (r *transactionRepository) DayDigests(from, to time.Time, until *uint64, scope *models.BranchScope) ([]models.DayDigest, error) {
+	query := r.db.Model(&models.Transaction{}).
+		Select("id, branch_id, type, amount, created_at").
+		Where("created_at >= ? AND created_at < ?", from, to)
+	if until != nil {
+		query = query.Where("sync_seq <= ?", *until)
+	}
+	if scope != nil && !scope.AllBranches {
+		if len(scope.BranchIDs) == 0 {
+			return []models.DayDigest{}, nil
+		}
+		query = query.Where("branch_id IN ?", scope.BranchIDs)
+	}
+
+	rows, err := query.Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	builder := models.NewDigestBuilder()
+	for rows.Next() {
+		var tx models.Transaction
+		if err := r.db.ScanRows(rows, &tx); err != nil {
+			return nil, err
+		}
+		builder.Add(tx.BranchID, tx.ID, tx.Type, tx.Amount, tx.CreatedAt)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return builder.Digests(), nil
+}
+
+// FindByBranchDay returns a branch's transactions created on the UTC day
+// that starts at day, whatever their stamp.
+func (r *transactionRepository) FindByBranchDay(branchID uuid.UUID, day time.Time) ([]models.Transaction, error) {
+	var transactions []models.Transaction
+	err := r.db.Where("branch_id = ? AND created_at >= ? AND created_at < ?", branchID, day, day.AddDate(0, 0, 1)).
+		Order("created_at asc").
+		Find(&transactions).Error
+	return transactions, err
+}
+
+// FindSimilar returns transactions of the same branch, type, category and
+// amount recorded within window of tx.
+func (r *transactionRepository) FindSimilar(tx *models.Transaction, window time.Duration) ([]models.Transaction, error) {
+	var transactions []models.Transaction
+	err := r.db.Where("branch_id = ? AND type = ? AND category = ? AND amount = ?", tx.BranchID, tx.Type, tx.Category, tx.Amount).
+		Where("created_at >= ? AND created_at <= ?", tx.CreatedAt.Add(-window), tx.CreatedAt.Add(window)).
+		Where("id <> ?", tx.ID).
+		Order("created_at ASC").
+		Find(&transactions).Error
+	return transactions, err
+}
+
+func (r *transactionRepository) FindByPeriod(filter *DashboardFilter) ([]models.Transaction, error) {
+	var transactions []models.Transaction
+	query := r.db.Model(&models.Transaction{}).Scopes(r.opts.Scope.filter("branch_id"))
+	if filter != nil {
+		if filter.BranchID != nil {
+			query = query.Where("branch_id = ?", *filter.BranchID)
+		}
+		if filter.StartDate != nil {
+			query = query.Where("created_at >= ?", *filter.StartDate)
+		}
+		if filter.EndDate != nil {
+			query = query.Where("created_at < ?", *filter.EndDate)
+		}
 	}
-	err := query.Find(&transactions).Error
+	err := query.Order("created_at ASC").Find(&transactions).Error
 	return transactions, err
 }
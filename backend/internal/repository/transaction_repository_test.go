@@ -0,0 +1,82 @@
+package repository
+
+import (
+	"testing"
+	"time"
+
+	"shosha-finance/internal/database"
+	"shosha-finance/internal/models"
+
+	"github.com/google/uuid"
+)
+
+func TestMixedZones(t *testing.T) {
+	jakarta := time.FixedZone("WIB", 7*3600)
+	newYork := time.FixedZone("EST", -5*3600)
+	day := time.Date(2026, 10, 19, 0, 0, 0, 0, time.UTC)
+	branch := models.Branch{ID: uuid.New(), Code: "A", Name: "Branch A"}
+
+	transaction := func(createdAt time.Time) *models.Transaction {
+		return &models.Transaction{ID: uuid.New(), BranchID: branch.ID, Type: models.TransactionTypeIN, Category: "Sales", Amount: 1000, CreatedAt: createdAt}
+	}
+	// Written on devices in different zones, each before or after the day
+	// in UTC but not by its own clock
+	before := transaction(day.Add(-30 * time.Minute).In(jakarta))
+	early := transaction(day.Add(time.Hour).In(newYork))
+	late := transaction(day.Add(12 * time.Hour))
+
+	db := newTestDB(t)
+	if err := db.Create(&branch).Error; err != nil {
+		t.Fatal(err)
+	}
+	for _, tx := range []*models.Transaction{late, before, early} {
+		if err := db.Create(tx).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	repo := NewTransactionRepository(db, Options{})
+
+	assertIDs := func(t *testing.T, got []models.Transaction, want ...*models.Transaction) {
+		t.Helper()
+		if len(got) != len(want) {
+			t.Fatalf("got %d transactions, want %d", len(got), len(want))
+		}
+		for i := range want {
+			if got[i].ID != want[i].ID {
+				t.Errorf("transaction %d = created %v, want created %v", i, got[i].CreatedAt, want[i].CreatedAt)
+			}
+		}
+	}
+
+	t.Run("find by period", func(t *testing.T) {
+		start, end := day.In(jakarta), day.AddDate(0, 0, 1).In(jakarta)
+		got, err := repo.FindByPeriod(&DashboardFilter{StartDate: &start, EndDate: &end})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertIDs(t, got, early, late)
+	})
+
+	t.Run("find similar", func(t *testing.T) {
+		got, err := repo.FindSimilar(early, 2*time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertIDs(t, got, before)
+	})
+
+	t.Run("times written before they were kept in UTC", func(t *testing.T) {
+		stored := day.Add(time.Hour).In(newYork).Format("2006-01-02 15:04:05.999999999-07:00")
+		if err := db.Exec("UPDATE transactions SET created_at = '"+stored+"' WHERE id = ?", early.ID).Error; err != nil {
+			t.Fatal(err)
+		}
+		if err := database.Migrate(db); err != nil {
+			t.Fatal(err)
+		}
+		got, err := repo.FindByPeriod(&DashboardFilter{StartDate: &day})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertIDs(t, got, early, late)
+	})
+}
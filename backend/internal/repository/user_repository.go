@@ -1,6 +1,8 @@
 package repository
 
 import (
+	"time"
+
 	"shosha-finance/internal/models"
 
 	"github.com/google/uuid"
@@ -17,6 +19,8 @@ type UserRepository interface {
 	Update(user *models.User) error
 	Delete(id uuid.UUID) error
 	Count() (int64, error)
+	GetUpdatedBetween(since, until uint64) ([]models.User, error)
+	ApplyPulled(users []models.User, revoked []uuid.UUID) error
 }
 
 type userRepository struct {
@@ -77,8 +81,10 @@ func (r *userRepository) Update(user *models.User) error {
 	return r.db.Save(user).Error
 }
 
+// Delete soft-deletes the user through an update, so the delete is stamped
+// and devices pull it.
 func (r *userRepository) Delete(id uuid.UUID) error {
-	return r.db.Delete(&models.User{}, id).Error
+	return r.db.Model(&models.User{}).Where("id = ?", id).Update("deleted_at", time.Now()).Error
 }
 
 func (r *userRepository) Count() (int64, error) {
@@ -86,3 +92,45 @@ func (r *userRepository) Count() (int64, error) {
 	err := r.db.Model(&models.User{}).Count(&count).Error
 	return count, err
 }
+
+// GetUpdatedBetween returns users written or deleted after the since
+// receive sequence number and no later than until, in the order they were
+// written.
+func (r *userRepository) GetUpdatedBetween(since, until uint64) ([]models.User, error) {
+	var users []models.User
+	err := r.db.Unscoped().Model(&models.User{}).
+		Where("sync_seq > ? AND sync_seq <= ?", since, until).
+		Order("sync_seq asc").
+		Find(&users).Error
+	return users, err
+}
+
+// ApplyPulled stores users received from the cloud on a local install and
+// removes those revoked from it. Once the cloud has sent users, the ones
+// only known here, such as the seeded defaults, are removed too: users are
+// managed on the cloud.
+func (r *userRepository) ApplyPulled(users []models.User, revoked []uuid.UUID) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		if len(users) > 0 {
+			if err := tx.Unscoped().Where("is_synced = ?", false).Delete(&models.User{}).Error; err != nil {
+				return err
+			}
+		}
+
+		now := time.Now()
+		for i := range users {
+			user := &users[i]
+			user.IsSynced = true
+			user.SyncedAt = &now
+
+			if err := upsertReceived(tx, user); err != nil {
+				return err
+			}
+		}
+
+		if len(revoked) == 0 {
+			return nil
+		}
+		return tx.Unscoped().Where("id IN ?", revoked).Delete(&models.User{}).Error
+	})
+}
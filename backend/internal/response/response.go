@@ -62,6 +62,24 @@ func InternalError(c *fiber.Ctx, message string) error {
 	})
 }
 
+func Conflict(c *fiber.Ctx, message string, data interface{}) error {
+	return c.Status(fiber.StatusConflict).JSON(APIResponse{
+		Success: false,
+		Message: message,
+		Data:    data,
+	})
+}
+
+// UpgradeRequired answers 426 when the client speaks a protocol the server
+// no longer accepts; data tells it what to update.
+func UpgradeRequired(c *fiber.Ctx, message string, data interface{}) error {
+	return c.Status(fiber.StatusUpgradeRequired).JSON(APIResponse{
+		Success: false,
+		Message: message,
+		Data:    data,
+	})
+}
+
 func NotFound(c *fiber.Ctx, message string) error {
 	return c.Status(fiber.StatusNotFound).JSON(APIResponse{
 		Success: false,
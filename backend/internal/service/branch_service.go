@@ -1,8 +1,6 @@
 package service
 
 import (
-	"time"
-
 	"shosha-finance/internal/models"
 	"shosha-finance/internal/repository"
 
@@ -20,7 +18,7 @@ type BranchService interface {
 	Count() (int64, error)
 	CreateDefaultBranches() error
 	Upsert(branch *models.Branch) error
-	GetUpdatedAfter(since *time.Time) ([]models.Branch, error)
+	GetUpdatedBetween(since, until uint64) ([]models.Branch, error)
 }
 
 type branchService struct {
@@ -121,6 +119,6 @@ func (s *branchService) Upsert(branch *models.Branch) error {
 	return s.repo.Upsert(branch)
 }
 
-func (s *branchService) GetUpdatedAfter(since *time.Time) ([]models.Branch, error) {
-	return s.repo.GetUpdatedAfter(since)
+func (s *branchService) GetUpdatedBetween(since, until uint64) ([]models.Branch, error) {
+	return s.repo.GetUpdatedBetween(since, until)
 }
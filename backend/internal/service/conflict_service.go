@@ -0,0 +1,66 @@
+package service
+
+import (
+	"errors"
+
+	"shosha-finance/internal/models"
+	"shosha-finance/internal/repository"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	ErrInvalidConflictSide = errors.New("winner must be local or cloud")
+	ErrConflictNotFound    = errors.New("sync conflict not found")
+)
+
+type ConflictService interface {
+	GetAll(filter *repository.ConflictFilter) ([]models.SyncConflict, error)
+	GetByID(id uuid.UUID) (*models.SyncConflict, error)
+	CountOpen() (int64, error)
+	Resolve(id uuid.UUID, winner models.ConflictSide, userID uuid.UUID) (*models.SyncConflict, error)
+}
+
+type conflictService struct {
+	repo repository.ConflictRepository
+}
+
+func NewConflictService(repo repository.ConflictRepository) ConflictService {
+	return &conflictService{repo: repo}
+}
+
+func (s *conflictService) GetAll(filter *repository.ConflictFilter) ([]models.SyncConflict, error) {
+	return s.repo.FindAll(filter)
+}
+
+func (s *conflictService) GetByID(id uuid.UUID) (*models.SyncConflict, error) {
+	return s.repo.FindByID(id)
+}
+
+func (s *conflictService) CountOpen() (int64, error) {
+	return s.repo.CountOpen()
+}
+
+// Resolve keeps the chosen version of the record. Conflicts already settled
+// by policy can be resolved again to override the decision.
+func (s *conflictService) Resolve(id uuid.UUID, winner models.ConflictSide, userID uuid.UUID) (*models.SyncConflict, error) {
+	if winner != models.ConflictSideLocal && winner != models.ConflictSideCloud {
+		return nil, ErrInvalidConflictSide
+	}
+
+	conflict, err := s.repo.FindByID(id)
+	if err != nil {
+		return nil, ErrConflictNotFound
+	}
+	if err := s.repo.Resolve(conflict, winner, userID); err != nil {
+		return nil, err
+	}
+
+	log.Info().
+		Str("entity_type", conflict.EntityType).
+		Str("entity_id", conflict.EntityID.String()).
+		Str("winner", string(winner)).
+		Msg("Sync conflict resolved")
+	return conflict, nil
+}
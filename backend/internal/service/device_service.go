@@ -0,0 +1,457 @@
+package service
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	"shosha-finance/internal/config"
+	"shosha-finance/internal/models"
+	"shosha-finance/internal/repository"
+	"shosha-finance/internal/syncproto"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrDeviceNotFound        = errors.New("device not found")
+	ErrInvalidScopeBranch    = errors.New("branch in scope does not exist")
+	ErrDeviceUnauthorized    = errors.New("invalid device credential")
+	ErrDeviceInactive        = errors.New("device has been deactivated")
+	ErrEnrollmentBranch      = errors.New("branch of enrollment code does not exist")
+	ErrInvalidEnrollmentCode = errors.New("enrollment code is invalid, expired or already used")
+)
+
+type DeviceService interface {
+	Authenticate(deviceID, credential, appVersion string) (*models.Device, error)
+	CreateEnrollmentCode(req *models.EnrollmentCodeRequest, userID uuid.UUID) (*models.EnrollmentCode, error)
+	GetEnrollmentCodes() ([]models.EnrollmentCode, error)
+	Enroll(req *models.EnrollRequest) (*models.EnrollResponse, error)
+	GetAll() ([]models.Device, error)
+	UpdateScope(id string, req *models.DeviceScopeRequest) (*models.Device, error)
+	SetActive(id string, active bool) (*models.Device, error)
+	Handshake(device *models.Device, hello *syncproto.Hello) (*syncproto.Welcome, error)
+	MinProtocol() int
+	RecordPush(deviceID string, err error)
+	RecordPull(deviceID string, err error)
+	RecordReport(deviceID string, report *syncproto.StatusReport) error
+	GetSyncHealth(thresholds models.SyncHealthThresholds) (*models.SyncHealth, error)
+}
+
+type deviceService struct {
+	repo        repository.DeviceRepository
+	branchRepo  repository.BranchRepository
+	minProtocol int
+}
+
+// NewDeviceService returns a device service that accepts sync protocol
+// versions from minProtocol up to the current one.
+func NewDeviceService(repo repository.DeviceRepository, branchRepo repository.BranchRepository, minProtocol int) DeviceService {
+	if minProtocol < syncproto.MinVersion {
+		minProtocol = syncproto.MinVersion
+	}
+	return &deviceService{repo: repo, branchRepo: branchRepo, minProtocol: minProtocol}
+}
+
+// Handshake settles the sync protocol with a device and records the agreed
+// version. It returns a *syncproto.Refusal when the two share none.
+func (s *deviceService) Handshake(device *models.Device, hello *syncproto.Hello) (*syncproto.Welcome, error) {
+	welcome, err := syncproto.Agree(hello, s.minProtocol)
+	if err != nil {
+		log.Warn().
+			Err(err).
+			Str("device_id", device.ID).
+			Int("protocol_version", hello.ProtocolVersion).
+			Msg("Sync handshake refused")
+		s.recordError(device.ID, "handshake", err)
+		return nil, err
+	}
+	welcome.AppVersion = config.AppVersion
+
+	if err := s.repo.SetProtocol(device.ID, welcome.ProtocolVersion); err != nil {
+		return nil, err
+	}
+	device.ProtocolVersion = welcome.ProtocolVersion
+	return welcome, nil
+}
+
+// MinProtocol is the oldest sync protocol version accepted.
+func (s *deviceService) MinProtocol() int {
+	return s.minProtocol
+}
+
+// Authenticate checks the credential a device syncs with and records that
+// it was seen, with the app version it runs.
+func (s *deviceService) Authenticate(deviceID, credential, appVersion string) (*models.Device, error) {
+	device, err := s.repo.FindByID(deviceID)
+	if err != nil || device.CredentialHash == "" {
+		return nil, ErrDeviceUnauthorized
+	}
+	if subtle.ConstantTimeCompare([]byte(hashCredential(credential)), []byte(device.CredentialHash)) != 1 {
+		return nil, ErrDeviceUnauthorized
+	}
+	if !device.IsActive {
+		return nil, ErrDeviceInactive
+	}
+
+	now := time.Now()
+	if err := s.repo.MarkSeen(device.ID, appVersion, now); err != nil {
+		log.Warn().Err(err).Str("device_id", device.ID).Msg("Failed to record device last seen")
+	}
+	device.LastSeenAt = &now
+	if appVersion != "" {
+		device.AppVersion = appVersion
+	}
+	return device, nil
+}
+
+// RecordPush notes a push from the device, or why the cloud failed it.
+func (s *deviceService) RecordPush(deviceID string, err error) {
+	s.recordSync(deviceID, "last_push_at", "push", err)
+}
+
+// RecordPull notes a completed pull by the device, or why the cloud failed
+// it.
+func (s *deviceService) RecordPull(deviceID string, err error) {
+	s.recordSync(deviceID, "last_pull_at", "pull", err)
+}
+
+func (s *deviceService) recordSync(deviceID, column, stage string, err error) {
+	if err != nil {
+		s.recordError(deviceID, stage, err)
+		return
+	}
+	if err := s.repo.UpdateSyncHealth(deviceID, map[string]interface{}{column: time.Now()}); err != nil {
+		log.Warn().Err(err).Str("device_id", deviceID).Msg("Failed to record device sync")
+	}
+}
+
+func (s *deviceService) recordError(deviceID, stage string, err error) {
+	columns := map[string]interface{}{
+		"last_error":    stage + ": " + err.Error(),
+		"last_error_at": time.Now(),
+	}
+	if err := s.repo.UpdateSyncHealth(deviceID, columns); err != nil {
+		log.Warn().Err(err).Str("device_id", deviceID).Msg("Failed to record device sync error")
+	}
+}
+
+// RecordReport stores what the device reported at the end of a sync
+// cycle. The last error is kept until a later one replaces it; whether it
+// still applies shows from its time against the last sync.
+func (s *deviceService) RecordReport(deviceID string, report *syncproto.StatusReport) error {
+	now := time.Now()
+	columns := map[string]interface{}{
+		"pending_count": report.QueueDepth,
+		"reported_at":   now,
+	}
+	if report.LastError != "" {
+		columns["last_error"] = report.LastError
+		columns["last_error_at"] = now
+	}
+	return s.repo.UpdateSyncHealth(deviceID, columns)
+}
+
+// GetSyncHealth rates every device by the time since its last push or
+// pull and groups them by branch. A branch takes the status of its
+// healthiest active device; every active branch is listed, so one whose
+// device was never enrolled shows too.
+func (s *deviceService) GetSyncHealth(thresholds models.SyncHealthThresholds) (*models.SyncHealth, error) {
+	devices, err := s.repo.FindAll()
+	if err != nil {
+		return nil, err
+	}
+	branches, err := s.branchRepo.FindActive()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	health := &models.SyncHealth{
+		GeneratedAt:  now,
+		Thresholds:   thresholds,
+		Summary:      map[models.SyncHealthStatus]int{},
+		Branches:     make([]models.BranchSyncHealth, 0, len(branches)),
+		OtherDevices: []models.DeviceSyncHealth{},
+	}
+
+	byBranch := map[uuid.UUID][]models.DeviceSyncHealth{}
+	for i := range devices {
+		device := deviceSyncHealth(&devices[i], thresholds, now)
+		if devices[i].AllBranches || len(devices[i].Branches) == 0 {
+			health.OtherDevices = append(health.OtherDevices, device)
+			continue
+		}
+		for _, assignment := range devices[i].Branches {
+			byBranch[assignment.BranchID] = append(byBranch[assignment.BranchID], device)
+		}
+	}
+
+	for _, branch := range branches {
+		entry := models.BranchSyncHealth{
+			BranchID: branch.ID,
+			Code:     branch.Code,
+			Name:     branch.Name,
+			Status:   models.SyncHealthNever,
+			Devices:  byBranch[branch.ID],
+		}
+		if entry.Devices == nil {
+			entry.Devices = []models.DeviceSyncHealth{}
+		}
+		// A branch is as healthy as its best active device
+		active := false
+		for _, device := range entry.Devices {
+			if device.Status == models.SyncHealthInactive {
+				continue
+			}
+			entry.PendingCount += device.PendingCount
+			if !active || device.Status.Severity() < entry.Status.Severity() {
+				entry.Status = device.Status
+			}
+			active = true
+			if device.LastSyncAt != nil && (entry.LastSyncAt == nil || device.LastSyncAt.After(*entry.LastSyncAt)) {
+				entry.LastSyncAt = device.LastSyncAt
+			}
+		}
+		health.Summary[entry.Status]++
+		health.Branches = append(health.Branches, entry)
+	}
+
+	// Worst first; among equals, the longest without a sync first
+	sort.SliceStable(health.Branches, func(i, j int) bool {
+		a, b := health.Branches[i], health.Branches[j]
+		if a.Status != b.Status {
+			return a.Status.Severity() > b.Status.Severity()
+		}
+		if a.LastSyncAt == nil || b.LastSyncAt == nil {
+			return a.LastSyncAt == nil && b.LastSyncAt != nil
+		}
+		return a.LastSyncAt.Before(*b.LastSyncAt)
+	})
+
+	return health, nil
+}
+
+// deviceSyncHealth rates a device against the thresholds.
+func deviceSyncHealth(device *models.Device, thresholds models.SyncHealthThresholds, now time.Time) models.DeviceSyncHealth {
+	health := models.DeviceSyncHealth{
+		DeviceID:        device.ID,
+		Name:            device.Name,
+		AppVersion:      device.AppVersion,
+		ProtocolVersion: device.ProtocolVersion,
+		LastSeenAt:      device.LastSeenAt,
+		LastPushAt:      device.LastPushAt,
+		LastPullAt:      device.LastPullAt,
+		LastSyncAt:      device.LastPullAt,
+		PendingCount:    device.PendingCount,
+		ReportedAt:      device.ReportedAt,
+		LastError:       device.LastError,
+		LastErrorAt:     device.LastErrorAt,
+	}
+	if device.LastPushAt != nil && (health.LastSyncAt == nil || device.LastPushAt.After(*health.LastSyncAt)) {
+		health.LastSyncAt = device.LastPushAt
+	}
+
+	switch {
+	case !device.IsActive:
+		health.Status = models.SyncHealthInactive
+	case health.LastSyncAt == nil:
+		health.Status = models.SyncHealthNever
+	case now.Sub(*health.LastSyncAt) >= time.Duration(thresholds.OfflineAfterHours)*time.Hour:
+		health.Status = models.SyncHealthOffline
+	case now.Sub(*health.LastSyncAt) >= time.Duration(thresholds.StaleAfterHours)*time.Hour:
+		health.Status = models.SyncHealthStale
+	case device.LastErrorAt != nil && device.LastErrorAt.After(*health.LastSyncAt):
+		health.Status = models.SyncHealthFailing
+	default:
+		health.Status = models.SyncHealthOK
+	}
+	return health
+}
+
+// CreateEnrollmentCode issues a one-time code that enrolls a device for the
+// branch. Codes expire after three days unless asked otherwise.
+func (s *deviceService) CreateEnrollmentCode(req *models.EnrollmentCodeRequest, userID uuid.UUID) (*models.EnrollmentCode, error) {
+	branchID, err := uuid.Parse(req.BranchID)
+	if err != nil {
+		return nil, ErrEnrollmentBranch
+	}
+	if _, err := s.branchRepo.FindByID(branchID); err != nil {
+		return nil, ErrEnrollmentBranch
+	}
+
+	hours := req.ExpiresInHours
+	if hours <= 0 {
+		hours = 72
+	}
+	code, err := newEnrollmentCode()
+	if err != nil {
+		return nil, err
+	}
+
+	enrollment := &models.EnrollmentCode{
+		Code:       code,
+		BranchID:   branchID,
+		DeviceName: req.DeviceName,
+		ExpiresAt:  time.Now().Add(time.Duration(hours) * time.Hour),
+		CreatedBy:  userID,
+	}
+	if err := s.repo.CreateEnrollmentCode(enrollment); err != nil {
+		return nil, err
+	}
+
+	log.Info().Str("branch_id", branchID.String()).Time("expires_at", enrollment.ExpiresAt).Msg("Enrollment code created")
+	return enrollment, nil
+}
+
+func (s *deviceService) GetEnrollmentCodes() ([]models.EnrollmentCode, error) {
+	return s.repo.FindEnrollmentCodes()
+}
+
+// Enroll exchanges an enrollment code for a new device ID and credential.
+// Only a hash of the credential is kept.
+func (s *deviceService) Enroll(req *models.EnrollRequest) (*models.EnrollResponse, error) {
+	code, err := s.repo.FindEnrollmentCode(strings.ToUpper(strings.TrimSpace(req.Code)))
+	if err != nil || code.UsedAt != nil || time.Now().After(code.ExpiresAt) {
+		return nil, ErrInvalidEnrollmentCode
+	}
+
+	credential, err := randomHex(32)
+	if err != nil {
+		return nil, err
+	}
+
+	name := code.DeviceName
+	if name == "" {
+		name = req.Name
+	}
+	now := time.Now()
+	device := &models.Device{
+		ID:             uuid.New().String(),
+		Name:           name,
+		CredentialHash: hashCredential(credential),
+		IsActive:       true,
+		AppVersion:     req.AppVersion,
+		LastSeenAt:     &now,
+		EnrolledAt:     &now,
+	}
+	if err := s.repo.Enroll(code, device); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrInvalidEnrollmentCode
+		}
+		return nil, err
+	}
+
+	log.Info().
+		Str("device_id", device.ID).
+		Str("name", device.Name).
+		Str("branch_id", code.BranchID.String()).
+		Str("app_version", device.AppVersion).
+		Msg("Device enrolled")
+
+	return &models.EnrollResponse{
+		DeviceID:   device.ID,
+		Credential: credential,
+		BranchID:   code.BranchID,
+	}, nil
+}
+
+// SetActive deactivates a device, e.g. a lost laptop, or lets it sync
+// again.
+func (s *deviceService) SetActive(id string, active bool) (*models.Device, error) {
+	device, err := s.repo.FindByID(id)
+	if err != nil {
+		return nil, ErrDeviceNotFound
+	}
+
+	device.IsActive = active
+	if active {
+		device.DeactivatedAt = nil
+	} else if device.DeactivatedAt == nil {
+		now := time.Now()
+		device.DeactivatedAt = &now
+	}
+	if err := s.repo.Update(device); err != nil {
+		return nil, err
+	}
+
+	log.Info().Str("device_id", device.ID).Bool("is_active", active).Msg("Device activation changed")
+	return device, nil
+}
+
+func (s *deviceService) GetAll() ([]models.Device, error) {
+	return s.repo.FindAll()
+}
+
+// UpdateScope replaces the branches a device may pull. Head-office devices
+// are given all branches instead of a list.
+func (s *deviceService) UpdateScope(id string, req *models.DeviceScopeRequest) (*models.Device, error) {
+	device, err := s.repo.FindByID(id)
+	if err != nil {
+		return nil, ErrDeviceNotFound
+	}
+
+	branchIDs := make([]uuid.UUID, 0, len(req.BranchIDs))
+	for _, raw := range req.BranchIDs {
+		branchID, err := uuid.Parse(raw)
+		if err != nil {
+			return nil, ErrInvalidScopeBranch
+		}
+		if _, err := s.branchRepo.FindByID(branchID); err != nil {
+			return nil, ErrInvalidScopeBranch
+		}
+		branchIDs = append(branchIDs, branchID)
+	}
+
+	if req.Name != nil {
+		device.Name = *req.Name
+	}
+	device.AllBranches = req.AllBranches
+	if err := s.repo.UpdateScope(device, branchIDs); err != nil {
+		return nil, err
+	}
+
+	log.Info().
+		Str("device_id", device.ID).
+		Bool("all_branches", device.AllBranches).
+		Int("branches", len(branchIDs)).
+		Msg("Device branch scope updated")
+	return device, nil
+}
+
+// enrollmentAlphabet leaves out characters easily misread when a code is
+// typed in by hand.
+var enrollmentAlphabet = base32.NewEncoding("ABCDEFGHJKLMNPQRSTUVWXYZ23456789").WithPadding(base32.NoPadding)
+
+// newEnrollmentCode returns a random code in the form XXXX-XXXX-XXXX.
+func newEnrollmentCode() (string, error) {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	code := enrollmentAlphabet.EncodeToString(buf)[:12]
+	return code[:4] + "-" + code[4:8] + "-" + code[8:], nil
+}
+
+func randomHex(n int) (string, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// hashCredential hashes a device credential for storage. Credentials are
+// long random strings, so a plain SHA-256 is enough.
+func hashCredential(credential string) string {
+	sum := sha256.Sum256([]byte(credential))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,111 @@
+package service
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"shosha-finance/internal/models"
+	"shosha-finance/internal/repository"
+
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrIdempotencyKeyReused     = errors.New("idempotency key was used for a different request")
+	ErrIdempotencyKeyInProgress = errors.New("a request with this idempotency key is still in progress")
+)
+
+type IdempotencyService interface {
+	Begin(key, userID, method, path string, body []byte) (*models.IdempotencyKey, error)
+	Complete(key string, statusCode int, body []byte) error
+	Release(key string) error
+	PurgeExpired() error
+}
+
+type idempotencyService struct {
+	repo repository.IdempotencyRepository
+	ttl  time.Duration
+}
+
+func NewIdempotencyService(repo repository.IdempotencyRepository, ttl time.Duration) IdempotencyService {
+	return &idempotencyService{repo: repo, ttl: ttl}
+}
+
+// Begin reserves the key for a new request. It returns the stored record when
+// the request is a replay of one that already completed, or nil when the
+// caller should process the request and then Complete or Release the key.
+func (s *idempotencyService) Begin(key, userID, method, path string, body []byte) (*models.IdempotencyKey, error) {
+	hash := requestHash(method, path, body)
+
+	existing, err := s.repo.FindByKey(key)
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+
+	if existing != nil && time.Since(existing.CreatedAt) > s.ttl {
+		if err := s.repo.Delete(key); err != nil {
+			return nil, err
+		}
+		existing = nil
+	}
+
+	if existing != nil {
+		if existing.UserID != userID || existing.RequestHash != hash {
+			return nil, ErrIdempotencyKeyReused
+		}
+		if existing.StatusCode == 0 {
+			return nil, ErrIdempotencyKeyInProgress
+		}
+		log.Info().Str("key", key).Msg("Replaying idempotent request")
+		return existing, nil
+	}
+
+	record := &models.IdempotencyKey{
+		Key:         key,
+		UserID:      userID,
+		Method:      method,
+		Path:        path,
+		RequestHash: hash,
+	}
+
+	// The primary key makes a concurrent request with the same key fail here
+	if err := s.repo.Create(record); err != nil {
+		return nil, ErrIdempotencyKeyInProgress
+	}
+
+	return nil, nil
+}
+
+func (s *idempotencyService) Complete(key string, statusCode int, body []byte) error {
+	return s.repo.Complete(key, statusCode, string(body))
+}
+
+// Release drops a reservation so that the request can be retried, used when
+// processing did not succeed.
+func (s *idempotencyService) Release(key string) error {
+	return s.repo.Delete(key)
+}
+
+func (s *idempotencyService) PurgeExpired() error {
+	deleted, err := s.repo.DeleteOlderThan(time.Now().Add(-s.ttl))
+	if err != nil {
+		return err
+	}
+	if deleted > 0 {
+		log.Info().Int64("deleted", deleted).Msg("Purged expired idempotency keys")
+	}
+	return nil
+}
+
+func requestHash(method, path string, body []byte) string {
+	h := sha256.New()
+	h.Write([]byte(method))
+	h.Write([]byte{0})
+	h.Write([]byte(path))
+	h.Write([]byte{0})
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
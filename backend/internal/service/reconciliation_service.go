@@ -0,0 +1,142 @@
+package service
+
+import (
+	"sort"
+	"time"
+
+	"shosha-finance/internal/models"
+	"shosha-finance/internal/repository"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+)
+
+type ReconciliationService interface {
+	Create(req *models.CashReconciliationRequest, userID uuid.UUID) (*models.CashReconciliation, error)
+	GetByID(id uuid.UUID) (*models.CashReconciliation, error)
+	GetAll(filter *repository.ReconciliationFilter) ([]models.CashReconciliation, error)
+	GetSummary(filter *repository.ReconciliationFilter) ([]models.CashReconciliationSummary, error)
+	Upsert(rec *models.CashReconciliation) error
+}
+
+type reconciliationService struct {
+	repo   repository.ReconciliationRepository
+	txRepo repository.TransactionRepository
+}
+
+func NewReconciliationService(repo repository.ReconciliationRepository, txRepo repository.TransactionRepository) ReconciliationService {
+	return &reconciliationService{repo: repo, txRepo: txRepo}
+}
+
+// Create records a cash count against the branch balance at this moment. The
+// balance comes from the dashboard summary so both always agree.
+func (s *reconciliationService) Create(req *models.CashReconciliationRequest, userID uuid.UUID) (*models.CashReconciliation, error) {
+	branchID, err := uuid.Parse(req.BranchID)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	summary, err := s.txRepo.GetDashboardSummary(&repository.DashboardFilter{
+		BranchID: &branchID,
+		EndDate:  &now,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	rec := &models.CashReconciliation{
+		ID:            uuid.New(),
+		BranchID:      branchID,
+		UserID:        userID,
+		CountedAmount: req.CountedAmount,
+		SystemBalance: summary.Balance,
+		Difference:    req.CountedAmount - summary.Balance,
+		Notes:         req.Notes,
+		ReconciledAt:  now,
+	}
+
+	var adjustment *models.Transaction
+	if req.PostAdjustment && rec.Difference != 0 {
+		adjustment = &models.Transaction{
+			ID:          uuid.New(),
+			BranchID:    branchID,
+			Type:        models.TransactionTypeIN,
+			Category:    models.CategoryCashAdjustment,
+			Amount:      rec.Difference,
+			Description: "Penyesuaian kas opname",
+		}
+		if rec.Difference < 0 {
+			adjustment.Type = models.TransactionTypeOUT
+			adjustment.Amount = -rec.Difference
+		}
+	}
+
+	if err := s.repo.Create(rec, adjustment); err != nil {
+		log.Error().Err(err).Msg("Failed to create cash reconciliation")
+		return nil, err
+	}
+
+	log.Info().
+		Str("id", rec.ID.String()).
+		Int64("system_balance", rec.SystemBalance).
+		Int64("counted", rec.CountedAmount).
+		Int64("difference", rec.Difference).
+		Bool("adjusted", adjustment != nil).
+		Msg("Cash reconciliation recorded")
+
+	return rec, nil
+}
+
+func (s *reconciliationService) GetByID(id uuid.UUID) (*models.CashReconciliation, error) {
+	return s.repo.FindByID(id)
+}
+
+func (s *reconciliationService) GetAll(filter *repository.ReconciliationFilter) ([]models.CashReconciliation, error) {
+	return s.repo.FindAll(filter)
+}
+
+// GetSummary aggregates the reconciliation history per branch.
+func (s *reconciliationService) GetSummary(filter *repository.ReconciliationFilter) ([]models.CashReconciliationSummary, error) {
+	recs, err := s.repo.FindAll(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	byBranch := map[uuid.UUID]*models.CashReconciliationSummary{}
+	for _, rec := range recs {
+		summary, ok := byBranch[rec.BranchID]
+		if !ok {
+			summary = &models.CashReconciliationSummary{BranchID: rec.BranchID}
+			byBranch[rec.BranchID] = summary
+		}
+
+		summary.Count++
+		summary.TotalDifference += rec.Difference
+		if rec.Difference < 0 {
+			summary.TotalShortage += -rec.Difference
+		} else {
+			summary.TotalSurplus += rec.Difference
+		}
+		if rec.AdjustmentTxID != nil {
+			summary.AdjustedCount++
+		}
+		if rec.ReconciledAt.After(summary.LastReconciledAt) {
+			summary.LastReconciledAt = rec.ReconciledAt
+		}
+	}
+
+	summaries := make([]models.CashReconciliationSummary, 0, len(byBranch))
+	for _, summary := range byBranch {
+		summaries = append(summaries, *summary)
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		return summaries[i].LastReconciledAt.After(summaries[j].LastReconciledAt)
+	})
+
+	return summaries, nil
+}
+
+func (s *reconciliationService) Upsert(rec *models.CashReconciliation) error {
+	return s.repo.Upsert(rec)
+}
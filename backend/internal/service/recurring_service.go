@@ -0,0 +1,227 @@
+package service
+
+import (
+	"errors"
+	"time"
+
+	"shosha-finance/internal/models"
+	"shosha-finance/internal/repository"
+	"shosha-finance/internal/settings"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	ErrInvalidSchedule = errors.New("invalid recurring schedule")
+	ErrInvalidDate     = errors.New("invalid date, use YYYY-MM-DD")
+	ErrScheduleEnded   = errors.New("recurring schedule has ended")
+)
+
+type RecurringService interface {
+	Create(req *models.RecurringTransactionRequest) (*models.RecurringTransaction, error)
+	GetByID(id uuid.UUID) (*models.RecurringTransaction, error)
+	GetAll() ([]models.RecurringTransaction, error)
+	Pause(id uuid.UUID) (*models.RecurringTransaction, error)
+	Resume(id uuid.UUID) (*models.RecurringTransaction, error)
+	Preview(id uuid.UUID, count int) ([]time.Time, error)
+	ProcessDue(now time.Time) (int, error)
+}
+
+type recurringService struct {
+	repo     repository.RecurringRepository
+	settings *settings.Store
+}
+
+func NewRecurringService(repo repository.RecurringRepository, store *settings.Store) RecurringService {
+	return &recurringService{repo: repo, settings: store}
+}
+
+func (s *recurringService) Create(req *models.RecurringTransactionRequest) (*models.RecurringTransaction, error) {
+	branchID, err := uuid.Parse(req.BranchID)
+	if err != nil {
+		return nil, err
+	}
+
+	switch req.Frequency {
+	case models.FrequencyDaily:
+	case models.FrequencyWeekly:
+		if req.DayOfWeek < 0 || req.DayOfWeek > 6 {
+			return nil, ErrInvalidSchedule
+		}
+	case models.FrequencyMonthly:
+		if req.DayOfMonth < 1 || req.DayOfMonth > 31 {
+			return nil, ErrInvalidSchedule
+		}
+	default:
+		return nil, ErrInvalidSchedule
+	}
+
+	if !categoryAllowed(s.settings, req.Category) {
+		return nil, ErrCategoryNotAllowed
+	}
+
+	loc := s.settings.Location()
+	now := time.Now().In(loc)
+	startDate := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, loc)
+	if req.StartDate != "" {
+		startDate, err = time.ParseInLocation("2006-01-02", req.StartDate, loc)
+		if err != nil {
+			return nil, ErrInvalidDate
+		}
+	}
+
+	var endDate *time.Time
+	if req.EndDate != "" {
+		end, err := time.ParseInLocation("2006-01-02", req.EndDate, loc)
+		if err != nil {
+			return nil, ErrInvalidDate
+		}
+		if end.Before(startDate) {
+			return nil, ErrInvalidSchedule
+		}
+		endDate = &end
+	}
+
+	rec := &models.RecurringTransaction{
+		ID:          uuid.New(),
+		BranchID:    branchID,
+		Type:        req.Type,
+		Category:    req.Category,
+		Amount:      req.Amount,
+		Description: req.Description,
+		Frequency:   req.Frequency,
+		DayOfMonth:  req.DayOfMonth,
+		DayOfWeek:   req.DayOfWeek,
+		StartDate:   startDate,
+		EndDate:     endDate,
+		IsActive:    true,
+	}
+	rec.NextRunAt = rec.FirstOccurrence(loc)
+
+	if err := s.repo.Create(rec); err != nil {
+		log.Error().Err(err).Msg("Failed to create recurring transaction")
+		return nil, err
+	}
+
+	log.Info().Str("id", rec.ID.String()).Time("next_run_at", rec.NextRunAt).Msg("Recurring transaction created")
+	return rec, nil
+}
+
+func (s *recurringService) GetByID(id uuid.UUID) (*models.RecurringTransaction, error) {
+	return s.repo.FindByID(id)
+}
+
+func (s *recurringService) GetAll() ([]models.RecurringTransaction, error) {
+	return s.repo.FindAll()
+}
+
+func (s *recurringService) Pause(id uuid.UUID) (*models.RecurringTransaction, error) {
+	rec, err := s.repo.FindByID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	rec.IsActive = false
+	if err := s.repo.Update(rec); err != nil {
+		return nil, err
+	}
+
+	return rec, nil
+}
+
+// Resume reactivates a paused template. Occurrences that fell inside the
+// paused period are skipped rather than caught up.
+func (s *recurringService) Resume(id uuid.UUID) (*models.RecurringTransaction, error) {
+	rec, err := s.repo.FindByID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if rec.NextRunAt.Before(now) {
+		next := rec.NextOccurrence(now, s.settings.Location())
+		if next == nil {
+			return nil, ErrScheduleEnded
+		}
+		rec.NextRunAt = *next
+	}
+
+	rec.IsActive = true
+	if err := s.repo.Update(rec); err != nil {
+		return nil, err
+	}
+
+	return rec, nil
+}
+
+func (s *recurringService) Preview(id uuid.UUID, count int) ([]time.Time, error) {
+	rec, err := s.repo.FindByID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	occurrences := []time.Time{}
+	next := &rec.NextRunAt
+	if rec.EndDate != nil && next.After(*rec.EndDate) {
+		return occurrences, nil
+	}
+
+	loc := s.settings.Location()
+	for next != nil && len(occurrences) < count {
+		occurrences = append(occurrences, *next)
+		next = rec.NextOccurrence(*next, loc)
+	}
+
+	return occurrences, nil
+}
+
+// ProcessDue materializes every occurrence that is due at now, including
+// the ones missed while the app was not running.
+func (s *recurringService) ProcessDue(now time.Time) (int, error) {
+	recs, err := s.repo.FindDue(now)
+	if err != nil {
+		return 0, err
+	}
+
+	loc := s.settings.Location()
+	created := 0
+	for i := range recs {
+		rec := &recs[i]
+		for rec.IsActive && !rec.NextRunAt.After(now) {
+			occurrence := rec.NextRunAt
+			recurringID := rec.ID
+			tx := &models.Transaction{
+				ID:          uuid.New(),
+				BranchID:    rec.BranchID,
+				Type:        rec.Type,
+				Category:    rec.Category,
+				Amount:      rec.Amount,
+				Description: rec.Description,
+				RecurringID: &recurringID,
+				CreatedAt:   occurrence,
+			}
+
+			rec.LastRunAt = &occurrence
+			if next := rec.NextOccurrence(occurrence, loc); next != nil {
+				rec.NextRunAt = *next
+			} else {
+				rec.IsActive = false
+			}
+
+			if err := s.repo.Materialize(rec, tx); err != nil {
+				log.Error().Err(err).Str("recurring_id", rec.ID.String()).Msg("Failed to materialize recurring transaction")
+				return created, err
+			}
+			created++
+
+			log.Info().
+				Str("recurring_id", rec.ID.String()).
+				Str("transaction_id", tx.ID.String()).
+				Time("occurrence", occurrence).
+				Msg("Recurring transaction materialized")
+		}
+	}
+
+	return created, nil
+}
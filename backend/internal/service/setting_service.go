@@ -0,0 +1,188 @@
+package service
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"sort"
+
+	"shosha-finance/internal/models"
+	"shosha-finance/internal/repository"
+	"shosha-finance/internal/settings"
+	"shosha-finance/internal/syncproto"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrSettingNotFound = errors.New("setting not found")
+	ErrSettingScope    = errors.New("scope must be global, branch or device")
+	ErrSettingTarget   = errors.New("branch or device of setting does not exist")
+)
+
+type SettingService interface {
+	GetAll(filter *repository.SettingFilter) ([]models.Setting, error)
+	Set(req *models.SettingRequest, userID uuid.UUID) (*models.Setting, error)
+	Delete(id uuid.UUID) error
+	Resolve(device *models.Device) (*syncproto.Settings, error)
+}
+
+type settingService struct {
+	repo       repository.SettingRepository
+	branchRepo repository.BranchRepository
+	deviceRepo repository.DeviceRepository
+}
+
+func NewSettingService(repo repository.SettingRepository, branchRepo repository.BranchRepository, deviceRepo repository.DeviceRepository) SettingService {
+	return &settingService{
+		repo:       repo,
+		branchRepo: branchRepo,
+		deviceRepo: deviceRepo,
+	}
+}
+
+func (s *settingService) GetAll(filter *repository.SettingFilter) ([]models.Setting, error) {
+	return s.repo.FindAll(filter)
+}
+
+// Set creates or replaces the value of a known setting for a scope. The
+// value is checked against the setting's kind before it is stored.
+func (s *settingService) Set(req *models.SettingRequest, userID uuid.UUID) (*models.Setting, error) {
+	value, err := settings.Validate(req.Key, req.Value)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.checkScope(req); err != nil {
+		return nil, err
+	}
+
+	setting, err := s.repo.FindByScope(req.Key, req.Scope, req.ScopeID)
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+	if setting == nil {
+		setting = &models.Setting{Key: req.Key, Scope: req.Scope, ScopeID: req.ScopeID}
+	}
+	setting.Value = value
+	setting.UpdatedBy = &userID
+
+	if setting.ID == uuid.Nil {
+		err = s.repo.Create(setting)
+	} else {
+		err = s.repo.Update(setting)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	log.Info().
+		Str("key", setting.Key).
+		Str("scope", string(setting.Scope)).
+		Str("scope_id", setting.ScopeID).
+		RawJSON("value", setting.Value).
+		Msg("Setting changed")
+	return setting, nil
+}
+
+// checkScope makes sure the scope is known and its branch or device exists.
+func (s *settingService) checkScope(req *models.SettingRequest) error {
+	switch req.Scope {
+	case models.SettingScopeGlobal:
+		if req.ScopeID != "" {
+			return ErrSettingTarget
+		}
+	case models.SettingScopeBranch:
+		id, err := uuid.Parse(req.ScopeID)
+		if err != nil {
+			return ErrSettingTarget
+		}
+		if _, err := s.branchRepo.FindByID(id); err != nil {
+			return ErrSettingTarget
+		}
+		req.ScopeID = id.String()
+	case models.SettingScopeDevice:
+		if _, err := s.deviceRepo.FindByID(req.ScopeID); err != nil {
+			return ErrSettingTarget
+		}
+	default:
+		return ErrSettingScope
+	}
+	return nil
+}
+
+// Delete removes a value; the devices it applied to fall back to the next
+// wider scope, or the default, at their next sync.
+func (s *settingService) Delete(id uuid.UUID) error {
+	err := s.repo.Delete(id)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return ErrSettingNotFound
+	}
+	return err
+}
+
+// Resolve works out the settings of a device: its own values first, then
+// those of its branches, then the global ones. When its branches disagree
+// the branch with the lowest code wins. Head-office devices assigned to all
+// branches only get global and device values. The digest changes whenever
+// any value does, so a device can tell there is nothing new.
+func (s *settingService) Resolve(device *models.Device) (*syncproto.Settings, error) {
+	var branchIDs []string
+	if !device.AllBranches {
+		for _, assignment := range device.Branches {
+			branchIDs = append(branchIDs, assignment.BranchID.String())
+		}
+	}
+
+	rows, err := s.repo.FindForDevice(device.ID, branchIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	// Branch codes order the branches' values
+	codes := map[string]string{}
+	for _, id := range branchIDs {
+		branchID, _ := uuid.Parse(id)
+		if branch, err := s.branchRepo.FindByID(branchID); err == nil {
+			codes[id] = branch.Code
+		}
+	}
+
+	rank := map[models.SettingScope]int{
+		models.SettingScopeDevice: 0,
+		models.SettingScopeBranch: 1,
+		models.SettingScopeGlobal: 2,
+	}
+	sort.SliceStable(rows, func(i, j int) bool {
+		a, b := rows[i], rows[j]
+		if rank[a.Scope] != rank[b.Scope] {
+			return rank[a.Scope] < rank[b.Scope]
+		}
+		return codes[a.ScopeID] < codes[b.ScopeID]
+	})
+
+	resolved := &syncproto.Settings{Settings: map[string]json.RawMessage{}}
+	for _, row := range rows {
+		if _, ok := resolved.Settings[row.Key]; !ok {
+			resolved.Settings[row.Key] = row.Value
+		}
+	}
+
+	keys := make([]string, 0, len(resolved.Settings))
+	for key := range resolved.Settings {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	hash := sha256.New()
+	for _, key := range keys {
+		hash.Write([]byte(key))
+		hash.Write([]byte{'='})
+		hash.Write(resolved.Settings[key])
+		hash.Write([]byte{'\n'})
+	}
+	resolved.Digest = hex.EncodeToString(hash.Sum(nil)[:16])
+
+	return resolved, nil
+}
@@ -0,0 +1,191 @@
+package service
+
+import (
+	"errors"
+	"time"
+
+	"shosha-finance/internal/models"
+	"shosha-finance/internal/repository"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	ErrShiftAlreadyOpen    = errors.New("branch already has an open shift")
+	ErrShiftNotOpen        = errors.New("shift is not open")
+	ErrInvalidDenomination = errors.New("invalid denomination")
+	ErrInvalidShiftBranch  = errors.New("invalid branch ID")
+)
+
+type ShiftService interface {
+	Open(req *models.OpenShiftRequest, userID uuid.UUID) (*models.Shift, error)
+	Close(id uuid.UUID, req *models.CloseShiftRequest) (*models.ShiftReport, error)
+	GetByID(id uuid.UUID) (*models.Shift, error)
+	GetOpenByBranch(branchID uuid.UUID) (*models.Shift, error)
+	GetAll(filter *repository.ShiftFilter) ([]models.Shift, error)
+	GetReport(id uuid.UUID) (*models.ShiftReport, error)
+	Upsert(shift *models.Shift) error
+}
+
+type shiftService struct {
+	repo repository.ShiftRepository
+}
+
+func NewShiftService(repo repository.ShiftRepository) ShiftService {
+	return &shiftService{repo: repo}
+}
+
+func (s *shiftService) Open(req *models.OpenShiftRequest, userID uuid.UUID) (*models.Shift, error) {
+	branchID, err := uuid.Parse(req.BranchID)
+	if err != nil {
+		return nil, ErrInvalidShiftBranch
+	}
+
+	if _, err := s.repo.FindOpenByBranch(branchID); err == nil {
+		return nil, ErrShiftAlreadyOpen
+	}
+
+	shift := &models.Shift{
+		ID:           uuid.New(),
+		BranchID:     branchID,
+		UserID:       userID,
+		Status:       models.ShiftStatusOpen,
+		OpeningFloat: req.OpeningFloat,
+		Notes:        req.Notes,
+		OpenedAt:     time.Now(),
+	}
+
+	// A concurrent open that won the race trips the open shift constraint
+	if err := s.repo.Create(shift); err != nil {
+		if _, findErr := s.repo.FindOpenByBranch(branchID); findErr == nil {
+			return nil, ErrShiftAlreadyOpen
+		}
+		log.Error().Err(err).Msg("Failed to open shift")
+		return nil, err
+	}
+
+	log.Info().Str("id", shift.ID.String()).Str("branch_id", branchID.String()).Msg("Shift opened")
+	return shift, nil
+}
+
+func (s *shiftService) Close(id uuid.UUID, req *models.CloseShiftRequest) (*models.ShiftReport, error) {
+	shift, err := s.repo.FindByID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if shift.Status != models.ShiftStatusOpen {
+		return nil, ErrShiftNotOpen
+	}
+
+	denominations := []models.ShiftDenomination{}
+	var counted int64
+	for _, d := range req.Denominations {
+		if !isValidDenomination(d.Value) || d.Quantity < 0 {
+			return nil, ErrInvalidDenomination
+		}
+		if d.Quantity == 0 {
+			continue
+		}
+		subtotal := d.Value * int64(d.Quantity)
+		counted += subtotal
+		denominations = append(denominations, models.ShiftDenomination{
+			ID:       uuid.New(),
+			Value:    d.Value,
+			Quantity: d.Quantity,
+			Subtotal: subtotal,
+		})
+	}
+
+	totals, err := s.repo.GetTotals(shift.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	shift.Status = models.ShiftStatusClosed
+	shift.ClosedAt = &now
+	shift.ExpectedCash = shift.OpeningFloat + totals.TotalIn - totals.TotalOut
+	shift.CountedCash = counted
+	shift.Variance = counted - shift.ExpectedCash
+	shift.Denominations = denominations
+	shift.IsSynced = false
+	if req.Notes != "" {
+		shift.Notes = req.Notes
+	}
+
+	if err := s.repo.Close(shift); err != nil {
+		log.Error().Err(err).Str("id", shift.ID.String()).Msg("Failed to close shift")
+		return nil, err
+	}
+
+	log.Info().
+		Str("id", shift.ID.String()).
+		Int64("expected", shift.ExpectedCash).
+		Int64("counted", shift.CountedCash).
+		Int64("variance", shift.Variance).
+		Msg("Shift closed")
+
+	return buildShiftReport(shift, totals), nil
+}
+
+func (s *shiftService) GetByID(id uuid.UUID) (*models.Shift, error) {
+	return s.repo.FindByID(id)
+}
+
+func (s *shiftService) GetOpenByBranch(branchID uuid.UUID) (*models.Shift, error) {
+	return s.repo.FindOpenByBranch(branchID)
+}
+
+func (s *shiftService) GetAll(filter *repository.ShiftFilter) ([]models.Shift, error) {
+	return s.repo.FindAll(filter)
+}
+
+// GetReport summarizes a shift. For a shift that is still open the expected
+// cash is computed from the transactions recorded so far.
+func (s *shiftService) GetReport(id uuid.UUID) (*models.ShiftReport, error) {
+	shift, err := s.repo.FindByID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	totals, err := s.repo.GetTotals(shift.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	return buildShiftReport(shift, totals), nil
+}
+
+func (s *shiftService) Upsert(shift *models.Shift) error {
+	return s.repo.Upsert(shift)
+}
+
+func buildShiftReport(shift *models.Shift, totals *repository.ShiftTotals) *models.ShiftReport {
+	report := &models.ShiftReport{
+		Shift:        *shift,
+		TotalIn:      totals.TotalIn,
+		TotalOut:     totals.TotalOut,
+		CountIn:      totals.CountIn,
+		CountOut:     totals.CountOut,
+		ExpectedCash: shift.ExpectedCash,
+		CountedCash:  shift.CountedCash,
+		Variance:     shift.Variance,
+	}
+
+	if shift.Status == models.ShiftStatusOpen {
+		report.ExpectedCash = shift.OpeningFloat + totals.TotalIn - totals.TotalOut
+	}
+
+	return report
+}
+
+func isValidDenomination(value int64) bool {
+	for _, d := range models.Denominations {
+		if d == value {
+			return true
+		}
+	}
+	return false
+}
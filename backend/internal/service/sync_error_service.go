@@ -0,0 +1,78 @@
+package service
+
+import (
+	"time"
+
+	"shosha-finance/internal/models"
+	"shosha-finance/internal/repository"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+)
+
+type SyncErrorService interface {
+	GetAll(status models.SyncErrorStatus) ([]models.SyncError, error)
+	CountOpen() (int64, error)
+	Retry(id uuid.UUID) (*models.SyncError, error)
+	Resolve(id uuid.UUID) (*models.SyncError, error)
+}
+
+type syncErrorService struct {
+	repo          repository.SyncErrorRepository
+	changeLogRepo repository.ChangeLogRepository
+}
+
+func NewSyncErrorService(repo repository.SyncErrorRepository, changeLogRepo repository.ChangeLogRepository) SyncErrorService {
+	return &syncErrorService{repo: repo, changeLogRepo: changeLogRepo}
+}
+
+func (s *syncErrorService) GetAll(status models.SyncErrorStatus) ([]models.SyncError, error) {
+	return s.repo.FindAll(status)
+}
+
+func (s *syncErrorService) CountOpen() (int64, error) {
+	return s.repo.CountOpen()
+}
+
+// Retry lifts the quarantine, resets the attempt count and queues the
+// record's current state so the worker pushes it on its next cycle.
+func (s *syncErrorService) Retry(id uuid.UUID) (*models.SyncError, error) {
+	syncErr, err := s.repo.FindByID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if syncErr.Status == models.SyncErrorQuarantined {
+		if err := s.changeLogRepo.EnqueueSnapshot(syncErr.EntityType, syncErr.EntityID); err != nil {
+			return nil, err
+		}
+	}
+
+	syncErr.Status = models.SyncErrorPending
+	syncErr.Attempts = 0
+	if err := s.repo.Update(syncErr); err != nil {
+		return nil, err
+	}
+
+	log.Info().Str("entity_type", syncErr.EntityType).Str("entity_id", syncErr.EntityID.String()).Msg("Sync error queued for retry")
+	return syncErr, nil
+}
+
+// Resolve marks the error as handled, for instance after the data was
+// corrected; the correction itself is pushed through the change log.
+func (s *syncErrorService) Resolve(id uuid.UUID) (*models.SyncError, error) {
+	syncErr, err := s.repo.FindByID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	syncErr.Status = models.SyncErrorResolved
+	syncErr.ResolvedAt = &now
+	if err := s.repo.Update(syncErr); err != nil {
+		return nil, err
+	}
+
+	log.Info().Str("entity_type", syncErr.EntityType).Str("entity_id", syncErr.EntityID.String()).Msg("Sync error resolved")
+	return syncErr, nil
+}
@@ -0,0 +1,40 @@
+package service
+
+import (
+	"time"
+
+	"shosha-finance/internal/models"
+	"shosha-finance/internal/repository"
+
+	"github.com/rs/zerolog/log"
+)
+
+type SyncRunService interface {
+	GetRecent(filter *repository.SyncRunFilter) ([]models.SyncRun, error)
+	PurgeExpired() error
+}
+
+type syncRunService struct {
+	repo      repository.SyncRunRepository
+	retention time.Duration
+}
+
+func NewSyncRunService(repo repository.SyncRunRepository, retention time.Duration) SyncRunService {
+	return &syncRunService{repo: repo, retention: retention}
+}
+
+func (s *syncRunService) GetRecent(filter *repository.SyncRunFilter) ([]models.SyncRun, error) {
+	return s.repo.FindRecent(filter)
+}
+
+// PurgeExpired removes sync runs older than the retention window.
+func (s *syncRunService) PurgeExpired() error {
+	deleted, err := s.repo.DeleteOlderThan(time.Now().Add(-s.retention))
+	if err != nil {
+		return err
+	}
+	if deleted > 0 {
+		log.Info().Int64("deleted", deleted).Msg("Purged old sync runs")
+	}
+	return nil
+}
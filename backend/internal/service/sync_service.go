@@ -0,0 +1,302 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"shosha-finance/internal/events"
+	"shosha-finance/internal/models"
+	"shosha-finance/internal/repository"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+)
+
+var ErrMissingDeviceID = errors.New("changes require a device ID")
+
+type SyncService interface {
+	Push(batch *models.SyncPushBatch, scope *models.BranchScope) (*models.SyncPushResult, error)
+	PushStream(batch *models.SyncPushBatch, scope *models.BranchScope, next repository.ChangeSource) (*models.SyncPushResult, error)
+	GetBatches(filter *repository.SyncBatchFilter) ([]models.SyncBatch, error)
+	Snapshot(scope *models.BranchScope) (*models.SyncSnapshot, error)
+	LatestSeq() (uint64, error)
+}
+
+type syncService struct {
+	repo   repository.SyncRepository
+	events *events.Broker
+}
+
+func NewSyncService(repo repository.SyncRepository, broker *events.Broker) SyncService {
+	return &syncService{repo: repo, events: broker}
+}
+
+// Push validates the pushed records and applies the valid ones as a single
+// batch. When an error is returned nothing was stored and the local app
+// should send the batch again. A batch that was already applied is not
+// applied again; the original result is returned from its receipt. Records
+// of branches outside the device's scope are rejected.
+func (s *syncService) Push(batch *models.SyncPushBatch, scope *models.BranchScope) (*models.SyncPushResult, error) {
+	// Change sequence numbers are only meaningful per device
+	if len(batch.Changes) > 0 && batch.DeviceID == "" {
+		return nil, ErrMissingDeviceID
+	}
+
+	if result, err := s.replayOrAssignID(batch); result != nil || err != nil {
+		return result, err
+	}
+
+	result := models.NewSyncPushResult()
+	result.BatchID = batch.BatchID
+	valid := &models.SyncPushBatch{
+		DeviceID: batch.DeviceID,
+		Changes:  batch.Changes,
+	}
+
+	for _, branch := range batch.Branches {
+		if reason := validateSyncBranch(&branch); reason != "" {
+			result.Reject(models.EntityBranch, branch.ID, reason)
+			continue
+		}
+		valid.Branches = append(valid.Branches, branch)
+	}
+
+	for _, tx := range batch.Transactions {
+		if reason := validateSyncTransaction(&tx); reason != "" {
+			result.Reject(models.EntityTransaction, tx.ID, reason)
+			continue
+		}
+		valid.Transactions = append(valid.Transactions, tx)
+	}
+
+	for _, shift := range batch.Shifts {
+		if shift.ID == uuid.Nil {
+			result.Reject(models.EntityShift, shift.ID, "missing id")
+			continue
+		}
+		valid.Shifts = append(valid.Shifts, shift)
+	}
+
+	for _, rec := range batch.Reconciliations {
+		if rec.ID == uuid.Nil {
+			result.Reject(models.EntityReconciliation, rec.ID, "missing id")
+			continue
+		}
+		valid.Reconciliations = append(valid.Reconciliations, rec)
+	}
+
+	receipt := newReceipt(batch)
+	receipt.ReceivedCount = batch.Received()
+
+	err := s.repo.ApplyPush(valid, scope, validateSyncChange, result, receipt)
+	return s.committed(batch, result, err)
+}
+
+// PushStream applies a push whose changes are decoded one at a time by
+// next, so the batch is never held in memory as a whole. It answers re-sent
+// batches from their receipt like Push; the rest of such a stream is not
+// read.
+func (s *syncService) PushStream(batch *models.SyncPushBatch, scope *models.BranchScope, next repository.ChangeSource) (*models.SyncPushResult, error) {
+	if batch.DeviceID == "" {
+		return nil, ErrMissingDeviceID
+	}
+
+	if result, err := s.replayOrAssignID(batch); result != nil || err != nil {
+		return result, err
+	}
+
+	result := models.NewSyncPushResult()
+	result.BatchID = batch.BatchID
+	receipt := newReceipt(batch)
+	counted := func() (*models.SyncChange, error) {
+		change, err := next()
+		if change != nil {
+			receipt.ReceivedCount++
+		}
+		return change, err
+	}
+
+	err := s.repo.ApplyPushStream(batch, scope, counted, validateSyncChange, result, receipt)
+	return s.committed(batch, result, err)
+}
+
+func newReceipt(batch *models.SyncPushBatch) *models.SyncBatch {
+	return &models.SyncBatch{
+		ID:         batch.BatchID,
+		DeviceID:   batch.DeviceID,
+		BranchID:   batch.BranchID,
+		ReceivedAt: time.Now(),
+	}
+}
+
+// committed logs and announces a push once it was applied, or the failure
+// that rolled it back.
+func (s *syncService) committed(batch *models.SyncPushBatch, result *models.SyncPushResult, err error) (*models.SyncPushResult, error) {
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to apply sync batch, rolled back")
+		return nil, err
+	}
+
+	for _, rejected := range result.Rejected {
+		log.Warn().
+			Str("entity_type", rejected.EntityType).
+			Str("id", rejected.EntityID.String()).
+			Str("reason", rejected.Reason).
+			Msg("Rejected pushed record")
+	}
+
+	log.Info().
+		Str("batch_id", batch.BatchID.String()).
+		Str("device_id", batch.DeviceID).
+		Uint64("acked_seq", result.AckedSeq).
+		Int("branches", len(result.Branches)).
+		Int("transactions", len(result.Transactions)).
+		Int("shifts", len(result.Shifts)).
+		Int("reconciliations", len(result.Reconciliations)).
+		Int("rejected", len(result.Rejected)).
+		Msg("Sync batch committed")
+
+	s.events.Publish(events.SyncPush, events.SyncPushData{
+		BatchID:  batch.BatchID,
+		DeviceID: batch.DeviceID,
+		BranchID: batch.BranchID,
+		Accepted: result.Accepted(),
+		Rejected: len(result.Rejected),
+	})
+	if len(result.Transactions) > 0 {
+		s.events.Publish(events.TransactionsChanged, events.TransactionsChangedData{
+			Source:         events.SourcePush,
+			TransactionIDs: result.Transactions,
+		})
+	}
+
+	return result, nil
+}
+
+// replayOrAssignID answers a re-sent batch from its receipt. A batch
+// without an ID is given one: older local apps do not send it, so their
+// batches get a receipt but cannot be recognised when re-sent.
+func (s *syncService) replayOrAssignID(batch *models.SyncPushBatch) (*models.SyncPushResult, error) {
+	if batch.BatchID == uuid.Nil {
+		batch.BatchID = uuid.New()
+		return nil, nil
+	}
+	return s.replay(batch.BatchID)
+}
+
+// replay answers a re-sent batch from its receipt. It returns nil, nil when
+// the batch has not been seen before.
+func (s *syncService) replay(batchID uuid.UUID) (*models.SyncPushResult, error) {
+	receipt, err := s.repo.FindBatch(batchID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var result models.SyncPushResult
+	if err := json.Unmarshal([]byte(receipt.Result), &result); err != nil {
+		return nil, err
+	}
+	result.Replayed = true
+
+	if err := s.repo.MarkReplayed(receipt); err != nil {
+		log.Warn().Err(err).Msg("Failed to update sync batch receipt")
+	}
+
+	log.Info().
+		Str("batch_id", batchID.String()).
+		Str("device_id", receipt.DeviceID).
+		Int("replay_count", receipt.ReplayCount).
+		Msg("Re-sent sync batch answered from receipt")
+
+	return &result, nil
+}
+
+func (s *syncService) GetBatches(filter *repository.SyncBatchFilter) ([]models.SyncBatch, error) {
+	return s.repo.FindBatches(filter)
+}
+
+// Snapshot returns a consistent copy of the scope's data for a local
+// install to restore from.
+func (s *syncService) Snapshot(scope *models.BranchScope) (*models.SyncSnapshot, error) {
+	snapshot, err := s.repo.Snapshot(scope)
+	if err != nil {
+		return nil, err
+	}
+	log.Info().
+		Bool("all_branches", scope.AllBranches).
+		Int("branches", len(scope.BranchIDs)).
+		Int("records", snapshot.Records()).
+		Msg("Sync snapshot taken")
+	return snapshot, nil
+}
+
+// LatestSeq returns the newest receive sequence number committed on the
+// cloud. A pull reads up to it, so records written while the pull is sent
+// wait for the next one.
+func (s *syncService) LatestSeq() (uint64, error) {
+	return s.repo.LatestSeq()
+}
+
+// validateSyncChange checks a change-log entry once its record is decoded.
+func validateSyncChange(change *models.SyncChange, record interface{}) string {
+	if change.EntityID == uuid.Nil {
+		return "missing entity id"
+	}
+
+	switch rec := record.(type) {
+	case *models.Branch:
+		if rec.ID != change.EntityID {
+			return "payload does not match entity id"
+		}
+		return validateSyncBranch(rec)
+	case *models.Transaction:
+		if rec.ID != change.EntityID {
+			return "payload does not match entity id"
+		}
+		return validateSyncTransaction(rec)
+	case *models.Shift:
+		if rec.ID != change.EntityID {
+			return "payload does not match entity id"
+		}
+	case *models.CashReconciliation:
+		if rec.ID != change.EntityID {
+			return "payload does not match entity id"
+		}
+	case *models.Tombstone:
+		if rec.EntityID != change.EntityID {
+			return "payload does not match entity id"
+		}
+	}
+	return ""
+}
+
+func validateSyncBranch(branch *models.Branch) string {
+	if branch.ID == uuid.Nil {
+		return "missing id"
+	}
+	if branch.Code == "" || branch.Name == "" {
+		return "code and name are required"
+	}
+	return ""
+}
+
+func validateSyncTransaction(tx *models.Transaction) string {
+	if tx.ID == uuid.Nil {
+		return "missing id"
+	}
+	if tx.Type != models.TransactionTypeIN && tx.Type != models.TransactionTypeOUT {
+		return "type must be IN or OUT"
+	}
+	if tx.Amount <= 0 {
+		return "amount must be greater than 0"
+	}
+	if tx.Category == "" {
+		return "category is required"
+	}
+	return ""
+}
@@ -0,0 +1,40 @@
+package service
+
+import (
+	"time"
+
+	"shosha-finance/internal/models"
+	"shosha-finance/internal/repository"
+
+	"github.com/rs/zerolog/log"
+)
+
+type SyncVerificationService interface {
+	GetRecent(limit int) ([]models.SyncVerification, error)
+	PurgeExpired() error
+}
+
+type syncVerificationService struct {
+	repo      repository.SyncVerificationRepository
+	retention time.Duration
+}
+
+func NewSyncVerificationService(repo repository.SyncVerificationRepository, retention time.Duration) SyncVerificationService {
+	return &syncVerificationService{repo: repo, retention: retention}
+}
+
+func (s *syncVerificationService) GetRecent(limit int) ([]models.SyncVerification, error) {
+	return s.repo.FindRecent(limit)
+}
+
+// PurgeExpired removes verifications older than the retention window.
+func (s *syncVerificationService) PurgeExpired() error {
+	deleted, err := s.repo.DeleteOlderThan(time.Now().Add(-s.retention))
+	if err != nil {
+		return err
+	}
+	if deleted > 0 {
+		log.Info().Int64("deleted", deleted).Msg("Purged old sync verifications")
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+package service
+
+import (
+	"time"
+
+	"shosha-finance/internal/models"
+	"shosha-finance/internal/repository"
+
+	"github.com/rs/zerolog/log"
+)
+
+type TombstoneService interface {
+	GetBetween(since, until uint64) ([]models.Tombstone, error)
+	PurgeExpired() error
+}
+
+type tombstoneService struct {
+	repo      repository.TombstoneRepository
+	retention time.Duration
+}
+
+func NewTombstoneService(repo repository.TombstoneRepository, retention time.Duration) TombstoneService {
+	return &tombstoneService{repo: repo, retention: retention}
+}
+
+func (s *tombstoneService) GetBetween(since, until uint64) ([]models.Tombstone, error) {
+	return s.repo.FindBetween(since, until)
+}
+
+// PurgeExpired drops tombstones older than the retention window. A device
+// that stays offline longer than that no longer learns about the deletes.
+func (s *tombstoneService) PurgeExpired() error {
+	purged, err := s.repo.Purge(time.Now().Add(-s.retention))
+	if purged > 0 {
+		log.Info().Int64("purged", purged).Msg("Purged expired tombstones")
+	}
+	return err
+}
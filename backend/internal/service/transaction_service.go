@@ -1,15 +1,39 @@
 package service
 
 import (
+	"errors"
+	"fmt"
+	"strings"
 	"time"
 
 	"shosha-finance/internal/models"
 	"shosha-finance/internal/repository"
+	"shosha-finance/internal/settings"
 
 	"github.com/google/uuid"
 	"github.com/rs/zerolog/log"
 )
 
+var (
+	ErrPossibleDuplicate     = errors.New("possible duplicate transaction")
+	ErrTransactionIDConflict = errors.New("transaction ID already used for different data")
+	ErrCategoryNotAllowed    = errors.New("category is not in the allowed categories")
+)
+
+// DuplicateError is returned by Create when matching transactions already
+// exist. Resubmitting with Force set skips the check.
+type DuplicateError struct {
+	IDs []uuid.UUID
+}
+
+func (e *DuplicateError) Error() string {
+	return fmt.Sprintf("%s: %d matching transaction(s)", ErrPossibleDuplicate, len(e.IDs))
+}
+
+func (e *DuplicateError) Unwrap() error {
+	return ErrPossibleDuplicate
+}
+
 type TransactionService interface {
 	Create(req *models.TransactionRequest) (*models.Transaction, error)
 	GetByID(id uuid.UUID) (*models.Transaction, error)
@@ -17,30 +41,83 @@ type TransactionService interface {
 	GetDashboardSummary(filter *repository.DashboardFilter) (*repository.DashboardSummary, error)
 	GetUnsyncedCount() (int64, error)
 	Upsert(tx *models.Transaction) error
-	GetUpdatedAfter(since *time.Time) ([]models.Transaction, error)
+	GetUpdatedBetween(since, until uint64, scope *models.BranchScope) ([]models.Transaction, error)
+	EachUpdatedBetween(since, until uint64, scope *models.BranchScope, size int, fn func([]models.Transaction) error) error
+	FindDuplicates(filter *repository.DashboardFilter) ([]models.DuplicateGroup, error)
+	GetDayDigests(from, to time.Time, until uint64, scope *models.BranchScope) ([]models.DayDigest, error)
+	GetBranchDay(branchID uuid.UUID, day time.Time) ([]models.Transaction, error)
 }
 
 type transactionService struct {
-	repo repository.TransactionRepository
+	repo      repository.TransactionRepository
+	shiftRepo repository.ShiftRepository
+	settings  *settings.Store
 }
 
-func NewTransactionService(repo repository.TransactionRepository) TransactionService {
-	return &transactionService{repo: repo}
+// NewTransactionService creates the service. When shiftRepo is nil new
+// transactions are not tied to a cashier shift. The duplicate window,
+// allowed categories and approval threshold are read from the settings on
+// every use.
+func NewTransactionService(repo repository.TransactionRepository, shiftRepo repository.ShiftRepository, store *settings.Store) TransactionService {
+	return &transactionService{
+		repo:      repo,
+		shiftRepo: shiftRepo,
+		settings:  store,
+	}
 }
 
+// Create stores a new transaction. When the request carries a client
+// generated ID that is already stored, the existing transaction is returned
+// so that a retried request does not create a second row.
 func (s *transactionService) Create(req *models.TransactionRequest) (*models.Transaction, error) {
 	branchID, err := uuid.Parse(req.BranchID)
 	if err != nil {
 		return nil, err
 	}
 
+	id := uuid.New()
+	if req.ID != "" {
+		id, err = uuid.Parse(req.ID)
+		if err != nil {
+			return nil, err
+		}
+
+		if existing, err := s.repo.FindByID(id); err == nil {
+			if existing.BranchID != branchID || existing.Type != req.Type ||
+				existing.Category != req.Category || existing.Amount != req.Amount ||
+				existing.Description != req.Description {
+				return nil, ErrTransactionIDConflict
+			}
+			log.Info().Str("id", id.String()).Msg("Transaction already exists, returning stored copy")
+			return existing, nil
+		}
+	}
+
+	if !categoryAllowed(s.settings, req.Category) {
+		return nil, ErrCategoryNotAllowed
+	}
+
 	tx := &models.Transaction{
-		ID:          uuid.New(),
+		ID:          id,
 		BranchID:    branchID,
 		Type:        req.Type,
 		Category:    req.Category,
 		Amount:      req.Amount,
 		Description: req.Description,
+		CreatedAt:   time.Now(),
+	}
+	tx.RequiresApproval = s.requiresApproval(tx.Amount)
+
+	if !req.Force {
+		if err := s.checkDuplicate(tx); err != nil {
+			return nil, err
+		}
+	}
+
+	if s.shiftRepo != nil {
+		if shift, err := s.shiftRepo.FindOpenByBranch(branchID); err == nil {
+			tx.ShiftID = &shift.ID
+		}
 	}
 
 	err = s.repo.Create(tx)
@@ -73,6 +150,137 @@ func (s *transactionService) Upsert(tx *models.Transaction) error {
 	return s.repo.Upsert(tx)
 }
 
-func (s *transactionService) GetUpdatedAfter(since *time.Time) ([]models.Transaction, error) {
-	return s.repo.GetUpdatedAfter(since)
+func (s *transactionService) GetUpdatedBetween(since, until uint64, scope *models.BranchScope) ([]models.Transaction, error) {
+	return s.repo.GetUpdatedBetween(since, until, scope)
+}
+
+func (s *transactionService) EachUpdatedBetween(since, until uint64, scope *models.BranchScope, size int, fn func([]models.Transaction) error) error {
+	return s.repo.EachUpdatedBetween(since, until, scope, size, fn)
+}
+
+func (s *transactionService) GetDayDigests(from, to time.Time, until uint64, scope *models.BranchScope) ([]models.DayDigest, error) {
+	return s.repo.DayDigests(from, to, &until, scope)
+}
+
+func (s *transactionService) GetBranchDay(branchID uuid.UUID, day time.Time) ([]models.Transaction, error) {
+	return s.repo.FindByBranchDay(branchID, day)
+}
+
+func (s *transactionService) checkDuplicate(tx *models.Transaction) error {
+	candidates, err := s.repo.FindSimilar(tx, s.duplicateWindow())
+	if err != nil {
+		return err
+	}
+
+	ids := []uuid.UUID{}
+	for _, candidate := range candidates {
+		if similarDescription(candidate.Description, tx.Description) {
+			ids = append(ids, candidate.ID)
+		}
+	}
+
+	if len(ids) > 0 {
+		log.Warn().Str("branch_id", tx.BranchID.String()).Int("matches", len(ids)).Msg("Possible duplicate transaction")
+		return &DuplicateError{IDs: ids}
+	}
+
+	return nil
+}
+
+// FindDuplicates groups transactions in the period that match on branch,
+// type, category and amount, were recorded within the duplicate window of
+// each other and have similar descriptions.
+func (s *transactionService) FindDuplicates(filter *repository.DashboardFilter) ([]models.DuplicateGroup, error) {
+	transactions, err := s.repo.FindByPeriod(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	type groupKey struct {
+		branchID uuid.UUID
+		txType   models.TransactionType
+		category string
+		amount   int64
+	}
+
+	buckets := map[groupKey][]models.Transaction{}
+	keys := []groupKey{}
+	for _, tx := range transactions {
+		key := groupKey{tx.BranchID, tx.Type, tx.Category, tx.Amount}
+		if _, ok := buckets[key]; !ok {
+			keys = append(keys, key)
+		}
+		buckets[key] = append(buckets[key], tx)
+	}
+
+	window := s.duplicateWindow()
+	groups := []models.DuplicateGroup{}
+	for _, key := range keys {
+		bucket := buckets[key]
+		grouped := make([]bool, len(bucket))
+
+		// Buckets are ordered by created_at, so the inner loop can stop at
+		// the first transaction outside the window.
+		for i := range bucket {
+			if grouped[i] {
+				continue
+			}
+			members := []models.Transaction{bucket[i]}
+			for j := i + 1; j < len(bucket); j++ {
+				if bucket[j].CreatedAt.Sub(bucket[i].CreatedAt) > window {
+					break
+				}
+				if !grouped[j] && similarDescription(bucket[i].Description, bucket[j].Description) {
+					grouped[j] = true
+					members = append(members, bucket[j])
+				}
+			}
+			if len(members) > 1 {
+				groups = append(groups, models.DuplicateGroup{
+					BranchID:     key.branchID,
+					Type:         key.txType,
+					Category:     key.category,
+					Amount:       key.amount,
+					Transactions: members,
+				})
+			}
+		}
+	}
+
+	return groups, nil
+}
+
+// similarDescription treats descriptions as similar when, ignoring case and
+// extra whitespace, one contains the other. An empty description matches
+// anything.
+func similarDescription(a, b string) bool {
+	a = strings.Join(strings.Fields(strings.ToLower(a)), " ")
+	b = strings.Join(strings.Fields(strings.ToLower(b)), " ")
+	return strings.Contains(a, b) || strings.Contains(b, a)
+}
+
+func (s *transactionService) duplicateWindow() time.Duration {
+	return time.Duration(s.settings.Int(settings.KeyDuplicateWindow)) * time.Minute
+}
+
+// requiresApproval reports whether a new transaction of amount needs a
+// supervisor's approval. A threshold of 0 never asks for one.
+func (s *transactionService) requiresApproval(amount int64) bool {
+	threshold := s.settings.Int(settings.KeyApprovalThreshold)
+	return threshold > 0 && amount > threshold
+}
+
+// categoryAllowed reports whether new transactions may use the category.
+// Any category is allowed while the list is empty.
+func categoryAllowed(store *settings.Store, category string) bool {
+	allowed := store.List(settings.KeyCategories)
+	if len(allowed) == 0 {
+		return true
+	}
+	for _, name := range allowed {
+		if strings.EqualFold(name, category) {
+			return true
+		}
+	}
+	return false
 }
@@ -0,0 +1,203 @@
+package service
+
+import (
+	"errors"
+
+	"shosha-finance/internal/models"
+	"shosha-finance/internal/repository"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	ErrInvalidRole   = errors.New("role must be admin, manager or staff")
+	ErrUsernameTaken = errors.New("username or email is already used")
+	ErrUserBranch    = errors.New("branch of user does not exist")
+)
+
+type UserService interface {
+	GetAll() ([]models.User, error)
+	GetByID(id uuid.UUID) (*models.User, error)
+	Create(req *models.CreateUserRequest) (*models.User, error)
+	Update(id uuid.UUID, req *models.UpdateUserRequest) (*models.User, error)
+	Delete(id uuid.UUID) error
+	GetUpdatedBetween(since, until uint64, scope *models.BranchScope) (*UserChanges, error)
+}
+
+// UserChanges are the user changes a device pulls.
+type UserChanges struct {
+	Users   []models.SyncUser
+	Revoked []uuid.UUID
+}
+
+type userService struct {
+	repo       repository.UserRepository
+	branchRepo repository.BranchRepository
+}
+
+func NewUserService(repo repository.UserRepository, branchRepo repository.BranchRepository) UserService {
+	return &userService{repo: repo, branchRepo: branchRepo}
+}
+
+func (s *userService) GetAll() ([]models.User, error) {
+	return s.repo.FindAll()
+}
+
+func (s *userService) GetByID(id uuid.UUID) (*models.User, error) {
+	user, err := s.repo.FindByID(id)
+	if err != nil {
+		return nil, ErrUserNotFound
+	}
+	return user, nil
+}
+
+func (s *userService) Create(req *models.CreateUserRequest) (*models.User, error) {
+	if !models.ValidRole(req.Role) {
+		return nil, ErrInvalidRole
+	}
+	if err := s.checkBranch(req.BranchID); err != nil {
+		return nil, err
+	}
+	if err := s.checkUnique(uuid.Nil, req.Username, req.Email); err != nil {
+		return nil, err
+	}
+
+	user := &models.User{
+		Username:     req.Username,
+		Email:        req.Email,
+		Name:         req.Name,
+		Role:         req.Role,
+		BranchID:     req.BranchID,
+		OfflineLogin: req.OfflineLogin,
+		IsActive:     true,
+	}
+	if err := user.SetPassword(req.Password); err != nil {
+		return nil, err
+	}
+	if err := s.repo.Create(user); err != nil {
+		return nil, err
+	}
+
+	log.Info().Str("username", user.Username).Str("role", string(user.Role)).Msg("User created")
+	return user, nil
+}
+
+// Update changes a user. Deactivated users cannot log in anywhere once the
+// devices have pulled the change.
+func (s *userService) Update(id uuid.UUID, req *models.UpdateUserRequest) (*models.User, error) {
+	user, err := s.repo.FindByID(id)
+	if err != nil {
+		return nil, ErrUserNotFound
+	}
+
+	if req.Role != nil {
+		if !models.ValidRole(*req.Role) {
+			return nil, ErrInvalidRole
+		}
+		user.Role = *req.Role
+	}
+	if req.BranchID != nil {
+		if err := s.checkBranch(req.BranchID); err != nil {
+			return nil, err
+		}
+		user.BranchID = req.BranchID
+	}
+	if req.Email != nil {
+		if err := s.checkUnique(user.ID, "", req.Email); err != nil {
+			return nil, err
+		}
+		user.Email = req.Email
+	}
+	if req.Name != nil {
+		user.Name = *req.Name
+	}
+	if req.OfflineLogin != nil {
+		user.OfflineLogin = *req.OfflineLogin
+	}
+	if req.IsActive != nil {
+		user.IsActive = *req.IsActive
+	}
+	if req.Password != nil {
+		if err := user.SetPassword(*req.Password); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := s.repo.Update(user); err != nil {
+		return nil, err
+	}
+
+	log.Info().Str("username", user.Username).Bool("is_active", user.IsActive).Msg("User updated")
+	return user, nil
+}
+
+func (s *userService) Delete(id uuid.UUID) error {
+	user, err := s.repo.FindByID(id)
+	if err != nil {
+		return ErrUserNotFound
+	}
+	if err := s.repo.Delete(id); err != nil {
+		return err
+	}
+
+	log.Info().Str("username", user.Username).Msg("User deleted")
+	return nil
+}
+
+// GetUpdatedBetween returns the users written after since and no later
+// than until that a device with the given scope may log in with: users of
+// its branches and users without a branch that are marked for offline
+// login. Other users without a branch, cloud admins among them, never
+// leave the cloud. Users that changed but belong elsewhere are returned by
+// ID only, so the device drops them if it had them.
+func (s *userService) GetUpdatedBetween(since, until uint64, scope *models.BranchScope) (*UserChanges, error) {
+	users, err := s.repo.GetUpdatedBetween(since, until)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := &UserChanges{Users: []models.SyncUser{}, Revoked: []uuid.UUID{}}
+	for i := range users {
+		if offlineLogin(&users[i], scope) {
+			changes.Users = append(changes.Users, users[i].ToSync())
+		} else {
+			changes.Revoked = append(changes.Revoked, users[i].ID)
+		}
+	}
+	return changes, nil
+}
+
+// offlineLogin reports whether a device with the scope gets the user's
+// password hash.
+func offlineLogin(user *models.User, scope *models.BranchScope) bool {
+	if user.BranchID == nil {
+		return user.OfflineLogin
+	}
+	return scope.Contains(*user.BranchID)
+}
+
+func (s *userService) checkBranch(branchID *uuid.UUID) error {
+	if branchID == nil {
+		return nil
+	}
+	if _, err := s.branchRepo.FindByID(*branchID); err != nil {
+		return ErrUserBranch
+	}
+	return nil
+}
+
+// checkUnique makes sure no other user has the username or email.
+func (s *userService) checkUnique(id uuid.UUID, username string, email *string) error {
+	if username != "" {
+		if existing, err := s.repo.FindByUsername(username); err == nil && existing.ID != id {
+			return ErrUsernameTaken
+		}
+	}
+	if email != nil && *email != "" {
+		if existing, err := s.repo.FindByEmail(*email); err == nil && existing.ID != id {
+			return ErrUsernameTaken
+		}
+	}
+	return nil
+}
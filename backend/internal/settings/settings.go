@@ -0,0 +1,337 @@
+// Package settings holds the settings head office manages from the cloud:
+// the known keys with their kinds and defaults, and the store a local
+// install reads them from. Settings are set globally, per branch or per
+// device on the cloud, pulled by the sync worker and take effect without a
+// restart. An environment variable set on the laptop overrides whatever
+// the cloud says.
+package settings
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Keys of the known settings.
+const (
+	// KeySyncInterval is the seconds between sync cycles.
+	KeySyncInterval = "sync.interval"
+	// KeySyncVerifyInterval is the minutes between comparisons of the local
+	// books with the cloud's, 0 to only compare on request.
+	KeySyncVerifyInterval = "sync.verify_interval"
+	// KeySyncVerifyDays is how many days back each comparison covers.
+	KeySyncVerifyDays = "sync.verify_days"
+	// KeyDuplicateWindow is how many minutes apart two otherwise matching
+	// transactions may be and still be flagged as probable duplicates.
+	KeyDuplicateWindow = "transactions.duplicate_window"
+	// KeyCategories lists the categories new transactions may use; empty
+	// allows any.
+	KeyCategories = "transactions.categories"
+	// KeyApprovalThreshold is the amount above which a new transaction
+	// needs a supervisor's approval, 0 for never.
+	KeyApprovalThreshold = "transactions.approval_threshold"
+	// KeyTimezone is the IANA time zone business days are counted in, empty
+	// for the machine's own.
+	KeyTimezone = "business.timezone"
+)
+
+// Kind is the type of a setting's value.
+type Kind string
+
+const (
+	KindInt      Kind = "int"
+	KindAmount   Kind = "amount"
+	KindList     Kind = "list"
+	KindTimezone Kind = "timezone"
+)
+
+// Definition describes a known setting. Default is its JSON value when
+// neither the cloud nor the environment sets it.
+type Definition struct {
+	Key         string `json:"key"`
+	Kind        Kind   `json:"kind"`
+	Env         string `json:"env"`
+	Default     string `json:"default"`
+	Min         int64  `json:"min"`
+	Description string `json:"description"`
+}
+
+// Definitions lists every known setting.
+var Definitions = []Definition{
+	{Key: KeySyncInterval, Kind: KindInt, Env: "SYNC_INTERVAL", Default: "30", Min: 5, Description: "Seconds between sync cycles"},
+	{Key: KeySyncVerifyInterval, Kind: KindInt, Env: "SYNC_VERIFY_INTERVAL", Default: "360", Description: "Minutes between verifications of the local books with the cloud, 0 to only verify on request"},
+	{Key: KeySyncVerifyDays, Kind: KindInt, Env: "SYNC_VERIFY_DAYS", Default: "30", Min: 1, Description: "Days back each verification covers"},
+	{Key: KeyDuplicateWindow, Kind: KindInt, Env: "DUPLICATE_WINDOW_MINUTES", Default: "10", Description: "Minutes apart matching transactions are flagged as probable duplicates"},
+	{Key: KeyCategories, Kind: KindList, Env: "TRANSACTION_CATEGORIES", Default: "[]", Description: "Categories new transactions may use, empty for any"},
+	{Key: KeyApprovalThreshold, Kind: KindAmount, Env: "APPROVAL_THRESHOLD", Default: "0", Description: "Amount above which new transactions need a supervisor's approval, 0 for never"},
+	{Key: KeyTimezone, Kind: KindTimezone, Env: "BUSINESS_TIMEZONE", Default: `""`, Description: "Time zone business days are counted in, empty for the machine's"},
+}
+
+var (
+	ErrUnknownKey   = errors.New("unknown setting")
+	ErrInvalidValue = errors.New("invalid setting value")
+)
+
+// Lookup returns the definition of a known setting.
+func Lookup(key string) (*Definition, bool) {
+	for i := range Definitions {
+		if Definitions[i].Key == key {
+			return &Definitions[i], true
+		}
+	}
+	return nil, false
+}
+
+// Validate checks a value for the setting and returns it in canonical
+// JSON form.
+func Validate(key string, value json.RawMessage) (json.RawMessage, error) {
+	def, ok := Lookup(key)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownKey, key)
+	}
+	return def.normalize(value)
+}
+
+func (d *Definition) normalize(value json.RawMessage) (json.RawMessage, error) {
+	switch d.Kind {
+	case KindInt, KindAmount:
+		var n int64
+		if err := json.Unmarshal(value, &n); err != nil {
+			return nil, fmt.Errorf("%w: %s must be a whole number", ErrInvalidValue, d.Key)
+		}
+		if n < d.Min {
+			return nil, fmt.Errorf("%w: %s must be at least %d", ErrInvalidValue, d.Key, d.Min)
+		}
+		return json.Marshal(n)
+	case KindList:
+		var items []string
+		if err := json.Unmarshal(value, &items); err != nil {
+			return nil, fmt.Errorf("%w: %s must be a list of strings", ErrInvalidValue, d.Key)
+		}
+		list := make([]string, 0, len(items))
+		for _, item := range items {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		return json.Marshal(list)
+	case KindTimezone:
+		var name string
+		if err := json.Unmarshal(value, &name); err != nil {
+			return nil, fmt.Errorf("%w: %s must be a string", ErrInvalidValue, d.Key)
+		}
+		if _, err := time.LoadLocation(name); err != nil {
+			return nil, fmt.Errorf("%w: %s is not a known time zone", ErrInvalidValue, d.Key)
+		}
+		return json.Marshal(name)
+	}
+	return nil, fmt.Errorf("%w: %s", ErrUnknownKey, d.Key)
+}
+
+// parseEnv reads the setting from its environment variable, where lists
+// are comma separated.
+func (d *Definition) parseEnv(value string) (json.RawMessage, error) {
+	switch d.Kind {
+	case KindInt, KindAmount:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s must be a whole number", ErrInvalidValue, d.Env)
+		}
+		return d.normalize(json.RawMessage(strconv.FormatInt(n, 10)))
+	case KindList:
+		raw, _ := json.Marshal(strings.Split(value, ","))
+		return d.normalize(raw)
+	default:
+		raw, _ := json.Marshal(value)
+		return d.normalize(raw)
+	}
+}
+
+// Source is where a setting's value comes from.
+type Source string
+
+const (
+	SourceDefault Source = "default"
+	SourceCloud   Source = "cloud"
+	SourceEnv     Source = "env"
+)
+
+// Value is a setting's value in effect and where it comes from.
+type Value struct {
+	Definition
+	Value  json.RawMessage `json:"value"`
+	Source Source          `json:"source"`
+	Cloud  json.RawMessage `json:"cloud,omitempty"`
+}
+
+// Store holds the settings in effect. It is safe for concurrent use;
+// readers get the new value as soon as the cloud's settings are applied.
+type Store struct {
+	mu        sync.RWMutex
+	env       map[string]json.RawMessage
+	cloud     map[string]json.RawMessage
+	appliedAt *time.Time
+}
+
+// NewStore reads the environment overrides. Invalid ones are logged and
+// ignored.
+func NewStore() *Store {
+	s := &Store{
+		env:   map[string]json.RawMessage{},
+		cloud: map[string]json.RawMessage{},
+	}
+	for i := range Definitions {
+		def := &Definitions[i]
+		value := os.Getenv(def.Env)
+		if value == "" {
+			continue
+		}
+		parsed, err := def.parseEnv(value)
+		if err != nil {
+			log.Warn().Err(err).Str("env", def.Env).Msg("Ignoring invalid setting override")
+			continue
+		}
+		s.env[def.Key] = parsed
+	}
+	return s
+}
+
+// Load sets the cloud's settings kept from the last sync, at startup.
+func (s *Store) Load(cloud map[string]json.RawMessage) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cloud = validCloud(cloud)
+}
+
+// Apply replaces the cloud's settings and returns the keys whose value in
+// effect changed. Keys this build does not know and invalid values are
+// skipped.
+func (s *Store) Apply(cloud map[string]json.RawMessage) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	before := s.effective()
+	s.cloud = validCloud(cloud)
+	now := time.Now()
+	s.appliedAt = &now
+	after := s.effective()
+
+	var changed []string
+	for key, value := range after {
+		if string(before[key]) != string(value) {
+			changed = append(changed, key)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// AppliedAt is when the cloud's settings were last applied, nil before the
+// first sync since startup.
+func (s *Store) AppliedAt() *time.Time {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.appliedAt
+}
+
+// Values lists every setting in effect, in definition order.
+func (s *Store) Values() []Value {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	values := make([]Value, 0, len(Definitions))
+	for _, def := range Definitions {
+		value := Value{Definition: def, Cloud: s.cloud[def.Key]}
+		value.Value, value.Source = s.lookup(def.Key)
+		values = append(values, value)
+	}
+	return values
+}
+
+// Int returns an int or amount setting.
+func (s *Store) Int(key string) int64 {
+	var n int64
+	s.decode(key, &n)
+	return n
+}
+
+// List returns a list setting.
+func (s *Store) List(key string) []string {
+	var list []string
+	s.decode(key, &list)
+	return list
+}
+
+// Location returns the business time zone, the machine's own when none
+// is set. Times are stored in UTC; the zone only decides where a business
+// day starts, so callers read it each time they need one.
+func (s *Store) Location() *time.Location {
+	var name string
+	s.decode(KeyTimezone, &name)
+	if name == "" {
+		return time.Local
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return time.Local
+	}
+	return loc
+}
+
+func (s *Store) decode(key string, v interface{}) {
+	s.mu.RLock()
+	raw, _ := s.lookup(key)
+	s.mu.RUnlock()
+	if err := json.Unmarshal(raw, v); err != nil {
+		log.Error().Err(err).Str("key", key).Msg("Failed to read setting")
+	}
+}
+
+// lookup finds the value in effect: the environment, then the cloud, then
+// the default. The caller holds the lock.
+func (s *Store) lookup(key string) (json.RawMessage, Source) {
+	if value, ok := s.env[key]; ok {
+		return value, SourceEnv
+	}
+	if value, ok := s.cloud[key]; ok {
+		return value, SourceCloud
+	}
+	if def, ok := Lookup(key); ok {
+		return json.RawMessage(def.Default), SourceDefault
+	}
+	return nil, SourceDefault
+}
+
+// effective returns every value in effect. The caller holds the lock.
+func (s *Store) effective() map[string]json.RawMessage {
+	values := make(map[string]json.RawMessage, len(Definitions))
+	for _, def := range Definitions {
+		values[def.Key], _ = s.lookup(def.Key)
+	}
+	return values
+}
+
+func validCloud(cloud map[string]json.RawMessage) map[string]json.RawMessage {
+	valid := make(map[string]json.RawMessage, len(cloud))
+	for key, value := range cloud {
+		normalized, err := Validate(key, value)
+		if errors.Is(err, ErrUnknownKey) {
+			log.Debug().Str("key", key).Msg("Skipping setting unknown to this version")
+			continue
+		}
+		if err != nil {
+			log.Warn().Err(err).Msg("Skipping invalid setting from cloud")
+			continue
+		}
+		valid[key] = normalized
+	}
+	return valid
+}
@@ -0,0 +1,124 @@
+package syncproto
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"time"
+
+	"shosha-finance/internal/models"
+
+	"github.com/google/uuid"
+)
+
+// Frame kinds. A push is a batch frame followed by its changes. A pull
+// starts with the device's scope, carries the records written since the
+// cursor and ends with an end frame; a pull that stops without one was cut
+// off and must not move the cursor.
+const (
+	KindBatch       = "batch"
+	KindChange      = "change"
+	KindScope       = "scope"
+	KindBranch      = "branch"
+	KindTransaction = "transaction"
+	KindUser        = "user"
+	KindRevokedUser = "revoked_user"
+	KindTombstone   = "tombstone"
+	KindEnd         = "end"
+	KindError       = "error"
+)
+
+// PushHeader opens a push stream. The batch ID stays the same when a
+// batch is re-sent.
+type PushHeader struct {
+	BatchID  uuid.UUID  `json:"batch_id"`
+	DeviceID string     `json:"device_id"`
+	BranchID *uuid.UUID `json:"branch_id,omitempty"`
+}
+
+// PullEnd closes a complete pull. Cursor is the receive sequence number
+// the next pull continues after.
+type PullEnd struct {
+	Cursor     uint64 `json:"cursor"`
+	LastSyncAt string `json:"last_sync_at"`
+	Records    int    `json:"records"`
+}
+
+// StreamError is sent in place of the end frame when the sender fails
+// after the stream has started.
+type StreamError struct {
+	Message string `json:"message"`
+}
+
+// PullResponse is a pull sent as a single JSON document, for Version1 or
+// a local app that does not stream.
+type PullResponse struct {
+	Branches     []models.Branch      `json:"branches"`
+	Transactions []models.Transaction `json:"transactions"`
+	Tombstones   []models.Tombstone   `json:"tombstones"`
+	Users        []models.SyncUser    `json:"users"`
+	RevokedUsers []uuid.UUID          `json:"revoked_users"`
+	Scope        *models.BranchScope  `json:"scope"`
+	Cursor       uint64               `json:"cursor"`
+	LastSyncAt   string               `json:"last_sync_at"`
+}
+
+// DecodeResponse reads a cloud API answer, which comes wrapped as
+// {"success", "message", "data"}, and decodes its data into data. An
+// answer with success false returns its message as the error.
+func DecodeResponse(r io.Reader, data interface{}) error {
+	envelope := struct {
+		Success bool        `json:"success"`
+		Message string      `json:"message"`
+		Data    interface{} `json:"data"`
+	}{Data: data}
+	if err := json.NewDecoder(r).Decode(&envelope); err != nil {
+		return err
+	}
+	if !envelope.Success {
+		if envelope.Message == "" {
+			return errors.New("cloud API did not report success")
+		}
+		return errors.New(envelope.Message)
+	}
+	return nil
+}
+
+// Digests answers a verification: the cloud's day digests of the device's
+// scope for the days from From to To, counting transactions received up to
+// the Until sequence number.
+type Digests struct {
+	From    string             `json:"from"`
+	To      string             `json:"to"`
+	Until   uint64             `json:"until"`
+	Digests []models.DayDigest `json:"digests"`
+}
+
+// DigestDay is the drill-down into a day whose digests differ: every
+// transaction of the branch on that day the cloud received up to the
+// device's pull cursor, whatever its stamp, and the IDs of those received
+// since, which are still on their way.
+type DigestDay struct {
+	BranchID     uuid.UUID            `json:"branch_id"`
+	Day          string               `json:"day"`
+	Transactions []models.Transaction `json:"transactions"`
+	Pending      []uuid.UUID          `json:"pending"`
+}
+
+// StatusReport is what a device tells the cloud at the end of each sync
+// cycle: its push backlog and, when the cycle failed, why.
+type StatusReport struct {
+	State               string    `json:"state"`
+	QueueDepth          int64     `json:"queue_depth"`
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+	LastError           string    `json:"last_error,omitempty"`
+	FinishedAt          time.Time `json:"finished_at"`
+}
+
+// Settings are the values head office set for a device, resolved across
+// the global, branch and device scopes. Keys not set on the cloud are left
+// out. Digest changes whenever a value does.
+type Settings struct {
+	Settings map[string]json.RawMessage `json:"settings"`
+	Digest   string                     `json:"digest"`
+}
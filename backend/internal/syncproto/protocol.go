@@ -0,0 +1,169 @@
+// Package syncproto defines the sync protocol spoken between local installs
+// and the cloud: its versions and capabilities, the handshake that settles
+// them, the messages exchanged, and the compressed NDJSON streams that
+// carry pushes and pulls. Both sides use these types, so a message has one
+// definition.
+package syncproto
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// Protocol versions.
+const (
+	// Version1 exchanges pushes and pulls as single JSON documents. Local
+	// apps that predate the handshake speak it without saying so.
+	Version1 = 1
+	// Version2 starts with a handshake and can stream pushes and pulls as
+	// compressed NDJSON.
+	Version2 = 2
+
+	// CurrentVersion is the newest version this build speaks and MinVersion
+	// the oldest.
+	CurrentVersion = Version2
+	MinVersion     = Version1
+)
+
+// HeaderVersion carries the agreed protocol version on every sync request.
+// Requests without it are taken as Version1.
+const HeaderVersion = "X-Sync-Protocol"
+
+// Capabilities a side may support within a protocol version.
+const (
+	// CapabilityStream sends pushes and pulls as frames.
+	CapabilityStream = "stream"
+	// CapabilityZstd and CapabilityGzip compress streams.
+	CapabilityZstd = "zstd"
+	CapabilityGzip = "gzip"
+	// CapabilitySnapshot restores an install from a cloud snapshot.
+	CapabilitySnapshot = "snapshot"
+	// CapabilityVerify compares day digests of the books on both sides.
+	CapabilityVerify = "verify"
+	// CapabilityReport sends the cloud the outcome of every sync cycle.
+	CapabilityReport = "report"
+	// CapabilitySettings pulls the settings head office set for the device.
+	CapabilitySettings = "settings"
+)
+
+// Capabilities lists everything this build supports.
+func Capabilities() []string {
+	return []string{CapabilityStream, CapabilityZstd, CapabilityGzip, CapabilitySnapshot, CapabilityVerify, CapabilityReport, CapabilitySettings}
+}
+
+// Sides that may have to be updated when a handshake is refused.
+const (
+	UpdateLocal = "local"
+	UpdateCloud = "cloud"
+)
+
+// Hello opens the handshake: the local app's range of protocol versions,
+// its app version and its capabilities.
+type Hello struct {
+	ProtocolVersion    int      `json:"protocol_version"`
+	MinProtocolVersion int      `json:"min_protocol_version"`
+	AppVersion         string   `json:"app_version"`
+	Capabilities       []string `json:"capabilities"`
+}
+
+// Welcome is the cloud's answer to a Hello it accepts: the version and
+// capabilities both sides share, and the encoding streams should use.
+type Welcome struct {
+	ProtocolVersion    int      `json:"protocol_version"`
+	MinProtocolVersion int      `json:"min_protocol_version"`
+	Capabilities       []string `json:"capabilities"`
+	Encoding           string   `json:"encoding,omitempty"`
+	AppVersion         string   `json:"app_version"`
+}
+
+// Legacy is what a local app assumes of a cloud that predates the
+// handshake.
+func Legacy() *Welcome {
+	return &Welcome{ProtocolVersion: Version1, MinProtocolVersion: Version1, Capabilities: []string{}}
+}
+
+// Has reports whether both sides agreed on the capability.
+func (w *Welcome) Has(capability string) bool {
+	for _, c := range w.Capabilities {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
+
+// Streams reports whether pushes and pulls are sent as frames.
+func (w *Welcome) Streams() bool {
+	return w.ProtocolVersion >= Version2 && w.Has(CapabilityStream)
+}
+
+// Refusal is sent with 426 Upgrade Required when the two sides share no
+// protocol version. Update names the side that is out of date.
+type Refusal struct {
+	Update             string `json:"update"`
+	ProtocolVersion    int    `json:"protocol_version"`
+	MinProtocolVersion int    `json:"min_protocol_version"`
+	RequestedVersion   int    `json:"requested_version"`
+}
+
+func (r *Refusal) Error() string {
+	if r.Update == UpdateCloud {
+		return fmt.Sprintf("the cloud speaks sync protocol up to v%d but this app needs v%d or newer, please update the cloud", r.ProtocolVersion, r.RequestedVersion)
+	}
+	return fmt.Sprintf("this app speaks sync protocol v%d but the cloud needs v%d or newer, please update the app", r.RequestedVersion, r.MinProtocolVersion)
+}
+
+// Agree settles the protocol for a local app's Hello on the cloud, which
+// accepts versions from minVersion up to CurrentVersion. The newest version
+// both speak is used with the capabilities both have, preferring zstd over
+// gzip for streams. A Refusal is returned when the ranges do not meet.
+func Agree(hello *Hello, minVersion int) (*Welcome, error) {
+	if hello.ProtocolVersion < minVersion {
+		return nil, &Refusal{
+			Update:             UpdateLocal,
+			ProtocolVersion:    CurrentVersion,
+			MinProtocolVersion: minVersion,
+			RequestedVersion:   hello.ProtocolVersion,
+		}
+	}
+	if hello.MinProtocolVersion > CurrentVersion {
+		return nil, &Refusal{
+			Update:             UpdateCloud,
+			ProtocolVersion:    CurrentVersion,
+			MinProtocolVersion: minVersion,
+			RequestedVersion:   hello.MinProtocolVersion,
+		}
+	}
+
+	welcome := &Welcome{
+		ProtocolVersion:    min(hello.ProtocolVersion, CurrentVersion),
+		MinProtocolVersion: minVersion,
+		Capabilities:       []string{},
+	}
+	offered := map[string]bool{}
+	for _, c := range hello.Capabilities {
+		offered[c] = true
+	}
+	for _, c := range Capabilities() {
+		if offered[c] {
+			welcome.Capabilities = append(welcome.Capabilities, c)
+		}
+	}
+
+	switch {
+	case welcome.Has(CapabilityZstd):
+		welcome.Encoding = EncodingZstd
+	case welcome.Has(CapabilityGzip):
+		welcome.Encoding = EncodingGzip
+	}
+	return welcome, nil
+}
+
+// RequestVersion reads the protocol version from a request's header value.
+func RequestVersion(header string) int {
+	version, err := strconv.Atoi(header)
+	if err != nil || version < Version1 {
+		return Version1
+	}
+	return version
+}
@@ -0,0 +1,113 @@
+package syncproto
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestAgree(t *testing.T) {
+	tests := []struct {
+		name         string
+		hello        Hello
+		minVersion   int
+		wantVersion  int
+		wantCaps     []string
+		wantEncoding string
+		wantUpdate   string
+	}{
+		{
+			name:         "same range",
+			hello:        Hello{ProtocolVersion: Version2, MinProtocolVersion: Version1, Capabilities: Capabilities()},
+			minVersion:   Version1,
+			wantVersion:  Version2,
+			wantCaps:     Capabilities(),
+			wantEncoding: EncodingZstd,
+		},
+		{
+			name:         "newer app",
+			hello:        Hello{ProtocolVersion: Version2 + 1, MinProtocolVersion: Version1, Capabilities: []string{CapabilityStream, CapabilityGzip, "teleport"}},
+			minVersion:   Version1,
+			wantVersion:  Version2,
+			wantCaps:     []string{CapabilityStream, CapabilityGzip},
+			wantEncoding: EncodingGzip,
+		},
+		{
+			name:        "no shared compression",
+			hello:       Hello{ProtocolVersion: Version2, MinProtocolVersion: Version1, Capabilities: []string{CapabilityVerify, CapabilityStream}},
+			minVersion:  Version1,
+			wantVersion: Version2,
+			wantCaps:    []string{CapabilityStream, CapabilityVerify},
+		},
+		{
+			name:        "older app",
+			hello:       Hello{ProtocolVersion: Version1, MinProtocolVersion: Version1},
+			minVersion:  Version1,
+			wantVersion: Version1,
+			wantCaps:    []string{},
+		},
+		{
+			name:       "app too old",
+			hello:      Hello{ProtocolVersion: Version1, MinProtocolVersion: Version1},
+			minVersion: Version2,
+			wantUpdate: UpdateLocal,
+		},
+		{
+			name:       "cloud too old",
+			hello:      Hello{ProtocolVersion: CurrentVersion + 2, MinProtocolVersion: CurrentVersion + 1},
+			minVersion: Version1,
+			wantUpdate: UpdateCloud,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			welcome, err := Agree(&tt.hello, tt.minVersion)
+			if tt.wantUpdate != "" {
+				var refusal *Refusal
+				if !errors.As(err, &refusal) {
+					t.Fatalf("Agree() error = %v, want a refusal", err)
+				}
+				if refusal.Update != tt.wantUpdate {
+					t.Errorf("Update = %q, want %q", refusal.Update, tt.wantUpdate)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Agree() error = %v", err)
+			}
+			if welcome.ProtocolVersion != tt.wantVersion {
+				t.Errorf("ProtocolVersion = %d, want %d", welcome.ProtocolVersion, tt.wantVersion)
+			}
+			if welcome.MinProtocolVersion != tt.minVersion {
+				t.Errorf("MinProtocolVersion = %d, want %d", welcome.MinProtocolVersion, tt.minVersion)
+			}
+			if !reflect.DeepEqual(welcome.Capabilities, tt.wantCaps) {
+				t.Errorf("Capabilities = %v, want %v", welcome.Capabilities, tt.wantCaps)
+			}
+			if welcome.Encoding != tt.wantEncoding {
+				t.Errorf("Encoding = %q, want %q", welcome.Encoding, tt.wantEncoding)
+			}
+		})
+	}
+}
+
+func TestRequestVersion(t *testing.T) {
+	tests := []struct {
+		header string
+		want   int
+	}{
+		{"", Version1},
+		{"2", Version2},
+		{"0", Version1},
+		{"-3", Version1},
+		{"v2", Version1},
+		{"7", 7},
+	}
+
+	for _, tt := range tests {
+		if got := RequestVersion(tt.header); got != tt.want {
+			t.Errorf("RequestVersion(%q) = %d, want %d", tt.header, got, tt.want)
+		}
+	}
+}
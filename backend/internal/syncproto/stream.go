@@ -0,0 +1,207 @@
+package syncproto
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Streams hold one frame per line, each carrying a single record, as
+// NDJSON that is usually compressed. Both sides read and write frames one
+// at a time, so neither has to hold a whole batch or pull, encoded or
+// decoded, in memory.
+
+// ContentType marks a request or response body holding frames.
+const ContentType = "application/x-ndjson"
+
+// Content encodings a stream may be compressed with. An empty encoding is
+// uncompressed NDJSON.
+const (
+	EncodingZstd = "zstd"
+	EncodingGzip = "gzip"
+)
+
+// maxFrameSize bounds a single decoded frame and maxWindowSize the zstd
+// window, so a corrupt or hostile stream cannot make the reader buffer
+// without limit.
+const (
+	maxFrameSize  = 16 << 20
+	maxWindowSize = 32 << 20
+)
+
+var ErrUnsupportedEncoding = errors.New("unsupported content encoding")
+
+// Frame is one line of a stream. Data is decoded by the reader according
+// to the kind.
+type Frame struct {
+	Kind string          `json:"kind"`
+	Data json.RawMessage `json:"data"`
+}
+
+// Decode unmarshals the frame's data into v.
+func (f *Frame) Decode(v interface{}) error {
+	if err := json.Unmarshal(f.Data, v); err != nil {
+		return fmt.Errorf("invalid %s frame: %w", f.Kind, err)
+	}
+	return nil
+}
+
+// IsStream reports whether a Content-Type or Accept header names frames.
+func IsStream(header string) bool {
+	return strings.Contains(header, ContentType)
+}
+
+// Negotiate picks the encoding for a response from the client's
+// Accept-Encoding header, preferring zstd. It returns an empty string when
+// the client accepts neither.
+func Negotiate(acceptEncoding string) string {
+	accepted := map[string]bool{}
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if strings.ReplaceAll(params, " ", "") == "q=0" {
+			continue
+		}
+		accepted[strings.ToLower(strings.TrimSpace(name))] = true
+	}
+	switch {
+	case accepted[EncodingZstd]:
+		return EncodingZstd
+	case accepted[EncodingGzip]:
+		return EncodingGzip
+	}
+	return ""
+}
+
+// Writer writes frames to an underlying writer, compressing them with the
+// chosen encoding.
+type Writer struct {
+	buf        *bufio.Writer
+	compressor io.WriteCloser
+	enc        *json.Encoder
+	flusher    interface{ Flush() error }
+}
+
+func NewWriter(w io.Writer, encoding string) (*Writer, error) {
+	sw := &Writer{}
+	switch encoding {
+	case EncodingZstd:
+		zw, err := zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		sw.compressor, sw.flusher = zw, zw
+	case EncodingGzip:
+		gw := gzip.NewWriter(w)
+		sw.compressor, sw.flusher = gw, gw
+	case "":
+	default:
+		return nil, ErrUnsupportedEncoding
+	}
+
+	if sw.compressor != nil {
+		sw.buf = bufio.NewWriter(sw.compressor)
+	} else {
+		sw.buf = bufio.NewWriter(w)
+	}
+	sw.enc = json.NewEncoder(sw.buf)
+	return sw, nil
+}
+
+// Write appends one frame.
+func (w *Writer) Write(kind string, data interface{}) error {
+	return w.enc.Encode(struct {
+		Kind string      `json:"kind"`
+		Data interface{} `json:"data"`
+	}{kind, data})
+}
+
+// Flush pushes the frames written so far through the compressor, so the
+// reader can start on them while more are being produced.
+func (w *Writer) Flush() error {
+	if err := w.buf.Flush(); err != nil {
+		return err
+	}
+	if w.flusher != nil {
+		return w.flusher.Flush()
+	}
+	return nil
+}
+
+// Close flushes the remaining frames and ends the compressed stream. It
+// does not close the underlying writer.
+func (w *Writer) Close() error {
+	if err := w.buf.Flush(); err != nil {
+		return err
+	}
+	if w.compressor != nil {
+		return w.compressor.Close()
+	}
+	return nil
+}
+
+// Reader reads frames from a possibly compressed stream.
+type Reader struct {
+	scanner *bufio.Scanner
+	closer  func()
+}
+
+func NewReader(r io.Reader, encoding string) (*Reader, error) {
+	sr := &Reader{closer: func() {}}
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case EncodingZstd:
+		zr, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxWindow(maxWindowSize))
+		if err != nil {
+			return nil, err
+		}
+		r, sr.closer = zr, zr.Close
+	case EncodingGzip:
+		gr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		r, sr.closer = gr, func() { gr.Close() }
+	case "", "identity":
+	default:
+		return nil, ErrUnsupportedEncoding
+	}
+
+	sr.scanner = bufio.NewScanner(r)
+	sr.scanner.Buffer(make([]byte, 0, 64<<10), maxFrameSize)
+	return sr, nil
+}
+
+// Next returns the next frame, or io.EOF once the stream has ended. A
+// stream cut off inside a compressed block returns an error instead.
+func (r *Reader) Next() (*Frame, error) {
+	for r.scanner.Scan() {
+		line := r.scanner.Bytes()
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		var frame Frame
+		if err := json.Unmarshal(line, &frame); err != nil {
+			return nil, fmt.Errorf("invalid frame: %w", err)
+		}
+		if frame.Kind == "" {
+			return nil, errors.New("invalid frame: missing kind")
+		}
+		return &frame, nil
+	}
+	if err := r.scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, io.EOF
+}
+
+// Close releases the decompressor. It does not close the underlying
+// reader.
+func (r *Reader) Close() {
+	r.closer()
+}
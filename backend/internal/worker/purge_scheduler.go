@@ -0,0 +1,63 @@
+package worker
+
+import (
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Purge is a cleanup the purge scheduler runs, such as dropping expired
+// tombstones. Each purge logs how many rows it removed.
+type Purge struct {
+	Name string
+	Run  func() error
+}
+
+// PurgeScheduler runs the retention purges at startup and then on every
+// tick, so a long-running server keeps its tables trimmed.
+type PurgeScheduler struct {
+	purges   []Purge
+	interval time.Duration
+	stopChan chan struct{}
+}
+
+func NewPurgeScheduler(interval time.Duration, purges ...Purge) *PurgeScheduler {
+	return &PurgeScheduler{
+		purges:   purges,
+		interval: interval,
+		stopChan: make(chan struct{}),
+	}
+}
+
+func (s *PurgeScheduler) Start() {
+	log.Info().Dur("interval", s.interval).Msg("Starting purge scheduler")
+
+	go func() {
+		s.run()
+
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				s.run()
+			case <-s.stopChan:
+				log.Info().Msg("Purge scheduler stopped")
+				return
+			}
+		}
+	}()
+}
+
+func (s *PurgeScheduler) Stop() {
+	close(s.stopChan)
+}
+
+func (s *PurgeScheduler) run() {
+	for _, purge := range s.purges {
+		if err := purge.Run(); err != nil {
+			log.Warn().Err(err).Str("purge", purge.Name).Msg("Failed to purge expired rows")
+		}
+	}
+}
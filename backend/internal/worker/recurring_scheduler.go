@@ -0,0 +1,61 @@
+package worker
+
+import (
+	"time"
+
+	"shosha-finance/internal/service"
+
+	"github.com/rs/zerolog/log"
+)
+
+type RecurringScheduler struct {
+	recurringService service.RecurringService
+	interval         time.Duration
+	stopChan         chan struct{}
+}
+
+func NewRecurringScheduler(recurringService service.RecurringService, interval time.Duration) *RecurringScheduler {
+	return &RecurringScheduler{
+		recurringService: recurringService,
+		interval:         interval,
+		stopChan:         make(chan struct{}),
+	}
+}
+
+func (s *RecurringScheduler) Start() {
+	log.Info().Dur("interval", s.interval).Msg("Starting recurring scheduler")
+
+	go func() {
+		// Initial run catches up on occurrences missed while the app was off
+		s.run()
+
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				s.run()
+			case <-s.stopChan:
+				log.Info().Msg("Recurring scheduler stopped")
+				return
+			}
+		}
+	}()
+}
+
+func (s *RecurringScheduler) Stop() {
+	close(s.stopChan)
+}
+
+func (s *RecurringScheduler) run() {
+	created, err := s.recurringService.ProcessDue(time.Now())
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to process recurring transactions")
+		return
+	}
+
+	if created > 0 {
+		log.Info().Int("created", created).Msg("Recurring transactions materialized")
+	}
+}
@@ -0,0 +1,124 @@
+package worker
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+
+	"shosha-finance/internal/config"
+	"shosha-finance/internal/syncproto"
+
+	"github.com/rs/zerolog/log"
+)
+
+// ensureProtocol settles the sync protocol with the cloud once; it is
+// settled again after a failed cycle, in case the cloud was updated in
+// between.
+func (w *SyncWorker) ensureProtocol() error {
+	w.mu.Lock()
+	settled := w.protocol != nil && w.failures == 0
+	w.mu.Unlock()
+	if settled {
+		return nil
+	}
+	return w.handshake()
+}
+
+// handshake offers the protocol versions and capabilities this build
+// supports and keeps what the cloud agrees to. A cloud that predates the
+// handshake is spoken to in version 1. A *syncproto.Refusal is returned
+// when one side has to be updated.
+func (w *SyncWorker) handshake() error {
+	deviceID, err := w.deviceID()
+	if err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(w.hello())
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(w.ctx, "POST", w.cfg.CloudAPIURL+"/api/v1/sync/handshake", bytes.NewBuffer(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	w.authorize(req, deviceID)
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		log.Info().Msg("Cloud predates the sync handshake, using protocol v1")
+		w.setProtocol(syncproto.Legacy())
+		return nil
+	case http.StatusUpgradeRequired:
+		// The refusal comes as the data of an unsuccessful answer
+		refusal := &syncproto.Refusal{}
+		syncproto.DecodeResponse(resp.Body, refusal)
+		if refusal.Update == "" {
+			refusal.Update = syncproto.UpdateLocal
+		}
+		w.mu.Lock()
+		w.protocol = nil
+		w.updateRequired = refusal.Error()
+		w.mu.Unlock()
+		log.Error().Str("update", refusal.Update).Msg(refusal.Error())
+		return refusal
+	default:
+		log.Warn().Int("status", resp.StatusCode).Msg("Cloud API handshake returned non-200 status")
+		return newCloudError(resp)
+	}
+
+	welcome := &syncproto.Welcome{}
+	if err := syncproto.DecodeResponse(resp.Body, welcome); err != nil {
+		return err
+	}
+	w.setProtocol(welcome)
+
+	log.Info().
+		Int("protocol_version", welcome.ProtocolVersion).
+		Strs("capabilities", welcome.Capabilities).
+		Str("encoding", welcome.Encoding).
+		Str("cloud_version", welcome.AppVersion).
+		Msg("Sync protocol agreed with cloud")
+	return nil
+}
+
+// hello describes this build to the cloud. SYNC_ENCODING narrows what is
+// offered: "json" leaves streaming out, "gzip" leaves zstd out.
+func (w *SyncWorker) hello() *syncproto.Hello {
+	capabilities := syncproto.Capabilities()
+	switch w.cfg.SyncEncoding {
+	case syncEncodingJSON:
+		capabilities = []string{syncproto.CapabilitySnapshot, syncproto.CapabilityVerify, syncproto.CapabilityReport, syncproto.CapabilitySettings}
+	case syncproto.EncodingGzip:
+		capabilities = []string{syncproto.CapabilityStream, syncproto.CapabilityGzip, syncproto.CapabilitySnapshot, syncproto.CapabilityVerify, syncproto.CapabilityReport, syncproto.CapabilitySettings}
+	}
+
+	return &syncproto.Hello{
+		ProtocolVersion:    syncproto.CurrentVersion,
+		MinProtocolVersion: syncproto.MinVersion,
+		AppVersion:         config.AppVersion,
+		Capabilities:       capabilities,
+	}
+}
+
+func (w *SyncWorker) currentProtocol() *syncproto.Welcome {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.protocol
+}
+
+// setProtocol keeps the agreed protocol.
+func (w *SyncWorker) setProtocol(protocol *syncproto.Welcome) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.protocol = protocol
+	w.updateRequired = ""
+}
@@ -0,0 +1,377 @@
+package worker
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"shosha-finance/internal/events"
+	"shosha-finance/internal/models"
+	"shosha-finance/internal/repository"
+	"shosha-finance/internal/syncproto"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+)
+
+// pullApplyBatch is how many pulled transactions are written to SQLite in
+// one DB transaction.
+const pullApplyBatch = 200
+
+// errPullCutOff is returned when a streamed pull ends without its end
+// frame, for instance because the connection dropped.
+var errPullCutOff = errors.New("pull stream ended before it was complete")
+
+// pull fetches the records written on the cloud since the stored cursor and
+// applies them as they arrive. The cursor only moves once the whole pull
+// was applied, so an interrupted pull starts again from the same place.
+func (w *SyncWorker) pull(run *models.SyncRun) error {
+	cursor, err := w.stateRepo.Get(models.SyncStatePullCursor)
+	if err != nil {
+		return err
+	}
+
+	deviceID, err := w.deviceID()
+	if err != nil {
+		return err
+	}
+
+	url := w.cfg.CloudAPIURL + "/api/v1/sync/pull"
+	if cursor != "" {
+		url += "?since=" + cursor
+	}
+	req, err := http.NewRequestWithContext(w.ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+	w.authorize(req, deviceID)
+	if encoding, ok := w.streamEncoding(); ok {
+		req.Header.Set("Accept", syncproto.ContentType)
+		if encoding == syncproto.EncodingZstd {
+			req.Header.Set("Accept-Encoding", "zstd, gzip")
+		} else {
+			req.Header.Set("Accept-Encoding", encoding)
+		}
+	}
+
+	// A streamed pull may run for a while on a slow connection; it is
+	// read and applied as it arrives
+	client := *w.client
+	client.Timeout = transferTimeout
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		log.Error().Msg("Cloud refused the device credential, the device may have been deactivated")
+	}
+	if resp.StatusCode != http.StatusOK {
+		log.Warn().Int("status", resp.StatusCode).Msg("Cloud API pull returned non-200 status")
+		return newCloudError(resp)
+	}
+
+	applier, err := w.newPullApplier(run, cursor != "")
+	if err != nil {
+		return err
+	}
+
+	// Clouds that predate streaming answer with a single JSON document
+	var restart bool
+	if syncproto.IsStream(resp.Header.Get("Content-Type")) {
+		restart, err = applier.readStream(resp)
+	} else {
+		restart, err = applier.readDocument(resp)
+	}
+	if err != nil || !restart {
+		return err
+	}
+
+	// A new scope may bring branches whose older records were never
+	// pulled, so the pull starts over under it
+	resp.Body.Close()
+	log.Info().Msg("Branch scope changed, pulling from the start")
+	if err := w.stateRepo.Delete(models.SyncStatePullCursor); err != nil {
+		return err
+	}
+	return w.pull(run)
+}
+
+// pullApplier stores the records of one pull as they arrive. Transactions,
+// the bulk of a pull, are written in batches, each in one DB transaction;
+// the few users and tombstones are kept until the pull is complete.
+type pullApplier struct {
+	w       *SyncWorker
+	run     *models.SyncRun
+	resumed bool
+	now     time.Time
+
+	// Branches deleted here whose tombstone has not reached the cloud yet;
+	// saving them would bring them back. Once the cloud has taken the
+	// delete, a copy it still sends is one it kept
+	deletedBranches map[uuid.UUID]bool
+
+	pending    []models.Transaction
+	users      []models.User
+	revoked    []uuid.UUID
+	tombstones []models.Tombstone
+
+	branches     int
+	transactions int
+	conflicts    int
+	failed       int
+}
+
+func (w *SyncWorker) newPullApplier(run *models.SyncRun, resumed bool) (*pullApplier, error) {
+	var deletedBranchIDs []uuid.UUID
+	err := w.db.Unscoped().Model(&models.Branch{}).
+		Where("deleted_at IS NOT NULL").
+		Where("id IN (?)", w.db.Model(&models.ChangeLog{}).Select("entity_id").Where("entity_type = ?", models.EntityBranch)).
+		Pluck("id", &deletedBranchIDs).Error
+	if err != nil {
+		return nil, err
+	}
+	deletedBranches := map[uuid.UUID]bool{}
+	for _, id := range deletedBranchIDs {
+		deletedBranches[id] = true
+	}
+
+	return &pullApplier{
+		w:               w,
+		run:             run,
+		resumed:         resumed,
+		now:             time.Now(),
+		deletedBranches: deletedBranches,
+		pending:         make([]models.Transaction, 0, pullApplyBatch),
+	}, nil
+}
+
+// readStream applies a pull sent as frames. It reports whether the branch
+// scope changed on a resumed pull, in which case the rest of the stream is
+// left unread and the pull has to start over.
+func (p *pullApplier) readStream(resp *http.Response) (bool, error) {
+	reader, err := syncproto.NewReader(resp.Body, resp.Header.Get("Content-Encoding"))
+	if err != nil {
+		return false, err
+	}
+	defer reader.Close()
+
+	// Whatever arrived before a failure is kept; the cursor is not moved,
+	// so the next pull sends it again
+	fail := func(err error) (bool, error) {
+		p.flush()
+		return false, err
+	}
+
+	for {
+		frame, err := reader.Next()
+		if err == io.EOF {
+			return fail(errPullCutOff)
+		}
+		if err != nil {
+			return fail(err)
+		}
+
+		switch frame.Kind {
+		case syncproto.KindScope:
+			var scope models.BranchScope
+			if err := frame.Decode(&scope); err != nil {
+				return fail(err)
+			}
+			if restart, err := p.scope(&scope); restart || err != nil {
+				return restart, err
+			}
+		case syncproto.KindBranch:
+			var branch models.Branch
+			if err := frame.Decode(&branch); err != nil {
+				return fail(err)
+			}
+			p.branch(&branch)
+		case syncproto.KindTransaction:
+			var tx models.Transaction
+			if err := frame.Decode(&tx); err != nil {
+				return fail(err)
+			}
+			p.transaction(tx)
+		case syncproto.KindUser:
+			var user models.SyncUser
+			if err := frame.Decode(&user); err != nil {
+				return fail(err)
+			}
+			p.users = append(p.users, *user.ToUser())
+		case syncproto.KindRevokedUser:
+			var id uuid.UUID
+			if err := frame.Decode(&id); err != nil {
+				return fail(err)
+			}
+			p.revoked = append(p.revoked, id)
+		case syncproto.KindTombstone:
+			var tombstone models.Tombstone
+			if err := frame.Decode(&tombstone); err != nil {
+				return fail(err)
+			}
+			p.tombstones = append(p.tombstones, tombstone)
+		case syncproto.KindError:
+			var streamErr syncproto.StreamError
+			frame.Decode(&streamErr)
+			return fail(fmt.Errorf("cloud API failed during pull: %s", streamErr.Message))
+		case syncproto.KindEnd:
+			var end syncproto.PullEnd
+			if err := frame.Decode(&end); err != nil {
+				return fail(err)
+			}
+			return false, p.finish(end.Cursor)
+		default:
+			// Kinds added by newer clouds are skipped
+			log.Debug().Str("kind", frame.Kind).Msg("Skipping unknown pull frame")
+		}
+	}
+}
+
+// readDocument applies a pull sent as a single JSON document.
+func (p *pullApplier) readDocument(resp *http.Response) (bool, error) {
+	var pulled syncproto.PullResponse
+	if err := syncproto.DecodeResponse(resp.Body, &pulled); err != nil {
+		return false, err
+	}
+
+	if pulled.Scope != nil {
+		if restart, err := p.scope(pulled.Scope); restart || err != nil {
+			return restart, err
+		}
+	}
+	for i := range pulled.Branches {
+		p.branch(&pulled.Branches[i])
+	}
+	for i := range pulled.Transactions {
+		p.transaction(pulled.Transactions[i])
+	}
+	for i := range pulled.Users {
+		p.users = append(p.users, *pulled.Users[i].ToUser())
+	}
+	p.revoked = pulled.RevokedUsers
+	p.tombstones = pulled.Tombstones
+
+	return false, p.finish(pulled.Cursor)
+}
+
+// scope stores the branch scope the cloud reported and reports whether a
+// resumed pull has to start over under it.
+func (p *pullApplier) scope(scope *models.BranchScope) (bool, error) {
+	changed, err := p.w.updateScope(scope)
+	if err != nil {
+		return false, err
+	}
+	return changed && p.resumed, nil
+}
+
+func (p *pullApplier) branch(branch *models.Branch) {
+	if p.deletedBranches[branch.ID] {
+		return
+	}
+	branch.IsSynced = true
+	branch.SyncedAt = &p.now
+	p.apply(p.w.conflictRepo, models.EntityBranch, branch)
+	p.branches++
+}
+
+func (p *pullApplier) transaction(tx models.Transaction) {
+	tx.IsSynced = true
+	tx.SyncedAt = &p.now
+	p.pending = append(p.pending, tx)
+	if len(p.pending) == pullApplyBatch {
+		p.flush()
+	}
+}
+
+// apply writes one pulled record. Records with local changes still waiting
+// go through the conflict policy instead of being overwritten.
+func (p *pullApplier) apply(conflictRepo repository.ConflictRepository, entityType string, record models.Versioned) {
+	conflict, err := conflictRepo.ApplyCloudVersion(entityType, record)
+	if err != nil {
+		p.failed++
+		log.Error().Err(err).Str("entity_type", entityType).Msg("Failed to apply pulled record")
+		return
+	}
+	if conflict != nil {
+		p.conflicts++
+		log.Warn().
+			Str("entity_type", entityType).
+			Str("entity_id", conflict.EntityID.String()).
+			Str("winner", string(conflict.Winner)).
+			Msg("Sync conflict settled")
+	}
+}
+
+// flush writes the pending transactions in one DB transaction. A record
+// that fails is rolled back on its own and counted; the others are kept.
+func (p *pullApplier) flush() {
+	if len(p.pending) == 0 {
+		return
+	}
+
+	err := p.w.db.Transaction(func(tx *gorm.DB) error {
+		conflictRepo := repository.NewConflictRepository(tx, p.w.repoOpts)
+		for i := range p.pending {
+			p.apply(conflictRepo, models.EntityTransaction, &p.pending[i])
+		}
+		return nil
+	})
+	if err != nil {
+		p.failed += len(p.pending)
+		log.Error().Err(err).Int("transactions", len(p.pending)).Msg("Failed to apply pulled transactions")
+	} else {
+		p.transactions += len(p.pending)
+		p.run.Pulled += len(p.pending)
+		p.w.publishTransactions(events.SourcePull, p.pending)
+		p.w.publishProgress("pull", p.run)
+	}
+	p.pending = p.pending[:0]
+}
+
+// finish applies what was held back until the pull was complete and moves
+// the cursor, unless a record failed and has to be pulled again.
+func (p *pullApplier) finish(cursor uint64) error {
+	p.flush()
+
+	// Users are managed on the cloud; keeping them here lets staff log in
+	// while offline, and deactivations take effect with this pull
+	if err := p.w.userRepo.ApplyPulled(p.users, p.revoked); err != nil {
+		p.failed++
+		log.Error().Err(err).Msg("Failed to apply pulled users")
+	}
+
+	// Apply deletes made elsewhere; soft-deleted rows are kept as tombstones
+	for i := range p.tombstones {
+		if err := p.w.tombstoneRepo.Apply(&p.tombstones[i]); err != nil {
+			p.failed++
+			log.Error().Err(err).Msg("Failed to apply pulled tombstone")
+		}
+	}
+
+	// Keep the old cursor when something failed so the next pull retries it
+	if p.failed == 0 && cursor != 0 {
+		if err := p.w.stateRepo.Set(models.SyncStatePullCursor, strconv.FormatUint(cursor, 10)); err != nil {
+			return err
+		}
+	}
+
+	p.run.Pulled += p.branches + len(p.users) + len(p.tombstones)
+	p.run.Conflicts += p.conflicts
+	p.w.publishProgress("pull", p.run)
+
+	log.Info().
+		Int("branches", p.branches).
+		Int("transactions", p.transactions).
+		Int("tombstones", len(p.tombstones)).
+		Int("users", len(p.users)).
+		Int("conflicts", p.conflicts).
+		Msg("Pulled data from cloud")
+
+	return nil
+}
@@ -0,0 +1,73 @@
+package worker
+
+import (
+	"encoding/json"
+
+	"shosha-finance/internal/events"
+	"shosha-finance/internal/models"
+	"shosha-finance/internal/repository"
+	"shosha-finance/internal/settings"
+	"shosha-finance/internal/syncproto"
+
+	"github.com/rs/zerolog/log"
+)
+
+// LoadSettings puts the settings the cloud last sent into the store, so
+// they are in effect from startup rather than from the first sync.
+func LoadSettings(stateRepo repository.SyncStateRepository, store *settings.Store) error {
+	value, err := stateRepo.Get(models.SyncStateSettings)
+	if err != nil || value == "" {
+		return err
+	}
+	var stored syncproto.Settings
+	if err := json.Unmarshal([]byte(value), &stored); err != nil {
+		return err
+	}
+	store.Load(stored.Settings)
+	return nil
+}
+
+// pullSettings fetches the settings head office set for this device and
+// applies them when they changed since the last pull. A cloud that does not
+// offer settings is not asked.
+func (w *SyncWorker) pullSettings() error {
+	protocol := w.currentProtocol()
+	if protocol == nil || !protocol.Has(syncproto.CapabilitySettings) {
+		return nil
+	}
+
+	var resolved syncproto.Settings
+	if err := w.getCloud("/api/v1/sync/settings", &resolved); err != nil {
+		return err
+	}
+
+	var stored syncproto.Settings
+	if value, err := w.stateRepo.Get(models.SyncStateSettings); err != nil {
+		return err
+	} else if value != "" {
+		if err := json.Unmarshal([]byte(value), &stored); err != nil {
+			log.Warn().Err(err).Msg("Discarding unreadable stored settings")
+		}
+	}
+	if stored.Digest == resolved.Digest && w.settings.AppliedAt() != nil {
+		return nil
+	}
+
+	if resolved.Settings == nil {
+		resolved.Settings = map[string]json.RawMessage{}
+	}
+	body, err := json.Marshal(resolved)
+	if err != nil {
+		return err
+	}
+	if err := w.stateRepo.Set(models.SyncStateSettings, string(body)); err != nil {
+		return err
+	}
+
+	changed := w.settings.Apply(resolved.Settings)
+	if len(changed) > 0 {
+		log.Info().Strs("keys", changed).Msg("Settings from cloud changed")
+		w.events.Publish(events.ConfigChanged, events.ConfigChangedData{Keys: changed})
+	}
+	return nil
+}
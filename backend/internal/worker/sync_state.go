@@ -0,0 +1,90 @@
+package worker
+
+import (
+	"time"
+
+	"shosha-finance/internal/events"
+
+	"github.com/rs/zerolog/log"
+)
+
+// State is what the sync worker is doing.
+type State string
+
+const (
+	// StateIdle waits for the next tick or a manual trigger.
+	StateIdle State = "idle"
+	// StateChecking checks that the cloud is reachable and the device is
+	// enrolled.
+	StateChecking State = "checking"
+	// StatePulling restores from a snapshot or pulls changes from the cloud.
+	StatePulling State = "pulling"
+	// StatePushing drains the change log to the cloud.
+	StatePushing State = "pushing"
+	// StateVerifying compares the local books with the cloud's.
+	StateVerifying State = "verifying"
+	// StateBackoff waits before retrying after a failed cycle.
+	StateBackoff State = "backoff"
+	// StateStopped is final; the worker does not run again.
+	StateStopped State = "stopped"
+)
+
+// transitions lists the states each state may move to. Any state may stop.
+var transitions = map[State][]State{
+	StateIdle:      {StateChecking},
+	StateChecking:  {StatePulling, StateIdle, StateBackoff},
+	StatePulling:   {StatePushing, StateBackoff},
+	StatePushing:   {StateVerifying, StateIdle, StateBackoff},
+	StateVerifying: {StateIdle},
+	StateBackoff:   {StateChecking},
+	StateStopped:   {},
+}
+
+func canTransition(from, to State) bool {
+	if to == StateStopped {
+		return from != StateStopped
+	}
+	for _, next := range transitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// transition moves the worker to the given state and announces it on the
+// event stream. A move the state machine does not allow is a bug; it is
+// logged and ignored.
+func (w *SyncWorker) transition(to State) {
+	w.mu.Lock()
+	from := w.state
+	if !canTransition(from, to) {
+		w.mu.Unlock()
+		log.Error().Str("from", string(from)).Str("to", string(to)).Msg("Invalid sync worker state transition")
+		return
+	}
+	w.state = to
+	w.stateSince = time.Now()
+	data := events.SyncStateData{State: string(to), Online: w.online}
+	if to == StateBackoff {
+		data.NextRetryAt = w.nextRetryAt
+	}
+	w.mu.Unlock()
+
+	log.Debug().Str("from", string(from)).Str("to", string(to)).Msg("Sync worker state changed")
+	w.events.Publish(events.SyncState, data)
+}
+
+// State returns the worker's current state and since when it has been in
+// it.
+func (w *SyncWorker) State() (State, time.Time) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.state, w.stateSince
+}
+
+func (w *SyncWorker) setOnline(online bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.online = online
+}
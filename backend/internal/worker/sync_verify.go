@@ -0,0 +1,306 @@
+package worker
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"shosha-finance/internal/events"
+	"shosha-finance/internal/models"
+	"shosha-finance/internal/settings"
+	"shosha-finance/internal/syncproto"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+)
+
+// RequestVerification makes the next sync cycle compare the local books
+// with the cloud's, and starts that cycle right away.
+func (w *SyncWorker) RequestVerification() error {
+	w.mu.Lock()
+	w.verifyRequested = true
+	w.mu.Unlock()
+
+	_, err := w.TriggerSync()
+	return err
+}
+
+// verifyDue reports whether this cycle should end with a verification: one
+// was requested or the interval has passed, the cloud supports it and
+// nothing is waiting to be pushed, which would only show as a difference.
+func (w *SyncWorker) verifyDue() bool {
+	protocol := w.currentProtocol()
+	if protocol == nil || !protocol.Has(syncproto.CapabilityVerify) {
+		return false
+	}
+	if depth, err := w.changeLogRepo.Count(); err != nil || depth > 0 {
+		return false
+	}
+
+	w.mu.Lock()
+	requested := w.verifyRequested
+	w.mu.Unlock()
+	if requested {
+		return true
+	}
+	interval := w.settings.Int(settings.KeySyncVerifyInterval)
+	if interval <= 0 {
+		return false
+	}
+
+	if w.lastVerifiedAt.IsZero() {
+		latest, err := w.verifyRepo.FindLatest()
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return false
+		}
+		if latest != nil {
+			w.lastVerifiedAt = latest.StartedAt
+		}
+	}
+	return time.Since(w.lastVerifiedAt) >= time.Duration(interval)*time.Minute
+}
+
+// verify compares the local books with the cloud's and records the result.
+// Differences are repaired on the way; a failed verification does not fail
+// the sync cycle.
+func (w *SyncWorker) verify() {
+	verification := &models.SyncVerification{
+		StartedAt:  time.Now(),
+		Mismatches: []models.DayMismatch{},
+	}
+
+	err := w.compareBooks(verification)
+	verification.FinishedAt = time.Now()
+	switch {
+	case err != nil:
+		log.Error().Err(err).Msg("Failed to verify books with cloud")
+		w.publishError("verify", err)
+		verification.Status = models.SyncVerificationFailed
+		verification.Error = err.Error()
+	case verification.Repulled+verification.Repushed > 0:
+		verification.Status = models.SyncVerificationRepaired
+	case verification.DaysMismatched > 0:
+		verification.Status = models.SyncVerificationPending
+	default:
+		verification.Status = models.SyncVerificationMatched
+	}
+
+	w.mu.Lock()
+	w.verifyRequested = false
+	w.mu.Unlock()
+	w.lastVerifiedAt = verification.StartedAt
+
+	if err := w.verifyRepo.Create(verification); err != nil {
+		log.Error().Err(err).Msg("Failed to record sync verification")
+	}
+	w.events.Publish(events.SyncVerification, verification)
+
+	log.Info().
+		Str("status", string(verification.Status)).
+		Int("days", verification.DaysChecked).
+		Int("mismatched", verification.DaysMismatched).
+		Int("repulled", verification.Repulled).
+		Int("repushed", verification.Repushed).
+		Msg("Verified books with cloud")
+}
+
+// compareBooks compares day digests up to the pull cursor and drills down
+// into the days that differ.
+func (w *SyncWorker) compareBooks(verification *models.SyncVerification) error {
+	value, err := w.stateRepo.Get(models.SyncStatePullCursor)
+	if err != nil {
+		return err
+	}
+	if value == "" {
+		return errors.New("nothing has been pulled from the cloud yet")
+	}
+	cursor, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return err
+	}
+
+	days := int(w.settings.Int(settings.KeySyncVerifyDays))
+	if days < 1 {
+		days = 1
+	}
+	to := time.Now().UTC().Truncate(24 * time.Hour)
+	from := to.AddDate(0, 0, 1-days)
+	verification.From = from.Format(models.DigestDayLayout)
+	verification.To = to.Format(models.DigestDayLayout)
+	verification.Cursor = cursor
+
+	query := url.Values{}
+	query.Set("from", verification.From)
+	query.Set("to", verification.To)
+	query.Set("until", value)
+	var cloud syncproto.Digests
+	if err := w.getCloud("/api/v1/sync/digests?"+query.Encode(), &cloud); err != nil {
+		return err
+	}
+
+	// Everything here has been pushed, so the local books count in full
+	local, err := w.txRepo.DayDigests(from, to.AddDate(0, 0, 1), nil, nil)
+	if err != nil {
+		return err
+	}
+
+	// Pair the digests of both sides by branch and day
+	type pair struct{ local, cloud models.DayDigest }
+	pairs := map[string]*pair{}
+	var keys []string
+	add := func(digest models.DayDigest, isLocal bool) {
+		key := digest.BranchID.String() + "/" + digest.Day
+		p, ok := pairs[key]
+		if !ok {
+			p = &pair{}
+			pairs[key] = p
+			keys = append(keys, key)
+		}
+		if isLocal {
+			p.local = digest
+		} else {
+			p.cloud = digest
+		}
+	}
+	for _, digest := range local {
+		add(digest, true)
+	}
+	for _, digest := range cloud.Digests {
+		add(digest, false)
+	}
+	verification.DaysChecked = len(keys)
+
+	for _, key := range keys {
+		p := pairs[key]
+		if p.local.Matches(p.cloud) {
+			continue
+		}
+		mismatch := models.DayMismatch{Local: p.local, Cloud: p.cloud}
+		mismatch.BranchID, mismatch.Day = p.local.BranchID, p.local.Day
+		if mismatch.Day == "" {
+			mismatch.BranchID, mismatch.Day = p.cloud.BranchID, p.cloud.Day
+		}
+		if err := w.drillDown(&mismatch, value, verification); err != nil {
+			return err
+		}
+		verification.DaysMismatched++
+		verification.Mismatches = append(verification.Mismatches, mismatch)
+	}
+	return nil
+}
+
+// drillDown compares a mismatching day row by row and repairs what it can.
+// Rows the cloud received after the cursor are still on their way and left
+// alone. A row missing here, or older here, is taken from the cloud; a row
+// missing on the cloud, or older there, is queued to be pushed again.
+func (w *SyncWorker) drillDown(mismatch *models.DayMismatch, cursor string, verification *models.SyncVerification) error {
+	var cloud syncproto.DigestDay
+	path := "/api/v1/sync/digests/" + mismatch.BranchID.String() + "/" + mismatch.Day + "?until=" + cursor
+	if err := w.getCloud(path, &cloud); err != nil {
+		return err
+	}
+
+	day, err := time.Parse(models.DigestDayLayout, mismatch.Day)
+	if err != nil {
+		return err
+	}
+	local, err := w.txRepo.FindByBranchDay(mismatch.BranchID, day)
+	if err != nil {
+		return err
+	}
+
+	mismatch.MissingLocal = []uuid.UUID{}
+	mismatch.MissingCloud = []uuid.UUID{}
+	mismatch.Differing = []uuid.UUID{}
+
+	localByID := make(map[uuid.UUID]*models.Transaction, len(local))
+	for i := range local {
+		localByID[local[i].ID] = &local[i]
+	}
+	for _, id := range cloud.Pending {
+		delete(localByID, id)
+	}
+
+	var repull []models.Transaction
+	var repush []uuid.UUID
+	for i := range cloud.Transactions {
+		remote := &cloud.Transactions[i]
+		mine, ok := localByID[remote.ID]
+		delete(localByID, remote.ID)
+
+		switch {
+		case !ok:
+			mismatch.MissingLocal = append(mismatch.MissingLocal, remote.ID)
+			repull = append(repull, *remote)
+		case mine.Checksum() != remote.Checksum():
+			mismatch.Differing = append(mismatch.Differing, remote.ID)
+			if remote.HLC >= mine.HLC {
+				repull = append(repull, *remote)
+			} else {
+				repush = append(repush, mine.ID)
+			}
+		}
+	}
+	for id := range localByID {
+		mismatch.MissingCloud = append(mismatch.MissingCloud, id)
+		repush = append(repush, id)
+	}
+
+	now := time.Now()
+	for i := range repull {
+		repull[i].IsSynced = true
+		repull[i].SyncedAt = &now
+		if _, err := w.conflictRepo.ApplyCloudVersion(models.EntityTransaction, &repull[i]); err != nil {
+			log.Error().Err(err).Str("transaction_id", repull[i].ID.String()).Msg("Failed to repair transaction from cloud")
+			continue
+		}
+		verification.Repulled++
+	}
+	w.publishTransactions(events.SourcePull, repull)
+
+	for _, id := range repush {
+		if err := w.changeLogRepo.EnqueueSnapshot(models.EntityTransaction, id); err != nil {
+			log.Error().Err(err).Str("transaction_id", id.String()).Msg("Failed to queue transaction for push")
+			continue
+		}
+		verification.Repushed++
+	}
+
+	log.Warn().
+		Str("branch_id", mismatch.BranchID.String()).
+		Str("day", mismatch.Day).
+		Int("missing_local", len(mismatch.MissingLocal)).
+		Int("missing_cloud", len(mismatch.MissingCloud)).
+		Int("differing", len(mismatch.Differing)).
+		Msg("Books differ from cloud")
+	return nil
+}
+
+// getCloud makes an authorized GET to the cloud and decodes the data of
+// its answer.
+func (w *SyncWorker) getCloud(path string, data interface{}) error {
+	deviceID, err := w.deviceID()
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(w.ctx, "GET", w.cfg.CloudAPIURL+path, nil)
+	if err != nil {
+		return err
+	}
+	w.authorize(req, deviceID)
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		log.Warn().Int("status", resp.StatusCode).Str("path", path).Msg("Cloud API returned non-200 status")
+		return newCloudError(resp)
+	}
+	return syncproto.DecodeResponse(resp.Body, data)
+}
@@ -2,73 +2,257 @@ package worker
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"shosha-finance/internal/config"
+	"shosha-finance/internal/events"
 	"shosha-finance/internal/models"
+	"shosha-finance/internal/repository"
+	"shosha-finance/internal/secret"
+	"shosha-finance/internal/settings"
+	"shosha-finance/internal/syncproto"
 
 	"github.com/google/uuid"
 	"github.com/rs/zerolog/log"
 	"gorm.io/gorm"
 )
 
+// errNotEnrolled is returned when the device has no credential and no
+// enrollment code to get one with.
+var errNotEnrolled = errors.New("device is not enrolled with the cloud")
+
+// ErrSyncDisabled is returned when a sync is requested from a worker that
+// was never started or has stopped.
+var ErrSyncDisabled = errors.New("sync worker is not running")
+
+// syncRetryBase is the first backoff delay after a failed sync; it doubles
+// with every consecutive failure up to the configured maximum.
+const syncRetryBase = config.MinSyncBackoff * time.Second
+
+// transferTimeout bounds downloads that can be much larger than a regular
+// request: restore snapshots and streamed pulls.
+const transferTimeout = 5 * time.Minute
+
+// syncEncodingJSON sends pushes and pulls as single JSON documents, for a
+// cloud that predates streaming.
+const syncEncodingJSON = "json"
+
+// SyncWorker pulls from and pushes to the cloud on its own goroutine. Its
+// state machine is in sync_state.go; state, online status and stats are
+// safe to read from other goroutines. HTTP calls and DB writes run under
+// the worker's context, which Stop cancels when shutdown cannot wait any
+// longer.
 type SyncWorker struct {
-	db       *gorm.DB
-	cfg      *config.Config
-	client   *http.Client
-	stopChan chan struct{}
-	isOnline bool
+	db            *gorm.DB
+	cfg           *config.Config
+	settings      *settings.Store
+	client        *http.Client
+	syncErrRepo   repository.SyncErrorRepository
+	syncRepo      repository.SyncRepository
+	runRepo       repository.SyncRunRepository
+	stateRepo     repository.SyncStateRepository
+	changeLogRepo repository.ChangeLogRepository
+	conflictRepo  repository.ConflictRepository
+	tombstoneRepo repository.TombstoneRepository
+	userRepo      repository.UserRepository
+	txRepo        repository.TransactionRepository
+	verifyRepo    repository.SyncVerificationRepository
+	repoOpts      repository.Options
+	events        *events.Broker
+	device        string
+	credential    string
+	trigger       chan struct{}
+
+	ctx      context.Context
+	cancel   context.CancelFunc
+	stopping chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+
+	mu          sync.Mutex
+	state       State
+	stateSince  time.Time
+	online      bool
+	started     bool
+	failures    int
+	nextRetryAt *time.Time
+	throughput  float64 // records per second, smoothed over recent drains
+
+	// Sync protocol agreed at the last handshake, and why the cloud
+	// refused one when it did
+	protocol       *syncproto.Welcome
+	updateRequired string
+
+	// A verification was asked for; lastVerifiedAt is only used on the
+	// worker's goroutine
+	verifyRequested bool
+	lastVerifiedAt  time.Time
+}
+
+// SyncStats describes the push backlog and how fast it is being worked off.
+type SyncStats struct {
+	State                   State      `json:"state"`
+	StateSince              time.Time  `json:"state_since"`
+	Online                  bool       `json:"online"`
+	QueueDepth              int64      `json:"queue_depth"`
+	Throughput              float64    `json:"throughput"`
+	EstimatedCatchUpSeconds *int64     `json:"estimated_catch_up_seconds"`
+	ConsecutiveFailures     int        `json:"consecutive_failures"`
+	NextRetryAt             *time.Time `json:"next_retry_at,omitempty"`
+
+	// Protocol is nil until the worker has shaken hands with the cloud;
+	// UpdateRequired is set when the cloud refused to.
+	Protocol       *syncproto.Welcome `json:"protocol,omitempty"`
+	UpdateRequired string             `json:"update_required,omitempty"`
 }
 
-type SyncPushRequest struct {
-	Branches     []models.Branch      `json:"branches"`
-	Transactions []models.Transaction `json:"transactions"`
+// cloudError is returned when the cloud answers with a non-200 status.
+// RetryAfter is set when the response carried a Retry-After header.
+type cloudError struct {
+	Status     int
+	RetryAfter time.Duration
 }
 
-type SyncPullResponse struct {
-	Success bool `json:"success"`
-	Data    struct {
-		Branches     []models.Branch      `json:"branches"`
-		Transactions []models.Transaction `json:"transactions"`
-		LastSyncAt   string               `json:"last_sync_at"`
-	} `json:"data"`
+func (e *cloudError) Error() string {
+	return fmt.Sprintf("cloud API returned status %d", e.Status)
 }
 
-type SyncPushResponse struct {
-	Success bool `json:"success"`
-	Data    struct {
-		Branches     []uuid.UUID `json:"branches"`
-		Transactions []uuid.UUID `json:"transactions"`
-	} `json:"data"`
+func newCloudError(resp *http.Response) *cloudError {
+	return &cloudError{
+		Status:     resp.StatusCode,
+		RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+	}
 }
 
-func NewSyncWorker(db *gorm.DB, cfg *config.Config) *SyncWorker {
+// parseRetryAfter accepts both forms of the header: delay in seconds or an
+// HTTP date.
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		if d := time.Until(at); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+// SyncRepositories are the repositories the sync worker reads and writes
+// through.
+type SyncRepositories struct {
+	SyncErrors    repository.SyncErrorRepository
+	Sync          repository.SyncRepository
+	Runs          repository.SyncRunRepository
+	State         repository.SyncStateRepository
+	ChangeLog     repository.ChangeLogRepository
+	Conflicts     repository.ConflictRepository
+	Tombstones    repository.TombstoneRepository
+	Users         repository.UserRepository
+	Transactions  repository.TransactionRepository
+	Verifications repository.SyncVerificationRepository
+	// Options are those the repositories were built with; the worker uses
+	// them for repositories bound to its own DB transactions and keeps
+	// their Scope up to date with the branches the device pulls.
+	Options repository.Options
+}
+
+// NewSyncWorker creates the worker. db and the repositories must be bound
+// to ctx, see NewSyncContext, so that cancel stops their writes when
+// shutdown cannot wait.
+func NewSyncWorker(ctx context.Context, cancel context.CancelFunc, db *gorm.DB, repos SyncRepositories, cfg *config.Config, store *settings.Store, broker *events.Broker) *SyncWorker {
 	return &SyncWorker{
-		db:       db,
-		cfg:      cfg,
-		client:   &http.Client{Timeout: 30 * time.Second},
-		stopChan: make(chan struct{}),
-		isOnline: false,
+		db:            db,
+		cfg:           cfg,
+		settings:      store,
+		client:        &http.Client{Timeout: 30 * time.Second},
+		syncErrRepo:   repos.SyncErrors,
+		syncRepo:      repos.Sync,
+		runRepo:       repos.Runs,
+		stateRepo:     repos.State,
+		changeLogRepo: repos.ChangeLog,
+		conflictRepo:  repos.Conflicts,
+		tombstoneRepo: repos.Tombstones,
+		userRepo:      repos.Users,
+		txRepo:        repos.Transactions,
+		verifyRepo:    repos.Verifications,
+		repoOpts:      repos.Options,
+		events:        broker,
+		trigger:       make(chan struct{}, 1),
+		ctx:           ctx,
+		cancel:        cancel,
+		stopping:      make(chan struct{}),
+		done:          make(chan struct{}),
+		state:         StateIdle,
+		stateSince:    time.Now(),
 	}
 }
 
+// NewSyncContext returns the context the sync worker runs under and the DB
+// handle bound to it, to build the worker's repositories on.
+func NewSyncContext(db *gorm.DB) (context.Context, context.CancelFunc, *gorm.DB) {
+	ctx, cancel := context.WithCancel(context.Background())
+	return ctx, cancel, db.WithContext(ctx)
+}
+
+// Start runs the worker until Stop is called. A stopped worker does not
+// start again.
 func (w *SyncWorker) Start() {
-	log.Info().Int("interval", w.cfg.SyncInterval).Msg("Starting sync worker")
+	w.mu.Lock()
+	if w.started || w.state == StateStopped {
+		w.mu.Unlock()
+		return
+	}
+	w.started = true
+	w.mu.Unlock()
+
+	log.Info().Int64("interval", w.settings.Int(settings.KeySyncInterval)).Msg("Starting sync worker")
+
+	// Records written before the change log existed still need to be pushed
+	if queued, err := w.changeLogRepo.BackfillUnsynced(); err != nil {
+		log.Error().Err(err).Msg("Failed to queue unsynced records")
+	} else if queued > 0 {
+		log.Info().Int("records", queued).Msg("Queued unsynced records in change log")
+	}
+
+	// Hide other branches' data until the cloud reports a new scope
+	if err := w.loadScope(); err != nil {
+		log.Error().Err(err).Msg("Failed to load branch scope")
+	}
 
 	go func() {
-		// Initial sync
-		w.sync()
+		defer close(w.done)
 
-		ticker := time.NewTicker(time.Duration(w.cfg.SyncInterval) * time.Second)
-		defer ticker.Stop()
+		// Initial sync runs right away; each run decides when the next one is
+		timer := time.NewTimer(0)
+		defer timer.Stop()
 
 		for {
 			select {
-			case <-ticker.C:
-				w.sync()
-			case <-w.stopChan:
+			case <-timer.C:
+				timer.Reset(w.run(models.SyncRunScheduled))
+			case <-w.trigger:
+				if !timer.Stop() {
+					select {
+					case <-timer.C:
+					default:
+					}
+				}
+				timer.Reset(w.run(models.SyncRunManual))
+			case <-w.stopping:
+				w.transition(StateStopped)
 				log.Info().Msg("Sync worker stopped")
 				return
 			}
@@ -76,190 +260,958 @@ func (w *SyncWorker) Start() {
 	}()
 }
 
-func (w *SyncWorker) Stop() {
-	close(w.stopChan)
+// Stop ends the worker and waits for it. A cycle in progress finishes the
+// batch it is pushing and stops there; if ctx ends first, the HTTP calls
+// and DB writes in flight are cancelled. Calling Stop again, or on a
+// worker that never started, is safe.
+func (w *SyncWorker) Stop(ctx context.Context) error {
+	w.stopOnce.Do(func() {
+		close(w.stopping)
+	})
+
+	w.mu.Lock()
+	started := w.started
+	w.mu.Unlock()
+	if !started {
+		w.transition(StateStopped)
+		w.cancel()
+		return nil
+	}
+
+	select {
+	case <-w.done:
+		w.cancel()
+		return nil
+	case <-ctx.Done():
+		log.Warn().Msg("Sync worker did not stop in time, cancelling work in flight")
+		w.cancel()
+		<-w.done
+		return ctx.Err()
+	}
+}
+
+// stopRequested reports whether Stop has been called.
+func (w *SyncWorker) stopRequested() bool {
+	select {
+	case <-w.stopping:
+		return true
+	default:
+		return false
+	}
 }
 
 func (w *SyncWorker) IsOnline() bool {
-	return w.isOnline
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.online
 }
 
-func (w *SyncWorker) sync() {
+// TriggerSync asks for a sync cycle right away instead of at the next
+// tick. Requests made while one is already waiting join it, so a burst of
+// requests runs a single extra cycle. It reports whether a new cycle was
+// queued.
+func (w *SyncWorker) TriggerSync() (bool, error) {
+	w.mu.Lock()
+	started := w.started
+	w.mu.Unlock()
+	if !started || w.stopRequested() {
+		return false, ErrSyncDisabled
+	}
+
+	select {
+	case w.trigger <- struct{}{}:
+		return true, nil
+	default:
+		return false, nil
+	}
+}
+
+// run performs one sync cycle and records it in the sync history. Quiet
+// scheduled cycles, which moved nothing and did not fail, are not kept.
+func (w *SyncWorker) run(trigger models.SyncRunTrigger) time.Duration {
+	run := &models.SyncRun{Trigger: trigger, StartedAt: time.Now()}
+
+	next := w.sync(run)
+	run.FinishedAt = time.Now()
+	if run.Status == "" {
+		run.Status = models.SyncRunSucceeded
+	}
+	w.events.Publish(events.SyncRun, run)
+	if run.Status != models.SyncRunSkipped {
+		w.report(run)
+	}
+
+	if trigger == models.SyncRunManual || run.Status == models.SyncRunFailed || run.Moved() {
+		if err := w.runRepo.Create(run); err != nil {
+			log.Error().Err(err).Msg("Failed to record sync run")
+		}
+	}
+	return next
+}
+
+// sync runs one pull and drains the push backlog, counting what moved in
+// the given run. It moves the worker from checking through pulling and
+// pushing, ending idle or in backoff, and returns how long to wait before
+// the next run: the regular interval after success, a backoff delay after
+// failure.
+func (w *SyncWorker) sync(run *models.SyncRun) time.Duration {
+	interval := w.interval()
+	w.transition(StateChecking)
+
 	online := w.checkOnline()
-	w.isOnline = online
+	w.setOnline(online)
 
 	if !online {
 		log.Debug().Msg("Offline, skipping sync")
-		return
+		run.Status = models.SyncRunSkipped
+		run.Error = "cloud API is unreachable"
+		w.transition(StateIdle)
+		return interval
+	}
+
+	if err := w.ensureEnrolled(); err != nil {
+		if errors.Is(err, errNotEnrolled) {
+			log.Warn().Msg("Device is not enrolled, set ENROLLMENT_CODE to enroll it with the cloud")
+			run.Status = models.SyncRunSkipped
+			run.Error = err.Error()
+			w.transition(StateIdle)
+			return interval
+		}
+		log.Error().Err(err).Msg("Failed to enroll device")
+		w.publishError("enroll", err)
+		run.Status = models.SyncRunFailed
+		run.Error = "enroll: " + err.Error()
+		return w.backoff(err)
+	}
+
+	if err := w.ensureProtocol(); err != nil {
+		log.Error().Err(err).Msg("Failed to settle sync protocol with cloud")
+		w.publishError("handshake", err)
+		run.Status = models.SyncRunFailed
+		run.Error = "handshake: " + err.Error()
+		return w.backoff(err)
+	}
+
+	w.transition(StatePulling)
+
+	// A restoring install loads the cloud snapshot before anything else
+	if w.RestorePending() {
+		if err := w.restore(run); err != nil {
+			log.Error().Err(err).Msg("Failed to restore from cloud snapshot")
+			w.publishError("restore", err)
+			run.Status = models.SyncRunFailed
+			run.Error = "restore: " + err.Error()
+			return w.backoff(err)
+		}
 	}
 
+	var failure error
+	var messages []string
+
 	// Pull first (get latest data from cloud)
-	if err := w.pull(); err != nil {
+	if err := w.pull(run); err != nil {
 		log.Error().Err(err).Msg("Failed to pull from cloud")
+		w.publishError("pull", err)
+		failure = err
+		messages = append(messages, "pull: "+err.Error())
+	}
+
+	// Settings are best effort; the last ones received stay in effect
+	if err := w.pullSettings(); err != nil {
+		log.Warn().Err(err).Msg("Failed to pull settings from cloud")
+		w.publishError("settings", err)
 	}
 
 	// Then push (send local unsynced data to cloud)
-	if err := w.push(); err != nil {
+	w.transition(StatePushing)
+	if err := w.drain(run); err != nil {
 		log.Error().Err(err).Msg("Failed to push to cloud")
+		w.publishError("push", err)
+		failure = err
+		messages = append(messages, "push: "+err.Error())
 	}
+
+	if failure != nil {
+		run.Status = models.SyncRunFailed
+		run.Error = strings.Join(messages, "; ")
+		return w.backoff(failure)
+	}
+
+	w.mu.Lock()
+	w.failures = 0
+	w.nextRetryAt = nil
+	w.mu.Unlock()
+
+	if !w.stopRequested() && w.verifyDue() {
+		w.transition(StateVerifying)
+		w.verify()
+	}
+
+	// The cycle may have brought a new interval
+	w.transition(StateIdle)
+	return w.interval()
+}
+
+// interval is the regular delay between sync cycles.
+func (w *SyncWorker) interval() time.Duration {
+	return time.Duration(w.settings.Int(settings.KeySyncInterval)) * time.Second
 }
 
-func (w *SyncWorker) pull() error {
-	url := w.cfg.CloudAPIURL + "/api/v1/sync/pull"
-	req, err := http.NewRequest("GET", url, nil)
+// report tells the cloud how the cycle went, so head office can see a
+// device's backlog and errors. It is best effort; a cloud that did not
+// agree to reports, or cannot be reached, is not told.
+func (w *SyncWorker) report(run *models.SyncRun) {
+	protocol := w.currentProtocol()
+	if protocol == nil || !protocol.Has(syncproto.CapabilityReport) {
+		return
+	}
+	stats, err := w.Stats()
 	if err != nil {
-		return err
+		return
+	}
+	body, err := json.Marshal(syncproto.StatusReport{
+		State:               string(stats.State),
+		QueueDepth:          stats.QueueDepth,
+		ConsecutiveFailures: stats.ConsecutiveFailures,
+		LastError:           run.Error,
+		FinishedAt:          run.FinishedAt,
+	})
+	if err != nil {
+		return
+	}
+	deviceID, err := w.deviceID()
+	if err != nil {
+		return
 	}
 
-	// Authorization header removed, BranchAPIKey no longer used
+	req, err := http.NewRequestWithContext(w.ctx, "POST", w.cfg.CloudAPIURL+"/api/v1/sync/report", bytes.NewBuffer(body))
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	w.authorize(req, deviceID)
 
 	resp, err := w.client.Do(req)
 	if err != nil {
-		return err
+		log.Debug().Err(err).Msg("Failed to report sync status to cloud")
+		return
 	}
-	defer resp.Body.Close()
-
+	resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
-		log.Warn().Int("status", resp.StatusCode).Msg("Cloud API pull returned non-200 status")
+		log.Debug().Int("status", resp.StatusCode).Msg("Cloud API report returned non-200 status")
+	}
+}
+
+// publishError reports a failed sync step on the event stream.
+func (w *SyncWorker) publishError(stage string, err error) {
+	w.events.Publish(events.SyncError, events.SyncErrorData{Stage: stage, Message: err.Error()})
+}
+
+// publishProgress reports what the current cycle has moved so far.
+func (w *SyncWorker) publishProgress(stage string, run *models.SyncRun) {
+	depth, _ := w.changeLogRepo.Count()
+	w.events.Publish(events.SyncProgress, events.SyncProgressData{
+		Stage:      stage,
+		Restored:   run.Restored,
+		Pulled:     run.Pulled,
+		Pushed:     run.Pushed,
+		QueueDepth: depth,
+	})
+}
+
+// publishTransactions reports transactions received from the cloud.
+func (w *SyncWorker) publishTransactions(source string, transactions []models.Transaction) {
+	if len(transactions) == 0 {
+		return
+	}
+	ids := make([]uuid.UUID, len(transactions))
+	for i := range transactions {
+		ids[i] = transactions[i].ID
+	}
+	w.events.Publish(events.TransactionsChanged, events.TransactionsChangedData{Source: source, TransactionIDs: ids})
+}
+
+// drain pushes batch after batch until the backlog is empty, the cloud
+// stops accepting records or the worker is stopped.
+func (w *SyncWorker) drain(run *models.SyncRun) error {
+	start := time.Now()
+	total := 0
+	batches := 0
+	// Records rejected earlier in this drain are not sent again until the
+	// next run, so one bad record cannot burn through its attempts at once
+	rejected := map[uuid.UUID]bool{}
+
+	for {
+		// Stopping waits for the batch in flight, not the whole backlog
+		if w.stopRequested() {
+			return nil
+		}
+
+		accepted, full, err := w.push(rejected, run)
+		total += accepted
+		run.Pushed += accepted
+		if err != nil {
+			return err
+		}
+		w.publishProgress("push", run)
+		batches++
+
+		// A batch that was not full means the backlog is empty; a batch
+		// with nothing accepted would only resend the same records.
+		if !full || accepted == 0 {
+			break
+		}
+	}
+
+	if total > 0 {
+		w.recordThroughput(total, time.Since(start))
+		if batches > 1 {
+			log.Info().Int("records", total).Int("batches", batches).Dur("took", time.Since(start)).Msg("Push backlog drained")
+		}
+	}
+
+	return nil
+}
+
+// backoff computes the delay before the next attempt after a failure:
+// exponential with jitter, but never shorter than a Retry-After from the
+// cloud. It puts the worker in backoff.
+func (w *SyncWorker) backoff(err error) time.Duration {
+	w.mu.Lock()
+	w.failures++
+
+	maxDelay := time.Duration(w.cfg.SyncMaxBackoff) * time.Second
+	if maxDelay < syncRetryBase {
+		maxDelay = syncRetryBase
+	}
+	delay := syncRetryBase
+	for i := 1; i < w.failures && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+	// Full delay halved plus a random half, so devices that went offline
+	// together do not retry in lockstep
+	delay = delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+
+	if cloudErr, ok := err.(*cloudError); ok && cloudErr.RetryAfter > delay {
+		delay = cloudErr.RetryAfter
+	}
+
+	retryAt := time.Now().Add(delay)
+	w.nextRetryAt = &retryAt
+	failures := w.failures
+	w.mu.Unlock()
+
+	log.Warn().Int("failures", failures).Dur("retry_in", delay).Msg("Sync failed, backing off")
+	w.transition(StateBackoff)
+	return delay
+}
+
+func (w *SyncWorker) recordThroughput(records int, took time.Duration) {
+	if took <= 0 {
+		took = time.Millisecond
+	}
+	rate := float64(records) / took.Seconds()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.throughput == 0 {
+		w.throughput = rate
+	} else {
+		w.throughput = 0.7*w.throughput + 0.3*rate
+	}
+}
+
+// RequestRestore marks the install to be restored from a cloud snapshot
+// before its next sync. An install that was already restored is not
+// restored again, so RESTORE_FROM_CLOUD can stay set across restarts.
+func (w *SyncWorker) RequestRestore() error {
+	restoredAt, err := w.stateRepo.Get(models.SyncStateRestoredAt)
+	if err != nil {
+		return err
+	}
+	if restoredAt != "" {
+		log.Info().Str("restored_at", restoredAt).Msg("Install was already restored from the cloud, skipping restore")
 		return nil
 	}
+	log.Info().Msg("Install will be restored from the cloud before sync starts")
+	return w.stateRepo.Set(models.SyncStateRestorePending, "true")
+}
 
-	var pullResp SyncPullResponse
-	if err := json.NewDecoder(resp.Body).Decode(&pullResp); err != nil {
+// Enrolled reports whether the install has enrolled with the cloud or will
+// on start, in which case its branches come from the cloud.
+func (w *SyncWorker) Enrolled() bool {
+	if w.cfg.EnrollmentCode != "" {
+		return true
+	}
+	sealed, err := w.stateRepo.Get(models.SyncStateDeviceCredential)
+	return err == nil && sealed != ""
+}
+
+// RestorePending reports whether the install is waiting to be restored
+// from a cloud snapshot.
+func (w *SyncWorker) RestorePending() bool {
+	pending, err := w.stateRepo.Get(models.SyncStateRestorePending)
+	return err == nil && pending != ""
+}
+
+// restore downloads a snapshot of the device's branch scope and loads it
+// in one go, leaving the pull cursor at the snapshot so normal sync picks
+// up from there. Local changes still waiting to be pushed would be
+// overwritten, so the restore is called off when there are any.
+func (w *SyncWorker) restore(run *models.SyncRun) error {
+	depth, err := w.changeLogRepo.Count()
+	if err != nil {
 		return err
 	}
+	if depth > 0 {
+		log.Error().Int64("queue_depth", depth).Msg("Restore from cloud called off: local changes are still waiting to be pushed")
+		return w.stateRepo.Delete(models.SyncStateRestorePending)
+	}
 
-	if !pullResp.Success {
-		return nil
+	deviceID, err := w.deviceID()
+	if err != nil {
+		return err
 	}
 
-	// Upsert branches
-	for _, branch := range pullResp.Data.Branches {
-		branch.IsSynced = true
-		now := time.Now()
-		branch.SyncedAt = &now
-		w.db.Save(&branch)
+	req, err := http.NewRequestWithContext(w.ctx, "GET", w.cfg.CloudAPIURL+"/api/v1/sync/snapshot", nil)
+	if err != nil {
+		return err
 	}
+	w.authorize(req, deviceID)
 
-	// Upsert transactions
-	for _, tx := range pullResp.Data.Transactions {
-		tx.IsSynced = true
-		now := time.Now()
-		tx.SyncedAt = &now
-		w.db.Save(&tx)
+	log.Info().Msg("Downloading snapshot from cloud")
+	client := *w.client
+	client.Timeout = transferTimeout
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
 	}
+	defer resp.Body.Close()
 
-	log.Info().
-		Int("branches", len(pullResp.Data.Branches)).
-		Int("transactions", len(pullResp.Data.Transactions)).
-		Msg("Pulled data from cloud")
+	if resp.StatusCode == http.StatusUnauthorized {
+		log.Error().Msg("Cloud refused the device credential, the device may have been deactivated")
+	}
+	if resp.StatusCode != http.StatusOK {
+		log.Warn().Int("status", resp.StatusCode).Msg("Cloud API snapshot returned non-200 status")
+		return newCloudError(resp)
+	}
 
+	snapshot := &models.SyncSnapshot{}
+	if err := syncproto.DecodeResponse(resp.Body, snapshot); err != nil {
+		return err
+	}
+	if snapshot.Scope == nil {
+		snapshot.Scope = &models.BranchScope{}
+	}
+	if err := w.syncRepo.LoadSnapshot(snapshot); err != nil {
+		return err
+	}
+	w.repoOpts.Scope.Set(snapshot.Scope)
+	run.Restored = snapshot.Records()
+	w.publishTransactions(events.SourcePull, snapshot.Transactions)
+	w.publishProgress("restore", run)
+
+	log.Info().
+		Int("branches", len(snapshot.Branches)).
+		Int("users", len(snapshot.Users)).
+		Int("transactions", len(snapshot.Transactions)).
+		Int("shifts", len(snapshot.Shifts)).
+		Int("reconciliations", len(snapshot.Reconciliations)).
+		Uint64("cursor", snapshot.Cursor).
+		Msg("Restored from cloud snapshot")
 	return nil
 }
 
-func (w *SyncWorker) push() error {
-	// Get unsynced branches
-	var branches []models.Branch
-	w.db.Where("is_synced = ?", false).Find(&branches)
+// loadScope restores the branch scope stored by an earlier pull.
+func (w *SyncWorker) loadScope() error {
+	stored, err := w.stateRepo.Get(models.SyncStateBranchScope)
+	if err != nil || stored == "" {
+		return err
+	}
+	var scope models.BranchScope
+	if err := json.Unmarshal([]byte(stored), &scope); err != nil {
+		return err
+	}
+	w.repoOpts.Scope.Set(&scope)
+	return nil
+}
 
-	// Get unsynced transactions
-	var transactions []models.Transaction
-	w.db.Where("is_synced = ?", false).Limit(100).Find(&transactions)
+// updateScope stores the branch scope the cloud reported and reports
+// whether it differs from the stored one. Synced transactions of branches
+// that left the scope are removed; the cloud keeps them.
+func (w *SyncWorker) updateScope(scope *models.BranchScope) (bool, error) {
+	data, err := json.Marshal(scope)
+	if err != nil {
+		return false, err
+	}
+	stored, err := w.stateRepo.Get(models.SyncStateBranchScope)
+	if err != nil {
+		return false, err
+	}
+	if stored == string(data) {
+		return false, nil
+	}
 
-	log.Info().
-		Int("unsynced_branches", len(branches)).
-		Int("unsynced_transactions", len(transactions)).
-		Msg("Checking unsynced data")
+	if err := w.stateRepo.Set(models.SyncStateBranchScope, string(data)); err != nil {
+		return false, err
+	}
+	w.repoOpts.Scope.Set(scope)
 
-	if len(branches) == 0 && len(transactions) == 0 {
-		log.Debug().Msg("No unsynced data to push")
-		return nil
+	if !scope.AllBranches {
+		query := w.db.Unscoped().
+			Where("is_synced = ?", true).
+			Where("id NOT IN (?)", w.db.Model(&models.ChangeLog{}).Select("entity_id"))
+		if len(scope.BranchIDs) > 0 {
+			query = query.Where("branch_id NOT IN ?", scope.BranchIDs)
+		}
+		result := query.Delete(&models.Transaction{})
+		if result.Error != nil {
+			return false, result.Error
+		}
+		if result.RowsAffected > 0 {
+			log.Info().Int64("transactions", result.RowsAffected).Msg("Removed transactions outside the branch scope")
+		}
 	}
 
-	reqBody := SyncPushRequest{
-		Branches:     branches,
-		Transactions: transactions,
+	log.Info().
+		Bool("all_branches", scope.AllBranches).
+		Int("branches", len(scope.BranchIDs)).
+		Msg("Branch scope updated")
+	return true, nil
+}
+
+// push sends one batch of unsynced records and returns how many the cloud
+// accepted and whether more records may be waiting. Rejected records are
+// added to the given map and counted in the run.
+func (w *SyncWorker) push(rejected map[uuid.UUID]bool, run *models.SyncRun) (int, bool, error) {
+	batch, full, err := w.nextBatch(rejected)
+	if err != nil || batch == nil {
+		return 0, false, err
 	}
 
-	jsonBody, err := json.Marshal(reqBody)
+	body, err := w.encodePush(batch)
 	if err != nil {
-		return err
+		return 0, false, err
 	}
 
 	url := w.cfg.CloudAPIURL + "/api/v1/sync/push"
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonBody))
+	req, err := http.NewRequestWithContext(w.ctx, "POST", url, body)
 	if err != nil {
-		return err
+		return 0, false, err
 	}
 
-	req.Header.Set("Content-Type", "application/json")
-	// Authorization header removed, BranchAPIKey no longer used
+	if encoding, ok := w.streamEncoding(); ok {
+		req.Header.Set("Content-Type", syncproto.ContentType)
+		req.Header.Set("Content-Encoding", encoding)
+	} else {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	deviceID, err := w.deviceID()
+	if err != nil {
+		return 0, false, err
+	}
+	w.authorize(req, deviceID)
 
 	resp, err := w.client.Do(req)
 	if err != nil {
-		return err
+		return 0, false, err
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusUnauthorized {
+		log.Error().Msg("Cloud refused the device credential, the device may have been deactivated")
+	}
 	if resp.StatusCode != http.StatusOK {
 		log.Warn().Int("status", resp.StatusCode).Msg("Cloud API push returned non-200 status")
-		return nil
+		// The cloud refused the batch itself; build a fresh one next time
+		// instead of re-sending it forever
+		if resp.StatusCode >= 400 && resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests {
+			w.stateRepo.Delete(models.SyncStatePendingBatch)
+		}
+		return 0, false, newCloudError(resp)
 	}
 
-	var pushResp SyncPushResponse
-	if err := json.NewDecoder(resp.Body).Decode(&pushResp); err != nil {
+	var result models.SyncPushResult
+	if err := syncproto.DecodeResponse(resp.Body, &result); err != nil {
 		log.Error().Err(err).Msg("Failed to decode push response")
-		return err
+		return 0, false, err
+	}
+
+	// The cloud has answered; the batch no longer needs to be re-sent
+	if err := w.stateRepo.Delete(models.SyncStatePendingBatch); err != nil {
+		log.Error().Err(err).Msg("Failed to clear pending push batch")
 	}
 
 	log.Info().
-		Bool("success", pushResp.Success).
-		Int("synced_branches", len(pushResp.Data.Branches)).
-		Int("synced_transactions", len(pushResp.Data.Transactions)).
+		Str("batch_id", result.BatchID.String()).
+		Bool("replayed", result.Replayed).
+		Int("synced_branches", len(result.Branches)).
+		Int("synced_transactions", len(result.Transactions)).
+		Int("synced_shifts", len(result.Shifts)).
+		Int("synced_reconciliations", len(result.Reconciliations)).
+		Int("rejected", len(result.Rejected)).
 		Msg("Push response received")
 
-	if !pushResp.Success {
-		log.Warn().Msg("Push response success=false")
-		return nil
+	run.Rejected += len(result.Rejected)
+
+	// A rejected change that a later change to the same record supersedes
+	// is dropped; sent again it would overwrite the newer version. This
+	// runs before acknowledging, while a later change taken in the same
+	// batch is still queued.
+	superseded := map[uint64]bool{}
+	keep := make([]uint64, 0, len(result.Rejected))
+	for _, item := range result.Rejected {
+		if item.Seq == 0 {
+			continue
+		}
+		dropped, err := w.changeLogRepo.Supersede(item.Seq)
+		if err != nil {
+			return 0, false, err
+		}
+		if dropped {
+			superseded[item.Seq] = true
+			continue
+		}
+		keep = append(keep, item.Seq)
 	}
 
-	now := time.Now()
+	// Drop acknowledged entries; their records are synced unless changed again
+	acked, err := w.changeLogRepo.Acknowledge(result.AckedSeq, keep)
+	if err != nil {
+		return 0, false, err
+	}
 
-	// Mark branches as synced
-	if len(pushResp.Data.Branches) > 0 {
-		w.db.Model(&models.Branch{}).
-			Where("id IN ?", pushResp.Data.Branches).
-			Updates(map[string]interface{}{
-				"is_synced": true,
-				"synced_at": now,
-			})
+	// Close errors for records that went through this time
+	ackedIDs := map[string][]uuid.UUID{}
+	for _, entry := range acked {
+		ackedIDs[entry.EntityType] = append(ackedIDs[entry.EntityType], entry.EntityID)
 	}
+	for entityType, ids := range ackedIDs {
+		w.syncErrRepo.ResolveEntities(entityType, ids)
+	}
+
+	// Record rejections. The cloud's cursor has moved past them, so they go
+	// back to the end of the queue under a new sequence number until they
+	// are quarantined.
+	for _, item := range result.Rejected {
+		if superseded[item.Seq] {
+			log.Debug().
+				Str("entity_type", item.EntityType).
+				Str("entity_id", item.EntityID.String()).
+				Uint64("seq", item.Seq).
+				Msg("Dropped rejected change superseded by a later one")
+			continue
+		}
+		rejected[item.EntityID] = true
+		entityID := item.EntityID
+		w.events.Publish(events.SyncError, events.SyncErrorData{
+			Stage:      "push",
+			Message:    item.Reason,
+			EntityType: item.EntityType,
+			EntityID:   &entityID,
+		})
 
-	// Mark transactions as synced
-	if len(pushResp.Data.Transactions) > 0 {
-		w.db.Model(&models.Transaction{}).
-			Where("id IN ?", pushResp.Data.Transactions).
-			Updates(map[string]interface{}{
-				"is_synced": true,
-				"synced_at": now,
-			})
+		syncErr, err := w.syncErrRepo.RecordFailure(item.EntityType, item.EntityID, item.Reason, w.cfg.SyncMaxAttempts)
+		if err != nil {
+			log.Error().Err(err).Str("entity_id", item.EntityID.String()).Msg("Failed to record sync error")
+			continue
+		}
+		if item.Seq == 0 {
+			continue
+		}
+
+		if syncErr.Status == models.SyncErrorQuarantined {
+			log.Warn().
+				Str("entity_type", item.EntityType).
+				Str("entity_id", item.EntityID.String()).
+				Str("reason", item.Reason).
+				Msg("Record quarantined after repeated sync rejections")
+			err = w.changeLogRepo.Remove(item.Seq)
+		} else {
+			err = w.changeLogRepo.Requeue(item.Seq)
+		}
+		if err != nil {
+			log.Error().Err(err).Uint64("seq", item.Seq).Msg("Failed to update rejected change")
+		}
 	}
 
 	log.Info().
-		Int("branches", len(pushResp.Data.Branches)).
-		Int("transactions", len(pushResp.Data.Transactions)).
+		Int("branches", len(result.Branches)).
+		Int("transactions", len(result.Transactions)).
+		Int("shifts", len(result.Shifts)).
+		Int("reconciliations", len(result.Reconciliations)).
+		Int("rejected", len(result.Rejected)).
+		Uint64("acked_seq", result.AckedSeq).
 		Msg("Pushed data to cloud")
 
+	return len(acked), full, nil
+}
+
+// streamEncoding returns the compression pushes and pulls are streamed
+// with, as agreed at the handshake, or false when the cloud is sent JSON
+// documents instead.
+func (w *SyncWorker) streamEncoding() (string, bool) {
+	protocol := w.currentProtocol()
+	if protocol == nil || !protocol.Streams() {
+		return "", false
+	}
+	return protocol.Encoding, true
+}
+
+// encodePush writes a batch as the request body: a batch frame followed by
+// one frame per change, compressed, or a JSON document.
+func (w *SyncWorker) encodePush(batch *models.SyncPushBatch) (*bytes.Buffer, error) {
+	body := &bytes.Buffer{}
+	encoding, ok := w.streamEncoding()
+	if !ok {
+		return body, json.NewEncoder(body).Encode(batch)
+	}
+
+	stream, err := syncproto.NewWriter(body, encoding)
+	if err != nil {
+		return nil, err
+	}
+	err = stream.Write(syncproto.KindBatch, syncproto.PushHeader{
+		BatchID:  batch.BatchID,
+		DeviceID: batch.DeviceID,
+		BranchID: batch.BranchID,
+	})
+	if err != nil {
+		return nil, err
+	}
+	for i := range batch.Changes {
+		if err := stream.Write(syncproto.KindChange, &batch.Changes[i]); err != nil {
+			return nil, err
+		}
+	}
+	return body, stream.Close()
+}
+
+// nextBatch returns the next batch to push. A batch whose response was
+// lost is re-sent as is, with its original batch ID, so the cloud can answer
+// it from its receipt; otherwise a new batch is built from the oldest
+// change-log entries, leaving out records rejected earlier in this drain.
+// It returns nil when there is nothing to push.
+func (w *SyncWorker) nextBatch(rejected map[uuid.UUID]bool) (*models.SyncPushBatch, bool, error) {
+	pending, err := w.stateRepo.Get(models.SyncStatePendingBatch)
+	if err != nil {
+		return nil, false, err
+	}
+	if pending != "" {
+		var batch models.SyncPushBatch
+		if err := json.Unmarshal([]byte(pending), &batch); err != nil {
+			return nil, false, err
+		}
+		log.Info().Msg("Re-sending unacknowledged push batch")
+		return &batch, true, nil
+	}
+
+	skip := make([]uuid.UUID, 0, len(rejected))
+	for id := range rejected {
+		skip = append(skip, id)
+	}
+
+	entries, err := w.changeLogRepo.FindPending(w.cfg.SyncBatchSize, skip)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if len(entries) == 0 {
+		log.Debug().Msg("No unsynced data to push")
+		return nil, false, nil
+	}
+
+	changes := make([]models.SyncChange, len(entries))
+	for i := range entries {
+		changes[i] = entries[i].ToSyncChange()
+	}
+
+	log.Info().
+		Int("changes", len(changes)).
+		Uint64("first_seq", changes[0].Seq).
+		Uint64("last_seq", changes[len(changes)-1].Seq).
+		Msg("Pushing change log")
+
+	deviceID, err := w.deviceID()
+	if err != nil {
+		return nil, false, err
+	}
+
+	batch := &models.SyncPushBatch{
+		BatchID:  uuid.New(),
+		DeviceID: deviceID,
+		BranchID: w.branchID(),
+		Changes:  changes,
+	}
+
+	jsonBody, err := json.Marshal(batch)
+	if err != nil {
+		return nil, false, err
+	}
+
+	// Keep the batch until the cloud answers so it can be re-sent unchanged
+	if err := w.stateRepo.Set(models.SyncStatePendingBatch, string(jsonBody)); err != nil {
+		return nil, false, err
+	}
+
+	return batch, len(entries) == w.cfg.SyncBatchSize, nil
+}
+
+// deviceID returns the ID this installation was enrolled under.
+func (w *SyncWorker) deviceID() (string, error) {
+	if w.device != "" {
+		return w.device, nil
+	}
+
+	id, err := w.stateRepo.Get(models.SyncStateDeviceID)
+	if err != nil {
+		return "", err
+	}
+	if id == "" {
+		return "", errNotEnrolled
+	}
+
+	w.device = id
+	return id, nil
+}
+
+// branchID returns the configured branch of this installation, or else the
+// branch it was enrolled for.
+func (w *SyncWorker) branchID() *uuid.UUID {
+	value := w.cfg.BranchID
+	if value == "" {
+		value, _ = w.stateRepo.Get(models.SyncStateBranchID)
+		if value == "" {
+			return nil
+		}
+	}
+	id, err := uuid.Parse(value)
+	if err != nil {
+		log.Warn().Str("branch_id", value).Msg("Ignoring invalid BRANCH_ID")
+		return nil
+	}
+	return &id
+}
+
+// authorize adds the device's identity to a request to the cloud.
+func (w *SyncWorker) authorize(req *http.Request, deviceID string) {
+	req.Header.Set("X-Device-ID", deviceID)
+	req.Header.Set("Authorization", "Bearer "+w.credential)
+	req.Header.Set("X-App-Version", config.AppVersion)
+	if protocol := w.currentProtocol(); protocol != nil {
+		req.Header.Set(syncproto.HeaderVersion, strconv.Itoa(protocol.ProtocolVersion))
+	}
+}
+
+// ensureEnrolled loads the device credential, enrolling the device with
+// the configured enrollment code on first start.
+func (w *SyncWorker) ensureEnrolled() error {
+	if w.credential != "" {
+		return nil
+	}
+
+	sealed, err := w.stateRepo.Get(models.SyncStateDeviceCredential)
+	if err != nil {
+		return err
+	}
+	if sealed != "" {
+		credential, err := secret.Open(w.cfg.DeviceKey, sealed)
+		if err != nil {
+			return fmt.Errorf("cannot decrypt device credential, check DEVICE_KEY: %w", err)
+		}
+		w.credential = credential
+		return nil
+	}
+
+	if w.cfg.EnrollmentCode == "" {
+		return errNotEnrolled
+	}
+	return w.enroll()
+}
+
+// enroll exchanges the enrollment code for a device ID and credential and
+// stores them, the credential encrypted.
+func (w *SyncWorker) enroll() error {
+	body, err := json.Marshal(models.EnrollRequest{
+		Code:       w.cfg.EnrollmentCode,
+		Name:       w.cfg.DeviceName,
+		AppVersion: config.AppVersion,
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(w.ctx, "POST", w.cfg.CloudAPIURL+"/api/v1/sync/enroll", bytes.NewBuffer(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		log.Warn().Int("status", resp.StatusCode).Msg("Cloud refused the enrollment code")
+		return newCloudError(resp)
+	}
+
+	var enrolled models.EnrollResponse
+	if err := syncproto.DecodeResponse(resp.Body, &enrolled); err != nil {
+		return err
+	}
+
+	err = w.db.Transaction(func(tx *gorm.DB) error {
+		stateRepo := repository.NewSyncStateRepository(tx)
+		if err := stateRepo.Set(models.SyncStateDeviceID, enrolled.DeviceID); err != nil {
+			return err
+		}
+		if err := stateRepo.Set(models.SyncStateBranchID, enrolled.BranchID.String()); err != nil {
+			return err
+		}
+		return w.sealCredential(stateRepo, enrolled.Credential)
+	})
+	if err != nil {
+		return err
+	}
+
+	w.device = enrolled.DeviceID
+	w.credential = enrolled.Credential
+
+	log.Info().
+		Str("device_id", w.device).
+		Str("branch_id", enrolled.BranchID.String()).
+		Msg("Device enrolled with the cloud")
 	return nil
 }
 
+// sealCredential stores the device credential encrypted under the device
+// key.
+func (w *SyncWorker) sealCredential(stateRepo repository.SyncStateRepository, credential string) error {
+	sealed, err := secret.Seal(w.cfg.DeviceKey, credential)
+	if err != nil {
+		return err
+	}
+	return stateRepo.Set(models.SyncStateDeviceCredential, sealed)
+}
+
 func (w *SyncWorker) checkOnline() bool {
 	if w.cfg.CloudAPIURL == "" {
 		return false
 	}
 
+	req, err := http.NewRequestWithContext(w.ctx, "GET", w.cfg.CloudAPIURL+"/api/v1/health", nil)
+	if err != nil {
+		return false
+	}
+
 	client := &http.Client{Timeout: 3 * time.Second}
-	resp, err := client.Get(w.cfg.CloudAPIURL + "/api/v1/health")
+	resp, err := client.Do(req)
 	if err != nil {
 		return false
 	}
@@ -267,6 +1219,49 @@ func (w *SyncWorker) checkOnline() bool {
 	return resp.StatusCode == http.StatusOK
 }
 
+// QueueDepth counts the change-log entries still waiting to be pushed.
+func (w *SyncWorker) QueueDepth() (int64, error) {
+	return w.changeLogRepo.Count()
+}
+
+// Stats reports the push backlog and an estimate of how long it takes to
+// clear it at the recently observed throughput.
+func (w *SyncWorker) Stats() (*SyncStats, error) {
+	depth, err := w.QueueDepth()
+	if err != nil {
+		return nil, err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	stats := &SyncStats{
+		State:               w.state,
+		StateSince:          w.stateSince,
+		Online:              w.online,
+		QueueDepth:          depth,
+		Throughput:          w.throughput,
+		ConsecutiveFailures: w.failures,
+		NextRetryAt:         w.nextRetryAt,
+		Protocol:            w.protocol,
+		UpdateRequired:      w.updateRequired,
+	}
+
+	if depth == 0 {
+		zero := int64(0)
+		stats.EstimatedCatchUpSeconds = &zero
+	} else if w.throughput > 0 {
+		seconds := float64(depth) / w.throughput
+		if w.nextRetryAt != nil {
+			seconds += time.Until(*w.nextRetryAt).Seconds()
+		}
+		estimate := int64(seconds + 0.5)
+		stats.EstimatedCatchUpSeconds = &estimate
+	}
+
+	return stats, nil
+}
+
 func (w *SyncWorker) GetUnsyncedCount() (int64, error) {
 	var count int64
 	err := w.db.Model(&models.Transaction{}).Where("is_synced = ?", false).Count(&count).Error
@@ -0,0 +1,46 @@
+package worker
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"shosha-finance/internal/config"
+)
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		name       string
+		failures   int
+		maxBackoff int
+		err        error
+		min, max   time.Duration
+	}{
+		{"first failure", 0, 300, errors.New("offline"), 2500 * time.Millisecond, 5 * time.Second},
+		{"doubles per failure", 2, 300, errors.New("offline"), 10 * time.Second, 20 * time.Second},
+		{"capped at the maximum", 20, 30, errors.New("offline"), 15 * time.Second, 30 * time.Second},
+		{"maximum below the base", 0, 1, errors.New("offline"), 2500 * time.Millisecond, 5 * time.Second},
+		{"longer retry-after wins", 0, 300, &cloudError{Status: 503, RetryAfter: 2 * time.Minute}, 2 * time.Minute, 2 * time.Minute},
+		{"shorter retry-after ignored", 2, 300, &cloudError{Status: 429, RetryAfter: time.Second}, 10 * time.Second, 20 * time.Second},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := &SyncWorker{cfg: &config.Config{SyncMaxBackoff: tt.maxBackoff}, state: StatePulling, failures: tt.failures}
+
+			delay := w.backoff(tt.err)
+			if delay < tt.min || delay > tt.max {
+				t.Errorf("delay = %v, want between %v and %v", delay, tt.min, tt.max)
+			}
+			if w.failures != tt.failures+1 {
+				t.Errorf("failures = %d, want %d", w.failures, tt.failures+1)
+			}
+			if state, _ := w.State(); state != StateBackoff {
+				t.Errorf("state = %s, want %s", state, StateBackoff)
+			}
+			if w.nextRetryAt == nil {
+				t.Error("nextRetryAt not set")
+			}
+		})
+	}
+}